@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"net"
+	"time"
+)
+
+// Direction is whether a CapturedPacket was received or sent.
+type Direction int
+
+// Packet directions.
+const (
+	DirectionIn Direction = iota + 1
+	DirectionOut
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionIn:
+		return "in"
+	case DirectionOut:
+		return "out"
+	default:
+		return "unknown"
+	}
+}
+
+// A CapturedPacket is a raw DHCP packet as it was received or sent.
+type CapturedPacket struct {
+	Time      time.Time
+	Direction Direction
+	// Interface is the network interface the packet went through, or
+	// nil if unknown.
+	Interface *net.Interface
+	// Src and Dst are the UDP endpoints of the packet. Local
+	// addresses that aren't known are the unspecified address.
+	Src, Dst *net.UDPAddr
+	Data     []byte
+}
+
+// A Tap is called with every packet that a Conn receives or sends. The
+// packet's Data is only valid until the Tap returns.
+type Tap func(*CapturedPacket)
+
+// SetTap makes c call tap with the packets it receives and sends, or
+// stops calling a previous Tap if tap is nil. Received packets are
+// only passed to tap if they are valid DHCP packets.
+func (c *Conn) SetTap(tap Tap) {
+	if tap == nil {
+		c.tap.Store(nil)
+		return
+	}
+	c.tap.Store(&tap)
+}
+
+func (c *Conn) capture(dir Direction, b []byte, intf *net.Interface, src, dst *net.UDPAddr) {
+	tap := c.tap.Load()
+	if tap == nil {
+		return
+	}
+	(*tap)(&CapturedPacket{
+		Time:      time.Now(),
+		Direction: dir,
+		Interface: intf,
+		Src:       src,
+		Dst:       dst,
+		Data:      b,
+	})
+}
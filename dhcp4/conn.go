@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/ipv4"
@@ -63,12 +64,23 @@ type conn interface {
 	SetWriteDeadline(t time.Time) error
 }
 
+// linkConn sends packets in link-layer frames, for txHardwareAddr.
+type linkConn interface {
+	io.Closer
+	// Send sends b from src to addr, in a frame addressed to hwaddr
+	// on intf.
+	Send(b []byte, src net.IP, addr *net.UDPAddr, hwaddr net.HardwareAddr, intf *net.Interface) error
+}
+
 // Conn is a DHCP-oriented packet socket.
 //
 // Multiple goroutines may invoke methods on a Conn simultaneously.
 type Conn struct {
 	conn    conn
+	link    linkConn
 	ifIndex int
+	port    int
+	tap     atomic.Pointer[Tap]
 }
 
 // NewConn creates a Conn bound to the given UDP ip:port.
@@ -105,6 +117,7 @@ func newConn(addr string, n func(int) (conn, error)) (*Conn, error) {
 	return &Conn{
 		conn:    c,
 		ifIndex: ifIndex,
+		port:    udpAddr.Port,
 	}, nil
 }
 
@@ -132,6 +145,9 @@ func ipToIfindex(ip net.IP) (int, error) {
 // Close closes the DHCP socket.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *Conn) Close() error {
+	if c.link != nil {
+		_ = c.link.Close()
+	}
 	return c.conn.Close()
 }
 
@@ -140,7 +156,7 @@ func (c *Conn) Close() error {
 func (c *Conn) RecvDHCP() (*Packet, *net.Interface, error) {
 	var buf [1500]byte
 	for {
-		b, _, ifidx, err := c.conn.Recv(buf[:])
+		b, addr, ifidx, err := c.conn.Recv(buf[:])
 		if err != nil {
 			return nil, nil, err
 		}
@@ -155,6 +171,7 @@ func (c *Conn) RecvDHCP() (*Packet, *net.Interface, error) {
 		if err != nil {
 			return nil, nil, err
 		}
+		c.capture(DirectionIn, b, intf, addr, &net.UDPAddr{IP: net.IPv4zero, Port: c.port})
 
 		// TODO: possibly more validation that the source lines up
 		// with what the packet says.
@@ -172,34 +189,92 @@ func (c *Conn) SendDHCP(pkt *Packet, intf *net.Interface) error {
 		return err
 	}
 
+	var (
+		addr  net.UDPAddr
+		ifidx int
+		// hwaddr is the link-layer destination of packets that are
+		// sent with c.link.
+		hwaddr net.HardwareAddr
+	)
 	switch pkt.txType() {
 	case txClientBroadcast:
-		addr := net.UDPAddr{
+		addr = net.UDPAddr{
 			IP:   net.IPv4bcast,
 			Port: dhcpServerPort,
 		}
-		return c.conn.Send(b, &addr, intf.Index)
-	case txServerBroadcast, txHardwareAddr:
-		addr := net.UDPAddr{
+		ifidx = intf.Index
+	case txServerBroadcast:
+		addr = net.UDPAddr{
 			IP:   net.IPv4bcast,
 			Port: dhcpClientPort,
 		}
-		return c.conn.Send(b, &addr, intf.Index)
+		ifidx = intf.Index
+	case txHardwareAddr:
+		addr = net.UDPAddr{
+			IP:   net.IPv4bcast,
+			Port: dhcpClientPort,
+		}
+		ifidx = intf.Index
+		if c.link != nil && linkUnicast(pkt, intf) {
+			if pkt.YourAddr != nil && !pkt.YourAddr.IsUnspecified() {
+				addr.IP = pkt.YourAddr
+			}
+			hwaddr = pkt.HardwareAddr
+		}
 	case txRelayAddr:
-		addr := net.UDPAddr{
+		addr = net.UDPAddr{
 			IP:   pkt.RelayAddr,
 			Port: dhcpServerPort,
 		}
-		return c.conn.Send(b, &addr, 0)
 	case txClientAddr:
-		addr := net.UDPAddr{
+		addr = net.UDPAddr{
 			IP:   pkt.ClientAddr,
 			Port: dhcpClientPort,
 		}
-		return c.conn.Send(b, &addr, 0)
 	default:
 		return errors.New("unknown TX type for packet")
 	}
+	src := &net.UDPAddr{IP: net.IPv4zero, Port: c.port}
+	if hwaddr != nil {
+		src.IP = sourceAddr(pkt, intf)
+		err = c.link.Send(b, src.IP, &addr, hwaddr, intf)
+	} else {
+		err = c.conn.Send(b, &addr, ifidx)
+	}
+	if err != nil {
+		return err
+	}
+	c.capture(DirectionOut, b, intf, src, &addr)
+	return nil
+}
+
+// linkUnicast returns whether pkt can be sent to its hardware address
+// on intf. Only Ethernet frames are built.
+func linkUnicast(pkt *Packet, intf *net.Interface) bool {
+	return intf != nil &&
+		(pkt.HardwareType == 0 || pkt.HardwareType == HardwareTypeEthernet) &&
+		len(pkt.HardwareAddr) == 6 &&
+		len(intf.HardwareAddr) == 6
+}
+
+// sourceAddr returns the IPv4 address that pkt is sent from on intf:
+// the server identifier of pkt if it has one, as that is the address
+// the client expects replies from, or else the first IPv4 address of
+// intf.
+func sourceAddr(pkt *Packet, intf *net.Interface) net.IP {
+	if ip, err := pkt.Options.IP(OptServerIdentifier); err == nil && ip.To4() != nil {
+		return ip.To4()
+	}
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return net.IPv4zero.To4()
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+	return net.IPv4zero.To4()
 }
 
 // SetReadDeadline sets the deadline for future Read calls.  If the
@@ -0,0 +1,130 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package dhcp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const etherTypeIPv4 = 0x0800
+
+// EnableLinkLayerUnicast makes c send the packets that RFC 2131 wants
+// unicast to the client's hardware address, such as offers to clients
+// that don't have an address yet, in Ethernet frames addressed to that
+// hardware address. Without it, these packets are broadcast.
+//
+// The frames are sent with an AF_PACKET socket, which requires
+// CAP_NET_RAW. Packets for other hardware types are still broadcast.
+// EnableLinkLayerUnicast must be called before c is used.
+func (c *Conn) EnableLinkLayerUnicast() error {
+	l, err := newPacketLinkConn(c.port)
+	if err != nil {
+		return err
+	}
+	c.link = l
+	return nil
+}
+
+// packetLinkConn sends IPv4 UDP packets in Ethernet frames that it
+// builds itself, on an AF_PACKET socket.
+type packetLinkConn struct {
+	fd   int
+	port uint16
+}
+
+func newPacketLinkConn(port int) (*packetLinkConn, error) {
+	// Protocol 0 receives nothing, the socket is only used to send.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening packet socket: %w", err)
+	}
+	return &packetLinkConn{
+		fd:   fd,
+		port: uint16(port), // nolint:gosec
+	}, nil
+}
+
+func (c *packetLinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// Send sends b to addr in an Ethernet frame addressed to hwaddr. Write
+// deadlines don't apply, sending to a packet socket doesn't block for
+// long.
+func (c *packetLinkConn) Send(b []byte, src net.IP, addr *net.UDPAddr, hwaddr net.HardwareAddr, intf *net.Interface) error {
+	frame := ethernetFrame(b, &net.UDPAddr{IP: src, Port: int(c.port)}, addr, intf.HardwareAddr, hwaddr)
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(etherTypeIPv4),
+		Ifindex:  intf.Index,
+		Halen:    uint8(len(hwaddr)), // nolint:gosec
+	}
+	copy(sa.Addr[:], hwaddr)
+	return syscall.Sendto(c.fd, frame, 0, sa)
+}
+
+// ethernetFrame returns the Ethernet frame of an IPv4 UDP packet with
+// payload b.
+func ethernetFrame(b []byte, src, dst *net.UDPAddr, srcMAC, dstMAC net.HardwareAddr) []byte {
+	l := 14 + ipv4HeaderLen + 8 + len(b)
+	ret := make([]byte, 0, l)
+	ret = append(ret, dstMAC...)
+	ret = append(ret, srcMAC...)
+	ret = binary.BigEndian.AppendUint16(ret, etherTypeIPv4)
+
+	ip := make([]byte, ipv4HeaderLen)
+	ip[0] = 0x45                                                       // version 4, 20 byte header
+	ip[1] = 0xc0                                                       // DSCP CS6 (Network Control)
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HeaderLen+8+len(b))) // nolint:gosec
+	ip[8] = 64                                                         // TTL
+	ip[9] = 17                                                         // UDP
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+	ret = append(ret, ip...)
+
+	ret = binary.BigEndian.AppendUint16(ret, uint16(src.Port)) // nolint:gosec
+	ret = binary.BigEndian.AppendUint16(ret, uint16(dst.Port)) // nolint:gosec
+	ret = binary.BigEndian.AppendUint16(ret, uint16(8+len(b))) // nolint:gosec
+	// A zero UDP checksum means none was computed, like linuxConn.
+	ret = binary.BigEndian.AppendUint16(ret, 0)
+	return append(ret, b...)
+}
+
+const ipv4HeaderLen = 20
+
+// ipChecksum returns the checksum of the IPv4 header hdr.
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// htons converts v to network byte order, as sockaddr_ll wants its
+// protocol.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
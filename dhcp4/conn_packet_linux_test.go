@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package dhcp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestEthernetFrame(t *testing.T) {
+	payload := []byte("dhcp packet")
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 67}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 50), Port: 68}
+	srcMAC := net.HardwareAddr{0x52, 0x54, 0, 9, 9, 9}
+	dstMAC := net.HardwareAddr{0x52, 0x54, 0, 1, 2, 3}
+
+	frame := ethernetFrame(payload, src, dst, srcMAC, dstMAC)
+	if len(frame) != 14+20+8+len(payload) {
+		t.Fatalf("got %d byte frame, want %d", len(frame), 14+20+8+len(payload))
+	}
+	if !bytes.Equal(frame[:6], dstMAC) || !bytes.Equal(frame[6:12], srcMAC) {
+		t.Errorf("got link-layer addresses %x -> %x", frame[6:12], frame[:6])
+	}
+	if got := binary.BigEndian.Uint16(frame[12:]); got != etherTypeIPv4 {
+		t.Errorf("got ethertype %#x, want IPv4", got)
+	}
+
+	ip := frame[14:34]
+	if ipChecksum(ip) != 0 {
+		t.Errorf("IPv4 header checksum %#x doesn't verify", binary.BigEndian.Uint16(ip[10:]))
+	}
+	if got := int(binary.BigEndian.Uint16(ip[2:])); got != 20+8+len(payload) {
+		t.Errorf("got IPv4 total length %d, want %d", got, 20+8+len(payload))
+	}
+	if !net.IP(ip[12:16]).Equal(src.IP) || !net.IP(ip[16:20]).Equal(dst.IP) {
+		t.Errorf("got IPv4 addresses %s -> %s", net.IP(ip[12:16]), net.IP(ip[16:20]))
+	}
+
+	udp := frame[34:]
+	if sport, dport := binary.BigEndian.Uint16(udp), binary.BigEndian.Uint16(udp[2:]); sport != 67 || dport != 68 {
+		t.Errorf("got UDP ports %d -> %d, want 67 -> 68", sport, dport)
+	}
+	if !bytes.Equal(udp[8:], payload) {
+		t.Errorf("got payload %q, want %q", udp[8:], payload)
+	}
+}
+
+func TestHtons(t *testing.T) {
+	// The value must be laid out in memory in network byte order,
+	// whatever the byte order of the host.
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], htons(etherTypeIPv4))
+	if got := binary.BigEndian.Uint16(b[:]); got != etherTypeIPv4 {
+		t.Errorf("htons(%#04x) is %#04x in network byte order", etherTypeIPv4, got)
+	}
+}
@@ -15,6 +15,8 @@
 package dhcp4
 
 import (
+	"bytes"
+	"errors"
 	"net"
 	"reflect"
 	"testing"
@@ -22,7 +24,11 @@ import (
 )
 
 func testConn(t *testing.T, impl conn, addr string) {
-	c := &Conn{impl, 0}
+	c := &Conn{conn: impl}
+	var captured []Direction
+	c.SetTap(func(p *CapturedPacket) {
+		captured = append(captured, p.Direction)
+	})
 
 	s, err := net.Dial("udp4", addr)
 	if err != nil {
@@ -116,6 +122,9 @@ func testConn(t *testing.T, impl conn, addr string) {
 	if !reflect.DeepEqual(p, rpkt) {
 		t.Fatalf("DHCP packet not the same as when it was sent")
 	}
+	if want := []Direction{DirectionIn, DirectionOut}; !reflect.DeepEqual(captured, want) {
+		t.Errorf("tap saw packets %v, want %v", captured, want)
+	}
 }
 
 func TestPortableConn(t *testing.T) {
@@ -136,3 +145,101 @@ func TestPortableConn(t *testing.T) {
 
 	testConn(t, c, addr)
 }
+
+type fakeConn struct {
+	sent []*net.UDPAddr
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Recv([]byte) ([]byte, *net.UDPAddr, int, error) {
+	return nil, nil, 0, errors.New("no")
+}
+func (c *fakeConn) Send(b []byte, addr *net.UDPAddr, ifidx int) error {
+	c.sent = append(c.sent, addr)
+	return nil
+}
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type fakeLinkConn struct {
+	src    []net.IP
+	sent   []*net.UDPAddr
+	hwaddr []net.HardwareAddr
+}
+
+func (c *fakeLinkConn) Close() error { return nil }
+func (c *fakeLinkConn) Send(b []byte, src net.IP, addr *net.UDPAddr, hwaddr net.HardwareAddr, intf *net.Interface) error {
+	c.src = append(c.src, src)
+	c.sent = append(c.sent, addr)
+	c.hwaddr = append(c.hwaddr, hwaddr)
+	return nil
+}
+
+func TestLinkLayerUnicast(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0, 1, 2, 3}
+	intf := &net.Interface{Index: 1, Name: "eth0", HardwareAddr: net.HardwareAddr{0x52, 0x54, 0, 9, 9, 9}}
+	offer := func(typ HardwareType, yiaddr net.IP) *Packet {
+		p := &Packet{
+			Type:          MsgOffer,
+			TransactionID: []byte("1234"),
+			HardwareType:  typ,
+			HardwareAddr:  mac,
+			YourAddr:      yiaddr,
+			Options:       Options{},
+		}
+		_ = p.Options.SetIP(OptServerIdentifier, net.IPv4(10, 0, 0, 1))
+		if typ == HardwareTypeInfiniBand {
+			p.HardwareAddr = make(net.HardwareAddr, 16)
+		}
+		return p
+	}
+
+	impl, link := &fakeConn{}, &fakeLinkConn{}
+	c := &Conn{conn: impl, link: link}
+	if err := c.SendDHCP(offer(0, net.IPv4(10, 0, 0, 50)), intf); err != nil {
+		t.Fatal(err)
+	}
+	// ProxyDHCP offers have no address for the client, they are still
+	// sent to its hardware address unless it asked for broadcasts.
+	if err := c.SendDHCP(offer(HardwareTypeEthernet, nil), intf); err != nil {
+		t.Fatal(err)
+	}
+	broadcast := offer(HardwareTypeEthernet, nil)
+	broadcast.Broadcast = true
+	if err := c.SendDHCP(broadcast, intf); err != nil {
+		t.Fatal(err)
+	}
+	// Only Ethernet frames are built.
+	if err := c.SendDHCP(offer(HardwareTypeInfiniBand, nil), intf); err != nil {
+		t.Fatal(err)
+	}
+
+	wantLink := []string{"10.0.0.50:68", "255.255.255.255:68"}
+	if len(link.sent) != len(wantLink) {
+		t.Fatalf("sent %d packets to hardware addresses, want %d", len(link.sent), len(wantLink))
+	}
+	for i, want := range wantLink {
+		if got := link.sent[i].String(); got != want {
+			t.Errorf("packet %d sent to %s, want %s", i, got, want)
+		}
+		if !bytes.Equal(link.hwaddr[i], mac) {
+			t.Errorf("packet %d sent to hardware address %s, want %s", i, link.hwaddr[i], mac)
+		}
+		if !link.src[i].Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Errorf("packet %d sent from %s, want the server identifier", i, link.src[i])
+		}
+	}
+	if len(impl.sent) != 2 || !impl.sent[0].IP.Equal(net.IPv4bcast) || !impl.sent[1].IP.Equal(net.IPv4bcast) {
+		t.Errorf("got packets %v broadcast, want the broadcast flagged and InfiniBand offers", impl.sent)
+	}
+
+	// Without a link-layer conn, offers are broadcast.
+	impl = &fakeConn{}
+	c = &Conn{conn: impl}
+	if err := c.SendDHCP(offer(0, net.IPv4(10, 0, 0, 50)), intf); err != nil {
+		t.Fatal(err)
+	}
+	if len(impl.sent) != 1 || !impl.sent[0].IP.Equal(net.IPv4bcast) {
+		t.Errorf("got packets %v broadcast, want the offer", impl.sent)
+	}
+}
@@ -25,3 +25,10 @@ import "errors"
 func NewSnooperConn(addr string) (*Conn, error) {
 	return nil, errors.New("snooper Conns not supported on this OS")
 }
+
+// EnableLinkLayerUnicast makes c send the packets that RFC 2131 wants
+// unicast to the client's hardware address in link-layer frames
+// addressed to it. It is only supported on Linux.
+func (c *Conn) EnableLinkLayerUnicast() error {
+	return errors.New("link-layer unicast not supported on this OS")
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HardwareType is the hardware address type (htype) of a Packet, as
+// assigned in
+// https://www.iana.org/assignments/arp-parameters/arp-parameters.xhtml#arp-parameters-2.
+type HardwareType byte
+
+// Hardware types that are known to boot from pixiecore.
+const (
+	HardwareTypeEthernet   HardwareType = 1
+	HardwareTypeInfiniBand HardwareType = 32 // RFC 4390
+)
+
+// maxHardwareAddrLen is the size of the chaddr field of a Packet.
+const maxHardwareAddrLen = 16
+
+// MachineAddr returns the address that identifies the client of p:
+// its hardware address or, if the packet carries none, its client
+// identifier (option 61). InfiniBand clients, for example, leave the
+// hardware address empty and identify themselves only by the client
+// identifier (RFC 4390). MachineAddr returns nil if p carries neither.
+func (p *Packet) MachineAddr() net.HardwareAddr {
+	for _, b := range p.HardwareAddr {
+		if b != 0 {
+			return p.HardwareAddr
+		}
+	}
+	if id := p.Options[OptClientIdentifier]; len(id) > 0 {
+		return net.HardwareAddr(id)
+	}
+	return nil
+}
+
+// ParseHardwareAddr parses s as a hardware address of any length, in
+// the colon separated form returned by net.HardwareAddr.String. The
+// formats accepted by net.ParseMAC are accepted too.
+func ParseHardwareAddr(s string) (net.HardwareAddr, error) {
+	if mac, err := net.ParseMAC(s); err == nil {
+		return mac, nil
+	}
+	var ret net.HardwareAddr
+	for _, b := range strings.Split(s, ":") {
+		if len(b) != 2 {
+			return nil, fmt.Errorf("invalid hardware address %q", s)
+		}
+		v, err := hex.DecodeString(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hardware address %q", s)
+		}
+		ret = append(ret, v[0])
+	}
+	return ret, nil
+}
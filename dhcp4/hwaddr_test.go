@@ -0,0 +1,105 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestInfiniBandPacket(t *testing.T) {
+	clientID := []byte{0xff, 0, 0, 0, 1, 0, 4, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 2, 0xc9, 3, 0, 1, 2, 3}
+	pkt := &Packet{
+		Type:          MsgDiscover,
+		TransactionID: []byte{1, 2, 3, 4},
+		Broadcast:     true,
+		HardwareType:  HardwareTypeInfiniBand,
+		ClientAddr:    net.IPv4zero.To4(),
+		YourAddr:      net.IPv4zero.To4(),
+		ServerAddr:    net.IPv4zero.To4(),
+		RelayAddr:     net.IPv4zero.To4(),
+		Options:       Options{OptClientIdentifier: clientID},
+	}
+	raw, err := pkt.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling InfiniBand packet: %s", err)
+	}
+	if raw[1] != 32 || raw[2] != 0 || !bytes.Equal(raw[28:44], make([]byte, 16)) {
+		t.Errorf("got htype %d, hlen %d, chaddr %v", raw[1], raw[2], raw[28:44])
+	}
+	pkt2, err := Unmarshal(raw)
+	if err != nil {
+		t.Fatalf("unmarshaling InfiniBand packet: %s", err)
+	}
+	if !reflect.DeepEqual(pkt, pkt2) {
+		t.Errorf("packet mutated by write-then-read:\ngot  %#v\nwant %#v", pkt2, pkt)
+	}
+	if got := pkt2.MachineAddr(); !bytes.Equal(got, clientID) {
+		t.Errorf("got machine address %s, want client identifier", got)
+	}
+
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	if got := (&Packet{HardwareAddr: mac, Options: Options{OptClientIdentifier: clientID}}).MachineAddr(); !bytes.Equal(got, mac) {
+		t.Errorf("got machine address %s, want hardware address %s", got, mac)
+	}
+	if got := (&Packet{HardwareAddr: make(net.HardwareAddr, 6)}).MachineAddr(); got != nil {
+		t.Errorf("got machine address %s for packet without identity", got)
+	}
+
+	for _, bad := range []*Packet{
+		{Type: MsgDiscover, TransactionID: []byte{1, 2, 3, 4}},
+		{Type: MsgDiscover, TransactionID: []byte{1, 2, 3, 4}, HardwareType: HardwareTypeInfiniBand, HardwareAddr: make(net.HardwareAddr, 20)},
+	} {
+		if _, err := bad.Marshal(); err == nil {
+			t.Errorf("marshaled packet with hardware type %d and %d byte address", bad.HardwareType, len(bad.HardwareAddr))
+		}
+	}
+}
+
+func TestParseHardwareAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		want net.HardwareAddr
+	}{
+		{"01:02:03:04:05:06", net.HardwareAddr{1, 2, 3, 4, 5, 6}},
+		{"01-02-03-04-05-06", net.HardwareAddr{1, 2, 3, 4, 5, 6}},
+		{"ff:00:00:00:01", net.HardwareAddr{0xff, 0, 0, 0, 1}},
+		{"ab", net.HardwareAddr{0xab}},
+		{"", nil},
+		{"01:2", nil},
+		{"01:zz", nil},
+	}
+	for _, test := range tests {
+		got, err := ParseHardwareAddr(test.s)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parsed invalid hardware address %q as %s", test.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsing %q: %s", test.s, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("parsing %q: got %s, want %s", test.s, got, test.want)
+		}
+		if again, err := ParseHardwareAddr(got.String()); err != nil || !bytes.Equal(again, got) {
+			t.Errorf("%s doesn't round-trip through ParseHardwareAddr", got)
+		}
+	}
+}
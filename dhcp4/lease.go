@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// LeaseState is the state of a Lease.
+type LeaseState string
+
+// Lease states.
+const (
+	// LeaseOffered is an address offered to a client, which hasn't
+	// requested it yet.
+	LeaseOffered LeaseState = "offered"
+	// LeaseBound is an address a client has requested and got.
+	LeaseBound LeaseState = "bound"
+	// LeaseDeclined is an address a client found to be in use by
+	// another host. It isn't leased again until the Lease expires.
+	LeaseDeclined LeaseState = "declined"
+)
+
+// Lease associates an IPv4 address with a client until it expires.
+type Lease struct {
+	HardwareAddr net.HardwareAddr
+	IPAddress    net.IP
+	Expiry       time.Time
+	State        LeaseState
+}
+
+// Expired returns whether l has expired at now.
+func (l *Lease) Expired(now time.Time) bool {
+	return !now.Before(l.Expiry)
+}
+
+// leaseJSON is the wire format of a Lease.
+type leaseJSON struct {
+	MAC    string     `json:"mac"`
+	IP     string     `json:"ip"`
+	Expiry time.Time  `json:"expiry"`
+	State  LeaseState `json:"state"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (l *Lease) MarshalJSON() ([]byte, error) {
+	return json.Marshal(leaseJSON{
+		MAC:    l.HardwareAddr.String(),
+		IP:     l.IPAddress.String(),
+		Expiry: l.Expiry.UTC(),
+		State:  l.State,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *Lease) UnmarshalJSON(bs []byte) error {
+	var js leaseJSON
+	if err := json.Unmarshal(bs, &js); err != nil {
+		return err
+	}
+	mac, err := ParseHardwareAddr(js.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid lease MAC address %q: %w", js.MAC, err)
+	}
+	ip := net.ParseIP(js.IP).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid lease IPv4 address %q", js.IP)
+	}
+	switch js.State {
+	case LeaseOffered, LeaseBound, LeaseDeclined:
+	default:
+		return fmt.Errorf("invalid lease state %q", js.State)
+	}
+	*l = Lease{
+		HardwareAddr: mac,
+		IPAddress:    ip,
+		Expiry:       js.Expiry,
+		State:        js.State,
+	}
+	return nil
+}
+
+// WriteLeases writes leases to w as a JSON array, the format read by
+// ReadLeases.
+func WriteLeases(w io.Writer, leases []*Lease) error {
+	if leases == nil {
+		leases = []*Lease{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(leases)
+}
+
+// ReadLeases reads leases written by WriteLeases from r.
+func ReadLeases(r io.Reader) ([]*Lease, error) {
+	var ret []*Lease
+	if err := json.NewDecoder(r).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("decoding leases: %w", err)
+	}
+	return ret, nil
+}
+
+// LeaseStore keeps the leases of a DHCP server, so that they survive
+// restarts.
+type LeaseStore interface {
+	// Leases returns all stored leases.
+	Leases() ([]*Lease, error)
+	// PutLease stores l, replacing the lease of the same address.
+	PutLease(l *Lease) error
+	// DeleteLease removes the lease of ip, if there is one.
+	DeleteLease(ip net.IP) error
+}
@@ -0,0 +1,242 @@
+// Package leasestore implements dhcp4.LeaseStore.
+package leasestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// compactAfter is how many changes are appended to the journal before
+// it is folded into the lease file.
+const compactAfter = 1000
+
+// FileLeaseStore keeps leases in a JSON file, in the format of
+// dhcp4.WriteLeases. Changes are appended to a journal next to it, one
+// JSON object per line, which is folded into the file every
+// compactAfter changes and when the store is opened. The file is
+// rewritten atomically, so it is always complete even if the process
+// dies while writing.
+type FileLeaseStore struct {
+	path string
+
+	lock   sync.Mutex
+	leases map[string]*dhcp4.Lease
+	// journal is opened on the first change. journaled counts the
+	// changes in it.
+	journal   *os.File
+	journaled int
+}
+
+// journalEntry is a line of the journal: a lease that was put, or the
+// address of a lease that was deleted.
+type journalEntry struct {
+	Put    *dhcp4.Lease `json:"put,omitempty"`
+	Delete string       `json:"delete,omitempty"`
+}
+
+// NewFileLeaseStore returns a FileLeaseStore that keeps its leases in
+// path. If path or its journal exist, the leases in them are loaded.
+func NewFileLeaseStore(path string) (*FileLeaseStore, error) {
+	ret := &FileLeaseStore{
+		path:   path,
+		leases: map[string]*dhcp4.Lease{},
+	}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		leases, err := dhcp4.ReadLeases(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		for _, l := range leases {
+			ret.leases[l.IPAddress.String()] = l
+		}
+	}
+
+	replayed, err := ret.replay()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ret.journalPath(), err)
+	}
+	if replayed {
+		if err := ret.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Leases returns all stored leases, ordered by address.
+func (s *FileLeaseStore) Leases() ([]*dhcp4.Lease, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sorted(), nil
+}
+
+// PutLease stores l, replacing the lease of the same address.
+func (s *FileLeaseStore) PutLease(l *dhcp4.Lease) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := *l
+	c.IPAddress = l.IPAddress.To4()
+	if c.IPAddress == nil {
+		return fmt.Errorf("lease address %s is not IPv4", l.IPAddress)
+	}
+	c.HardwareAddr = slices.Clone(l.HardwareAddr)
+	if err := s.append(journalEntry{Put: &c}); err != nil {
+		return err
+	}
+	s.leases[c.IPAddress.String()] = &c
+	return s.maybeCompact()
+}
+
+// DeleteLease removes the lease of ip, if there is one.
+func (s *FileLeaseStore) DeleteLease(ip net.IP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := ip.String()
+	if s.leases[key] == nil {
+		return nil
+	}
+	if err := s.append(journalEntry{Delete: key}); err != nil {
+		return err
+	}
+	delete(s.leases, key)
+	return s.maybeCompact()
+}
+
+func (s *FileLeaseStore) journalPath() string {
+	return s.path + ".journal"
+}
+
+// replay applies the journal to s.leases, and returns whether there
+// was one. A torn last line, left by a crash while appending it, is
+// ignored.
+func (s *FileLeaseStore) replay() (bool, error) {
+	bs, err := os.ReadFile(s.journalPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Every entry ends with a newline, so the part after the last one
+	// is either empty or torn.
+	lines := bytes.Split(bs, []byte("\n"))
+	for i, line := range lines[:len(lines)-1] {
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return false, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		switch {
+		case e.Put != nil:
+			s.leases[e.Put.IPAddress.String()] = e.Put
+		case e.Delete != "":
+			delete(s.leases, e.Delete)
+		}
+	}
+	return true, nil
+}
+
+// append writes e to the journal and syncs it. s.lock must be held.
+func (s *FileLeaseStore) append(e journalEntry) error {
+	if s.journal == nil {
+		f, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		s.journal = f
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	fi, err := s.journal.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.journal.Write(append(bs, '\n'))
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial entry for the next one to follow.
+		_ = s.journal.Truncate(fi.Size())
+		return err
+	}
+	s.journaled++
+	return nil
+}
+
+// maybeCompact compacts the journal once it has compactAfter changes.
+// s.lock must be held.
+func (s *FileLeaseStore) maybeCompact() error {
+	if s.journaled < compactAfter {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact writes all leases to the file and removes the journal.
+// s.lock must be held.
+func (s *FileLeaseStore) compact() error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	if s.journal != nil {
+		_ = s.journal.Close()
+		s.journal = nil
+	}
+	s.journaled = 0
+	if err := os.Remove(s.journalPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sorted returns copies of the leases, ordered by address. s.lock must
+// be held.
+func (s *FileLeaseStore) sorted() []*dhcp4.Lease {
+	ret := make([]*dhcp4.Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		c := *l
+		ret = append(ret, &c)
+	}
+	slices.SortFunc(ret, func(a, b *dhcp4.Lease) int {
+		return bytes.Compare(a.IPAddress, b.IPAddress)
+	})
+	return ret
+}
+
+// write replaces the file with the current leases. s.lock must be held.
+func (s *FileLeaseStore) write() error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	if err := dhcp4.WriteLeases(f, s.sorted()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
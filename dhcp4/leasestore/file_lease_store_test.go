@@ -0,0 +1,131 @@
+package leasestore
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLeaseStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	expiry := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	store, err := NewFileLeaseStore(path)
+	require.NoError(t, err)
+	leases, err := store.Leases()
+	require.NoError(t, err)
+	require.Empty(t, leases)
+
+	a := &dhcp4.Lease{
+		HardwareAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		IPAddress:    net.IPv4(10, 1, 0, 101),
+		Expiry:       expiry,
+		State:        dhcp4.LeaseBound,
+	}
+	b := &dhcp4.Lease{
+		HardwareAddr: net.HardwareAddr{1, 2, 3, 4, 5, 7},
+		IPAddress:    net.IPv4(10, 1, 0, 100),
+		Expiry:       expiry,
+		State:        dhcp4.LeaseDeclined,
+	}
+	require.NoError(t, store.PutLease(a))
+	require.NoError(t, store.PutLease(b))
+	require.Error(t, store.PutLease(&dhcp4.Lease{IPAddress: net.ParseIP("fd00::1")}))
+
+	// A new store on the same file sees the leases, ordered by address.
+	store, err = NewFileLeaseStore(path)
+	require.NoError(t, err)
+	leases, err = store.Leases()
+	require.NoError(t, err)
+	require.Len(t, leases, 2)
+	require.Equal(t, "10.1.0.100", leases[0].IPAddress.String())
+	require.Equal(t, "01:02:03:04:05:07", leases[0].HardwareAddr.String())
+	require.Equal(t, dhcp4.LeaseDeclined, leases[0].State)
+	require.True(t, leases[0].Expiry.Equal(expiry))
+	require.Equal(t, "10.1.0.101", leases[1].IPAddress.String())
+
+	// A lease replaces the one of the same address.
+	a.HardwareAddr = net.HardwareAddr{1, 2, 3, 4, 5, 8}
+	require.NoError(t, store.PutLease(a))
+	require.NoError(t, store.DeleteLease(net.IPv4(10, 1, 0, 100)))
+	require.NoError(t, store.DeleteLease(net.IPv4(10, 1, 0, 200)))
+
+	store, err = NewFileLeaseStore(path)
+	require.NoError(t, err)
+	leases, err = store.Leases()
+	require.NoError(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, "01:02:03:04:05:08", leases[0].HardwareAddr.String())
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestFileLeaseStoreInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"mac":"01:02:03:04:05:06","ip":"10.1.0.1","state":"stolen"}]`), 0o600))
+	_, err := NewFileLeaseStore(path)
+	require.Error(t, err)
+}
+
+func TestFileLeaseStoreJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	lease := func(i int) *dhcp4.Lease {
+		return &dhcp4.Lease{
+			HardwareAddr: net.HardwareAddr{1, 2, 3, 4, byte(i >> 8), byte(i)},
+			IPAddress:    net.IPv4(10, 1, byte(i>>8), byte(i)),
+			Expiry:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			State:        dhcp4.LeaseBound,
+		}
+	}
+
+	// Changes only go to the journal.
+	store, err := NewFileLeaseStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.PutLease(lease(1)))
+	require.NoError(t, store.PutLease(lease(2)))
+	require.NoError(t, store.DeleteLease(net.IPv4(10, 1, 0, 1)))
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// A crash while appending leaves a torn last line, which is
+	// ignored. Opening folds the journal into the file.
+	f, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"put":{"mac":"01:02`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	store, err = NewFileLeaseStore(path)
+	require.NoError(t, err)
+	leases, err := store.Leases()
+	require.NoError(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, "10.1.0.2", leases[0].IPAddress.String())
+	_, err = os.Stat(path + ".journal")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// The journal is compacted after compactAfter changes.
+	for i := range compactAfter {
+		require.NoError(t, store.PutLease(lease(i)))
+	}
+	_, err = os.Stat(path + ".journal")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	f, err = os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	leases, err = dhcp4.ReadLeases(f)
+	require.NoError(t, err)
+	require.Len(t, leases, compactAfter)
+
+	// A corrupt line before the end is an error.
+	require.NoError(t, os.WriteFile(path+".journal", []byte("garbage\n{}\n"), 0o600))
+	_, err = NewFileLeaseStore(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,259 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// OptionType is the type of the value of an Option.
+type OptionType int
+
+// Option value types, named after the Options getter that decodes
+// them.
+const (
+	TypeBytes OptionType = iota
+	TypeString
+	TypeByte
+	TypeUint16
+	TypeUint16s
+	TypeUint32
+	TypeInt32
+	TypeDuration
+	TypeIP
+	TypeIPs
+	TypeIPMask
+	TypeGUID
+	// TypeOptionList is a list of option numbers, as in
+	// OptRequestedOptions.
+	TypeOptionList
+	// TypeRelayAgentInfo is the relay agent information option.
+	TypeRelayAgentInfo
+	// TypeClientNII is the client network interface identifier
+	// option.
+	TypeClientNII
+)
+
+// OptionInfo describes a known Option.
+type OptionInfo struct {
+	Name string
+	Type OptionType
+}
+
+var (
+	optionInfosMu sync.RWMutex
+	optionInfos   = map[Option]OptionInfo{
+		OptSubnetMask:         {"subnet mask", TypeIPMask},
+		OptTimeOffset:         {"time offset", TypeInt32},
+		OptRouters:            {"routers", TypeIPs},
+		OptDNSServers:         {"DNS servers", TypeIPs},
+		OptHostname:           {"hostname", TypeString},
+		OptBootFileSize:       {"boot file size", TypeUint16},
+		OptDomainName:         {"domain name", TypeString},
+		OptInterfaceMTU:       {"interface MTU", TypeUint16},
+		OptBroadcastAddr:      {"broadcast address", TypeIP},
+		OptNTPServers:         {"NTP servers", TypeIPs},
+		OptVendorSpecific:     {"vendor specific", TypeBytes},
+		OptRequestedIP:        {"requested address", TypeIP},
+		OptLeaseTime:          {"lease time", TypeDuration},
+		OptOverload:           {"overload", TypeByte},
+		OptDHCPMessageType:    {"message type", TypeByte},
+		OptServerIdentifier:   {"server identifier", TypeIP},
+		OptRequestedOptions:   {"parameter request list", TypeOptionList},
+		OptMessage:            {"message", TypeString},
+		OptMaximumMessageSize: {"maximum message size", TypeUint16},
+		OptRenewalTime:        {"renewal time", TypeDuration},
+		OptRebindingTime:      {"rebinding time", TypeDuration},
+		OptVendorIdentifier:   {"vendor class identifier", TypeString},
+		OptClientIdentifier:   {"client identifier", TypeBytes},
+		OptTFTPServer:         {"TFTP server", TypeString},
+		OptBootFile:           {"boot file", TypeString},
+		OptUserClass:          {"user class", TypeString},
+		OptFQDN:               {"client FQDN", TypeBytes},
+		OptAgentInformation:   {"relay agent information", TypeRelayAgentInfo},
+		OptClientSystem:       {"client system architecture", TypeUint16s},
+		OptClientNDI:          {"client network interface", TypeClientNII},
+		OptClientMachineID:    {"client machine identifier", TypeGUID},
+	}
+)
+
+// RegisterOption adds n to the known options, or replaces its
+// description, so that HumanReadable decodes its value.
+func RegisterOption(n Option, info OptionInfo) {
+	optionInfosMu.Lock()
+	defer optionInfosMu.Unlock()
+	optionInfos[n] = info
+}
+
+// LookupOption returns the description of n, if it is known.
+func LookupOption(n Option) (OptionInfo, bool) {
+	optionInfosMu.RLock()
+	defer optionInfosMu.RUnlock()
+	info, ok := optionInfos[n]
+	return info, ok
+}
+
+// String returns the name of n, if it is known, and its number.
+func (n Option) String() string {
+	if info, ok := LookupOption(n); ok {
+		return fmt.Sprintf("%d (%s)", n, info.Name)
+	}
+	return strconv.Itoa(int(n))
+}
+
+// Format returns the value of option n in human-readable form,
+// decoded according to its OptionType. Values that can't be decoded
+// are shown as bytes.
+func (o Options) Format(n Option) string {
+	bs := o[n]
+	info, _ := LookupOption(n)
+	switch info.Type {
+	case TypeString:
+		if printable(bs) {
+			return strconv.Quote(string(bs))
+		}
+	case TypeByte:
+		if v, err := o.Byte(n); err == nil {
+			return strconv.Itoa(int(v))
+		}
+	case TypeUint16:
+		if v, err := o.Uint16(n); err == nil {
+			return strconv.Itoa(int(v))
+		}
+	case TypeUint16s:
+		if v, err := o.Uint16s(n); err == nil {
+			vs := make([]string, 0, len(v))
+			for _, i := range v {
+				vs = append(vs, strconv.Itoa(int(i)))
+			}
+			return strings.Join(vs, ", ")
+		}
+	case TypeUint32:
+		if v, err := o.Uint32(n); err == nil {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+	case TypeInt32:
+		if v, err := o.Int32(n); err == nil {
+			return strconv.Itoa(int(v))
+		}
+	case TypeDuration:
+		if v, err := o.Duration(n); err == nil {
+			return v.String()
+		}
+	case TypeIP:
+		if v, err := o.IP(n); err == nil {
+			return v.String()
+		}
+	case TypeIPs:
+		if v, err := o.IPs(n); err == nil {
+			ips := make([]string, 0, len(v))
+			for _, ip := range v {
+				ips = append(ips, ip.String())
+			}
+			return strings.Join(ips, ", ")
+		}
+	case TypeIPMask:
+		if v, err := o.IPMask(n); err == nil {
+			return net.IP(v).String()
+		}
+	case TypeGUID:
+		if v, err := o.GUID(n); err == nil {
+			return v
+		}
+	case TypeOptionList:
+		opts := make([]string, 0, len(bs))
+		for _, b := range bs {
+			opts = append(opts, strconv.Itoa(int(b)))
+		}
+		return strings.Join(opts, ", ")
+	case TypeRelayAgentInfo:
+		if v, err := o.RelayAgentInfo(); err == nil {
+			return v.String()
+		}
+	case TypeClientNII:
+		if v, err := o.ClientNII(); err == nil {
+			return v.String()
+		}
+	}
+	return fmt.Sprintf("% x", bs)
+}
+
+// HumanReadable returns the options in human-readable form, one
+// "number (name): value" string per option, ordered by number.
+func (o Options) HumanReadable() []string {
+	ks := make([]int, 0, len(o))
+	for n := range o {
+		ks = append(ks, int(n))
+	}
+	sort.Ints(ks)
+	ret := make([]string, 0, len(ks))
+	for _, n := range ks {
+		ret = append(ret, fmt.Sprintf("%s: %s", Option(n), o.Format(Option(n))))
+	}
+	return ret
+}
+
+// String returns r in human-readable form.
+func (r *RelayAgentInfo) String() string {
+	var parts []string
+	if r.CircuitID != nil {
+		parts = append(parts, "circuit-id "+formatID(r.CircuitID))
+	}
+	if r.RemoteID != nil {
+		parts = append(parts, "remote-id "+formatID(r.RemoteID))
+	}
+	if r.LinkSelection != nil {
+		parts = append(parts, "link-selection "+r.LinkSelection.String())
+	}
+	if r.SubscriberID != "" {
+		parts = append(parts, "subscriber-id "+strconv.Quote(r.SubscriberID))
+	}
+	if r.ServerIdentifierOverride != nil {
+		parts = append(parts, "server-identifier-override "+r.ServerIdentifierOverride.String())
+	}
+	ks := make([]int, 0, len(r.Other))
+	for k := range r.Other {
+		ks = append(ks, int(k))
+	}
+	sort.Ints(ks)
+	for _, k := range ks {
+		parts = append(parts, fmt.Sprintf("%d % x", k, r.Other[RelayAgentSubOption(k)]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatID returns a circuit or remote ID quoted if it's text, or as
+// bytes otherwise.
+func formatID(id []byte) string {
+	if printable(id) {
+		return strconv.Quote(string(id))
+	}
+	return fmt.Sprintf("% x", id)
+}
+
+func printable(bs []byte) bool {
+	for _, r := range string(bs) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
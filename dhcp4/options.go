@@ -21,8 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"sort"
+	"strings"
+	"time"
 )
 
 // Option is a DHCP option.
@@ -54,8 +57,12 @@ const (
 	OptRebindingTime      Option = 59 // uint32
 	OptVendorIdentifier   Option = 60 // string
 	OptClientIdentifier   Option = 61 // string
+	OptUserClass          Option = 77 // string
 	OptFQDN               Option = 81 // string
 	OptAgentInformation   Option = 82 // struct
+	OptClientSystem       Option = 93 // []uint16
+	OptClientNDI          Option = 94 // struct
+	OptClientMachineID    Option = 97 // GUID
 
 	// You shouldn't need to use the following directly. Instead,
 	// refer to the fields in the Packet struct, and Marshal/Unmarshal
@@ -229,6 +236,22 @@ func (o Options) Uint16(n Option) (uint16, error) {
 	return binary.BigEndian.Uint16(bs), nil
 }
 
+// Uint16s returns the value of option n as a list of uint16s.
+func (o Options) Uint16s(n Option) ([]uint16, error) {
+	bs, err := o.Bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) < 2 || len(bs)%2 != 0 {
+		return nil, errOptionWrongSize
+	}
+	ret := make([]uint16, 0, len(bs)/2)
+	for i := 0; i < len(bs); i += 2 {
+		ret = append(ret, binary.BigEndian.Uint16(bs[i:]))
+	}
+	return ret, nil
+}
+
 // Uint32 returns the value of option n as a uint32.
 func (o Options) Uint32(n Option) (uint32, error) {
 	bs, err := o.Bytes(n)
@@ -306,7 +329,8 @@ func (o Options) GUID(n Option) (string, error) {
 		return "", fmt.Errorf("option %d is malformed", n)
 	}
 
-	bs = bs[1:17]
+	// Copy, so that reversing below doesn't modify the option.
+	bs = append([]byte(nil), bs[1:17]...)
 
 	// The guid is mixed endian, therefore we have to reverse some bytes:
 	// https://en.wikipedia.org/wiki/Universally_unique_identifier#Encoding
@@ -320,6 +344,130 @@ func (o Options) GUID(n Option) (string, error) {
 	return fmt.Sprintf("%s-%s-%s-%s-%s", dst[0:8], dst[8:12], dst[12:16], dst[16:20], dst[20:32]), nil
 }
 
+// Duration returns the value of option n, a number of seconds, as a
+// time.Duration.
+func (o Options) Duration(n Option) (time.Duration, error) {
+	v, err := o.Uint32(n)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(v) * time.Second, nil
+}
+
+// SetBytes sets option n to bs.
+func (o Options) SetBytes(n Option, bs []byte) {
+	o[n] = bs
+}
+
+// SetString sets option n to s.
+func (o Options) SetString(n Option, s string) {
+	o[n] = []byte(s)
+}
+
+// SetByte sets option n to b.
+func (o Options) SetByte(n Option, b byte) {
+	o[n] = []byte{b}
+}
+
+// SetUint16 sets option n to v.
+func (o Options) SetUint16(n Option, v uint16) {
+	o[n] = binary.BigEndian.AppendUint16(nil, v)
+}
+
+// SetUint16s sets option n to the list vs.
+func (o Options) SetUint16s(n Option, vs []uint16) {
+	var bs []byte
+	for _, v := range vs {
+		bs = binary.BigEndian.AppendUint16(bs, v)
+	}
+	o[n] = bs
+}
+
+// SetUint32 sets option n to v.
+func (o Options) SetUint32(n Option, v uint32) {
+	o[n] = binary.BigEndian.AppendUint32(nil, v)
+}
+
+// SetInt32 sets option n to v.
+func (o Options) SetInt32(n Option, v int32) {
+	o.SetUint32(n, uint32(v)) // nolint:gosec
+}
+
+// SetDuration sets option n to d in whole seconds. Durations that
+// don't fit are capped at the largest one that does, which DHCP
+// treats as infinity for lease times.
+func (o Options) SetDuration(n Option, d time.Duration) {
+	secs := d / time.Second
+	switch {
+	case secs < 0:
+		secs = 0
+	case secs > math.MaxUint32:
+		secs = math.MaxUint32
+	}
+	o.SetUint32(n, uint32(secs))
+}
+
+// SetIPs sets option n to a list of IPv4 addresses.
+func (o Options) SetIPs(n Option, ips []net.IP) error {
+	if len(ips) == 0 {
+		return errOptionWrongSize
+	}
+	bs := make([]byte, 0, 4*len(ips))
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return fmt.Errorf("%s is not an IPv4 address", ip)
+		}
+		bs = append(bs, ip4...)
+	}
+	o[n] = bs
+	return nil
+}
+
+// SetIP sets option n to an IPv4 address.
+func (o Options) SetIP(n Option, ip net.IP) error {
+	return o.SetIPs(n, []net.IP{ip})
+}
+
+// SetIPMask sets option n to an IPv4 net.IPMask.
+func (o Options) SetIPMask(n Option, mask net.IPMask) error {
+	// A 16 byte mask is an IPv4 mask if it's all ones up to the last
+	// 4 bytes, like the masks of IPv4-mapped IPv6 addresses.
+	if len(mask) == net.IPv6len && bytes.Equal(mask[:12], bytes.Repeat([]byte{0xff}, 12)) {
+		mask = mask[12:]
+	}
+	if len(mask) != net.IPv4len {
+		return fmt.Errorf("%s is not an IPv4 mask", mask)
+	}
+	o[n] = []byte(mask)
+	return nil
+}
+
+// SetGUID sets option n to a guid string, as returned by GUID.
+func (o Options) SetGUID(n Option, guid string) error {
+	bs, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil || len(bs) != 16 {
+		return fmt.Errorf("malformed guid %q", guid)
+	}
+	// Undo the mixed endianness, see GUID.
+	reverse(bs[0:4])
+	reverse(bs[4:6])
+	reverse(bs[6:8])
+	o[n] = append([]byte{0}, bs...)
+	return nil
+}
+
+// SetOptions sets option n to the encoding of sub, for options that
+// carry encapsulated options like OptVendorSpecific.
+func (o Options) SetOptions(n Option, sub Options) error {
+	bs, err := sub.Marshal()
+	if err != nil {
+		return err
+	}
+	o[n] = bs
+	return nil
+}
+
 func reverse(bytes []byte) []byte {
 	for i := 0; i < len(bytes)/2; i++ {
 		j := len(bytes) - i - 1
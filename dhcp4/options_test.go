@@ -16,7 +16,9 @@ package dhcp4
 
 import (
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestOptionByte(t *testing.T) {
@@ -209,4 +211,120 @@ func TestOptionGUID(t *testing.T) {
 	if guid != "4b37128e-6e72-4a8d-87da-8ad4d775582c" {
 		t.Fatalf("wrong guid, got %s", guid)
 	}
+
+	// Decoding must not modify the option, so that it can be
+	// decoded again and echoed back to the client.
+	guid, err = o.GUID(97)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guid != "4b37128e-6e72-4a8d-87da-8ad4d775582c" {
+		t.Fatalf("wrong guid on second decode, got %s", guid)
+	}
+}
+
+func TestOptionSetters(t *testing.T) {
+	o := Options{}
+	o.SetByte(1, 3)
+	o.SetUint16(2, 258)
+	o.SetUint32(3, 16909060)
+	o.SetInt32(4, -1)
+	o.SetDuration(5, time.Hour)
+	o.SetDuration(6, -time.Second)
+	o.SetString(7, "PXEClient")
+	if err := o.SetIPs(8, []net.IP{net.IPv4(1, 2, 3, 4), net.ParseIP("5.6.7.8")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.SetIPMask(9, net.CIDRMask(24, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.SetGUID(97, "4b37128e-6e72-4a8d-87da-8ad4d775582c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := o.Byte(1); err != nil || v != 3 {
+		t.Errorf("got byte %d, %v", v, err)
+	}
+	if v, err := o.Uint16(2); err != nil || v != 258 {
+		t.Errorf("got uint16 %d, %v", v, err)
+	}
+	if v, err := o.Uint32(3); err != nil || v != 16909060 {
+		t.Errorf("got uint32 %d, %v", v, err)
+	}
+	if v, err := o.Int32(4); err != nil || v != -1 {
+		t.Errorf("got int32 %d, %v", v, err)
+	}
+	if v, err := o.Duration(5); err != nil || v != time.Hour {
+		t.Errorf("got duration %s, %v", v, err)
+	}
+	if v, err := o.Duration(6); err != nil || v != 0 {
+		t.Errorf("got duration %s for negative duration, %v", v, err)
+	}
+	if v, err := o.String(7); err != nil || v != "PXEClient" {
+		t.Errorf("got string %q, %v", v, err)
+	}
+	if v, err := o.IPs(8); err != nil || len(v) != 2 || !v[1].Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Errorf("got IPs %v, %v", v, err)
+	}
+	if v, err := o.IPMask(9); err != nil || v.String() != "ffffff00" {
+		t.Errorf("got IPMask %s, %v", v, err)
+	}
+	if v, err := o.GUID(97); err != nil || v != "4b37128e-6e72-4a8d-87da-8ad4d775582c" {
+		t.Errorf("got guid %s, %v", v, err)
+	}
+
+	if err := o.SetIP(10, net.ParseIP("fd00::1")); err == nil {
+		t.Error("set IPv6 address in an IPv4 option")
+	}
+	if err := o.SetIPMask(10, net.CIDRMask(64, 128)); err == nil {
+		t.Error("set IPv6 mask in an IPv4 option")
+	}
+	if err := o.SetGUID(10, "not-a-guid"); err == nil {
+		t.Error("set malformed guid")
+	}
+	if _, ok := o[10]; ok {
+		t.Error("failed setter changed the option")
+	}
+}
+
+func TestHumanReadable(t *testing.T) {
+	o := Options{}
+	o.SetUint16(OptClientSystem, 7)
+	o.SetDuration(OptLeaseTime, time.Hour)
+	o.SetString(OptVendorIdentifier, "PXEClient")
+	o.SetString(OptHostname, "\x00\x01")
+	o.SetBytes(OptRequestedOptions, []byte{1, 3, 6})
+	_ = o.SetIP(OptServerIdentifier, net.IPv4(10, 0, 0, 1))
+	_ = o.SetRelayAgentInfo(&RelayAgentInfo{CircuitID: []byte("swp1"), RemoteID: []byte{1, 2}})
+	o.SetBytes(200, []byte{0xca, 0xfe})
+	o[OptRouters] = []byte{1, 2, 3}
+
+	want := []string{
+		`3 (routers): 01 02 03`,
+		`12 (hostname): 00 01`,
+		`51 (lease time): 1h0m0s`,
+		`54 (server identifier): 10.0.0.1`,
+		`55 (parameter request list): 1, 3, 6`,
+		`60 (vendor class identifier): "PXEClient"`,
+		`82 (relay agent information): circuit-id "swp1", remote-id 01 02`,
+		`93 (client system architecture): 7`,
+		`200: ca fe`,
+	}
+	got := o.HumanReadable()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got options\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	RegisterOption(200, OptionInfo{Name: "site specific", Type: TypeUint16})
+	defer func() {
+		optionInfosMu.Lock()
+		delete(optionInfos, 200)
+		optionInfosMu.Unlock()
+	}()
+	if got := o.Format(200); got != "51966" {
+		t.Errorf("registered option formatted as %q, want 51966", got)
+	}
+	if got := Option(200).String(); got != "200 (site specific)" {
+		t.Errorf("registered option named %q", got)
+	}
 }
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"sort"
 )
 
 var magic = []byte{99, 130, 83, 99}
@@ -69,7 +68,8 @@ type Packet struct {
 	Type          MessageType
 	TransactionID []byte // Always 4 bytes
 	Broadcast     bool
-	HardwareAddr  net.HardwareAddr // Only ethernet supported at the moment
+	HardwareType  HardwareType     // Zero means HardwareTypeEthernet
+	HardwareAddr  net.HardwareAddr // At most 16 bytes, may be empty
 
 	ClientAddr net.IP // Client's current IP address (it will respond to ARP for this IP)
 	YourAddr   net.IP // Client IP address offered/assigned by server
@@ -125,13 +125,8 @@ func (p *Packet) DebugString() string {
   Options:
 `, p.Type, p.TransactionID, bcast, p.HardwareAddr, p.ClientAddr, p.YourAddr, p.ServerAddr, p.RelayAddr, p.BootServerName, p.BootFilename)
 
-	var opts []int
-	for n := range p.Options {
-		opts = append(opts, int(n))
-	}
-	sort.Ints(opts)
-	for _, n := range opts {
-		fmt.Fprintf(&b, "    %d: %#v\n", n, p.Options[Option(n)])
+	for _, opt := range p.Options.HumanReadable() {
+		fmt.Fprintf(&b, "    %s\n", opt)
 	}
 	return b.String()
 }
@@ -141,8 +136,15 @@ func (p *Packet) Marshal() ([]byte, error) {
 	if len(p.TransactionID) != 4 {
 		return nil, errors.New("transaction ID must be 4 bytes")
 	}
-	if len(p.HardwareAddr) != 6 {
-		return nil, errors.New("non-ethernet hardware address not supported")
+	htype := p.HardwareType
+	if htype == 0 {
+		htype = HardwareTypeEthernet
+	}
+	if htype == HardwareTypeEthernet && len(p.HardwareAddr) != 6 {
+		return nil, errors.New("ethernet hardware address must be 6 bytes")
+	}
+	if len(p.HardwareAddr) > maxHardwareAddrLen {
+		return nil, fmt.Errorf("hardware address must be <= %d bytes", maxHardwareAddrLen)
 	}
 	if len(p.BootServerName) > 64 {
 		return nil, errors.New("sname must be <= 64 bytes")
@@ -170,10 +172,10 @@ func (p *Packet) Marshal() ([]byte, error) {
 	default:
 		return nil, fmt.Errorf("unknown DHCP message type %d", p.Type)
 	}
-	// Hardware address type = Ethernet
-	ret.WriteByte(1)
-	// Hardware address length = 6
-	ret.WriteByte(6)
+	// Hardware address type
+	ret.WriteByte(byte(htype))
+	// Hardware address length
+	ret.WriteByte(byte(len(p.HardwareAddr)))
 	// Hops = 0
 	ret.WriteByte(0)
 	// Transaction ID
@@ -192,9 +194,9 @@ func (p *Packet) Marshal() ([]byte, error) {
 	writeIP(ret, p.ServerAddr)
 	writeIP(ret, p.RelayAddr)
 
-	// MAC address + 10 bytes of padding
+	// Hardware address + padding
 	ret.Write([]byte(p.HardwareAddr))
-	ret.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	ret.Write(make([]byte, maxHardwareAddrLen-len(p.HardwareAddr)))
 
 	opts := make(Options, len(p.Options)+1)
 	for k, v := range p.Options {
@@ -265,10 +267,14 @@ func Unmarshal(bs []byte) (*Packet, error) {
 		Options: make(Options),
 	}
 
-	if bs[1] != 1 || bs[2] != 6 {
+	ret.HardwareType = HardwareType(bs[1])
+	hlen := int(bs[2])
+	if hlen > maxHardwareAddrLen || (ret.HardwareType == HardwareTypeEthernet && hlen != 6) {
 		return nil, fmt.Errorf("packet has unsupported hardware address type/length %d/%d", bs[1], bs[2])
 	}
-	ret.HardwareAddr = net.HardwareAddr(bs[28:34])
+	if hlen > 0 {
+		ret.HardwareAddr = net.HardwareAddr(bs[28 : 28+hlen])
+	}
 	ret.TransactionID = bs[4:8]
 	if binary.BigEndian.Uint16(bs[10:12])&0x8000 != 0 {
 		ret.Broadcast = true
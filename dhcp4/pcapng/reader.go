@@ -0,0 +1,274 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// Link types that ReadPackets decodes.
+const (
+	linkTypeEthernet = 1
+	linkTypeIPv4     = 228
+)
+
+// Magic numbers of libpcap files, with microsecond and nanosecond
+// timestamps.
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+)
+
+// ReadPackets returns the IPv4 UDP packets in the pcapng or libpcap
+// file r, such as those written by Writer or tcpdump. Other packets are
+// skipped. The Direction of the packets is only known for pcapng files
+// that record it, and their Interface is only known by name.
+func ReadPackets(r io.Reader) ([]*dhcp4.CapturedPacket, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("reading file magic: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic[:]) == blockSectionHeader {
+		return readPcapng(io.MultiReader(bytes.NewReader(magic[:]), r))
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic[:]) {
+		case pcapMagicMicro:
+			return readPcap(r, order, time.Microsecond)
+		case pcapMagicNano:
+			return readPcap(r, order, time.Nanosecond)
+		}
+	}
+	return nil, errors.New("not a pcapng or pcap file")
+}
+
+// readPcap reads the rest of a libpcap file, after its magic number.
+func readPcap(r io.Reader, order binary.ByteOrder, resolution time.Duration) ([]*dhcp4.CapturedPacket, error) {
+	var hdr [20]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %w", err)
+	}
+	linkType := order.Uint32(hdr[16:]) & 0xffff
+
+	var ret []*dhcp4.CapturedPacket
+	for {
+		var rec [16]byte
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return ret, nil
+			}
+			return nil, fmt.Errorf("reading pcap record: %w", err)
+		}
+		data := make([]byte, order.Uint32(rec[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("reading pcap record: %w", err)
+		}
+		ts := time.Unix(int64(order.Uint32(rec[0:])), int64(order.Uint32(rec[4:]))*int64(resolution))
+		if p := decode(linkType, data); p != nil {
+			p.Time = ts
+			ret = append(ret, p)
+		}
+	}
+}
+
+// pcapngInterface is an interface described in a pcapng section.
+type pcapngInterface struct {
+	linkType uint32
+	name     string
+	// resolution is the duration of a timestamp unit.
+	resolution time.Duration
+}
+
+// readPcapng reads a pcapng file.
+func readPcapng(r io.Reader) ([]*dhcp4.CapturedPacket, error) {
+	var (
+		ret    []*dhcp4.CapturedPacket
+		order  binary.ByteOrder = binary.LittleEndian
+		ifaces []pcapngInterface
+	)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return ret, nil
+			}
+			return nil, fmt.Errorf("reading pcapng block: %w", err)
+		}
+		typ := order.Uint32(hdr[:])
+		if typ == blockSectionHeader {
+			// The byte order of every section is given by its
+			// header, which we need to read the block length.
+			var bom [4]byte
+			if _, err := io.ReadFull(r, bom[:]); err != nil {
+				return nil, fmt.Errorf("reading pcapng section header: %w", err)
+			}
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(bom[:]) == byteOrderMagic {
+				order = binary.BigEndian
+			}
+			l := order.Uint32(hdr[4:])
+			if l < 28 || l%4 != 0 {
+				return nil, fmt.Errorf("invalid pcapng section header length %d", l)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(l)-12); err != nil {
+				return nil, fmt.Errorf("reading pcapng section header: %w", err)
+			}
+			ifaces = nil
+			continue
+		}
+
+		l := order.Uint32(hdr[4:])
+		if l < 12 || l%4 != 0 {
+			return nil, fmt.Errorf("invalid pcapng block length %d", l)
+		}
+		body := make([]byte, l-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("reading pcapng block: %w", err)
+		}
+		body = body[:len(body)-4]
+
+		switch typ {
+		case blockInterfaceDescription:
+			if len(body) < 8 {
+				return nil, errors.New("truncated pcapng interface description")
+			}
+			iface := pcapngInterface{
+				linkType:   uint32(order.Uint16(body)),
+				resolution: time.Microsecond,
+			}
+			for code, val := range options(order, body[8:]) {
+				switch code {
+				case optIfName:
+					iface.name = string(val)
+				case optIfTsresol:
+					if len(val) == 1 {
+						iface.resolution = tsresol(val[0])
+					}
+				}
+			}
+			ifaces = append(ifaces, iface)
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return nil, errors.New("truncated pcapng packet")
+			}
+			id := order.Uint32(body)
+			if int(id) >= len(ifaces) {
+				return nil, fmt.Errorf("pcapng packet on undescribed interface %d", id)
+			}
+			iface := ifaces[id]
+			caplen := int(order.Uint32(body[12:]))
+			if len(body[20:]) < caplen {
+				return nil, errors.New("truncated pcapng packet")
+			}
+			p := decode(iface.linkType, body[20:20+caplen])
+			if p == nil {
+				continue
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			p.Time = time.Unix(0, 0).Add(time.Duration(ts) * iface.resolution) // nolint:gosec
+			if iface.name != "" {
+				p.Interface = &net.Interface{Name: iface.name}
+			}
+			for code, val := range options(order, body[20+padded(caplen):]) {
+				if code == optEPBFlags && len(val) == 4 {
+					switch order.Uint32(val) & 3 {
+					case flagInbound:
+						p.Direction = dhcp4.DirectionIn
+					case flagOutbound:
+						p.Direction = dhcp4.DirectionOut
+					}
+				}
+			}
+			ret = append(ret, p)
+		}
+	}
+}
+
+// optIfTsresol is the timestamp resolution option of interfaces.
+const optIfTsresol = 9
+
+// tsresol returns the duration of a timestamp unit encoded as v.
+func tsresol(v byte) time.Duration {
+	if v&0x80 != 0 {
+		// Powers of two aren't worth supporting for DHCP traffic.
+		return time.Microsecond
+	}
+	d := time.Second
+	for range v {
+		d /= 10
+	}
+	if d == 0 {
+		d = 1
+	}
+	return d
+}
+
+// options returns the options of a pcapng block, by code. Malformed
+// options are ignored.
+func options(order binary.ByteOrder, b []byte) map[uint16][]byte {
+	ret := map[uint16][]byte{}
+	for len(b) >= 4 {
+		code, l := order.Uint16(b), int(order.Uint16(b[2:]))
+		if code == optEndOfOpt || len(b[4:]) < l {
+			break
+		}
+		ret[code] = b[4 : 4+l]
+		b = b[min(4+padded(l), len(b)):]
+	}
+	return ret
+}
+
+// decode returns the UDP packet in the frame data of linkType, or nil
+// if it isn't one.
+func decode(linkType uint32, data []byte) *dhcp4.CapturedPacket {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType, data := binary.BigEndian.Uint16(data[12:]), data[14:]
+		// Skip VLAN tags.
+		for etherType == 0x8100 && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+		if etherType != 0x0800 {
+			return nil
+		}
+		return decodeIPv4(data)
+	case linkTypeRaw, linkTypeIPv4:
+		return decodeIPv4(data)
+	default:
+		return nil
+	}
+}
+
+func decodeIPv4(data []byte) *dhcp4.CapturedPacket {
+	if len(data) < 20 || data[0]>>4 != 4 || data[9] != 17 {
+		return nil
+	}
+	// Fragments can't be decoded on their own.
+	if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+		return nil
+	}
+	hl := int(data[0]&0xf) * 4
+	if len(data) < hl+8 {
+		return nil
+	}
+	src, dst := net.IP(data[12:16]), net.IP(data[16:20])
+	udp := data[hl:]
+	l := int(binary.BigEndian.Uint16(udp[4:]))
+	if l < 8 || l > len(udp) {
+		return nil
+	}
+	return &dhcp4.CapturedPacket{
+		Src:  &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(udp))},
+		Dst:  &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(udp[2:]))},
+		Data: udp[8:l],
+	}
+}
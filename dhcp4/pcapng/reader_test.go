@@ -0,0 +1,81 @@
+package pcapng
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPacketsRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	require.NoError(t, err)
+
+	want := []*dhcp4.CapturedPacket{
+		{
+			Time:      time.Unix(1700000000, 123456000),
+			Direction: dhcp4.DirectionIn,
+			Interface: &net.Interface{Name: "eth0"},
+			Src:       &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5).To4(), Port: 68},
+			Dst:       &net.UDPAddr{IP: net.IPv4bcast.To4(), Port: 67},
+			Data:      []byte("request"),
+		},
+		{
+			Time:      time.Unix(1700000001, 0),
+			Direction: dhcp4.DirectionOut,
+			Src:       &net.UDPAddr{IP: net.IPv4zero.To4(), Port: 4011},
+			Dst:       &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5).To4(), Port: 4011},
+			Data:      []byte("reply"),
+		},
+	}
+	for _, p := range want {
+		require.NoError(t, w.WritePacket(p))
+	}
+	// A second section, as appended by another capture.
+	w, err = NewWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, w.WritePacket(want[0]))
+	want = append(want, want[0])
+
+	got, err := ReadPackets(&buf)
+	require.NoError(t, err)
+	require.Len(t, got, len(want))
+	for i := range want {
+		require.True(t, want[i].Time.Equal(got[i].Time), "time of packet %d", i)
+		require.Equal(t, want[i].Direction, got[i].Direction)
+		if want[i].Interface == nil {
+			require.Equal(t, unknownInterface, got[i].Interface.Name)
+		} else {
+			require.Equal(t, want[i].Interface.Name, got[i].Interface.Name)
+		}
+		require.Equal(t, want[i].Src.String(), got[i].Src.String())
+		require.Equal(t, want[i].Dst.String(), got[i].Dst.String())
+		require.Equal(t, want[i].Data, got[i].Data)
+	}
+}
+
+func TestReadPacketsPcap(t *testing.T) {
+	f, err := os.Open("../testdata/dhcp.pcap")
+	require.NoError(t, err)
+	defer f.Close()
+
+	pkts, err := ReadPackets(f)
+	require.NoError(t, err)
+	require.Len(t, pkts, 4)
+	for _, p := range pkts {
+		_, err := dhcp4.Unmarshal(p.Data)
+		require.NoError(t, err)
+		require.Zero(t, p.Direction)
+		require.Nil(t, p.Interface)
+	}
+	require.Equal(t, 67, pkts[0].Dst.Port)
+	require.Equal(t, 68, pkts[1].Dst.Port)
+
+	_, err = ReadPackets(bytes.NewReader([]byte("not a capture")))
+	require.Error(t, err)
+}
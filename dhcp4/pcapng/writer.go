@@ -0,0 +1,194 @@
+// Package pcapng writes captured DHCP packets as pcapng files, which
+// Wireshark and tcpdump can read, and reads them back from pcapng and
+// libpcap files.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// Block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html.
+const (
+	blockSectionHeader        = 0x0a0d0d0a
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEndOfOpt = 0
+	optIfName   = 2
+	optEPBFlags = 2
+
+	// linkTypeRaw is raw IPv4 or IPv6 packets, without a link-layer
+	// header.
+	linkTypeRaw = 101
+
+	flagInbound  = 1
+	flagOutbound = 2
+)
+
+// unknownInterface names the interface of packets that were captured
+// without one.
+const unknownInterface = "unknown"
+
+// Writer writes captured packets to a pcapng section. The packets are
+// wrapped in IPv4 and UDP headers built from their endpoints, so that
+// packet analyzers decode them as DHCP.
+//
+// A Writer is not safe for concurrent use.
+type Writer struct {
+	w      io.Writer
+	ifaces map[string]uint32
+}
+
+// NewWriter starts a pcapng section on w. Sections can be appended to
+// existing pcapng files.
+func NewWriter(w io.Writer) (*Writer, error) {
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, byteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1) // major version
+	b = binary.LittleEndian.AppendUint16(b, 0) // minor version
+	// Section length, unspecified.
+	b = binary.LittleEndian.AppendUint64(b, 0xffffffffffffffff)
+	if err := writeBlock(w, blockSectionHeader, b); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		ifaces: map[string]uint32{},
+	}, nil
+}
+
+// WritePacket writes p to the section.
+func (w *Writer) WritePacket(p *dhcp4.CapturedPacket) error {
+	id, err := w.iface(p.Interface)
+	if err != nil {
+		return err
+	}
+	pkt := ipPacket(p)
+
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, id)
+	// Timestamps are in microseconds, the default resolution.
+	ts := uint64(p.Time.UnixMicro()) // nolint:gosec
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt))) // nolint:gosec
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt))) // nolint:gosec
+	b = append(b, pad(pkt)...)
+
+	var flags uint32
+	switch p.Direction {
+	case dhcp4.DirectionIn:
+		flags = flagInbound
+	case dhcp4.DirectionOut:
+		flags = flagOutbound
+	}
+	b = appendOption(b, optEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	b = appendOption(b, optEndOfOpt, nil)
+	return writeBlock(w.w, blockEnhancedPacket, b)
+}
+
+// iface returns the ID of intf in the section, describing it first if
+// it is new.
+func (w *Writer) iface(intf *net.Interface) (uint32, error) {
+	name := unknownInterface
+	if intf != nil {
+		name = intf.Name
+	}
+	if id, ok := w.ifaces[name]; ok {
+		return id, nil
+	}
+
+	var b []byte
+	b = binary.LittleEndian.AppendUint16(b, linkTypeRaw)
+	b = binary.LittleEndian.AppendUint16(b, 0) // reserved
+	b = binary.LittleEndian.AppendUint32(b, 0) // no snap length
+	b = appendOption(b, optIfName, []byte(name))
+	b = appendOption(b, optEndOfOpt, nil)
+	if err := writeBlock(w.w, blockInterfaceDescription, b); err != nil {
+		return 0, err
+	}
+	id := uint32(len(w.ifaces)) // nolint:gosec
+	w.ifaces[name] = id
+	return id, nil
+}
+
+// ipPacket returns the payload of p with IPv4 and UDP headers.
+func ipPacket(p *dhcp4.CapturedPacket) []byte {
+	src, dst := endpoint(p.Src), endpoint(p.Dst)
+	l := 20 + 8 + len(p.Data)
+
+	ret := make([]byte, 20, l)
+	ret[0] = 0x45                                  // version 4, 20 byte header
+	binary.BigEndian.PutUint16(ret[2:], uint16(l)) // nolint:gosec
+	ret[8] = 64                                    // TTL
+	ret[9] = 17                                    // UDP
+	copy(ret[12:16], src.IP)
+	copy(ret[16:20], dst.IP)
+	binary.BigEndian.PutUint16(ret[10:], checksum(ret))
+
+	ret = binary.BigEndian.AppendUint16(ret, uint16(src.Port))      // nolint:gosec
+	ret = binary.BigEndian.AppendUint16(ret, uint16(dst.Port))      // nolint:gosec
+	ret = binary.BigEndian.AppendUint16(ret, uint16(8+len(p.Data))) // nolint:gosec
+	// A zero UDP checksum means none was computed.
+	ret = binary.BigEndian.AppendUint16(ret, 0)
+	return append(ret, p.Data...)
+}
+
+// endpoint returns addr with an IPv4 address, which is the unspecified
+// address if addr doesn't have one.
+func endpoint(addr *net.UDPAddr) net.UDPAddr {
+	if addr == nil {
+		return net.UDPAddr{IP: net.IPv4zero.To4()}
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	return net.UDPAddr{IP: ip, Port: addr.Port}
+}
+
+func checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func appendOption(b []byte, code uint16, val []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(val))) // nolint:gosec
+	return append(b, pad(val)...)
+}
+
+// pad returns b padded with zeros to a multiple of 4 bytes.
+func pad(b []byte) []byte {
+	return append(b, make([]byte, padded(len(b))-len(b))...)
+}
+
+// padded returns n rounded up to a multiple of 4.
+func padded(n int) int {
+	return (n + 3) &^ 3
+}
+
+// writeBlock writes a block of type typ with body to w.
+func writeBlock(w io.Writer, typ uint32, body []byte) error {
+	l := uint32(12 + len(body)) // nolint:gosec
+	b := make([]byte, 0, l)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, l)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, l)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,92 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"github.com/stretchr/testify/require"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+func readBlocks(t *testing.T, b []byte) []block {
+	var ret []block
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 12)
+		typ := binary.LittleEndian.Uint32(b)
+		l := int(binary.LittleEndian.Uint32(b[4:]))
+		require.Zero(t, l%4, "block length must be a multiple of 4")
+		require.GreaterOrEqual(t, len(b), l)
+		require.Equal(t, uint32(l), binary.LittleEndian.Uint32(b[l-4:]), "trailing block length")
+		ret = append(ret, block{typ, b[8 : l-4]})
+		b = b[l:]
+	}
+	return ret
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	require.NoError(t, err)
+
+	eth0 := &net.Interface{Name: "eth0"}
+	payload := []byte("not really DHCP")
+	now := time.Unix(1700000000, 123456000)
+	for _, p := range []*dhcp4.CapturedPacket{
+		{Time: now, Direction: dhcp4.DirectionIn, Interface: eth0, Src: &net.UDPAddr{IP: net.IPv4zero, Port: 68}, Dst: &net.UDPAddr{IP: net.IPv4zero, Port: 67}, Data: payload},
+		{Time: now, Direction: dhcp4.DirectionOut, Interface: eth0, Src: &net.UDPAddr{IP: net.IPv4zero, Port: 67}, Dst: &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, Data: payload},
+		{Time: now, Direction: dhcp4.DirectionIn, Src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 68}, Data: payload},
+	} {
+		require.NoError(t, w.WritePacket(p))
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	var types []uint32
+	for _, b := range blocks {
+		types = append(types, b.typ)
+	}
+	require.Equal(t, []uint32{
+		blockSectionHeader,
+		blockInterfaceDescription, blockEnhancedPacket, blockEnhancedPacket,
+		blockInterfaceDescription, blockEnhancedPacket,
+	}, types)
+
+	require.Equal(t, uint32(byteOrderMagic), binary.LittleEndian.Uint32(blocks[0].body))
+	require.Equal(t, uint16(linkTypeRaw), binary.LittleEndian.Uint16(blocks[1].body))
+	require.Equal(t, "eth0", string(blocks[1].body[12:16]))
+	require.Equal(t, unknownInterface, string(blocks[4].body[12:19]))
+
+	for i, want := range map[int]struct {
+		iface uint32
+		flags uint32
+		src   net.IP
+		dport uint16
+	}{
+		2: {0, flagInbound, net.IPv4zero, 67},
+		3: {0, flagOutbound, net.IPv4zero, 68},
+		5: {1, flagInbound, net.IPv4(10, 0, 0, 5), 0},
+	} {
+		body := blocks[i].body
+		require.Equal(t, want.iface, binary.LittleEndian.Uint32(body), "interface of block %d", i)
+		ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+		require.Equal(t, uint64(now.UnixMicro()), ts)
+		l := int(binary.LittleEndian.Uint32(body[12:]))
+		require.Equal(t, 28+len(payload), l)
+		pkt := body[20 : 20+l]
+		require.Equal(t, byte(0x45), pkt[0])
+		require.Equal(t, uint16(0), checksum(pkt[:20]), "IPv4 header checksum")
+		require.True(t, net.IP(pkt[12:16]).Equal(want.src))
+		require.Equal(t, want.dport, binary.BigEndian.Uint16(pkt[22:]))
+		require.Equal(t, payload, pkt[28:])
+		opts := body[20+padded(len(pkt)):]
+		require.Equal(t, uint16(optEPBFlags), binary.LittleEndian.Uint16(opts))
+		require.Equal(t, want.flags, binary.LittleEndian.Uint32(opts[4:]))
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PXE vendor sub-options, carried in OptVendorSpecific when the vendor
+// class is "PXEClient". See section 2.4 of the PXE 2.1 specification.
+const (
+	PXEOptDiscoveryControl Option = 6
+	PXEOptBootServers      Option = 8
+	PXEOptBootMenu         Option = 9
+	PXEOptMenuPrompt       Option = 10
+	PXEOptBootItem         Option = 71
+)
+
+// PXEDiscovery are the bits of PXEOptDiscoveryControl.
+type PXEDiscovery byte
+
+// Boot server discovery control bits.
+const (
+	// PXEDisableBroadcast disables broadcast discovery of boot
+	// servers.
+	PXEDisableBroadcast PXEDiscovery = 1 << iota
+	// PXEDisableMulticast disables multicast discovery of boot
+	// servers.
+	PXEDisableMulticast
+	// PXEOnlyListedServers makes the client only accept replies from
+	// the servers in PXEOptBootServers.
+	PXEOnlyListedServers
+	// PXEBypassDiscovery makes the client skip boot server discovery
+	// and download the boot file it was offered right away.
+	PXEBypassDiscovery
+)
+
+// PXELocalBoot is the boot server type of a menu item that boots from
+// the local disk instead of the network.
+const PXELocalBoot uint16 = 0
+
+// PXEBootServer is a boot server type and the addresses serving it.
+type PXEBootServer struct {
+	Type uint16
+	IPs  []net.IP
+}
+
+// PXEMenuItem is an entry of the boot menu, which boots from the
+// servers of Type.
+type PXEMenuItem struct {
+	Type        uint16
+	Description string
+}
+
+// PXEVendorOptions are the PXE vendor options that a ProxyDHCP server
+// sends to make a client boot, possibly through a boot menu.
+type PXEVendorOptions struct {
+	Discovery   PXEDiscovery
+	BootServers []PXEBootServer
+	Menu        []PXEMenuItem
+	// MenuPrompt is shown for MenuTimeout before the first menu item
+	// is booted. With a timeout of 0, the first item is booted right
+	// away, without a prompt. A negative timeout shows the menu and
+	// waits for a choice.
+	MenuPrompt  string
+	MenuTimeout time.Duration
+	// BootItem is the menu item chosen by the client, or the one the
+	// server's reply is for.
+	BootItem *PXEBootItem
+}
+
+// PXEBootItem is a chosen boot server type, and the layer of the boot
+// file to download from it.
+type PXEBootItem struct {
+	Type  uint16
+	Layer uint16
+}
+
+// Options returns the encapsulated options that carry p.
+func (p *PXEVendorOptions) Options() (Options, error) {
+	ret := Options{}
+	if p.Discovery != 0 || len(p.Menu) > 0 {
+		ret.SetByte(PXEOptDiscoveryControl, byte(p.Discovery))
+	}
+	if len(p.BootServers) > 0 {
+		var bs []byte
+		for _, srv := range p.BootServers {
+			if len(srv.IPs) == 0 || len(srv.IPs) > 255 {
+				return nil, fmt.Errorf("PXE boot server type %d has %d addresses, want 1-255", srv.Type, len(srv.IPs))
+			}
+			bs = binary.BigEndian.AppendUint16(bs, srv.Type)
+			bs = append(bs, byte(len(srv.IPs)))
+			for _, ip := range srv.IPs {
+				ip4 := ip.To4()
+				if ip4 == nil {
+					return nil, fmt.Errorf("PXE boot server %s is not an IPv4 address", ip)
+				}
+				bs = append(bs, ip4...)
+			}
+		}
+		ret.SetBytes(PXEOptBootServers, bs)
+	}
+	if len(p.Menu) > 0 {
+		var bs []byte
+		for _, item := range p.Menu {
+			if len(item.Description) > 255 {
+				return nil, fmt.Errorf("PXE menu item %q is too long", item.Description)
+			}
+			bs = binary.BigEndian.AppendUint16(bs, item.Type)
+			bs = append(bs, byte(len(item.Description)))
+			bs = append(bs, item.Description...)
+		}
+		ret.SetBytes(PXEOptBootMenu, bs)
+
+		timeout := byte(255)
+		if p.MenuTimeout >= 0 {
+			secs := (p.MenuTimeout + time.Second - 1) / time.Second
+			timeout = byte(min(secs, 254))
+		}
+		ret.SetBytes(PXEOptMenuPrompt, append([]byte{timeout}, p.MenuPrompt...))
+	}
+	if p.BootItem != nil {
+		bs := binary.BigEndian.AppendUint16(nil, p.BootItem.Type)
+		ret.SetBytes(PXEOptBootItem, binary.BigEndian.AppendUint16(bs, p.BootItem.Layer))
+	}
+	return ret, nil
+}
+
+// Unmarshal parses the value of OptVendorSpecific into p. Unknown
+// sub-options are ignored.
+func (p *PXEVendorOptions) Unmarshal(bs []byte) error {
+	*p = PXEVendorOptions{}
+	o := Options{}
+	if err := o.Unmarshal(bs); err != nil {
+		// Clients may leave out the end of options marker.
+		o = Options{}
+		if err := o.Unmarshal(append(append([]byte(nil), bs...), 255)); err != nil {
+			return err
+		}
+	}
+
+	if v, err := o.Byte(PXEOptDiscoveryControl); err == nil {
+		p.Discovery = PXEDiscovery(v)
+	}
+	if bs, err := o.Bytes(PXEOptBootServers); err == nil {
+		for len(bs) > 0 {
+			if len(bs) < 3 || len(bs[3:]) < 4*int(bs[2]) {
+				return errors.New("truncated PXE boot servers")
+			}
+			srv := PXEBootServer{Type: binary.BigEndian.Uint16(bs)}
+			n := int(bs[2])
+			bs = bs[3:]
+			for i := 0; i < n; i++ {
+				srv.IPs = append(srv.IPs, net.IP(bs[4*i:4*i+4]))
+			}
+			p.BootServers = append(p.BootServers, srv)
+			bs = bs[4*n:]
+		}
+	}
+	if bs, err := o.Bytes(PXEOptBootMenu); err == nil {
+		for len(bs) > 0 {
+			if len(bs) < 3 || len(bs[3:]) < int(bs[2]) {
+				return errors.New("truncated PXE boot menu")
+			}
+			l := int(bs[2])
+			p.Menu = append(p.Menu, PXEMenuItem{
+				Type:        binary.BigEndian.Uint16(bs),
+				Description: string(bs[3 : 3+l]),
+			})
+			bs = bs[3+l:]
+		}
+	}
+	if bs, err := o.Bytes(PXEOptMenuPrompt); err == nil {
+		if len(bs) < 1 {
+			return errors.New("truncated PXE menu prompt")
+		}
+		p.MenuTimeout = time.Duration(bs[0]) * time.Second
+		if bs[0] == 255 {
+			p.MenuTimeout = -1
+		}
+		p.MenuPrompt = string(bs[1:])
+	}
+	if bs, err := o.Bytes(PXEOptBootItem); err == nil {
+		if len(bs) != 4 {
+			return errors.New("malformed PXE boot item")
+		}
+		p.BootItem = &PXEBootItem{
+			Type:  binary.BigEndian.Uint16(bs),
+			Layer: binary.BigEndian.Uint16(bs[2:]),
+		}
+	}
+	return nil
+}
+
+// PXEVendorOptions returns the value of OptVendorSpecific, decoded as
+// PXE vendor options.
+func (o Options) PXEVendorOptions() (*PXEVendorOptions, error) {
+	bs, err := o.Bytes(OptVendorSpecific)
+	if err != nil {
+		return nil, err
+	}
+	ret := &PXEVendorOptions{}
+	if err := ret.Unmarshal(bs); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SetPXEVendorOptions sets OptVendorSpecific to the encoding of p.
+func (o Options) SetPXEVendorOptions(p *PXEVendorOptions) error {
+	sub, err := p.Options()
+	if err != nil {
+		return err
+	}
+	return o.SetOptions(OptVendorSpecific, sub)
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPXEVendorOptions(t *testing.T) {
+	// Bypassing discovery is what pixiecore has always sent.
+	o := Options{}
+	if err := o.SetPXEVendorOptions(&PXEVendorOptions{Discovery: PXEBypassDiscovery}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{6, 1, 8, 255}; !bytes.Equal(o[OptVendorSpecific], want) {
+		t.Errorf("got option 43 %v, want %v", o[OptVendorSpecific], want)
+	}
+
+	menu := &PXEVendorOptions{
+		Discovery: PXEDisableBroadcast | PXEDisableMulticast | PXEOnlyListedServers,
+		BootServers: []PXEBootServer{
+			{Type: 0x8000, IPs: []net.IP{net.IPv4(10, 0, 0, 1).To4()}},
+		},
+		Menu: []PXEMenuItem{
+			{Type: 0x8000, Description: "metal-hammer"},
+			{Type: PXELocalBoot, Description: "local disk"},
+		},
+		MenuPrompt:  "Press F8 for boot menu",
+		MenuTimeout: 5 * time.Second,
+	}
+	if err := o.SetPXEVendorOptions(menu); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		6, 1, 7,
+		8, 7, 0x80, 0, 1, 10, 0, 0, 1,
+		9, 28, 0x80, 0, 12, 'm', 'e', 't', 'a', 'l', '-', 'h', 'a', 'm', 'm', 'e', 'r', 0, 0, 10, 'l', 'o', 'c', 'a', 'l', ' ', 'd', 'i', 's', 'k',
+		10, 23, 5, 'P', 'r', 'e', 's', 's', ' ', 'F', '8', ' ', 'f', 'o', 'r', ' ', 'b', 'o', 'o', 't', ' ', 'm', 'e', 'n', 'u',
+		255,
+	}
+	if !bytes.Equal(o[OptVendorSpecific], want) {
+		t.Errorf("got option 43\n%v\nwant\n%v", o[OptVendorSpecific], want)
+	}
+	got, err := o.PXEVendorOptions()
+	if err != nil {
+		t.Fatalf("decoding PXE vendor options: %s", err)
+	}
+	if !reflect.DeepEqual(got, menu) {
+		t.Errorf("PXE vendor options don't round-trip:\ngot  %+v\nwant %+v", got, menu)
+	}
+
+	// A client's choice, without the end of options marker.
+	got = &PXEVendorOptions{}
+	if err := got.Unmarshal([]byte{71, 4, 0x80, 0, 0, 0}); err != nil {
+		t.Fatalf("decoding boot item: %s", err)
+	}
+	if got.BootItem == nil || *got.BootItem != (PXEBootItem{Type: 0x8000}) {
+		t.Errorf("got boot item %+v, want type 0x8000 layer 0", got.BootItem)
+	}
+
+	// A negative timeout waits for a choice.
+	menu.MenuTimeout = -1
+	sub, err := menu.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub[PXEOptMenuPrompt][0] != 255 {
+		t.Errorf("got menu timeout %d, want 255", sub[PXEOptMenuPrompt][0])
+	}
+
+	for _, bad := range [][]byte{
+		{8, 4, 0x80, 0, 1, 10, 255},
+		{9, 4, 0x80, 0, 5, 'a', 255},
+		{71, 2, 0x80, 0, 255},
+	} {
+		if err := new(PXEVendorOptions).Unmarshal(bad); err == nil {
+			t.Errorf("decoded invalid PXE vendor options %v", bad)
+		}
+	}
+}
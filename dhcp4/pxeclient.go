@@ -0,0 +1,138 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ClientNII is the client network interface identifier (option 94) of
+// a PXE client. See section 2.2 of RFC 4578.
+type ClientNII struct {
+	// Type is the interface type, 1 for UNDI.
+	Type byte
+	// Major and Minor are the version of the interface.
+	Major, Minor byte
+}
+
+// String returns n in human-readable form.
+func (n *ClientNII) String() string {
+	if n.Type == 1 {
+		return fmt.Sprintf("UNDI %d.%d", n.Major, n.Minor)
+	}
+	return fmt.Sprintf("type %d %d.%d", n.Type, n.Major, n.Minor)
+}
+
+// ClientNII returns the client network interface identifier option
+// (94).
+func (o Options) ClientNII() (*ClientNII, error) {
+	bs, err := o.Bytes(OptClientNDI)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) != 3 {
+		return nil, errOptionWrongSize
+	}
+	return &ClientNII{Type: bs[0], Major: bs[1], Minor: bs[2]}, nil
+}
+
+// SetClientNII sets the client network interface identifier option
+// (94) to n.
+func (o Options) SetClientNII(n *ClientNII) {
+	o[OptClientNDI] = []byte{n.Type, n.Major, n.Minor}
+}
+
+// PXEVendorClass is a vendor class identifier (option 60) of the form
+// "PXEClient:Arch:xxxxx:UNDI:yyyzzz", which PXE clients send. UEFI HTTP
+// boot clients send the same with "HTTPClient".
+type PXEVendorClass struct {
+	// Client is "PXEClient" or "HTTPClient".
+	Client string
+	// Arch is the client system architecture, as in option 93.
+	Arch uint16
+	// UNDIMajor and UNDIMinor are the UNDI version.
+	UNDIMajor, UNDIMinor int
+}
+
+// ParsePXEVendorClass parses a vendor class identifier of the form
+// "PXEClient:Arch:xxxxx:UNDI:yyyzzz". Anything after the UNDI version
+// is ignored.
+func ParsePXEVendorClass(s string) (*PXEVendorClass, error) {
+	fs := strings.Split(s, ":")
+	if len(fs) < 5 || (fs[0] != "PXEClient" && fs[0] != "HTTPClient") || fs[1] != "Arch" || fs[3] != "UNDI" {
+		return nil, fmt.Errorf("vendor class %q is not of the form PXEClient:Arch:xxxxx:UNDI:yyyzzz", s)
+	}
+	if len(fs[2]) != 5 || len(fs[4]) != 6 {
+		return nil, fmt.Errorf("vendor class %q has malformed architecture or UNDI version", s)
+	}
+	arch, err := strconv.ParseUint(fs[2], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("vendor class %q has malformed architecture: %w", s, err)
+	}
+	major, err1 := strconv.Atoi(fs[4][:3])
+	minor, err2 := strconv.Atoi(fs[4][3:])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("vendor class %q has malformed UNDI version", s)
+	}
+	return &PXEVendorClass{
+		Client:    fs[0],
+		Arch:      uint16(arch),
+		UNDIMajor: major,
+		UNDIMinor: minor,
+	}, nil
+}
+
+// String returns c in the form "PXEClient:Arch:xxxxx:UNDI:yyyzzz".
+func (c *PXEVendorClass) String() string {
+	return fmt.Sprintf("%s:Arch:%05d:UNDI:%03d%03d", c.Client, c.Arch, c.UNDIMajor, c.UNDIMinor)
+}
+
+// PXEClientInfo is what a PXE client says about itself in its
+// requests.
+type PXEClientInfo struct {
+	// Archs are the client system architectures (option 93), in the
+	// client's order of preference.
+	Archs []uint16
+	// NII is the client network interface identifier (option 94),
+	// or nil if the client didn't send a valid one.
+	NII *ClientNII
+	// VendorClass is the parsed vendor class identifier (option 60),
+	// or nil if the client didn't send one of the PXE form.
+	VendorClass *PXEVendorClass
+}
+
+// PXEClientInfo returns the PXE client information in o. Option 93 is
+// required, options 94 and 60 are optional and only parsed on a best
+// effort basis.
+func (o Options) PXEClientInfo() (*PXEClientInfo, error) {
+	archs, err := o.Uint16s(OptClientSystem)
+	if err != nil {
+		return nil, fmt.Errorf("malformed client system architecture (option 93): %w", err)
+	}
+	ret := &PXEClientInfo{Archs: archs}
+	if o[OptClientNDI] != nil {
+		// Some firmwares get option 94 wrong, which doesn't keep
+		// them from booting.
+		ret.NII, _ = o.ClientNII()
+	}
+	if vc, err := o.String(OptVendorIdentifier); err == nil {
+		// Other vendor classes are fine, the client just isn't
+		// telling us more.
+		ret.VendorClass, _ = ParsePXEVendorClass(vc)
+	}
+	return ret, nil
+}
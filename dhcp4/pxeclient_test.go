@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPXEClientInfo(t *testing.T) {
+	o := Options{}
+	o.SetUint16s(OptClientSystem, []uint16{16, 7})
+	o.SetClientNII(&ClientNII{Type: 1, Major: 3, Minor: 16})
+	o.SetString(OptVendorIdentifier, "PXEClient:Arch:00016:UNDI:003016")
+
+	info, err := o.PXEClientInfo()
+	if err != nil {
+		t.Fatalf("PXEClientInfo: %s", err)
+	}
+	want := &PXEClientInfo{
+		Archs:       []uint16{16, 7},
+		NII:         &ClientNII{Type: 1, Major: 3, Minor: 16},
+		VendorClass: &PXEVendorClass{Client: "PXEClient", Arch: 16, UNDIMajor: 3, UNDIMinor: 16},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+	if got := o.Format(OptClientSystem); got != "16, 7" {
+		t.Errorf("option 93 formatted as %q", got)
+	}
+	if got := o.Format(OptClientNDI); got != "UNDI 3.16" {
+		t.Errorf("option 94 formatted as %q", got)
+	}
+
+	// Only option 93 is required.
+	o = Options{}
+	o.SetUint16(OptClientSystem, 0)
+	o.SetString(OptVendorIdentifier, "PXEClient")
+	info, err = o.PXEClientInfo()
+	if err != nil {
+		t.Fatalf("PXEClientInfo: %s", err)
+	}
+	if !reflect.DeepEqual(info, &PXEClientInfo{Archs: []uint16{0}}) {
+		t.Errorf("got %+v for a minimal client", info)
+	}
+
+	// A malformed option 94 is ignored.
+	o = Options{OptClientSystem: {0, 7}, OptClientNDI: {1, 2}}
+	info, err = o.PXEClientInfo()
+	if err != nil {
+		t.Fatalf("PXEClientInfo with malformed option 94: %s", err)
+	}
+	if !reflect.DeepEqual(info, &PXEClientInfo{Archs: []uint16{7}}) {
+		t.Errorf("got %+v for a client with malformed option 94", info)
+	}
+
+	for _, bad := range []Options{
+		{},
+		{OptClientSystem: {0}},
+		{OptClientSystem: {0, 7, 0}},
+	} {
+		if info, err := bad.PXEClientInfo(); err == nil {
+			t.Errorf("PXEClientInfo of %v = %+v, want error", bad, info)
+		}
+	}
+}
+
+func TestParsePXEVendorClass(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *PXEVendorClass
+	}{
+		{"PXEClient:Arch:00000:UNDI:002001", &PXEVendorClass{Client: "PXEClient", Arch: 0, UNDIMajor: 2, UNDIMinor: 1}},
+		{"HTTPClient:Arch:00016:UNDI:003000", &PXEVendorClass{Client: "HTTPClient", Arch: 16, UNDIMajor: 3}},
+		{"PXEClient:Arch:00007:UNDI:003016:extra", &PXEVendorClass{Client: "PXEClient", Arch: 7, UNDIMajor: 3, UNDIMinor: 16}},
+		{"PXEClient", nil},
+		{"PXEClient:Arch:7:UNDI:003016", nil},
+		{"PXEClient:Arch:99999:UNDI:003016", nil},
+		{"PXEClient:Arch:00007:UNDI:0030xx", nil},
+		{"MSFT 5.0", nil},
+	}
+	for _, test := range tests {
+		got, err := ParsePXEVendorClass(test.in)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("ParsePXEVendorClass(%q) = %+v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePXEVendorClass(%q): %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParsePXEVendorClass(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+		if s := got.String(); s != test.in && len(test.in) == len(s) {
+			t.Errorf("%+v formatted as %q, want %q", got, s, test.in)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// RelayAgentSubOption is a sub-option of the relay agent information
+// option (82).
+type RelayAgentSubOption byte
+
+// Relay agent sub-options decoded into RelayAgentInfo. Refer to
+// https://www.iana.org/assignments/bootp-dhcp-parameters/bootp-dhcp-parameters.xhtml#relay-agent-sub-options
+// for the full list.
+const (
+	SubOptCircuitID                RelayAgentSubOption = 1  // RFC 3046
+	SubOptRemoteID                 RelayAgentSubOption = 2  // RFC 3046
+	SubOptLinkSelection            RelayAgentSubOption = 5  // RFC 3527
+	SubOptSubscriberID             RelayAgentSubOption = 6  // RFC 3993
+	SubOptServerIdentifierOverride RelayAgentSubOption = 11 // RFC 5107
+)
+
+// RelayAgentInfo is the decoded relay agent information option (82),
+// which relay agents add to the requests they forward.
+type RelayAgentInfo struct {
+	// CircuitID identifies the circuit the request came in on,
+	// typically the switch port.
+	CircuitID []byte
+	// RemoteID identifies the remote end of the circuit, typically
+	// the switch.
+	RemoteID []byte
+	// LinkSelection, if set, is the subnet of the client, which
+	// takes precedence over the relay address for picking one.
+	LinkSelection net.IP
+	// SubscriberID identifies the subscriber behind the circuit.
+	SubscriberID string
+	// ServerIdentifierOverride, if set, is the address the relay
+	// agent tells clients to use as the server identifier, so that
+	// renewals pass through the relay agent too.
+	ServerIdentifierOverride net.IP
+	// Other holds the sub-options that are not decoded above.
+	Other map[RelayAgentSubOption][]byte
+}
+
+// Unmarshal parses the value of a relay agent information option into
+// r.
+func (r *RelayAgentInfo) Unmarshal(bs []byte) error {
+	*r = RelayAgentInfo{}
+	seen := map[RelayAgentSubOption]bool{}
+	for len(bs) > 0 {
+		if len(bs) < 2 {
+			return fmt.Errorf("relay agent sub-option %d has no length byte", bs[0])
+		}
+		opt, l := RelayAgentSubOption(bs[0]), int(bs[1])
+		if len(bs[2:]) < l {
+			return fmt.Errorf("relay agent sub-option %d claims to have %d bytes of payload, but only has %d bytes", opt, l, len(bs[2:]))
+		}
+		if seen[opt] {
+			return fmt.Errorf("duplicate relay agent sub-option %d", opt)
+		}
+		seen[opt] = true
+		val := bs[2 : 2+l]
+		bs = bs[2+l:]
+
+		// nolint:exhaustive
+		switch opt {
+		case SubOptCircuitID:
+			r.CircuitID = val
+		case SubOptRemoteID:
+			r.RemoteID = val
+		case SubOptLinkSelection:
+			if l != 4 {
+				return fmt.Errorf("relay agent link selection has %d bytes, want 4", l)
+			}
+			r.LinkSelection = net.IP(val)
+		case SubOptSubscriberID:
+			r.SubscriberID = string(val)
+		case SubOptServerIdentifierOverride:
+			if l != 4 {
+				return fmt.Errorf("relay agent server identifier override has %d bytes, want 4", l)
+			}
+			r.ServerIdentifierOverride = net.IP(val)
+		default:
+			if r.Other == nil {
+				r.Other = map[RelayAgentSubOption][]byte{}
+			}
+			r.Other[opt] = val
+		}
+	}
+	return nil
+}
+
+// Marshal returns the value of the relay agent information option
+// that carries r.
+func (r *RelayAgentInfo) Marshal() ([]byte, error) {
+	opts := map[RelayAgentSubOption][]byte{}
+	for k, v := range r.Other {
+		opts[k] = v
+	}
+	if r.CircuitID != nil {
+		opts[SubOptCircuitID] = r.CircuitID
+	}
+	if r.RemoteID != nil {
+		opts[SubOptRemoteID] = r.RemoteID
+	}
+	if r.LinkSelection != nil {
+		ip := r.LinkSelection.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("relay agent link selection %s is not an IPv4 address", r.LinkSelection)
+		}
+		opts[SubOptLinkSelection] = ip
+	}
+	if r.SubscriberID != "" {
+		opts[SubOptSubscriberID] = []byte(r.SubscriberID)
+	}
+	if r.ServerIdentifierOverride != nil {
+		ip := r.ServerIdentifierOverride.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("relay agent server identifier override %s is not an IPv4 address", r.ServerIdentifierOverride)
+		}
+		opts[SubOptServerIdentifierOverride] = ip
+	}
+
+	ks := make([]int, 0, len(opts))
+	for k := range opts {
+		ks = append(ks, int(k))
+	}
+	sort.Ints(ks)
+
+	var ret bytes.Buffer
+	for _, k := range ks {
+		v := opts[RelayAgentSubOption(k)]
+		if len(v) > 255 {
+			return nil, fmt.Errorf("relay agent sub-option %d has value >255 bytes", k)
+		}
+		ret.Write([]byte{byte(k), byte(len(v))})
+		ret.Write(v)
+	}
+	if ret.Len() > 255 {
+		return nil, fmt.Errorf("relay agent information has %d bytes, more than fit in an option", ret.Len())
+	}
+	return ret.Bytes(), nil
+}
+
+// RelayAgentInfo returns the value of the relay agent information
+// option (82), decoded.
+func (o Options) RelayAgentInfo() (*RelayAgentInfo, error) {
+	bs, err := o.Bytes(OptAgentInformation)
+	if err != nil {
+		return nil, err
+	}
+	ret := &RelayAgentInfo{}
+	if err := ret.Unmarshal(bs); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SetRelayAgentInfo sets the relay agent information option (82) to
+// the encoding of r.
+func (o Options) SetRelayAgentInfo(r *RelayAgentInfo) error {
+	bs, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+	o[OptAgentInformation] = bs
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRelayAgentInfo(t *testing.T) {
+	raw := []byte{
+		1, 4, 's', 'w', 'p', '1',
+		2, 6, 'l', 'e', 'a', 'f', '0', '1',
+		5, 4, 10, 1, 0, 0,
+		6, 3, 'a', 'b', 'c',
+		9, 2, 0xca, 0xfe,
+		11, 4, 10, 1, 0, 1,
+	}
+	o := Options{OptAgentInformation: raw}
+	r, err := o.RelayAgentInfo()
+	if err != nil {
+		t.Fatalf("decoding relay agent information: %s", err)
+	}
+	if string(r.CircuitID) != "swp1" || string(r.RemoteID) != "leaf01" || r.SubscriberID != "abc" {
+		t.Errorf("got circuit-id %q, remote-id %q, subscriber-id %q", r.CircuitID, r.RemoteID, r.SubscriberID)
+	}
+	if !r.LinkSelection.Equal(net.IPv4(10, 1, 0, 0)) || !r.ServerIdentifierOverride.Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("got link selection %s, server identifier override %s", r.LinkSelection, r.ServerIdentifierOverride)
+	}
+	if !bytes.Equal(r.Other[9], []byte{0xca, 0xfe}) {
+		t.Errorf("got other sub-options %v", r.Other)
+	}
+
+	bs, err := r.Marshal()
+	if err != nil {
+		t.Fatalf("encoding relay agent information: %s", err)
+	}
+	if !bytes.Equal(bs, raw) {
+		t.Errorf("relay agent information doesn't round-trip:\ngot  %v\nwant %v", bs, raw)
+	}
+
+	if _, err := (Options{}).RelayAgentInfo(); err == nil {
+		t.Error("decoded missing relay agent information")
+	}
+	for _, bad := range [][]byte{
+		{1},
+		{1, 4, 's', 'w'},
+		{1, 1, 'a', 1, 1, 'b'},
+		{5, 3, 10, 1, 0},
+		{11, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	} {
+		if err := new(RelayAgentInfo).Unmarshal(bad); err == nil {
+			t.Errorf("decoded invalid relay agent information %v", bad)
+		}
+	}
+	if _, err := (&RelayAgentInfo{LinkSelection: net.ParseIP("fd00::1")}).Marshal(); err == nil {
+		t.Error("encoded IPv6 link selection")
+	}
+}
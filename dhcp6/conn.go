@@ -1,12 +1,17 @@
 package dhcp6
 
 import (
+	"errors"
 	"fmt"
 	"net"
 
 	"golang.org/x/net/ipv6"
 )
 
+// ErrMalformedPacket is returned by RecvDHCP for a packet that can't be unmarshalled. The
+// packet is discarded, and the Conn remains usable
+var ErrMalformedPacket = errors.New("malformed DHCPv6 packet")
+
 // Conn is dhcpv6-specific socket
 type Conn struct {
 	conn          *ipv6.PacketConn
@@ -85,35 +90,47 @@ func addrToIP(a net.Addr) net.IP {
 	return ip
 }
 
-// RecvDHCP reads next available dhcp packet from Conn
+// RecvDHCP reads next available dhcp packet from Conn. Packets from clients are only
+// accepted when multicast to ff02::1:2 on the interface of Conn, relayed packets
+// are also accepted when unicast to us, on any interface. Packets that can't be unmarshalled
+// are reported with an error wrapping ErrMalformedPacket
 func (c *Conn) RecvDHCP() (*Packet, net.IP, error) {
-	b := make([]byte, 1500)
+	// Relay agents add their own headers, so relayed packets can exceed the MTU
+	b := make([]byte, 65536)
 	for {
 		n, rcm, _, err := c.conn.ReadFrom(b)
 		if err != nil {
 			return nil, nil, err
 		}
-		if c.ifi.Index != 0 && rcm.IfIndex != c.ifi.Index {
+		multicast := rcm.Dst.IsMulticast()
+		if multicast && c.ifi.Index != 0 && rcm.IfIndex != c.ifi.Index {
 			continue
 		}
-		if !rcm.Dst.IsMulticast() || !rcm.Dst.Equal(c.group) {
+		if multicast && !rcm.Dst.Equal(c.group) {
 			continue // unknown group, discard
 		}
 		pkt, err := Unmarshal(b, n)
 		if err != nil {
-			return nil, nil, err
+			return nil, rcm.Src, fmt.Errorf("%w from %s: %w", ErrMalformedPacket, rcm.Src, err)
+		}
+		if !multicast && len(pkt.Relays) == 0 {
+			continue // unicast from a client, discard
 		}
 
 		return pkt, rcm.Src, nil
 	}
 }
 
-// SendDHCP sends a dhcp packet to the specified ip address using Conn
+// SendDHCP sends a dhcp packet to the specified ip address using Conn. Relay-reply
+// messages are sent to the server port of the relay agent, others to the client port
 func (c *Conn) SendDHCP(dst net.IP, p []byte) error {
 	dstAddr := &net.UDPAddr{
 		IP:   dst,
 		Port: 546,
 	}
+	if len(p) > 0 && MessageType(p[0]) == MsgRelayRepl {
+		dstAddr.Port = 547
+	}
 	_, err := c.conn.WriteTo(p, nil, dstAddr)
 	if err != nil {
 		return fmt.Errorf("error sending a reply to %s: %w", dst.String(), err)
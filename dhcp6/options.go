@@ -88,6 +88,9 @@ func UnmarshalOptions(bs []byte) (Options, error) {
 
 // UnmarshalOption de-serializes an Option
 func UnmarshalOption(bs []byte) (*Option, error) {
+	if len(bs) < 4 {
+		return nil, fmt.Errorf("option is %d bytes, shorter than its 4 bytes header", len(bs))
+	}
 	optionLength := binary.BigEndian.Uint16(bs[2:4])
 	optionID := binary.BigEndian.Uint16(bs[0:2])
 	switch optionID {
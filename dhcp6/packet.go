@@ -30,20 +30,45 @@ type Packet struct {
 	Type          MessageType
 	TransactionID [3]byte
 	Options       Options
+	// Relays are the relay messages around the packet, if it was relayed, starting with
+	// the relay agent closest to the client
+	Relays []*RelayMessage
 }
 
-// Unmarshal creates a Packet out of its serialized representation
+// Unmarshal creates a Packet out of its serialized representation. Relay-forward messages are
+// decapsulated into Relays, and the Packet is the message of the client. Relay-reply messages
+// are only sent by servers, so they are rejected
 func Unmarshal(bs []byte, packetLength int) (*Packet, error) {
-	options, err := UnmarshalOptions(bs[4:packetLength])
+	bs = bs[:packetLength]
+	var relays []*RelayMessage
+	for len(bs) > 0 && MessageType(bs[0]) == MsgRelayForw {
+		if len(relays) == maxRelayHops {
+			return nil, fmt.Errorf("packet is relayed more than %d times", maxRelayHops)
+		}
+		relay, msg, err := unmarshalRelay(bs)
+		if err != nil {
+			return nil, err
+		}
+		relays = append([]*RelayMessage{relay}, relays...)
+		bs = msg
+	}
+	if len(bs) < 4 {
+		return nil, fmt.Errorf("packet is %d bytes, shorter than its 4 bytes header", len(bs))
+	}
+	if MessageType(bs[0]) == MsgRelayRepl {
+		return nil, fmt.Errorf("packet is a relay-reply message, which only servers send")
+	}
+
+	options, err := UnmarshalOptions(bs[4:])
 	if err != nil {
 		return nil, fmt.Errorf("packet has malformed options section: %w", err)
 	}
-	ret := &Packet{Type: MessageType(bs[0]), Options: options}
+	ret := &Packet{Type: MessageType(bs[0]), Options: options, Relays: relays}
 	copy(ret.TransactionID[:], bs[1:4])
 	return ret, nil
 }
 
-// Marshal serializes the Packet
+// Marshal serializes the Packet, inside its Relays if there are any
 func (p *Packet) Marshal() ([]byte, error) {
 	marshalledOptions, err := p.Options.Marshal()
 	if err != nil {
@@ -55,6 +80,11 @@ func (p *Packet) Marshal() ([]byte, error) {
 	copy(ret[1:], p.TransactionID[:])
 	copy(ret[4:], marshalledOptions)
 
+	for _, relay := range p.Relays {
+		if ret, err = relay.marshal(ret); err != nil {
+			return nil, err
+		}
+	}
 	return ret, nil
 }
 
@@ -0,0 +1,115 @@
+package dhcp6
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// OptRemoteID is the Relay Agent Remote-ID Option, see RFC 4649
+const OptRemoteID uint16 = 37
+
+// maxRelayHops is the maximum number of nested relay messages accepted in a packet
+const maxRelayHops = 32
+
+// relayHeaderLength is the length of msg-type, hop-count, link-address and peer-address of a relay message
+const relayHeaderLength = 34
+
+// RelayMessage is one Relay-forward or Relay-reply message around a DHCPv6 packet. See RFC 8415, section 9
+type RelayMessage struct {
+	Type MessageType
+	// HopCount is the number of relay agents that have already relayed the message
+	HopCount uint8
+	// LinkAddr identifies the link of the client, it may be unspecified
+	LinkAddr net.IP
+	// PeerAddr is the address of the client or relay agent the message was received from
+	PeerAddr net.IP
+	// Options are the options of the relay message, except for the Relay Message Option
+	Options Options
+}
+
+// InterfaceID returns the value in the Interface-Id Option, or nil if the option doesn't exist
+func (r *RelayMessage) InterfaceID() []byte {
+	opt, exists := r.Options[OptInterfaceID]
+	if exists {
+		return opt[0].Value
+	}
+	return nil
+}
+
+// RemoteID returns the enterprise number and remote-id in the Remote-ID Option, or nil if the option doesn't exist
+func (r *RelayMessage) RemoteID() (uint32, []byte) {
+	opt, exists := r.Options[OptRemoteID]
+	if !exists || len(opt[0].Value) < 4 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint32(opt[0].Value[0:4]), opt[0].Value[4:]
+}
+
+// unmarshalRelay de-serializes a relay message, and returns it along with the value of its Relay Message Option
+func unmarshalRelay(bs []byte) (*RelayMessage, []byte, error) {
+	if len(bs) < relayHeaderLength {
+		return nil, nil, fmt.Errorf("relay message is %d bytes, shorter than its %d bytes header", len(bs), relayHeaderLength)
+	}
+	options, err := UnmarshalOptions(bs[relayHeaderLength:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("relay message has malformed options section: %w", err)
+	}
+	relayed, exists := options[OptRelayMessage]
+	if !exists {
+		return nil, nil, fmt.Errorf("relay message has no relay message option")
+	}
+	delete(options, OptRelayMessage)
+
+	ret := &RelayMessage{
+		Type:     MessageType(bs[0]),
+		HopCount: bs[1],
+		LinkAddr: make(net.IP, net.IPv6len),
+		PeerAddr: make(net.IP, net.IPv6len),
+		Options:  options,
+	}
+	copy(ret.LinkAddr, bs[2:18])
+	copy(ret.PeerAddr, bs[18:34])
+	return ret, relayed[0].Value, nil
+}
+
+// marshal serializes the relay message around the serialized message msg
+func (r *RelayMessage) marshal(msg []byte) ([]byte, error) {
+	marshalledOptions, err := r.Options.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("relay message has malformed options section: %w", err)
+	}
+	relayed, err := MakeOption(OptRelayMessage, msg).Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("error serializing relay message option: %w", err)
+	}
+
+	ret := make([]byte, relayHeaderLength, relayHeaderLength+len(marshalledOptions)+len(relayed))
+	ret[0] = byte(r.Type)
+	ret[1] = r.HopCount
+	copy(ret[2:18], r.LinkAddr.To16())
+	copy(ret[18:34], r.PeerAddr.To16())
+	ret = append(ret, marshalledOptions...)
+	ret = append(ret, relayed...)
+	return ret, nil
+}
+
+// ReplyRelays returns the Relay-reply messages that carry a reply to the Packet back through
+// the relay agents it came from. Interface-Id Options are echoed, as required by RFC 8415
+func (p *Packet) ReplyRelays() []*RelayMessage {
+	ret := make([]*RelayMessage, 0, len(p.Relays))
+	for _, r := range p.Relays {
+		reply := &RelayMessage{
+			Type:     MsgRelayRepl,
+			HopCount: r.HopCount,
+			LinkAddr: r.LinkAddr,
+			PeerAddr: r.PeerAddr,
+			Options:  make(Options),
+		}
+		if id := r.InterfaceID(); id != nil {
+			reply.Options.Add(MakeOption(OptInterfaceID, id))
+		}
+		ret = append(ret, reply)
+	}
+	return ret
+}
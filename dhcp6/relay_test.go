@@ -0,0 +1,175 @@
+package dhcp6
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func makeRelayedSolicit(t *testing.T) []byte {
+	clientID := []byte("clientid")
+	options := make(Options)
+	options.Add(MakeOptionRequestOptions([]uint16{OptBootfileURL}))
+	options.Add(MakeOption(OptClientID, clientID))
+	solicit := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	// The relay agent next to the client adds Interface-ID and Remote-ID, the second one only relays.
+	leaf := &RelayMessage{
+		Type:     MsgRelayForw,
+		HopCount: 0,
+		LinkAddr: net.ParseIP("2001:db8:1::1"),
+		PeerAddr: net.ParseIP("fe80::1"),
+		Options:  make(Options),
+	}
+	leaf.Options.Add(MakeOption(OptInterfaceID, []byte("swp1")))
+	leaf.Options.Add(MakeOption(OptRemoteID, []byte{0, 0, 0x7f, 0xff, 'l', 'e', 'a', 'f', '0'}))
+	spine := &RelayMessage{
+		Type:     MsgRelayForw,
+		HopCount: 1,
+		LinkAddr: net.IPv6unspecified,
+		PeerAddr: net.ParseIP("2001:db8:ff::1"),
+		Options:  make(Options),
+	}
+	solicit.Relays = []*RelayMessage{leaf, spine}
+
+	bs, err := solicit.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling relayed solicit: %s", err)
+	}
+	return bs
+}
+
+func TestUnmarshalRelayedPacket(t *testing.T) {
+	bs := makeRelayedSolicit(t)
+	if MessageType(bs[0]) != MsgRelayForw {
+		t.Fatalf("Expected relayed packet to start with a relay-forward message, got %d", bs[0])
+	}
+
+	pkt, err := Unmarshal(bs, len(bs))
+	if err != nil {
+		t.Fatalf("Error unmarshalling relayed solicit: %s", err)
+	}
+	if pkt.Type != MsgSolicit || pkt.TransactionID != [3]byte{'1', '2', '3'} {
+		t.Fatalf("Expected decapsulated solicit, got type %d, transaction %v", pkt.Type, pkt.TransactionID)
+	}
+	if err := pkt.ShouldDiscard(nil); err != nil {
+		t.Fatalf("Decapsulated solicit shouldn't be discarded: %s", err)
+	}
+	if len(pkt.Relays) != 2 {
+		t.Fatalf("Expected 2 relay messages, got %d", len(pkt.Relays))
+	}
+
+	leaf, spine := pkt.Relays[0], pkt.Relays[1]
+	if leaf.HopCount != 0 || !leaf.LinkAddr.Equal(net.ParseIP("2001:db8:1::1")) || !leaf.PeerAddr.Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("Unexpected relay message closest to the client: %+v", leaf)
+	}
+	if string(leaf.InterfaceID()) != "swp1" {
+		t.Fatalf("Expected interface id swp1, got %q", leaf.InterfaceID())
+	}
+	if enterprise, remoteID := leaf.RemoteID(); enterprise != 0x7fff || string(remoteID) != "leaf0" {
+		t.Fatalf("Expected remote id leaf0 of enterprise 32767, got %q of %d", remoteID, enterprise)
+	}
+	if _, present := leaf.Options[OptRelayMessage]; present {
+		t.Fatalf("Relay message option should be removed from the relay message options")
+	}
+	if spine.HopCount != 1 || !spine.PeerAddr.Equal(net.ParseIP("2001:db8:ff::1")) {
+		t.Fatalf("Unexpected outermost relay message: %+v", spine)
+	}
+	if spine.InterfaceID() != nil {
+		t.Fatalf("Expected no interface id, got %q", spine.InterfaceID())
+	}
+	if _, remoteID := spine.RemoteID(); remoteID != nil {
+		t.Fatalf("Expected no remote id, got %q", remoteID)
+	}
+}
+
+func TestMarshalRelayReply(t *testing.T) {
+	bs := makeRelayedSolicit(t)
+	pkt, err := Unmarshal(bs, len(bs))
+	if err != nil {
+		t.Fatalf("Error unmarshalling relayed solicit: %s", err)
+	}
+
+	reply := &Packet{Type: MsgAdvertise, TransactionID: pkt.TransactionID, Options: make(Options)}
+	reply.Options.Add(MakeOption(OptClientID, pkt.Options.ClientID()))
+	reply.Relays = pkt.ReplyRelays()
+	bs, err = reply.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling relay reply: %s", err)
+	}
+	if MessageType(bs[0]) != MsgRelayRepl || bs[1] != 1 {
+		t.Fatalf("Expected outermost relay-reply with hop count 1, got type %d, hop count %d", bs[0], bs[1])
+	}
+	if !bytes.Equal(bs[18:34], net.ParseIP("2001:db8:ff::1")) {
+		t.Fatalf("Expected peer address of the outermost relay-reply to be copied, got %v", net.IP(bs[18:34]))
+	}
+
+	if _, err := Unmarshal(bs, len(bs)); err == nil {
+		t.Fatalf("Should refuse to unmarshal relay reply, but didn't")
+	}
+
+	var relays []*RelayMessage
+	for MessageType(bs[0]) == MsgRelayRepl {
+		relay, msg, err := unmarshalRelay(bs)
+		if err != nil {
+			t.Fatalf("Error unmarshalling relay reply: %s", err)
+		}
+		relays = append([]*RelayMessage{relay}, relays...)
+		bs = msg
+	}
+	if len(relays) != 2 {
+		t.Fatalf("Expected 2 relay messages, got %d", len(relays))
+	}
+	got, err := Unmarshal(bs, len(bs))
+	if err != nil {
+		t.Fatalf("Error unmarshalling relayed advertise: %s", err)
+	}
+	if got.Type != MsgAdvertise || !bytes.Equal(got.Options.ClientID(), []byte("clientid")) {
+		t.Fatalf("Expected advertise for clientid, got type %d for %q", got.Type, got.Options.ClientID())
+	}
+	if string(relays[0].InterfaceID()) != "swp1" {
+		t.Fatalf("Expected interface id swp1 to be echoed, got %q", relays[0].InterfaceID())
+	}
+	if _, remoteID := relays[0].RemoteID(); remoteID != nil {
+		t.Fatalf("Expected remote id not to be echoed, got %q", remoteID)
+	}
+}
+
+func TestUnmarshalMalformedRelayedPacket(t *testing.T) {
+	bs := makeRelayedSolicit(t)
+
+	if _, err := Unmarshal(bs, relayHeaderLength-1); err == nil {
+		t.Fatalf("Should fail to unmarshal truncated relay message, but didn't")
+	}
+
+	noRelayMessage := make([]byte, relayHeaderLength)
+	noRelayMessage[0] = byte(MsgRelayForw)
+	if _, err := Unmarshal(noRelayMessage, len(noRelayMessage)); err == nil {
+		t.Fatalf("Should fail to unmarshal relay message without relay message option, but didn't")
+	}
+
+	forwardedReply := &Packet{Type: MsgAdvertise, Options: make(Options)}
+	forwardedReply.Relays = []*RelayMessage{
+		{Type: MsgRelayRepl, LinkAddr: net.IPv6unspecified, PeerAddr: net.IPv6unspecified, Options: make(Options)},
+		{Type: MsgRelayForw, LinkAddr: net.IPv6unspecified, PeerAddr: net.IPv6unspecified, Options: make(Options)},
+	}
+	bs, err := forwardedReply.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling forwarded relay reply: %s", err)
+	}
+	if _, err := Unmarshal(bs, len(bs)); err == nil {
+		t.Fatalf("Should fail to unmarshal relay reply inside a relay forward, but didn't")
+	}
+
+	pkt := &Packet{Type: MsgSolicit, Options: make(Options)}
+	for i := 0; i <= maxRelayHops; i++ {
+		pkt.Relays = append(pkt.Relays, &RelayMessage{Type: MsgRelayForw, LinkAddr: net.IPv6unspecified, PeerAddr: net.IPv6unspecified, Options: make(Options)})
+	}
+	bs, err = pkt.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling relayed packet: %s", err)
+	}
+	if _, err := Unmarshal(bs, len(bs)); err == nil {
+		t.Fatalf("Should fail to unmarshal packet relayed more than %d times, but didn't", maxRelayHops)
+	}
+}
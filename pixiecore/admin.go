@@ -0,0 +1,79 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveAdmin registers the admin API on the metrics server. That
+// server usually listens on all addresses, provisioning networks
+// included, so without an AdminToken the API only answers requests
+// from localhost.
+func (s *Server) serveAdmin(mux *http.ServeMux) {
+	mux.Handle("/admin/drain", s.adminHandler(s.handleDrain))
+	mux.Handle("/admin/reload", s.adminHandler(s.handleReload))
+	mux.Handle("/admin/leases", s.adminHandler(s.handleLeases))
+	mux.Handle("/admin/capture", s.adminHandler(s.handleCapture))
+	mux.Handle("/admin/filters", s.adminHandler(s.handleFilters))
+}
+
+// adminHandler wraps h to require AdminToken if one is set, and a
+// request from localhost otherwise.
+func (s *Server) adminHandler(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			if !fromLoopback(r) {
+				s.Log.Info("Refusing admin request from a remote address without an admin token", "url", r.URL, "remoteaddr", r.RemoteAddr)
+				http.Error(w, "admin API is only served to localhost unless an admin token is set", http.StatusForbidden)
+				return
+			}
+		} else {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	})
+}
+
+// fromLoopback returns whether r came from a loopback address.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeJSON writes v as the JSON response to an admin request.
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	js, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		s.Log.Error("Unable to marshal admin response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminRequest returns a request to the admin API from localhost, which
+// is allowed without an admin token.
+func adminRequest(method, url string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, url, body)
+	req.RemoteAddr = "127.0.0.1:1234"
+	return req
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	s := &Server{Log: slog.Default()}
+	mux := http.NewServeMux()
+	s.serveAdmin(mux)
+
+	for _, test := range []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"127.0.0.1:1234", http.StatusOK},
+		{"[::1]:1234", http.StatusOK},
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusForbidden},
+		{"garbage", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/admin/drain", nil)
+		req.RemoteAddr = test.remoteAddr
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != test.want {
+			t.Errorf("request from %s got HTTP %d, want %d", test.remoteAddr, rr.Code, test.want)
+		}
+	}
+}
@@ -16,14 +16,13 @@ package pixiecore
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"sort"
 	"strings"
 	"text/template"
@@ -31,34 +30,47 @@ import (
 
 	v1 "github.com/metal-stack/metal-api/pkg/api/v1"
 	"github.com/metal-stack/pixie/api"
+	"github.com/metal-stack/pixie/dhcp4"
+	"google.golang.org/grpc/metadata"
 )
 
 // APIBooter gets a BootSpec from a remote server over HTTP.
 //
 // The API is described in README.api.md
-func APIBooter(url string, timeout time.Duration) (Booter, error) {
+func APIBooter(url string, timeout time.Duration, ids SignedIDConfig) (Booter, error) {
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
 	}
 	ret := &apibooter{
 		client:    &http.Client{Timeout: timeout},
+		files:     newBootFileClient(),
 		urlPrefix: url + "v1",
+		ids:       ids,
 	}
-	if _, err := io.ReadFull(rand.Reader, ret.key[:]); err != nil {
-		return nil, fmt.Errorf("failed to get randomness for signing key: %w", err)
+	if ret.ids.Keys == nil {
+		keys, err := NewRandomKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		ret.ids.Keys = keys
 	}
 
 	return ret, nil
 }
-func GRPCBooter(log *slog.Logger, client *GrpcClient, partition string, metalAPIConfig *api.MetalConfig) (Booter, error) {
+func GRPCBooter(log *slog.Logger, client *GrpcClient, partition string, metalAPIConfig *api.MetalConfig, ids SignedIDConfig) (Booter, error) {
 	ret := &grpcbooter{
+		apibooter: apibooter{files: newBootFileClient(), ids: ids},
 		grpc:      client,
 		partition: partition,
 		log:       log,
 		config:    metalAPIConfig,
 	}
-	if _, err := io.ReadFull(rand.Reader, ret.key[:]); err != nil {
-		return nil, fmt.Errorf("failed to get randomness for signing key: %w", err)
+	if ret.ids.Keys == nil {
+		keys, err := NewRandomKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		ret.ids.Keys = keys
 	}
 	log.Info("starting grpc booter", "partition", partition)
 	return ret, nil
@@ -66,8 +78,9 @@ func GRPCBooter(log *slog.Logger, client *GrpcClient, partition string, metalAPI
 
 type apibooter struct {
 	client    *http.Client
+	files     *http.Client
 	urlPrefix string
-	key       [32]byte
+	ids       SignedIDConfig
 }
 
 type grpcbooter struct {
@@ -83,6 +96,7 @@ func (g *grpcbooter) BootSpec(m Machine) (*Spec, error) {
 	g.log.Info("bootspec", "machine", m.String())
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	ctx = relayMetadata(ctx, m.Relay)
 
 	var r rawSpec
 	if m.GUID != "" {
@@ -123,7 +137,7 @@ func (g *grpcbooter) BootSpec(m Machine) (*Spec, error) {
 		}
 	}
 
-	spec, err := bootSpec(g.key, g.urlPrefix, r)
+	spec, err := bootSpec(g.signer(m), g.urlPrefix, r)
 	g.log.Info("bootspec", "raw spec", r, "return spec", spec)
 	return spec, err
 }
@@ -135,6 +149,10 @@ func (b *apibooter) getAPIResponse(m Machine) (io.ReadCloser, error) {
 		reqURL = fmt.Sprintf("%s/dhcp/%s", b.urlPrefix, m.GUID)
 	}
 
+	if q := relayQuery(m.Relay); len(q) > 0 {
+		reqURL += "?" + q.Encode()
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
@@ -154,6 +172,43 @@ func (b *apibooter) getAPIResponse(m Machine) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+// relayQuery returns the relay agent information that the API server
+// gets along with a machine, so that it can pick a boot spec by switch
+// port.
+func relayQuery(relay *dhcp4.RelayAgentInfo) url.Values {
+	ret := url.Values{}
+	if relay == nil {
+		return ret
+	}
+	if relay.CircuitID != nil {
+		ret.Set("circuit-id", string(relay.CircuitID))
+	}
+	if relay.RemoteID != nil {
+		ret.Set("remote-id", string(relay.RemoteID))
+	}
+	if relay.LinkSelection != nil {
+		ret.Set("link-selection", relay.LinkSelection.String())
+	}
+	return ret
+}
+
+// relayMetadata adds the relay agent information of relayQuery to the
+// metadata of outgoing gRPC requests. BootServiceBootRequest has no
+// fields for it. The IDs may be binary, so they go in -bin keys.
+func relayMetadata(ctx context.Context, relay *dhcp4.RelayAgentInfo) context.Context {
+	var kv []string
+	for k, vs := range relayQuery(relay) {
+		if k != "link-selection" {
+			k += "-bin"
+		}
+		kv = append(kv, k, vs[0])
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
 func (b *apibooter) BootSpec(m Machine) (*Spec, error) {
 	body, err := b.getAPIResponse(m)
 	if body != nil {
@@ -170,7 +225,26 @@ func (b *apibooter) BootSpec(m Machine) (*Spec, error) {
 		return nil, err
 	}
 
-	return bootSpec(b.key, b.urlPrefix, r)
+	return bootSpec(b.signer(m), b.urlPrefix, r)
+}
+
+// signer returns a function that turns URLs into IDs for m, honoring
+// the booter's SignedIDConfig.
+func (b *apibooter) signer(m Machine) func(string) (ID, error) {
+	var (
+		expires time.Time
+		mac     net.HardwareAddr
+		ip      net.IP
+	)
+	if b.ids.TTL > 0 {
+		expires = time.Now().Add(b.ids.TTL)
+	}
+	if b.ids.BindMachine {
+		mac, ip = m.MAC, m.IP
+	}
+	return func(u string) (ID, error) {
+		return signURL(u, b.ids.Keys, expires, mac, ip)
+	}
 }
 
 type rawSpec struct {
@@ -179,12 +253,45 @@ type rawSpec struct {
 	Cmdline    any      `json:"cmdline"`
 	Message    string   `json:"message"`
 	IpxeScript string   `json:"ipxe-script"`
+	IpxeBinary string   `json:"ipxe-binary"`
+	PXEMenu    *rawMenu `json:"pxe-menu"`
+}
+
+type rawMenu struct {
+	Prompt  string `json:"prompt"`
+	Timeout int    `json:"timeout"`
+	Items   []struct {
+		Label      string `json:"label"`
+		Local      bool   `json:"local"`
+		IpxeBinary string `json:"ipxe-binary"`
+	} `json:"items"`
+}
+
+// pxeMenu converts the PXE menu returned by an API server.
+func (r *rawMenu) pxeMenu() *PXEMenu {
+	if r == nil {
+		return nil
+	}
+	ret := &PXEMenu{
+		Prompt:  r.Prompt,
+		Timeout: time.Duration(r.Timeout) * time.Second,
+	}
+	for _, item := range r.Items {
+		ret.Items = append(ret.Items, PXEMenuItem{
+			Label:      item.Label,
+			Local:      item.Local,
+			IpxeBinary: item.IpxeBinary,
+		})
+	}
+	return ret
 }
 
-func bootSpec(key [32]byte, prefix string, r rawSpec) (*Spec, error) {
+func bootSpec(sign func(string) (ID, error), prefix string, r rawSpec) (*Spec, error) {
 	if r.IpxeScript != "" {
 		return &Spec{
 			IpxeScript: r.IpxeScript,
+			IpxeBinary: r.IpxeBinary,
+			PXEMenu:    r.PXEMenu.pxeMenu(),
 		}, nil
 	}
 
@@ -201,13 +308,15 @@ func bootSpec(key [32]byte, prefix string, r rawSpec) (*Spec, error) {
 	}
 
 	ret := Spec{
-		Message: r.Message,
+		Message:    r.Message,
+		IpxeBinary: r.IpxeBinary,
+		PXEMenu:    r.PXEMenu.pxeMenu(),
 	}
-	if ret.Kernel, err = signURL(r.Kernel, &key); err != nil {
+	if ret.Kernel, err = sign(r.Kernel); err != nil {
 		return nil, err
 	}
 	for _, img := range r.Initrd {
-		initrd, err := signURL(img, &key)
+		initrd, err := sign(img)
 		if err != nil {
 			return nil, err
 		}
@@ -233,7 +342,7 @@ func bootSpec(key [32]byte, prefix string, r rawSpec) (*Spec, error) {
 		if err != nil {
 			return "", fmt.Errorf("invalid url %q for cmdline: %w", urlStr, err)
 		}
-		id, err := signURL(urlStr, &key)
+		id, err := sign(urlStr)
 		if err != nil {
 			return "", err
 		}
@@ -247,8 +356,13 @@ func bootSpec(key [32]byte, prefix string, r rawSpec) (*Spec, error) {
 	return &ret, nil
 }
 
+// ReadBootFile reads an ID that isn't bound to a machine.
 func (b *apibooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
-	urlStr, err := getURL(id, &b.key)
+	return b.ReadMachineBootFile(Machine{}, id)
+}
+
+func (b *apibooter) ReadMachineBootFile(m Machine, id ID) (io.ReadCloser, int64, error) {
+	urlStr, err := getURL(id, b.ids.Keys, time.Now(), m.MAC, m.IP)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -257,42 +371,26 @@ func (b *apibooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
 	if err != nil {
 		return nil, -1, fmt.Errorf("%q is not an URL", urlStr)
 	}
-	var (
-		ret io.ReadCloser
-		sz  int64
-	)
+	// Both kinds of file are BootFiles, so that clients can resume
+	// interrupted downloads. Remote files pass ranges on upstream.
 	if u.Scheme == "file" {
-		// TODO serveFile
-		f, err := os.Open(u.Path)
+		f, err := openLocalFile(u.Path)
 		if err != nil {
 			return nil, -1, err
 		}
-		fi, err := f.Stat()
-		if err != nil {
-			_ = f.Close()
-			return nil, -1, err
-		}
-		ret, sz = f, fi.Size()
-	} else {
-		// urlStr will get reparsed by http.Get, which is mildly
-		// wasteful, but the code looks nicer than constructing a
-		// Request.
-		resp, err := http.Get(urlStr) // nolint:gosec,bodyclose,noctx
-		if err != nil {
-			return nil, -1, err
-		}
-		if resp.StatusCode != 200 {
-			return nil, -1, fmt.Errorf("GET %q failed: %s", urlStr, resp.Status)
-		}
-
-		ret = resp.Body
-		sz = resp.ContentLength
+		return f, f.fi.Size(), nil
+	}
+	f, err := openHTTPFile(b.files, urlStr)
+	if err != nil {
+		return nil, -1, err
 	}
-	return ret, sz, nil
+	return f, f.size, nil
 }
 
 func (b *apibooter) WriteBootFile(id ID, body io.Reader) error {
-	u, err := getURL(id, &b.key)
+	// Writes have no requesting machine to check against, so they
+	// only work with IDs that aren't bound to one.
+	u, err := getURL(id, b.ids.Keys, time.Now(), nil, nil)
 	if err != nil {
 		return err
 	}
@@ -15,13 +15,23 @@
 package pixiecore
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"google.golang.org/grpc/metadata"
 )
 
 func mustMAC(s string) net.HardwareAddr {
@@ -72,7 +82,7 @@ func TestAPIBooter(t *testing.T) {
 	go http.Serve(l, nil)                                                                                   // nolint:errcheck,gosec
 
 	// Finally, build an APIBooter and test it.
-	b, err := APIBooter(fmt.Sprintf("http://%s/", l.Addr()), 100*time.Millisecond)
+	b, err := APIBooter(fmt.Sprintf("http://%s/", l.Addr()), 100*time.Millisecond, SignedIDConfig{TTL: time.Minute, BindMachine: true})
 	if err != nil {
 		t.Fatalf("Constructing APIBooter: %s", err)
 	}
@@ -80,6 +90,7 @@ func TestAPIBooter(t *testing.T) {
 	m := Machine{
 		MAC:  mustMAC("01:02:03:04:05:06"),
 		Arch: ArchIA32,
+		IP:   net.IPv4(192, 168, 0, 10),
 	}
 
 	spec, err := b.BootSpec(m)
@@ -109,9 +120,170 @@ func TestAPIBooter(t *testing.T) {
 		quuxID:         "quux file",
 	}
 	for id, contents := range fs {
-		v := mustRead(b.ReadBootFile(id))
+		v := mustRead(readMachineBootFile(b, m, id))
 		if v != contents {
 			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
 		}
 	}
+
+	// IDs are bound to the machine they were issued for.
+	if _, _, err := readMachineBootFile(b, Machine{MAC: mustMAC("06:05:04:03:02:01")}, spec.Kernel); err == nil {
+		t.Fatalf("Reading succeeded for the wrong machine")
+	}
+	if _, _, err := b.ReadBootFile(spec.Kernel); err == nil {
+		t.Fatalf("ReadBootFile succeeded without a machine")
+	}
+	// The MAC is in every URL, so a leaked URL must not work from
+	// another host.
+	if _, _, err := readMachineBootFile(b, Machine{MAC: m.MAC, IP: net.IPv4(192, 168, 0, 11)}, spec.Kernel); err == nil {
+		t.Fatalf("Reading succeeded from the wrong address")
+	}
+}
+
+func TestAPIBooterRelay(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"kernel": "/foo"}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+
+	b, err := APIBooter(srv.URL, time.Second, SignedIDConfig{})
+	if err != nil {
+		t.Fatalf("Constructing APIBooter: %s", err)
+	}
+
+	m := Machine{MAC: mustMAC("01:02:03:04:05:06")}
+	if _, err := b.BootSpec(m); err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if len(query) != 0 {
+		t.Errorf("Unrelayed machine sent query %v", query)
+	}
+
+	m.Relay = &dhcp4.RelayAgentInfo{
+		CircuitID:     []byte("Ethernet1/1"),
+		RemoteID:      []byte{0xde, 0xad},
+		LinkSelection: net.IPv4(192, 168, 1, 0),
+	}
+	if _, err := b.BootSpec(m); err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := url.Values{
+		"circuit-id":     {"Ethernet1/1"},
+		"remote-id":      {"\xde\xad"},
+		"link-selection": {"192.168.1.0"},
+	}
+	if !reflect.DeepEqual(query, want) {
+		t.Errorf("Relayed machine sent query %v, want %v", query, want)
+	}
+
+	md, _ := metadata.FromOutgoingContext(relayMetadata(context.Background(), m.Relay))
+	wantMD := metadata.Pairs("circuit-id-bin", "Ethernet1/1", "remote-id-bin", "\xde\xad", "link-selection", "192.168.1.0")
+	if !reflect.DeepEqual(md, wantMD) {
+		t.Errorf("Relayed machine got gRPC metadata %v, want %v", md, wantMD)
+	}
+}
+
+func TestHTTPFileRanges(t *testing.T) {
+	const contents = "0123456789"
+	var reqs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs = append(reqs, strings.TrimSpace(r.Method+" "+r.Header.Get("Range")))
+		if r.URL.Path == "/nohead" && r.Method == http.MethodHead {
+			http.Error(w, "no HEAD", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/noranges" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+			_, _ = w.Write([]byte(contents))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(contents))
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path string
+		// open are the upstream requests made by opening the file,
+		// seek the ones made by reading it from offset 6.
+		open, seek []string
+	}{
+		{"/ranges", []string{"HEAD"}, []string{"GET bytes=6-"}},
+		{"/noranges", []string{"HEAD"}, []string{"GET bytes=6-"}},
+		{"/nohead", []string{"HEAD", "GET bytes=0-0"}, []string{"GET bytes=6-"}},
+	} {
+		path := tc.path
+		reqs = nil
+		f, err := openHTTPFile(newBootFileClient(), ts.URL+path)
+		if err != nil {
+			t.Fatalf("%s: opening: %s", path, err)
+		}
+		if f.size != int64(len(contents)) || f.ETag() != `"v1"` {
+			t.Fatalf("%s: wrong size %d or ETag %q", path, f.size, f.ETag())
+		}
+		if !reflect.DeepEqual(reqs, tc.open) {
+			t.Fatalf("%s: opening made upstream requests %q, want %q", path, reqs, tc.open)
+		}
+		reqs = nil
+
+		if _, err = f.Seek(6, io.SeekStart); err != nil {
+			t.Fatalf("%s: seeking: %s", path, err)
+		}
+		bs, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("%s: reading: %s", path, err)
+		}
+		if string(bs) != "6789" {
+			t.Fatalf("%s: wrong contents after seek, want %q, got %q", path, "6789", bs)
+		}
+		if !reflect.DeepEqual(reqs, tc.seek) {
+			t.Fatalf("%s: reading made upstream requests %q, want %q", path, reqs, tc.seek)
+		}
+		_ = f.Close()
+
+		f, err = openHTTPFile(newBootFileClient(), ts.URL+path)
+		if err != nil {
+			t.Fatalf("%s: opening: %s", path, err)
+		}
+		reqs = nil
+		if got := mustRead(f, f.size, nil); got != contents {
+			t.Fatalf("%s: wrong contents, want %q, got %q", path, contents, got)
+		}
+		if !reflect.DeepEqual(reqs, []string{"GET"}) {
+			t.Fatalf("%s: reading made upstream requests %q, want %q", path, reqs, []string{"GET"})
+		}
+	}
+}
+
+func TestLocalFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kernel")
+	if err := os.WriteFile(path, []byte("kernel file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openLocalFile(path)
+	if err != nil {
+		t.Fatalf("Opening local file: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if f.ModTime().IsZero() || f.ETag() == "" {
+		t.Fatalf("Local file has no ModTime or ETag")
+	}
+	if _, err = f.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "file" {
+		t.Fatalf("Wrong contents after seek, want %q, got %q", "file", bs)
+	}
+
+	if _, err = openLocalFile(filepath.Dir(path)); err == nil {
+		t.Fatalf("Opening a directory succeeded")
+	}
 }
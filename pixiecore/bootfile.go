@@ -0,0 +1,259 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localFile is a BootFile on the local filesystem.
+//
+// It embeds the *os.File so that the HTTP server can still use
+// sendfile when copying it to the client.
+type localFile struct {
+	*os.File
+	fi os.FileInfo
+}
+
+func openLocalFile(path string) (*localFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		_ = f.Close()
+		return nil, fmt.Errorf("%q is a directory", path)
+	}
+	return &localFile{f, fi}, nil
+}
+
+func (f *localFile) ModTime() time.Time { return f.fi.ModTime() }
+
+func (f *localFile) ETag() string {
+	return fmt.Sprintf(`"%x-%x"`, f.fi.ModTime().UnixNano(), f.fi.Size())
+}
+
+// httpFile is a BootFile fetched from an HTTP server.
+//
+// Opening it only asks for the size and version of the file, the
+// first Read GETs it. Seeking elsewhere is free, the following Read
+// then issues a range request upstream, so that only the requested
+// part of the file is transferred.
+type httpFile struct {
+	client  *http.Client
+	url     string
+	size    int64
+	modTime time.Time
+	etag    string
+
+	// pos is the offset of the next Read, bodyPos the offset that
+	// body will return next.
+	pos     int64
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+// newBootFileClient returns the client that fetches remote boot files.
+// It has no overall timeout, since large initrds take a while to
+// stream to slow machines, but gives up on servers that don't connect
+// or answer. Compression is off so that sizes are known up front.
+func newBootFileClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			DisableCompression:    true,
+		},
+	}
+}
+
+// openHTTPFile asks the server of urlStr for the size and version of
+// the file with a HEAD request, or a request for its first byte if the
+// server doesn't allow HEAD, and returns it as an httpFile.
+func openHTTPFile(client *http.Client, urlStr string) (*httpFile, error) {
+	ret := &httpFile{
+		client: client,
+		url:    urlStr,
+	}
+	resp, err := ret.do(http.MethodHead, "")
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ret.setVersion(resp, resp.ContentLength)
+		return ret, nil
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+	default:
+		return nil, fmt.Errorf("HEAD %q failed: %s", urlStr, resp.Status)
+	}
+
+	resp, err = ret.do(http.MethodGet, "bytes=0-0")
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		_ = resp.Body.Close()
+		size := int64(-1)
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+				size = n
+			}
+		}
+		ret.setVersion(resp, size)
+	case http.StatusOK:
+		// The server doesn't do ranges, keep reading the whole file.
+		ret.setVersion(resp, resp.ContentLength)
+		ret.body = resp.Body
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("GET %q failed: %s", urlStr, resp.Status)
+	}
+	return ret, nil
+}
+
+func (f *httpFile) setVersion(resp *http.Response, size int64) {
+	f.size = size
+	f.etag = resp.Header.Get("ETag")
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		f.modTime = t
+	}
+}
+
+func (f *httpFile) do(method, rng string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.Background(), method, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+		// Make sure the rest of the file is from the same version
+		// we already started sending.
+		switch {
+		case f.etag != "" && !strings.HasPrefix(f.etag, "W/"):
+			req.Header.Set("If-Range", f.etag)
+		case !f.modTime.IsZero():
+			req.Header.Set("If-Range", f.modTime.UTC().Format(http.TimeFormat))
+		}
+	}
+	return f.client.Do(req)
+}
+
+func (f *httpFile) get(off int64) (*http.Response, error) {
+	if off == 0 {
+		return f.do(http.MethodGet, "")
+	}
+	return f.do(http.MethodGet, fmt.Sprintf("bytes=%d-", off))
+}
+
+// reopen replaces f.body with one that starts reading at f.pos.
+func (f *httpFile) reopen() error {
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	resp, err := f.get(f.pos)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if resp.ContentLength != f.size || resp.Header.Get("ETag") != f.etag {
+			_ = resp.Body.Close()
+			return fmt.Errorf("%q changed upstream", f.url)
+		}
+		// The server doesn't do ranges, skip ahead by hand.
+		if _, err = io.CopyN(io.Discard, resp.Body, f.pos); err != nil {
+			_ = resp.Body.Close()
+			return err
+		}
+	default:
+		_ = resp.Body.Close()
+		return fmt.Errorf("GET %q from offset %d failed: %s", f.url, f.pos, resp.Status)
+	}
+	f.body, f.bodyPos = resp.Body, f.pos
+	return nil
+}
+
+func (f *httpFile) Read(p []byte) (int, error) {
+	if f.size >= 0 && f.pos >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil || f.bodyPos != f.pos {
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	f.bodyPos = f.pos
+	return n, err
+}
+
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		if f.size < 0 {
+			return 0, errors.New("seeking relative to the end of a file of unknown size")
+		}
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *httpFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (f *httpFile) ModTime() time.Time { return f.modTime }
+
+func (f *httpFile) ETag() string { return f.etag }
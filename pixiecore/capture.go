@@ -0,0 +1,275 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"github.com/metal-stack/pixie/dhcp4/pcapng"
+)
+
+// defaultCapturePackets is how many packets are kept per captured
+// machine if Server.CapturePackets is unset.
+const defaultCapturePackets = 1000
+
+// captureTable holds the running packet captures, by machine.
+type captureTable struct {
+	mu    sync.Mutex
+	byMAC map[string]*capture
+}
+
+// A capture records the DHCP and PXE packets of one machine in a ring
+// buffer, and optionally in a pcapng file.
+type capture struct {
+	mac     net.HardwareAddr
+	started time.Time
+	// ring holds the last packets, oldest at next once it is full.
+	ring  []dhcp4.CapturedPacket
+	next  int
+	total int
+
+	file *os.File
+	w    *pcapng.Writer
+}
+
+// captureStatus is the admin API view of a capture.
+type captureStatus struct {
+	MAC     string    `json:"mac"`
+	Started time.Time `json:"started"`
+	Packets int       `json:"packets"`
+	File    string    `json:"file,omitempty"`
+}
+
+func (c *capture) status() captureStatus {
+	ret := captureStatus{
+		MAC:     c.mac.String(),
+		Started: c.started,
+		Packets: c.total,
+	}
+	if c.file != nil {
+		ret.File = c.file.Name()
+	}
+	return ret
+}
+
+func (c *capture) add(p dhcp4.CapturedPacket, size int) {
+	c.total++
+	if len(c.ring) < size {
+		c.ring = append(c.ring, p)
+		return
+	}
+	c.ring[c.next] = p
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+// packets returns the packets in the ring buffer, oldest first.
+func (c *capture) packets() []dhcp4.CapturedPacket {
+	return append(append([]dhcp4.CapturedPacket(nil), c.ring[c.next:]...), c.ring[:c.next]...)
+}
+
+func (c *capture) close() {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file, c.w = nil, nil
+	}
+}
+
+// capturePacket records p if it is to or from a captured machine.
+func (s *Server) capturePacket(p *dhcp4.CapturedPacket) {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	if len(s.captures.byMAC) == 0 {
+		return
+	}
+	pkt, err := dhcp4.Unmarshal(p.Data)
+	if err != nil {
+		return
+	}
+	c := s.captures.byMAC[pkt.MachineAddr().String()]
+	if c == nil {
+		return
+	}
+
+	cp := *p
+	cp.Data = bytes.Clone(p.Data)
+	size := s.CapturePackets
+	if size <= 0 {
+		size = defaultCapturePackets
+	}
+	c.add(cp, size)
+	if c.w != nil {
+		if err := c.w.WritePacket(&cp); err != nil {
+			s.Log.Error("Failed to write packet capture, keeping it in memory only", "mac", c.mac.String(), "file", c.file.Name(), "error", err)
+			c.close()
+		}
+	}
+}
+
+// startCapture starts capturing the packets of mac, unless they are
+// already captured.
+func (s *Server) startCapture(mac net.HardwareAddr) (captureStatus, error) {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	if c := s.captures.byMAC[mac.String()]; c != nil {
+		return c.status(), nil
+	}
+
+	c := &capture{
+		mac:     mac,
+		started: time.Now(),
+	}
+	if s.CaptureDir != "" {
+		name := filepath.Join(s.CaptureDir, strings.ReplaceAll(mac.String(), ":", "-")+".pcapng")
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return captureStatus{}, err
+		}
+		// Every capture appends a section to the file.
+		w, err := pcapng.NewWriter(f)
+		if err != nil {
+			_ = f.Close()
+			return captureStatus{}, fmt.Errorf("writing %s: %w", name, err)
+		}
+		c.file, c.w = f, w
+	}
+	if s.captures.byMAC == nil {
+		s.captures.byMAC = map[string]*capture{}
+	}
+	s.captures.byMAC[mac.String()] = c
+	return c.status(), nil
+}
+
+// stopCapture stops capturing the packets of mac. It returns false if
+// they weren't captured.
+func (s *Server) stopCapture(mac net.HardwareAddr) bool {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	c := s.captures.byMAC[mac.String()]
+	if c == nil {
+		return false
+	}
+	c.close()
+	delete(s.captures.byMAC, mac.String())
+	return true
+}
+
+// stopCaptures stops all captures.
+func (s *Server) stopCaptures() {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	for k, c := range s.captures.byMAC {
+		c.close()
+		delete(s.captures.byMAC, k)
+	}
+}
+
+// listCaptures returns the running captures, ordered by MAC.
+func (s *Server) listCaptures() []captureStatus {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	ret := []captureStatus{}
+	for _, c := range s.captures.byMAC {
+		ret = append(ret, c.status())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].MAC < ret[j].MAC })
+	return ret
+}
+
+// capturedPackets returns the packets in the ring buffer of the
+// capture of mac as a pcapng file, or false if mac isn't captured.
+func (s *Server) capturedPackets(mac net.HardwareAddr) ([]byte, bool, error) {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	c := s.captures.byMAC[mac.String()]
+	if c == nil {
+		return nil, false, nil
+	}
+	var buf bytes.Buffer
+	w, err := pcapng.NewWriter(&buf)
+	if err != nil {
+		return nil, true, err
+	}
+	for _, p := range c.packets() {
+		if err := w.WritePacket(&p); err != nil {
+			return nil, true, err
+		}
+	}
+	return buf.Bytes(), true, nil
+}
+
+// handleCapture serves /admin/capture, which starts, stops, lists and
+// downloads packet captures. Captures are selected by the mac query
+// parameter.
+func (s *Server) handleCapture(w http.ResponseWriter, r *http.Request) {
+	macStr := r.URL.Query().Get("mac")
+	var mac net.HardwareAddr
+	if macStr != "" || r.Method != http.MethodGet {
+		var err error
+		if mac, err = dhcp4.ParseHardwareAddr(macStr); err != nil {
+			http.Error(w, fmt.Sprintf("invalid MAC address %q", macStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if mac == nil {
+			break
+		}
+		pcap, ok, err := s.capturedPackets(mac)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no capture of %s", mac), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ReplaceAll(mac.String(), ":", "-")+".pcapng"))
+		_, _ = w.Write(pcap)
+		return
+	case http.MethodPut, http.MethodPost:
+		status, err := s.startCapture(mac)
+		if err != nil {
+			s.Log.Error("Couldn't start packet capture", "mac", mac.String(), "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.Log.Info("Capturing packets", "mac", mac.String(), "file", status.File, "remoteaddr", r.RemoteAddr)
+	case http.MethodDelete:
+		if !s.stopCapture(mac) {
+			http.Error(w, fmt.Sprintf("no capture of %s", mac), http.StatusNotFound)
+			return
+		}
+		s.Log.Info("Stopped capturing packets", "mac", mac.String(), "remoteaddr", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.writeJSON(w, s.listCaptures())
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// countPackets returns the number of enhanced packet blocks in the
+// pcapng file b.
+func countPackets(t *testing.T, b []byte) int {
+	if len(b) < 12 || binary.LittleEndian.Uint32(b) != 0x0a0d0d0a {
+		t.Fatalf("not a pcapng file: %v", b)
+	}
+	n := 0
+	for len(b) > 0 {
+		if binary.LittleEndian.Uint32(b) == 6 {
+			n++
+		}
+		b = b[binary.LittleEndian.Uint32(b[4:]):]
+	}
+	return n
+}
+
+func TestCaptureAdmin(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{Log: slog.Default(), CaptureDir: dir, CapturePackets: 2}
+	mux := http.NewServeMux()
+	s.serveAdmin(mux)
+
+	do := func(method, url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, adminRequest(method, url, nil))
+		return rr
+	}
+	send := func(mac net.HardwareAddr) {
+		raw, err := (&dhcp4.Packet{
+			Type:          dhcp4.MsgDiscover,
+			TransactionID: []byte{1, 2, 3, 4},
+			HardwareAddr:  mac,
+		}).Marshal()
+		if err != nil {
+			t.Fatalf("marshaling packet: %s", err)
+		}
+		s.capturePacket(&dhcp4.CapturedPacket{
+			Time:      time.Now(),
+			Direction: dhcp4.DirectionIn,
+			Interface: &net.Interface{Name: "eth0"},
+			Src:       &net.UDPAddr{IP: net.IPv4zero, Port: 68},
+			Dst:       &net.UDPAddr{IP: net.IPv4zero, Port: 67},
+			Data:      raw,
+		})
+	}
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	other := net.HardwareAddr{1, 2, 3, 4, 5, 7}
+
+	// Nothing is captured before a capture is started.
+	send(mac)
+	if rr := do("GET", "/admin/capture?mac=01:02:03:04:05:06"); rr.Code != http.StatusNotFound {
+		t.Errorf("downloading unknown capture got HTTP %d, want 404", rr.Code)
+	}
+
+	rr := do("PUT", "/admin/capture?mac=01:02:03:04:05:06")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("starting capture got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	var list []captureStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decoding captures: %s", err)
+	}
+	file := filepath.Join(dir, "01-02-03-04-05-06.pcapng")
+	if len(list) != 1 || list[0].MAC != mac.String() || list[0].File != file {
+		t.Errorf("got captures %+v, want one of %s into %s", list, mac, file)
+	}
+
+	for range 3 {
+		send(mac)
+	}
+	send(other)
+
+	rr = do("GET", "/admin/capture?mac=01:02:03:04:05:06")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-pcapng" {
+		t.Fatalf("downloading capture got HTTP %d, %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if n := countPackets(t, rr.Body.Bytes()); n != 2 {
+		t.Errorf("downloaded %d packets, want the last 2", n)
+	}
+	rr = do("GET", "/admin/capture")
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].Packets != 3 {
+		t.Errorf("got captures %s, want 3 packets of %s", rr.Body, mac)
+	}
+
+	if rr := do("DELETE", "/admin/capture?mac=01:02:03:04:05:06"); rr.Code != http.StatusOK || !bytes.Equal(bytes.TrimSpace(rr.Body.Bytes()), []byte("[]")) {
+		t.Errorf("stopping capture got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("reading capture file: %s", err)
+	}
+	if n := countPackets(t, bs); n != 3 {
+		t.Errorf("capture file has %d packets, want 3", n)
+	}
+
+	if rr := do("DELETE", "/admin/capture?mac=01:02:03:04:05:06"); rr.Code != http.StatusNotFound {
+		t.Errorf("stopping unknown capture got HTTP %d, want 404", rr.Code)
+	}
+	if rr := do("PUT", "/admin/capture?mac=nope"); rr.Code != http.StatusBadRequest {
+		t.Errorf("capturing invalid MAC got HTTP %d, want 400", rr.Code)
+	}
+	if rr := do("PATCH", "/admin/capture?mac=01:02:03:04:05:06"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PATCH got HTTP %d, want 405", rr.Code)
+	}
+}
@@ -42,19 +42,26 @@ the Pixiecore boot API. The specification can be found at <TODO>.`,
 			fatalf("Error reading flag: %s", err)
 		}
 
-		booter, err := pixiecore.APIBooter(server, timeout)
+		s := serverFromFlags(cmd)
+		booter, err := pixiecore.APIBooter(server, timeout, signedIDConfigFromFlags(cmd, s.Log))
 		if err != nil {
 			fatalf("Failed to create API booter: %s", err)
 		}
-		s := serverFromFlags(cmd)
 		s.Booter = booter
+		for _, iface := range s.Interfaces {
+			if iface.Partition != "" {
+				fatalf("--interface %q: partitions are only supported in grpc mode", iface.Name)
+			}
+		}
 
-		fmt.Println(s.Serve())
+		go reloadOnSIGHUP(s)
+		fmt.Println(serveUntilSignal(cmd, s.Log, s))
 	}}
 
 func init() {
 	rootCmd.AddCommand(apiCmd)
 	serverConfigFlags(apiCmd)
+	booterConfigFlags(apiCmd)
 	apiCmd.Flags().Duration("api-request-timeout", 5*time.Second, "Timeout for request to the API server")
 	// TODO: SSL cert flags for both client and server auth.
 }
@@ -16,12 +16,23 @@
 package cli // import "github.com/metal-stack/pixie/cli"
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/metal-stack/pixie/dhcp4"
+	"github.com/metal-stack/pixie/dhcp4/leasestore"
 	"github.com/metal-stack/pixie/pixiecore"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -60,27 +71,369 @@ func fatalf(msg string, args ...any) {
 	os.Exit(1)
 }
 
+// reloadableFlags defines the flags that can also be set in
+// --reload-file, and are applied again on every reload.
+func reloadableFlags(fs *pflag.FlagSet) {
+	fs.String("ipxe-bios", "", "Path to an iPXE binary for BIOS/UNDI")
+	fs.String("ipxe-ipxe", "", "Path to an iPXE binary for chainloading from another iPXE")
+	fs.String("ipxe-efi32", "", "Path to an iPXE binary for 32-bit UEFI")
+	fs.String("ipxe-efi64", "", "Path to an iPXE binary for 64-bit UEFI")
+	fs.String("ipxe-dir", "", "Directory of additional iPXE binaries that --ipxe-rule and Booters can select by file name")
+	fs.StringArray("ipxe-rule", nil, "Rule selecting a binary from --ipxe-dir, e.g. \"oui=00:1b:21,firmware=efi64,binary=snponly.efi\" (can be repeated, first match wins)")
+	fs.StringArray("firmware-rule", nil, "Rule classifying machines into a firmware type and architecture, e.g. \"arch=11,architecture=x64,firmware=efi64\" (can be repeated, first match wins)")
+	fs.StringArray("filter", nil, "Filter deciding which machines are served before the API is asked, e.g. \"action=deny,oui=00:1b:21\" (can be repeated, first match wins)")
+	fs.String("filter-default", "allow", "Action for machines that match no --filter, allow or deny")
+	fs.StringSlice("drain-allow", nil, "MAC addresses that are still offered to boot in drain mode")
+	fs.Float64("dhcp-machine-rate", 0, "Boot requests per second answered for a single machine (0 means unlimited)")
+	fs.Int("dhcp-machine-burst", 5, "Boot requests of a single machine answered at once")
+	fs.Float64("dhcp-interface-rate", 0, "Boot requests per second answered for all machines of an interface (0 means unlimited)")
+	fs.Int("dhcp-interface-burst", 50, "Boot requests of all machines of an interface answered at once")
+}
+
 func serverConfigFlags(cmd *cobra.Command) {
+	reloadableFlags(cmd.Flags())
+	cmd.Flags().String("reload-file", "", "File of settings that are re-read on SIGHUP and on reload through the admin API, one flag per line without the leading dashes, e.g. \"filter=action=deny,oui=00:1b:21\". Only iPXE, filter, firmware rule, drain allow-list and DHCP rate limit flags can be set in it, and they replace the same flags on the commandline")
 	cmd.Flags().BoolP("debug", "d", false, "Log more things that aren't directly related to booting a recognized client")
 	cmd.Flags().StringP("listen-addr", "l", "0.0.0.0", "IPv4 address to listen on")
+	cmd.Flags().StringArray("interface", nil, "Provisioning network to boot machines on, e.g. \"name=vlan100,subnet=10.1.0.0/24,advertise=10.1.0.1,firmware=efi64,partition=fra-1\" (can be repeated, default: all networks)")
 	cmd.Flags().IntP("port", "p", 80, "Port to listen on for HTTP")
 	cmd.Flags().String("metrics-listen-addr", "0.0.0.0", "IPv4 address of the metrics server to listen on")
 	cmd.Flags().Int("metrics-port", 2113, "Metrics server port")
+	cmd.Flags().String("admin-token", "", "Bearer token required by the admin API on the metrics server (default: $PIXIECORE_ADMIN_TOKEN; without a token, the admin API only answers localhost)")
+	cmd.Flags().Bool("drain", false, "Start in drain mode, making no new boot offers until it is switched off through the admin API")
+	cmd.Flags().String("capture-dir", "", "Directory that packet captures started through the admin API are written to, as one pcapng file per machine")
+	cmd.Flags().Int("capture-packets", 1000, "Number of packets of each captured machine kept in memory for download through the admin API")
 	cmd.Flags().Int("status-port", 0, "HTTP port for status information (can be the same as --port)")
 	cmd.Flags().Bool("dhcp-no-bind", false, "Handle DHCP traffic without binding to the DHCP server port")
-	cmd.Flags().String("ipxe-bios", "", "Path to an iPXE binary for BIOS/UNDI")
-	cmd.Flags().String("ipxe-ipxe", "", "Path to an iPXE binary for chainloading from another iPXE")
-	cmd.Flags().String("ipxe-efi32", "", "Path to an iPXE binary for 32-bit UEFI")
-	cmd.Flags().String("ipxe-efi64", "", "Path to an iPXE binary for 64-bit UEFI")
+	cmd.Flags().Bool("dhcp-unicast", false, "Send DHCP offers to the hardware address of machines instead of broadcasting them (Linux only, needs CAP_NET_RAW)")
+	cmd.Flags().StringArray("dhcp-pool", nil, "Lease addresses as a full DHCP server, e.g. \"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,router=10.1.0.1,dns=10.1.0.1,lease=1h\" (can be repeated)")
+	cmd.Flags().String("dhcp-lease-file", "", "File that keeps the leases of --dhcp-pool across restarts")
+	cmd.Flags().StringArray("dhcp-reservation", nil, "Address of a --dhcp-pool subnet that is only leased to one machine, e.g. \"mac=00:1b:21:0a:0b:0c,ip=10.1.0.10,hostname=node1\" (can be repeated)")
+	cmd.Flags().Duration("shutdown-timeout", time.Minute, "How long to let running transfers finish on SIGTERM or SIGINT")
+	cmd.Flags().Int("file-max-concurrent", 0, "Maximum number of boot file downloads served at once (0 means unlimited)")
+	cmd.Flags().Int("file-max-queued", 0, "Maximum number of boot file downloads waiting for a free slot")
+	cmd.Flags().Duration("file-queue-timeout", 30*time.Second, "How long a boot file download waits for a free slot")
+	cmd.Flags().Duration("file-retry-after", 10*time.Second, "Retry-After sent to clients whose boot file download couldn't be served")
+	cmd.Flags().Int64("file-bandwidth", 0, "Total bandwidth for boot file downloads in bytes per second (0 means unlimited)")
+	cmd.Flags().Int64("file-client-bandwidth", 0, "Bandwidth for boot file downloads per client in bytes per second (0 means unlimited)")
+	cmd.Flags().Int("tftp-max-block-size", 0, "Largest TFTP block size to negotiate with clients (0 means as large as the MTU allows)")
+	cmd.Flags().Duration("tftp-timeout", time.Minute, "How long to wait for a TFTP acknowledgement before retransmitting")
+	cmd.Flags().Int("tftp-retries", 0, "How often to retransmit a TFTP block before giving up (0 means the default of 5)")
+	cmd.Flags().Bool("tftp-single-port", false, "Serve all TFTP transfers from port 69, for clients behind NAT or firewalls")
+	cmd.Flags().String("tftp-listen-addr6", "", "IPv6 address to serve TFTP on in addition to --listen-addr (\"::\" for all)")
+}
+
+func booterConfigFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("file-id-ttl", 0, "How long signed boot file IDs remain valid after they are issued (0 means forever)")
+	cmd.Flags().Bool("file-id-bind-machine", false, "Only serve a signed boot file ID to the machine it was issued for, requested from the address it fetched its boot script from")
+	cmd.Flags().String("signing-keys-file", "", "Path to a file with the keys for signing boot file IDs, one per line, signing key first (default: $PIXIECORE_SIGNING_KEYS, or a random key)")
+	cmd.Flags().Duration("signing-keys-reload-interval", time.Minute, "How often to re-read --signing-keys-file for rotated keys, independently of reloads (0 disables reloading)")
+}
+
+func signedIDConfigFromFlags(cmd *cobra.Command, log *slog.Logger) pixiecore.SignedIDConfig {
+	ttl, err := cmd.Flags().GetDuration("file-id-ttl")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	bindMachine, err := cmd.Flags().GetBool("file-id-bind-machine")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	keysFile, err := cmd.Flags().GetString("signing-keys-file")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	reloadInterval, err := cmd.Flags().GetDuration("signing-keys-reload-interval")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if ttl < 0 {
+		fatalf("File ID TTL must be >=0")
+	}
+
+	ret := pixiecore.SignedIDConfig{
+		TTL:         ttl,
+		BindMachine: bindMachine,
+	}
+	switch {
+	case keysFile != "":
+		ret.Keys, err = pixiecore.LoadKeyRing(keysFile)
+		if err != nil {
+			fatalf("Couldn't load signing keys: %s", err)
+		}
+		if reloadInterval > 0 {
+			go reloadKeyRing(log, ret.Keys, reloadInterval)
+		}
+	case os.Getenv("PIXIECORE_SIGNING_KEYS") != "":
+		ret.Keys, err = pixiecore.ParseKeyRing([]byte(os.Getenv("PIXIECORE_SIGNING_KEYS")))
+		if err != nil {
+			fatalf("Couldn't parse $PIXIECORE_SIGNING_KEYS: %s", err)
+		}
+	default:
+		log.Info("No signing keys configured, using a random key; boot file IDs won't survive restarts or work across replicas")
+	}
+	if ret.Keys != nil {
+		log.Info("Loaded signing keys", "keys", ret.Keys.Len())
+	}
+
+	return ret
+}
+
+func reloadKeyRing(log *slog.Logger, keys *pixiecore.KeyRing, interval time.Duration) {
+	for range time.Tick(interval) {
+		before := keys.Len()
+		if err := keys.Reload(); err != nil {
+			log.Error("Couldn't reload signing keys, keeping the previous ones", "error", err)
+			continue
+		}
+		if after := keys.Len(); after != before {
+			log.Info("Reloaded signing keys", "keys", after)
+		}
+	}
+}
+
+// server is implemented by pixiecore.Server and pixiecore.ServerV6.
+type server interface {
+	Serve() error
+	Shutdown(ctx context.Context) error
+}
+
+// serveUntilSignal runs srv until it fails or the process receives
+// SIGTERM or SIGINT. On a signal, srv is shut down gracefully, giving
+// running transfers --shutdown-timeout to finish. A second signal
+// aborts them right away.
+func serveUntilSignal(cmd *cobra.Command, log *slog.Logger, srv server) error {
+	timeout, err := cmd.Flags().GetDuration("shutdown-timeout")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve() }()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		log.Info("Received signal, shutting down", "signal", sig, "timeout", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error("Running transfers did not finish in time", "error", err)
+	}
+	return <-errs
 }
 
-func mustFile(path string) []byte {
+// reloadFlags reads --reload-file, and returns the flags to read each
+// reloadable flag from: the file if it sets the flag, the commandline
+// otherwise.
+func reloadFlags(cmd *cobra.Command) (func(name string) *pflag.FlagSet, error) {
+	path, err := cmd.Flags().GetString("reload-file")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if path == "" {
+		return func(string) *pflag.FlagSet { return cmd.Flags() }, nil
+	}
 	bs, err := os.ReadFile(path)
 	if err != nil {
-		fatalf("couldn't read file %q: %s", path, err)
+		return nil, fmt.Errorf("couldn't read reload file %q: %w", path, err)
 	}
 
-	return bs
+	file := pflag.NewFlagSet(path, pflag.ContinueOnError)
+	file.SetOutput(io.Discard)
+	reloadableFlags(file)
+	var args []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, "--"+line)
+	}
+	if err := file.Parse(args); err != nil {
+		return nil, fmt.Errorf("invalid reload file %q: %w", path, err)
+	}
+	if file.NArg() > 0 {
+		return nil, fmt.Errorf("invalid reload file %q: unexpected %q", path, file.Arg(0))
+	}
+	return func(name string) *pflag.FlagSet {
+		if file.Changed(name) {
+			return file
+		}
+		return cmd.Flags()
+	}, nil
+}
+
+// reloadConfigFromFlags reads the reloadable settings given on the
+// commandline and in --reload-file. It runs again on every reload, so
+// it returns errors instead of exiting.
+func reloadConfigFromFlags(cmd *cobra.Command) (pixiecore.ReloadConfig, error) {
+	var ret pixiecore.ReloadConfig
+	flags, err := reloadFlags(cmd)
+	if err != nil {
+		return ret, err
+	}
+	if ret.IpxeConfig, err = ipxeConfigFromFlags(flags); err != nil {
+		return ret, err
+	}
+
+	firmwareRules, err := flags("firmware-rule").GetStringArray("firmware-rule")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	filters, err := flags("filter").GetStringArray("filter")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	filterDefault, err := flags("filter-default").GetString("filter-default")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	drainAllow, err := flags("drain-allow").GetStringSlice("drain-allow")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dhcpMachineRate, err := flags("dhcp-machine-rate").GetFloat64("dhcp-machine-rate")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dhcpMachineBurst, err := flags("dhcp-machine-burst").GetInt("dhcp-machine-burst")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dhcpInterfaceRate, err := flags("dhcp-interface-rate").GetFloat64("dhcp-interface-rate")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dhcpInterfaceBurst, err := flags("dhcp-interface-burst").GetInt("dhcp-interface-burst")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+
+	for _, r := range firmwareRules {
+		rule, err := pixiecore.ParseFirmwareRule(r)
+		if err != nil {
+			return ret, fmt.Errorf("invalid --firmware-rule %q: %w", r, err)
+		}
+		ret.FirmwareRules = append(ret.FirmwareRules, rule)
+	}
+	for _, f := range filters {
+		filter, err := pixiecore.ParseClientFilter(f)
+		if err != nil {
+			return ret, fmt.Errorf("invalid --filter %q: %w", f, err)
+		}
+		ret.ClientFilters = append(ret.ClientFilters, filter)
+	}
+	if filterDefault != "allow" && filterDefault != "deny" {
+		return ret, fmt.Errorf("invalid --filter-default %q, want allow or deny", filterDefault)
+	}
+	ret.FilterDefaultDeny = filterDefault == "deny"
+	for _, a := range drainAllow {
+		mac, err := dhcp4.ParseHardwareAddr(a)
+		if err != nil {
+			return ret, fmt.Errorf("invalid --drain-allow MAC address %q: %w", a, err)
+		}
+		ret.DrainAllow = append(ret.DrainAllow, mac)
+	}
+	if dhcpMachineRate < 0 || dhcpMachineBurst < 0 || dhcpInterfaceRate < 0 || dhcpInterfaceBurst < 0 {
+		return ret, errors.New("DHCP rate limits must be >=0")
+	}
+	ret.DHCPLimits = pixiecore.DHCPLimits{
+		MachineRate:    dhcpMachineRate,
+		MachineBurst:   dhcpMachineBurst,
+		InterfaceRate:  dhcpInterfaceRate,
+		InterfaceBurst: dhcpInterfaceBurst,
+	}
+	return ret, nil
+}
+
+// ipxeConfigFromFlags reads the iPXE binaries and selection rules
+// given in flags.
+func ipxeConfigFromFlags(flags func(name string) *pflag.FlagSet) (pixiecore.IpxeConfig, error) {
+	ret := pixiecore.IpxeConfig{
+		Ipxe: map[pixiecore.Firmware][]byte{},
+	}
+	for fwtype, bs := range Ipxe {
+		ret.Ipxe[fwtype] = bs
+	}
+
+	for _, f := range []struct {
+		flag      string
+		firmwares []pixiecore.Firmware
+	}{
+		{"ipxe-bios", []pixiecore.Firmware{pixiecore.FirmwareX86PC}},
+		{"ipxe-ipxe", []pixiecore.Firmware{pixiecore.FirmwareX86Ipxe}},
+		{"ipxe-efi32", []pixiecore.Firmware{pixiecore.FirmwareEFI32}},
+		{"ipxe-efi64", []pixiecore.Firmware{pixiecore.FirmwareEFI64, pixiecore.FirmwareEFIBC}},
+	} {
+		path, err := flags(f.flag).GetString(f.flag)
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if path == "" {
+			continue
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return ret, fmt.Errorf("couldn't read file %q: %w", path, err)
+		}
+		for _, fw := range f.firmwares {
+			ret.Ipxe[fw] = bs
+		}
+	}
+
+	ipxeDir, err := flags("ipxe-dir").GetString("ipxe-dir")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	ipxeRules, err := flags("ipxe-rule").GetStringArray("ipxe-rule")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if ipxeDir != "" {
+		ret.IpxeBinaries, err = pixiecore.LoadIpxeBinaries(ipxeDir)
+		if err != nil {
+			return ret, fmt.Errorf("couldn't load iPXE binaries: %w", err)
+		}
+	}
+	for _, r := range ipxeRules {
+		rule, err := pixiecore.ParseIpxeRule(r)
+		if err != nil {
+			return ret, fmt.Errorf("invalid --ipxe-rule %q: %w", r, err)
+		}
+		if _, ok := ret.IpxeBinaries[rule.Binary]; !ok {
+			return ret, fmt.Errorf("invalid --ipxe-rule %q: no binary %q in --ipxe-dir", r, rule.Binary)
+		}
+		ret.IpxeRules = append(ret.IpxeRules, rule)
+	}
+
+	return ret, nil
+}
+
+// reloadOnSIGHUP reloads the iPXE configuration of s whenever the
+// process receives SIGHUP.
+func reloadOnSIGHUP(s *pixiecore.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		s.Log.Info("Received SIGHUP, reloading")
+		// Reload logs the outcome.
+		_ = s.Reload()
+	}
 }
 
 func serverFromFlags(cmd *cobra.Command) *pixiecore.Server {
@@ -104,6 +457,22 @@ func serverFromFlags(cmd *cobra.Command) *pixiecore.Server {
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
+	adminToken, err := cmd.Flags().GetString("admin-token")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	drain, err := cmd.Flags().GetBool("drain")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	captureDir, err := cmd.Flags().GetString("capture-dir")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	capturePackets, err := cmd.Flags().GetInt("capture-packets")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
 	httpStatusPort, err := cmd.Flags().GetInt("status-port")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
@@ -112,19 +481,68 @@ func serverFromFlags(cmd *cobra.Command) *pixiecore.Server {
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
-	ipxeBios, err := cmd.Flags().GetString("ipxe-bios")
+	dhcpUnicast, err := cmd.Flags().GetBool("dhcp-unicast")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
-	ipxeIpxe, err := cmd.Flags().GetString("ipxe-ipxe")
+	interfaces, err := cmd.Flags().GetStringArray("interface")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
-	ipxeEFI32, err := cmd.Flags().GetString("ipxe-efi32")
+	dhcpPools, err := cmd.Flags().GetStringArray("dhcp-pool")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
-	ipxeEFI64, err := cmd.Flags().GetString("ipxe-efi64")
+	dhcpReservations, err := cmd.Flags().GetStringArray("dhcp-reservation")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dhcpLeaseFile, err := cmd.Flags().GetString("dhcp-lease-file")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+
+	fileMaxConcurrent, err := cmd.Flags().GetInt("file-max-concurrent")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	fileMaxQueued, err := cmd.Flags().GetInt("file-max-queued")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	fileQueueTimeout, err := cmd.Flags().GetDuration("file-queue-timeout")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	fileRetryAfter, err := cmd.Flags().GetDuration("file-retry-after")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	fileBandwidth, err := cmd.Flags().GetInt64("file-bandwidth")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	fileClientBandwidth, err := cmd.Flags().GetInt64("file-client-bandwidth")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	tftpMaxBlockSize, err := cmd.Flags().GetInt("tftp-max-block-size")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	tftpTimeout, err := cmd.Flags().GetDuration("tftp-timeout")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	tftpRetries, err := cmd.Flags().GetInt("tftp-retries")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	tftpSinglePort, err := cmd.Flags().GetBool("tftp-single-port")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	tftpAddr6, err := cmd.Flags().GetString("tftp-listen-addr6")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
@@ -132,31 +550,103 @@ func serverFromFlags(cmd *cobra.Command) *pixiecore.Server {
 	if httpPort <= 0 {
 		fatalf("HTTP port must be >0")
 	}
+	if fileMaxConcurrent < 0 || fileMaxQueued < 0 || fileBandwidth < 0 || fileClientBandwidth < 0 {
+		fatalf("Boot file download limits must be >=0")
+	}
+	if tftpMaxBlockSize != 0 && (tftpMaxBlockSize < 512 || tftpMaxBlockSize > 65464) {
+		fatalf("TFTP block size must be between 512 and 65464")
+	}
+	if tftpTimeout < 0 || tftpRetries < 0 {
+		fatalf("TFTP timeout and retries must be >=0")
+	}
+	if tftpAddr6 != "" {
+		if ip := net.ParseIP(tftpAddr6); ip == nil || ip.To4() != nil {
+			fatalf("TFTP IPv6 listen address %q is not an IPv6 address", tftpAddr6)
+		}
+	}
 
 	ret := &pixiecore.Server{
-		Ipxe:           map[pixiecore.Firmware][]byte{},
 		Log:            getLogger(debug),
 		HTTPPort:       httpPort,
 		HTTPStatusPort: httpStatusPort,
 		MetricsPort:    metricsPort,
 		MetricsAddress: metricsAddr,
+		AdminToken:     adminToken,
 		DHCPNoBind:     dhcpNoBind,
+		DHCPUnicast:    dhcpUnicast,
+		CaptureDir:     captureDir,
+		CapturePackets: capturePackets,
+		FileLimits: pixiecore.FileLimits{
+			MaxConcurrent:   fileMaxConcurrent,
+			MaxQueued:       fileMaxQueued,
+			QueueTimeout:    fileQueueTimeout,
+			RetryAfter:      fileRetryAfter,
+			Bandwidth:       fileBandwidth,
+			ClientBandwidth: fileClientBandwidth,
+		},
+		TFTP: pixiecore.TFTPConfig{
+			MaxBlockSize: tftpMaxBlockSize,
+			Timeout:      tftpTimeout,
+			Retries:      tftpRetries,
+			SinglePort:   tftpSinglePort,
+			IPv6Address:  tftpAddr6,
+		},
 	}
-	for fwtype, bs := range Ipxe {
-		ret.Ipxe[fwtype] = bs
+	cfg, err := reloadConfigFromFlags(cmd)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	ret.Ipxe = cfg.Ipxe
+	ret.IpxeBinaries = cfg.IpxeBinaries
+	ret.IpxeRules = cfg.IpxeRules
+	ret.FirmwareRules = cfg.FirmwareRules
+	ret.DHCPLimits = cfg.DHCPLimits
+	ret.SetClientFilters(cfg.ClientFilters, cfg.FilterDefaultDeny)
+	ret.SetDrain(drain, cfg.DrainAllow)
+	ret.Reloader = func() (pixiecore.ReloadConfig, error) { return reloadConfigFromFlags(cmd) }
+	if ret.AdminToken == "" {
+		ret.AdminToken = os.Getenv("PIXIECORE_ADMIN_TOKEN")
 	}
-	if ipxeBios != "" {
-		ret.Ipxe[pixiecore.FirmwareX86PC] = mustFile(ipxeBios)
+	for _, i := range interfaces {
+		iface, err := pixiecore.ParseInterface(i)
+		if err != nil {
+			fatalf("Invalid --interface %q: %s", i, err)
+		}
+		ret.Interfaces = append(ret.Interfaces, iface)
 	}
-	if ipxeIpxe != "" {
-		ret.Ipxe[pixiecore.FirmwareX86Ipxe] = mustFile(ipxeIpxe)
+	for _, p := range dhcpPools {
+		pool, err := pixiecore.ParseDHCPPool(p)
+		if err != nil {
+			fatalf("Invalid --dhcp-pool %q: %s", p, err)
+		}
+		ret.DHCPPools = append(ret.DHCPPools, pool)
 	}
-	if ipxeEFI32 != "" {
-		ret.Ipxe[pixiecore.FirmwareEFI32] = mustFile(ipxeEFI32)
+	for _, r := range dhcpReservations {
+		res, err := pixiecore.ParseDHCPReservation(r)
+		if err != nil {
+			fatalf("Invalid --dhcp-reservation %q: %s", r, err)
+		}
+		found := false
+		for i := range ret.DHCPPools {
+			if ret.DHCPPools[i].Subnet.Contains(res.IP) {
+				ret.DHCPPools[i].Reservations = append(ret.DHCPPools[i].Reservations, res)
+				found = true
+				break
+			}
+		}
+		if !found {
+			fatalf("Invalid --dhcp-reservation %q: address is in no --dhcp-pool subnet", r)
+		}
 	}
-	if ipxeEFI64 != "" {
-		ret.Ipxe[pixiecore.FirmwareEFI64] = mustFile(ipxeEFI64)
-		ret.Ipxe[pixiecore.FirmwareEFIBC] = ret.Ipxe[pixiecore.FirmwareEFI64]
+	if dhcpLeaseFile != "" {
+		if len(ret.DHCPPools) == 0 {
+			fatalf("--dhcp-lease-file requires --dhcp-pool")
+		}
+		store, err := leasestore.NewFileLeaseStore(dhcpLeaseFile)
+		if err != nil {
+			fatalf("Couldn't open --dhcp-lease-file: %s", err)
+		}
+		ret.LeaseStore = store
 	}
 	if addr != "" {
 		ret.Address = addr
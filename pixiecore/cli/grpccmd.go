@@ -50,19 +50,35 @@ the Pixiecore boot API. The specification can be found at <TODO>.`,
 		if err != nil {
 			fatalf("Error reading flag: %s", err)
 		}
-		booter, err := pixiecore.GRPCBooter(s.Log, client, partition, metalAPIConfig)
+		ids := signedIDConfigFromFlags(cmd, s.Log)
+		booter, err := pixiecore.GRPCBooter(s.Log, client, partition, metalAPIConfig, ids)
 		if err != nil {
 			fatalf("unable to create grpc booter: %s", err)
 		}
 		s.Booter = booter
 		s.MetalConfig = metalAPIConfig
+		for i := range s.Interfaces {
+			iface := &s.Interfaces[i]
+			if iface.Partition == "" || iface.Partition == partition {
+				continue
+			}
+			// Machines of other partitions are booted by a Booter of their own.
+			cfg := *metalAPIConfig
+			cfg.Partition = iface.Partition
+			iface.Booter, err = pixiecore.GRPCBooter(s.Log, client, iface.Partition, &cfg, ids)
+			if err != nil {
+				fatalf("unable to create grpc booter for interface %q: %s", iface.Name, err)
+			}
+		}
 
-		fmt.Println(s.Serve())
+		go reloadOnSIGHUP(s)
+		fmt.Println(serveUntilSignal(cmd, s.Log, s))
 	}}
 
 func init() {
 	rootCmd.AddCommand(grpcCmd)
 	serverConfigFlags(grpcCmd)
+	booterConfigFlags(grpcCmd)
 
 	grpcCmd.Flags().String("partition", "", "id of the partition this instance of pixie is running")
 
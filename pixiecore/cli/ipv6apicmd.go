@@ -77,7 +77,7 @@ var ipv6ApiCmd = &cobra.Command{
 		s.AddressPool = pool.NewRandomAddressPool(net.ParseIP(addressPoolStart), addressPoolSize, addressPoolValidLifetime)
 		s.PacketBuilder = dhcp6.MakePacketBuilder(addressPoolValidLifetime-addressPoolValidLifetime*3/100, addressPoolValidLifetime)
 
-		fmt.Println(s.Serve())
+		fmt.Println(serveUntilSignal(cmd, s.Log, s))
 	},
 }
 
@@ -91,6 +91,7 @@ func serverv6APIConfigFlags(cmd *cobra.Command) {
 	cmd.Flags().Uint64("address-pool-size", 50, "Address pool size")
 	cmd.Flags().Uint32("address-pool-lifetime", 1850, "Address pool ip address valid lifetime in seconds")
 	cmd.Flags().StringP("dns-servers", "", "", "Comma separated list of one or more dns server addresses")
+	cmd.Flags().Duration("shutdown-timeout", 10*time.Second, "How long to wait for the server to stop on SIGTERM or SIGINT")
 }
 
 func init() {
@@ -0,0 +1,92 @@
+// Copyright © 2016 David Anderson <dave@natulte.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4/pcapng"
+	"github.com/metal-stack/pixie/pixiecore"
+	"github.com/spf13/cobra"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay capture-file server",
+	Short: "Replay recorded DHCP and PXE requests offline",
+	Long: `Replay reads the DHCP and PXE requests in a pcap or pcapng file,
+for example one downloaded from /admin/capture or recorded with
+tcpdump, and prints the replies Pixiecore would make to them with the
+given API server and flags. No packets are sent.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fatalf("you must specify a capture file and an API URL")
+		}
+		timeout, err := cmd.Flags().GetDuration("api-request-timeout")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		serverIPStr, err := cmd.Flags().GetString("server-ip")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		serverIP := net.ParseIP(serverIPStr).To4()
+		if serverIP == nil {
+			fatalf("Invalid --server-ip %q", serverIPStr)
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			fatalf("Couldn't open capture file: %s", err)
+		}
+		pkts, err := pcapng.ReadPackets(f)
+		_ = f.Close()
+		if err != nil {
+			fatalf("Couldn't read capture file: %s", err)
+		}
+
+		s := serverFromFlags(cmd)
+		// Replayed requests must not change the leases of a running
+		// server.
+		s.LeaseStore = nil
+		booter, err := pixiecore.APIBooter(args[1], timeout, signedIDConfigFromFlags(cmd, s.Log))
+		if err != nil {
+			fatalf("Failed to create API booter: %s", err)
+		}
+		s.Booter = booter
+
+		replayed, err := s.Replay(pkts, serverIP)
+		if err != nil {
+			fatalf("Replay failed: %s", err)
+		}
+		for _, r := range replayed {
+			fmt.Printf("Request to port %d:\n%s", r.Port, r.Request.DebugString())
+			if r.Reply == nil {
+				fmt.Print("No reply\n\n")
+				continue
+			}
+			fmt.Printf("Reply:\n%s\n", r.Reply.DebugString())
+		}
+	}}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+	serverConfigFlags(replayCmd)
+	booterConfigFlags(replayCmd)
+	replayCmd.Flags().Duration("api-request-timeout", 5*time.Second, "Timeout for request to the API server")
+	replayCmd.Flags().String("server-ip", "192.0.2.1", "Address that replies advertise on interfaces without an --interface advertise address")
+}
@@ -32,54 +32,109 @@ func (s *Server) serveDHCP(conn *dhcp4.Conn) error {
 			return fmt.Errorf("received DHCP packet with no interface information (this is a violation of dhcp4.Conn's contract, please file a bug)")
 		}
 
-		if err = s.isBootDHCP(pkt); err != nil {
-			s.Log.Debug("Ignoring packet", "mac", pkt.HardwareAddr.String(), "error", err)
-			continue
-		}
-		mach, fwtype, err := s.validateDHCP(pkt)
-		if err != nil {
-			s.Log.Info("Unusable packet", "mac", pkt.HardwareAddr.String(), "error", err)
-			continue
-		}
+		s.Log.Debug("Received DHCP packet", "type", pkt.Type, "mac", pkt.MachineAddr().String(), "interface", intf.Name, "options", pkt.Options.HumanReadable())
 
-		s.Log.Debug("Got valid request to boot", "mac", mach.MAC.String(), "guid", mach.GUID, "arch", mach.Arch)
-
-		spec, err := s.Booter.BootSpec(mach)
+		iface, err := s.packetInterface(intf, pkt)
 		if err != nil {
-			s.Log.Info("Couldn't get bootspec", "mac", pkt.HardwareAddr.String(), "error", err)
+			s.Log.Debug("Ignoring packet", "mac", pkt.MachineAddr().String(), "interface", intf.Name, "error", err)
 			continue
 		}
-		if spec == nil {
-			s.Log.Debug("No boot spec, ignoring boot request", "mac", pkt.HardwareAddr.String())
-			s.machineEvent(pkt.HardwareAddr, machineStateIgnored, "Machine should not netboot")
+		if pkt.Options[93] != nil && s.throttled(pkt, iface, "dhcp") {
 			continue
 		}
 
-		s.Log.Info("Offering to boot", "mac", pkt.HardwareAddr.String())
-		if fwtype == FirmwarePixiecoreIpxe {
-			s.machineEvent(pkt.HardwareAddr, machineStateProxyDHCPIpxe, "Offering to boot iPXE")
-		} else {
-			s.machineEvent(pkt.HardwareAddr, machineStateProxyDHCP, "Offering to boot")
+		if s.leases != nil {
+			s.serveLease(conn, pkt, intf, iface)
+			continue
 		}
 
-		// Machine should be booted.
-		serverIP, err := interfaceIP(intf)
-		if err != nil {
-			s.Log.Info("Want to boot, but couldn't get a source address", "mac", pkt.HardwareAddr.String(), "interface", intf.Name, "error", err)
+		if err = s.isBootDHCP(pkt); err != nil {
+			s.Log.Debug("Ignoring packet", "mac", pkt.MachineAddr().String(), "error", err)
 			continue
 		}
-
-		resp, err := s.offerDHCP(pkt, mach, serverIP, fwtype)
-		if err != nil {
-			s.Log.Info("Failed to construct ProxyDHCP offer", "mac", pkt.HardwareAddr.String(), "error", err)
+		resp := s.bootOffer(pkt, intf, iface)
+		if resp == nil {
 			continue
 		}
 
 		if err = conn.SendDHCP(resp, intf); err != nil {
-			s.Log.Info("Failed to send ProxyDHCP offer", "mac", pkt.HardwareAddr.String(), "error", err)
+			s.Log.Info("Failed to send ProxyDHCP offer", "mac", pkt.MachineAddr().String(), "error", err)
 			continue
 		}
+		interfaceOffers.WithLabelValues(iface.Name, "dhcp").Inc()
+	}
+}
+
+// bootOffer returns the ProxyDHCP offer that boots the machine that
+// sent pkt on iface, or nil if the machine isn't booted.
+func (s *Server) bootOffer(pkt *dhcp4.Packet, intf *net.Interface, iface *Interface) *dhcp4.Packet {
+	interfaceRequests.WithLabelValues(iface.Name, "dhcp").Inc()
+	mach, fwtype, err := s.validateDHCP(pkt)
+	if err != nil {
+		s.Log.Info("Unusable packet", "mac", pkt.MachineAddr().String(), "error", err)
+		return nil
+	}
+	if !iface.servesFirmware(fwtype) {
+		s.Log.Debug("Ignoring packet, firmware type not booted on interface", "mac", pkt.MachineAddr().String(), "interface", iface.Name, "firmware", fwtype)
+		return nil
+	}
+
+	s.Log.Debug("Got valid request to boot", "mac", mach.MAC.String(), "guid", mach.GUID, "arch", mach.Arch, "interface", iface.Name)
+	if mach.Relay != nil {
+		s.Log.Debug("Request was relayed", "mac", mach.MAC.String(), "circuitid", string(mach.Relay.CircuitID), "remoteid", string(mach.Relay.RemoteID))
+	}
+
+	if s.filtered(pkt, iface) || !s.mayOffer(mach.MAC) {
+		return nil
+	}
+
+	spec, err := s.booterFor(iface).BootSpec(mach)
+	if err != nil {
+		s.Log.Info("Couldn't get bootspec", "mac", pkt.MachineAddr().String(), "error", err)
+		return nil
+	}
+	if spec == nil {
+		s.Log.Debug("No boot spec, ignoring boot request", "mac", pkt.MachineAddr().String())
+		s.machineEvent(mach.MAC, machineStateIgnored, "Machine should not netboot")
+		return nil
+	}
+
+	s.Log.Info("Offering to boot", "mac", pkt.MachineAddr().String(), "interface", iface.Name)
+	if fwtype == FirmwarePixiecoreIpxe {
+		s.machineEvent(mach.MAC, machineStateProxyDHCPIpxe, "Offering to boot iPXE")
+	} else {
+		s.machineEvent(mach.MAC, machineStateProxyDHCP, "Offering to boot")
+	}
+
+	// Machine should be booted.
+	serverIP, err := advertiseIP(iface, intf)
+	if err != nil {
+		s.Log.Info("Want to boot, but couldn't get a source address", "mac", pkt.MachineAddr().String(), "interface", intf.Name, "error", err)
+		return nil
+	}
+
+	ipxe := ""
+	if fwtype != FirmwarePixiecoreIpxe {
+		ipxe = s.selectIpxe(newIpxeClient(pkt, mach.GUID, fwtype), spec.IpxeBinary)
 	}
+
+	resp, err := s.offerDHCP(pkt, mach, iface, serverIP, fwtype, ipxe, spec.PXEMenu)
+	if err != nil {
+		s.Log.Info("Failed to construct ProxyDHCP offer", "mac", pkt.MachineAddr().String(), "error", err)
+		return nil
+	}
+	return resp
+}
+
+// clientLink returns the address that selects the subnet of the
+// machine that sent pkt: the link selection of the relay agent
+// information agent if set, otherwise the relay address. It is nil or
+// 0.0.0.0 for requests that weren't relayed.
+func clientLink(pkt *dhcp4.Packet, agent *dhcp4.RelayAgentInfo) net.IP {
+	if agent != nil && agent.LinkSelection != nil {
+		return agent.LinkSelection
+	}
+	return pkt.RelayAddr
 }
 
 func (s *Server) isBootDHCP(pkt *dhcp4.Packet) error {
@@ -95,50 +150,9 @@ func (s *Server) isBootDHCP(pkt *dhcp4.Packet) error {
 }
 
 func (s *Server) validateDHCP(pkt *dhcp4.Packet) (mach Machine, fwtype Firmware, err error) {
-	fwt, err := pkt.Options.Uint16(93)
+	mach.Arch, fwtype, err = s.classify(pkt, "dhcp")
 	if err != nil {
-		return mach, 0, fmt.Errorf("malformed DHCP option 93 (required for PXE): %w", err)
-	}
-
-	// Basic architecture and firmware identification, based purely on
-	// the PXE architecture option.
-	switch fwt {
-	case 0:
-		mach.Arch = ArchIA32
-		fwtype = FirmwareX86PC
-	case 6:
-		mach.Arch = ArchIA32
-		fwtype = FirmwareEFI32
-	case 7, 16:
-		mach.Arch = ArchX64
-		fwtype = FirmwareEFI64
-	case 9:
-		mach.Arch = ArchX64
-		fwtype = FirmwareEFIBC
-	default:
-		return mach, 0, fmt.Errorf("unsupported client firmware type '%d' (please file a bug!)", fwtype)
-	}
-
-	// Now, identify special sub-breeds of client firmware based on
-	// the user-class option. Note these only change the "firmware
-	// type", not the architecture we're reporting to Booters. We need
-	// to identify these as part of making the internal chainloading
-	// logic work properly.
-	if userClass, err := pkt.Options.String(77); err == nil {
-		// If the client has had iPXE burned into its ROM (or is a VM
-		// that uses iPXE as the PXE "ROM"), special handling is
-		// needed because in this mode the client is using iPXE native
-		// drivers and chainloading to a UNDI stack won't work.
-		if userClass == "iPXE" && fwtype == FirmwareX86PC {
-			fwtype = FirmwareX86Ipxe
-		}
-		// If the client identifies as "pixiecore", we've already
-		// chainloaded this client to the full-featured copy of iPXE
-		// we supply. We have to distinguish this case so we don't
-		// loop on the chainload step.
-		if userClass == "pixiecore" {
-			fwtype = FirmwarePixiecoreIpxe
-		}
+		return mach, 0, err
 	}
 
 	guid := pkt.Options[97]
@@ -157,7 +171,11 @@ func (s *Server) validateDHCP(pkt *dhcp4.Packet) (mach Machine, fwtype Firmware,
 		return mach, 0, errors.New("malformed client GUID (option 97), wrong size")
 	}
 
-	mach.MAC = pkt.HardwareAddr
+	mach.MAC = pkt.MachineAddr()
+	if mach.MAC == nil {
+		return mach, 0, errors.New("packet has neither a hardware address nor a client identifier (option 61)")
+	}
+	mach.Relay, _ = pkt.Options.RelayAgentInfo()
 	mach.GUID, err = pkt.Options.GUID(97)
 	if err != nil {
 		return mach, 0, fmt.Errorf("error decoding client GUID (option 97): %w", err)
@@ -165,59 +183,90 @@ func (s *Server) validateDHCP(pkt *dhcp4.Packet) (mach Machine, fwtype Firmware,
 	return mach, fwtype, nil
 }
 
-func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach Machine, serverIP net.IP, fwtype Firmware) (*dhcp4.Packet, error) {
+// echoClientID copies the client identifier of pkt into its reply
+// resp, which is how clients without a hardware address, such as
+// InfiniBand ones, recognize the replies meant for them.
+//
+// https://www.rfc-editor.org/rfc/rfc6842.html#section-3
+func echoClientID(pkt, resp *dhcp4.Packet) {
+	if pkt.Options[dhcp4.OptClientIdentifier] != nil {
+		resp.Options.SetBytes(dhcp4.OptClientIdentifier, pkt.Options[dhcp4.OptClientIdentifier])
+	}
+}
+
+// unicastOffer returns whether the ProxyDHCP offer for pkt may clear
+// the broadcast flag, so that DHCPUnicast sends it to the machine's
+// hardware address. A ProxyDHCP offer has no address for the machine,
+// so a relay agent could only deliver it as a broadcast, and machines
+// that asked for a broadcast get one.
+func (s *Server) unicastOffer(pkt *dhcp4.Packet) bool {
+	relayed := pkt.RelayAddr != nil && !pkt.RelayAddr.IsUnspecified()
+	return s.DHCPUnicast && !relayed && !pkt.Broadcast
+}
+
+// offerDHCP constructs the ProxyDHCP offer for mach, booting on iface.
+// ipxe names the binary in IpxeBinaries to chainload, or is empty for
+// the default binary of fwtype. menu, if set, is shown to legacy BIOS
+// machines.
+func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach Machine, iface *Interface, serverIP net.IP, fwtype Firmware, ipxe string, menu *PXEMenu) (*dhcp4.Packet, error) {
 	resp := &dhcp4.Packet{
 		Type:          dhcp4.MsgOffer,
 		TransactionID: pkt.TransactionID,
-		Broadcast:     true,
-		HardwareAddr:  mach.MAC,
+		Broadcast:     !s.unicastOffer(pkt),
+		HardwareType:  pkt.HardwareType,
+		HardwareAddr:  pkt.HardwareAddr,
 		RelayAddr:     pkt.RelayAddr,
 		ServerAddr:    serverIP,
 		Options:       make(dhcp4.Options),
 	}
-	resp.Options[dhcp4.OptServerIdentifier] = serverIP
+	if err := resp.Options.SetIP(dhcp4.OptServerIdentifier, serverIP); err != nil {
+		return nil, err
+	}
 	// says the server should identify itself as a PXEClient vendor
 	// type, even though it's a server. Strange.
-	resp.Options[dhcp4.OptVendorIdentifier] = []byte("PXEClient")
-	if pkt.Options[97] != nil {
-		resp.Options[97] = pkt.Options[97]
+	resp.Options.SetString(dhcp4.OptVendorIdentifier, "PXEClient")
+	if pkt.Options[dhcp4.OptClientMachineID] != nil {
+		resp.Options.SetBytes(dhcp4.OptClientMachineID, pkt.Options[dhcp4.OptClientMachineID])
 	}
 
 	// https://www.rfc-editor.org/rfc/rfc3046.html#section-2.2
 	if pkt.Options[dhcp4.OptAgentInformation] != nil {
-		resp.Options[dhcp4.OptAgentInformation] = pkt.Options[dhcp4.OptAgentInformation]
+		resp.Options.SetBytes(dhcp4.OptAgentInformation, pkt.Options[dhcp4.OptAgentInformation])
 	}
+	echoClientID(pkt, resp)
 
 	switch fwtype {
 	case FirmwareX86PC:
+		if menu != nil {
+			// Show the menu, the chosen item is booted through
+			// the PXE port (see pxe.go).
+			pxe, err := s.pxeMenuOptions(mach.MAC, menu, serverIP)
+			if err != nil {
+				return nil, err
+			}
+			if err := resp.Options.SetPXEVendorOptions(pxe); err != nil {
+				return nil, fmt.Errorf("failed to serialize PXE vendor options: %w", err)
+			}
+			break
+		}
+
 		// This is completely standard PXE: we tell the PXE client to
 		// bypass all the boot discovery rubbish that PXE supports,
 		// and just load a file from TFTP.
-
-		pxe := dhcp4.Options{
-			// PXE Boot Server Discovery Control - bypass, just boot from filename.
-			6: []byte{8},
-		}
-		bs, err := pxe.Marshal()
-		if err != nil {
+		pxe := &dhcp4.PXEVendorOptions{Discovery: dhcp4.PXEBypassDiscovery}
+		if err := resp.Options.SetPXEVendorOptions(pxe); err != nil {
 			return nil, fmt.Errorf("failed to serialize PXE vendor options: %w", err)
 		}
-		resp.Options[43] = bs
 		resp.BootServerName = serverIP.String()
-		resp.BootFilename = fmt.Sprintf("%s/%d", mach.MAC, fwtype)
+		resp.BootFilename = ipxePath(mach.MAC, fwtype, ipxe)
 
 	case FirmwareX86Ipxe:
 		// Almost standard PXE, but the boot filename needs to be a URL.
-		pxe := dhcp4.Options{
-			// PXE Boot Server Discovery Control - bypass, just boot from filename.
-			6: []byte{8},
-		}
-		bs, err := pxe.Marshal()
-		if err != nil {
+		pxe := &dhcp4.PXEVendorOptions{Discovery: dhcp4.PXEBypassDiscovery}
+		if err := resp.Options.SetPXEVendorOptions(pxe); err != nil {
 			return nil, fmt.Errorf("failed to serialize PXE vendor options: %w", err)
 		}
-		resp.Options[43] = bs
-		resp.BootFilename = fmt.Sprintf("tftp://%s/%s/%d", serverIP, mach.MAC, fwtype)
+		resp.BootFilename = fmt.Sprintf("tftp://%s/%s", serverIP, ipxePath(mach.MAC, fwtype, ipxe))
 
 	case FirmwareEFI32, FirmwareEFI64, FirmwareEFIBC:
 		// In theory, the response we send for FirmwareX86PC should
@@ -238,13 +287,13 @@ func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach Machine, serverIP net.IP, fwt
 		// and expect to be called again on port 4011 (which is in
 		// pxe.go).
 		resp.BootServerName = serverIP.String()
-		resp.BootFilename = fmt.Sprintf("%s/%d", mach.MAC, fwtype)
+		resp.BootFilename = ipxePath(mach.MAC, fwtype, ipxe)
 
 	case FirmwarePixiecoreIpxe:
 		// We've already gone through one round of chainloading, now
 		// we can finally chainload to HTTP for the actual boot
 		// script.
-		resp.BootFilename = fmt.Sprintf("http://%s:%d/_/ipxe?arch=%d&mac=%s", serverIP, s.HTTPPort, mach.Arch, mach.MAC)
+		resp.BootFilename = fmt.Sprintf("http://%s:%d/_/ipxe?arch=%d&mac=%s%s", serverIP, s.HTTPPort, mach.Arch, mach.MAC, iface.query())
 
 	default:
 		return nil, fmt.Errorf("unknown firmware type %d", fwtype)
@@ -0,0 +1,219 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// serveLease answers pkt as an authoritative DHCP server.
+func (s *Server) serveLease(conn *dhcp4.Conn, pkt *dhcp4.Packet, intf *net.Interface, iface *Interface) {
+	resp, booting := s.leaseReply(pkt, intf, iface)
+	if resp == nil {
+		return
+	}
+	if err := conn.SendDHCP(resp, intf); err != nil {
+		s.Log.Info("Failed to send DHCP reply", "mac", pkt.MachineAddr().String(), "type", resp.Type, "error", err)
+		return
+	}
+	dhcpServerReplies.WithLabelValues(resp.Type.String()).Inc()
+	if booting {
+		interfaceOffers.WithLabelValues(iface.Name, "dhcp").Inc()
+	}
+}
+
+// leaseReply returns the reply to pkt, or nil if pkt needs no reply.
+// If the machine is booted, the boot instructions are folded into the
+// reply and booting is true.
+func (s *Server) leaseReply(pkt *dhcp4.Packet, intf *net.Interface, iface *Interface) (resp *dhcp4.Packet, booting bool) {
+	resp = s.addressReply(pkt, intf, iface)
+	if resp == nil || resp.Type == dhcp4.MsgNack || pkt.Options[93] == nil {
+		return resp, false
+	}
+	if pkt.Type != dhcp4.MsgDiscover && pkt.Type != dhcp4.MsgRequest {
+		return resp, false
+	}
+	boot := s.bootOffer(pkt, intf, iface)
+	if boot == nil {
+		return resp, false
+	}
+	mergeBootOffer(resp, boot)
+	return resp, true
+}
+
+// addressReply returns the reply to pkt without boot instructions, or
+// nil if pkt needs no reply.
+func (s *Server) addressReply(pkt *dhcp4.Packet, intf *net.Interface, iface *Interface) *dhcp4.Packet {
+	mac := pkt.MachineAddr()
+	agent, _ := pkt.Options.RelayAgentInfo()
+	pool := s.leases.poolFor(intf, clientLink(pkt, agent))
+	if pool == nil {
+		s.Log.Debug("Ignoring packet, no DHCP pool for its network", "mac", pkt.MachineAddr().String(), "interface", intf.Name, "relay", pkt.RelayAddr)
+		return nil
+	}
+	serverIP, err := advertiseIP(iface, intf)
+	if err != nil {
+		s.Log.Info("Couldn't get a source address for DHCP reply", "mac", pkt.MachineAddr().String(), "interface", intf.Name, "error", err)
+		return nil
+	}
+	// https://www.rfc-editor.org/rfc/rfc5107.html#section-4
+	if agent != nil && agent.ServerIdentifierOverride != nil {
+		serverIP = agent.ServerIdentifierOverride
+	}
+
+	switch pkt.Type {
+	case dhcp4.MsgDiscover:
+		requested, _ := pkt.Options.IP(dhcp4.OptRequestedIP)
+		ip, err := s.leases.offer(pool, mac, requested)
+		if err != nil {
+			if errors.Is(err, errPoolExhausted) {
+				dhcpPoolExhausted.Inc()
+			}
+			s.Log.Info("Couldn't offer an address", "mac", pkt.MachineAddr().String(), "subnet", pool.Subnet, "error", err)
+			return nil
+		}
+		s.Log.Debug("Offering address", "mac", pkt.MachineAddr().String(), "ip", ip)
+		return leaseResponse(pkt, dhcp4.MsgOffer, pool, serverIP, ip, pool.LeaseTime)
+
+	case dhcp4.MsgRequest:
+		if id, err := pkt.Options.IP(dhcp4.OptServerIdentifier); err == nil && !id.Equal(serverIP) {
+			// The machine took another server's offer.
+			s.leases.forget(mac)
+			return nil
+		}
+		ip, err := pkt.Options.IP(dhcp4.OptRequestedIP)
+		if err != nil {
+			ip = pkt.ClientAddr
+		}
+		if ip == nil || ip.Equal(net.IPv4zero) {
+			s.Log.Debug("Ignoring DHCPREQUEST without an address", "mac", pkt.MachineAddr().String())
+			return nil
+		}
+		leaseTime, err := s.leases.ack(pool, mac, ip)
+		if err != nil {
+			s.Log.Info("Refusing address", "mac", pkt.MachineAddr().String(), "ip", ip, "error", err)
+			return nakResponse(pkt, serverIP, err.Error())
+		}
+		s.Log.Info("Leasing address", "mac", pkt.MachineAddr().String(), "ip", ip, "duration", leaseTime)
+		resp := leaseResponse(pkt, dhcp4.MsgAck, pool, serverIP, ip, leaseTime)
+		resp.ClientAddr = pkt.ClientAddr
+		return resp
+
+	case dhcp4.MsgDecline:
+		ip, err := pkt.Options.IP(dhcp4.OptRequestedIP)
+		if err != nil {
+			return nil
+		}
+		s.Log.Info("Machine declined address, it is in use", "mac", pkt.MachineAddr().String(), "ip", ip)
+		s.leases.decline(mac, ip)
+		return nil
+
+	case dhcp4.MsgRelease:
+		s.Log.Debug("Releasing address", "mac", pkt.MachineAddr().String(), "ip", pkt.ClientAddr)
+		s.leases.release(mac, pkt.ClientAddr)
+		return nil
+
+	case dhcp4.MsgInform:
+		resp := leaseResponse(pkt, dhcp4.MsgAck, pool, serverIP, nil, 0)
+		resp.ClientAddr = pkt.ClientAddr
+		return resp
+
+	default:
+		return nil
+	}
+}
+
+// leaseResponse constructs a reply to pkt that hands ip from pool to
+// the machine for leaseTime. If ip is nil, only the configuration of
+// pool is handed out.
+func leaseResponse(pkt *dhcp4.Packet, typ dhcp4.MessageType, pool *DHCPPool, serverIP, ip net.IP, leaseTime time.Duration) *dhcp4.Packet {
+	resp := &dhcp4.Packet{
+		Type:          typ,
+		TransactionID: pkt.TransactionID,
+		Broadcast:     pkt.Broadcast,
+		HardwareType:  pkt.HardwareType,
+		HardwareAddr:  pkt.HardwareAddr,
+		YourAddr:      ip,
+		RelayAddr:     pkt.RelayAddr,
+		Options:       dhcp4.Options{},
+	}
+	// The addresses of DHCPPools are validated to be IPv4, so setting
+	// them can't fail.
+	_ = resp.Options.SetIP(dhcp4.OptServerIdentifier, serverIP)
+	_ = resp.Options.SetIPMask(dhcp4.OptSubnetMask, pool.Subnet.Mask)
+	if len(pool.Routers) > 0 {
+		_ = resp.Options.SetIPs(dhcp4.OptRouters, pool.Routers)
+	}
+	if len(pool.DNSServers) > 0 {
+		_ = resp.Options.SetIPs(dhcp4.OptDNSServers, pool.DNSServers)
+	}
+	if len(pool.NTPServers) > 0 {
+		_ = resp.Options.SetIPs(dhcp4.OptNTPServers, pool.NTPServers)
+	}
+	if pool.DomainName != "" {
+		resp.Options.SetString(dhcp4.OptDomainName, pool.DomainName)
+	}
+	if r := pool.reservation(pkt.MachineAddr()); r != nil && r.Hostname != "" {
+		resp.Options.SetString(dhcp4.OptHostname, r.Hostname)
+	}
+	if ip != nil {
+		resp.Options.SetDuration(dhcp4.OptLeaseTime, leaseTime)
+		resp.Options.SetDuration(dhcp4.OptRenewalTime, leaseTime/2)
+		resp.Options.SetDuration(dhcp4.OptRebindingTime, leaseTime*7/8)
+	}
+	// https://www.rfc-editor.org/rfc/rfc3046.html#section-2.2
+	if pkt.Options[dhcp4.OptAgentInformation] != nil {
+		resp.Options.SetBytes(dhcp4.OptAgentInformation, pkt.Options[dhcp4.OptAgentInformation])
+	}
+	echoClientID(pkt, resp)
+	return resp
+}
+
+// nakResponse constructs a DHCPNAK to pkt, explaining why in msg.
+func nakResponse(pkt *dhcp4.Packet, serverIP net.IP, msg string) *dhcp4.Packet {
+	resp := &dhcp4.Packet{
+		Type:          dhcp4.MsgNack,
+		TransactionID: pkt.TransactionID,
+		Broadcast:     pkt.RelayAddr != nil && !pkt.RelayAddr.Equal(net.IPv4zero),
+		HardwareType:  pkt.HardwareType,
+		HardwareAddr:  pkt.HardwareAddr,
+		RelayAddr:     pkt.RelayAddr,
+		Options:       dhcp4.Options{},
+	}
+	_ = resp.Options.SetIP(dhcp4.OptServerIdentifier, serverIP)
+	resp.Options.SetString(dhcp4.OptMessage, msg)
+	if pkt.Options[dhcp4.OptAgentInformation] != nil {
+		resp.Options.SetBytes(dhcp4.OptAgentInformation, pkt.Options[dhcp4.OptAgentInformation])
+	}
+	echoClientID(pkt, resp)
+	return resp
+}
+
+// mergeBootOffer adds the boot instructions of the ProxyDHCP offer boot
+// to resp. Options that resp already has are kept.
+func mergeBootOffer(resp, boot *dhcp4.Packet) {
+	resp.ServerAddr = boot.ServerAddr
+	resp.BootServerName = boot.BootServerName
+	resp.BootFilename = boot.BootFilename
+	for k, v := range boot.Options {
+		if _, ok := resp.Options[k]; !ok {
+			resp.Options[k] = v
+		}
+	}
+}
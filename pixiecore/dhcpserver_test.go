@@ -0,0 +1,319 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestLeaseReply(t *testing.T) {
+	pool := mustPool(t, "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,router=10.1.0.1,dns=10.1.0.2,lease=1h")
+	leases, err := newLeaseTable([]DHCPPool{pool}, nil, nil, slog.Default())
+	if err != nil {
+		t.Fatalf("creating lease table: %s", err)
+	}
+	s := &Server{
+		Log: slog.Default(),
+		Booter: booterFunc(func(m Machine) (*Spec, error) {
+			return &Spec{Kernel: "k"}, nil
+		}),
+		Ipxe:     map[Firmware][]byte{FirmwareX86PC: []byte("undionly")},
+		HTTPPort: 1234,
+		events:   make(map[string][]machineEvent),
+		leases:   leases,
+	}
+	serverIP := net.IPv4(10, 1, 0, 2).To4()
+	iface := &Interface{Name: "test", AdvertiseIP: serverIP, implicit: true}
+	intf := &net.Interface{Name: "test"}
+	relay := net.IPv4(10, 1, 0, 1).To4()
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+
+	discover := &dhcp4.Packet{
+		Type:          dhcp4.MsgDiscover,
+		TransactionID: []byte{1, 2, 3, 4},
+		HardwareAddr:  mac,
+		RelayAddr:     relay,
+		Options: dhcp4.Options{
+			93: []byte{0, 0},
+			97: make([]byte, 17),
+		},
+	}
+	offer, booting := s.leaseReply(discover, intf, iface)
+	if offer == nil || offer.Type != dhcp4.MsgOffer {
+		t.Fatalf("got %v for DHCPDISCOVER, want DHCPOFFER", offer)
+	}
+	if !booting {
+		t.Error("PXE client isn't booted")
+	}
+	if !offer.YourAddr.Equal(net.IPv4(10, 1, 0, 100)) {
+		t.Errorf("offered %s, want 10.1.0.100", offer.YourAddr)
+	}
+	if !offer.RelayAddr.Equal(relay) {
+		t.Errorf("offer is relayed to %s, want %s", offer.RelayAddr, relay)
+	}
+	for opt, want := range map[dhcp4.Option][]byte{
+		dhcp4.OptServerIdentifier: serverIP,
+		dhcp4.OptSubnetMask:       {255, 255, 255, 0},
+		dhcp4.OptRouters:          {10, 1, 0, 1},
+		dhcp4.OptDNSServers:       {10, 1, 0, 2},
+		dhcp4.OptLeaseTime:        {0, 0, 0x0e, 0x10},
+		dhcp4.OptVendorIdentifier: []byte("PXEClient"),
+	} {
+		if !bytes.Equal(offer.Options[opt], want) {
+			t.Errorf("got option %d = %v, want %v", opt, offer.Options[opt], want)
+		}
+	}
+	if want := "01:02:03:04:05:06/0"; offer.BootFilename != want {
+		t.Errorf("got boot filename %q, want %q", offer.BootFilename, want)
+	}
+	if _, err := offer.Marshal(); err != nil {
+		t.Errorf("marshaling offer: %s", err)
+	}
+
+	request := &dhcp4.Packet{
+		Type:          dhcp4.MsgRequest,
+		TransactionID: []byte{1, 2, 3, 5},
+		HardwareAddr:  mac,
+		RelayAddr:     relay,
+		Options: dhcp4.Options{
+			dhcp4.OptServerIdentifier: serverIP,
+			dhcp4.OptRequestedIP:      offer.YourAddr.To4(),
+		},
+	}
+	ack, booting := s.leaseReply(request, intf, iface)
+	if ack == nil || ack.Type != dhcp4.MsgAck || !ack.YourAddr.Equal(offer.YourAddr) {
+		t.Fatalf("got %v for DHCPREQUEST, want DHCPACK of %s", ack, offer.YourAddr)
+	}
+	if booting || ack.BootFilename != "" {
+		t.Error("non-PXE request got boot instructions")
+	}
+
+	// Another machine can't have the same address.
+	request.HardwareAddr = net.HardwareAddr{1, 2, 3, 4, 5, 7}
+	nak, _ := s.leaseReply(request, intf, iface)
+	if nak == nil || nak.Type != dhcp4.MsgNack {
+		t.Fatalf("got %v for DHCPREQUEST of taken address, want DHCPNAK", nak)
+	}
+
+	// A request for another server is ignored.
+	request.Options[dhcp4.OptServerIdentifier] = []byte{10, 1, 0, 3}
+	if resp, _ := s.leaseReply(request, intf, iface); resp != nil {
+		t.Errorf("got %v for DHCPREQUEST to another server, want no reply", resp)
+	}
+
+	// Requests from networks without a pool are ignored.
+	discover.RelayAddr = net.IPv4(10, 2, 0, 1)
+	if resp, _ := s.leaseReply(discover, intf, iface); resp != nil {
+		t.Errorf("got %v for DHCPDISCOVER from unknown network, want no reply", resp)
+	}
+
+	release := &dhcp4.Packet{
+		Type:          dhcp4.MsgRelease,
+		TransactionID: []byte{1, 2, 3, 6},
+		HardwareAddr:  mac,
+		ClientAddr:    offer.YourAddr,
+		RelayAddr:     relay,
+		Options:       dhcp4.Options{},
+	}
+	if resp, _ := s.leaseReply(release, intf, iface); resp != nil {
+		t.Errorf("got %v for DHCPRELEASE, want no reply", resp)
+	}
+	request.HardwareAddr = net.HardwareAddr{1, 2, 3, 4, 5, 7}
+	request.Options[dhcp4.OptServerIdentifier] = serverIP
+	if ack, _ := s.leaseReply(request, intf, iface); ack == nil || ack.Type != dhcp4.MsgAck {
+		t.Errorf("got %v for DHCPREQUEST of released address, want DHCPACK", ack)
+	}
+
+	// A relay agent that overrides the server identifier gets its
+	// address back, and requests to it are ours.
+	override := net.IPv4(10, 1, 0, 1).To4()
+	agent := &dhcp4.RelayAgentInfo{ServerIdentifierOverride: override}
+	raw, err := agent.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Options[dhcp4.OptAgentInformation] = raw
+	request.Options[dhcp4.OptServerIdentifier] = override
+	ack, _ = s.leaseReply(request, intf, iface)
+	if ack == nil || ack.Type != dhcp4.MsgAck {
+		t.Fatalf("got %v for DHCPREQUEST through overriding relay agent, want DHCPACK", ack)
+	}
+	if id := ack.Options[dhcp4.OptServerIdentifier]; !bytes.Equal(id, override) {
+		t.Errorf("got server identifier %v, want %v", id, override)
+	}
+	if !bytes.Equal(ack.Options[dhcp4.OptAgentInformation], raw) {
+		t.Errorf("relay agent information not echoed: %v", ack.Options[dhcp4.OptAgentInformation])
+	}
+}
+
+func TestLeaseReplyInfiniBand(t *testing.T) {
+	pool := mustPool(t, "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,lease=1h")
+	leases, err := newLeaseTable([]DHCPPool{pool}, nil, nil, slog.Default())
+	if err != nil {
+		t.Fatalf("creating lease table: %s", err)
+	}
+	var booted Machine
+	s := &Server{
+		Log: slog.Default(),
+		Booter: booterFunc(func(m Machine) (*Spec, error) {
+			booted = m
+			return &Spec{Kernel: "k"}, nil
+		}),
+		Ipxe:   map[Firmware][]byte{FirmwareEFI64: []byte("ipxe.efi")},
+		events: make(map[string][]machineEvent),
+		leases: leases,
+	}
+	serverIP := net.IPv4(10, 1, 0, 2).To4()
+	iface := &Interface{Name: "test", AdvertiseIP: serverIP, implicit: true}
+	intf := &net.Interface{Name: "test"}
+	relay := net.IPv4(10, 1, 0, 1).To4()
+
+	// https://www.rfc-editor.org/rfc/rfc4390.html#section-2.1
+	clientID := []byte{0xff, 0, 0, 0, 1, 0, 4, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 2, 0xc9, 3, 0, 1, 2, 3}
+	discover := &dhcp4.Packet{
+		Type:          dhcp4.MsgDiscover,
+		TransactionID: []byte{1, 2, 3, 4},
+		Broadcast:     true,
+		HardwareType:  dhcp4.HardwareTypeInfiniBand,
+		RelayAddr:     relay,
+		Options: dhcp4.Options{
+			dhcp4.OptClientIdentifier: clientID,
+			93:                        []byte{0, 7},
+			97:                        make([]byte, 17),
+		},
+	}
+	offer, booting := s.leaseReply(discover, intf, iface)
+	if offer == nil || offer.Type != dhcp4.MsgOffer || !booting {
+		t.Fatalf("got %v, booting %v for DHCPDISCOVER, want booting DHCPOFFER", offer, booting)
+	}
+	if offer.HardwareType != dhcp4.HardwareTypeInfiniBand || len(offer.HardwareAddr) != 0 || !offer.Broadcast {
+		t.Errorf("got offer with hardware type %d, address %q, broadcast %v", offer.HardwareType, offer.HardwareAddr, offer.Broadcast)
+	}
+	if !bytes.Equal(offer.Options[dhcp4.OptClientIdentifier], clientID) {
+		t.Errorf("offer doesn't echo client identifier, got %v", offer.Options[dhcp4.OptClientIdentifier])
+	}
+	if !bytes.Equal(booted.MAC, clientID) {
+		t.Errorf("booted machine %s, want it identified by client identifier", booted.MAC)
+	}
+	if _, err := offer.Marshal(); err != nil {
+		t.Errorf("marshaling offer: %s", err)
+	}
+
+	request := &dhcp4.Packet{
+		Type:          dhcp4.MsgRequest,
+		TransactionID: []byte{1, 2, 3, 5},
+		Broadcast:     true,
+		HardwareType:  dhcp4.HardwareTypeInfiniBand,
+		RelayAddr:     relay,
+		Options: dhcp4.Options{
+			dhcp4.OptClientIdentifier: clientID,
+			dhcp4.OptServerIdentifier: serverIP,
+			dhcp4.OptRequestedIP:      offer.YourAddr.To4(),
+		},
+	}
+	ack, _ := s.leaseReply(request, intf, iface)
+	if ack == nil || ack.Type != dhcp4.MsgAck || !ack.YourAddr.Equal(offer.YourAddr) {
+		t.Fatalf("got %v for DHCPREQUEST, want DHCPACK of %s", ack, offer.YourAddr)
+	}
+	list := s.leases.list()
+	if len(list) != 1 || !bytes.Equal(list[0].HardwareAddr, clientID) {
+		t.Errorf("got leases %v, want one for the client identifier", list)
+	}
+}
+
+func TestValidateDHCPArchList(t *testing.T) {
+	s := &Server{Ipxe: map[Firmware][]byte{FirmwareEFI64: []byte("efi64")}}
+
+	tests := []struct {
+		archs  []uint16
+		arch   Architecture
+		fwtype Firmware
+		err    bool
+	}{
+		{archs: []uint16{0}, arch: ArchIA32, fwtype: FirmwareX86PC},
+		// The first architecture with an iPXE binary wins.
+		{archs: []uint16{0, 7}, arch: ArchX64, fwtype: FirmwareEFI64},
+		// Otherwise the first known one.
+		{archs: []uint16{11, 6, 0}, arch: ArchIA32, fwtype: FirmwareEFI32},
+		{archs: []uint16{11, 12}, err: true},
+	}
+	for _, test := range tests {
+		pkt := &dhcp4.Packet{
+			HardwareAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6},
+			Options:      dhcp4.Options{},
+		}
+		pkt.Options.SetUint16s(dhcp4.OptClientSystem, test.archs)
+		pkt.Options[97] = make([]byte, 17)
+		mach, fwtype, err := s.validateDHCP(pkt)
+		if test.err {
+			if err == nil {
+				t.Errorf("validateDHCP with archs %v = %s, %d, want error", test.archs, mach, fwtype)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("validateDHCP with archs %v: %s", test.archs, err)
+			continue
+		}
+		if mach.Arch != test.arch || fwtype != test.fwtype {
+			t.Errorf("validateDHCP with archs %v = %s, %d, want %s, %d", test.archs, mach.Arch, fwtype, test.arch, test.fwtype)
+		}
+	}
+}
+
+func TestOfferDHCPBroadcast(t *testing.T) {
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	relay := net.IPv4(10, 1, 0, 1).To4()
+	tests := []struct {
+		unicast   bool
+		broadcast bool
+		relay     net.IP
+		want      bool
+	}{
+		// Without DHCPUnicast, offers are always broadcast.
+		{false, false, nil, true},
+		{false, true, nil, true},
+		{false, false, relay, true},
+		// With it, only to machines that ask for broadcasts.
+		{true, false, nil, false},
+		{true, true, nil, true},
+		// The relay agent can't unicast an offer without yiaddr.
+		{true, false, relay, true},
+	}
+	for _, test := range tests {
+		s := &Server{Ipxe: map[Firmware][]byte{FirmwareEFI64: []byte("ipxe.efi")}, DHCPUnicast: test.unicast}
+		pkt := &dhcp4.Packet{
+			Type:          dhcp4.MsgDiscover,
+			TransactionID: []byte{1, 2, 3, 4},
+			Broadcast:     test.broadcast,
+			HardwareType:  dhcp4.HardwareTypeEthernet,
+			HardwareAddr:  mac,
+			RelayAddr:     test.relay,
+			Options:       dhcp4.Options{},
+		}
+		offer, err := s.offerDHCP(pkt, Machine{MAC: mac}, &Interface{implicit: true}, net.IPv4(192, 168, 0, 1), FirmwareEFI64, "", nil)
+		if err != nil {
+			t.Fatalf("constructing offer: %s", err)
+		}
+		if offer.Broadcast != test.want {
+			t.Errorf("unicast %v, broadcast %v, relay %v: got offer with broadcast %v, want %v", test.unicast, test.broadcast, test.relay, offer.Broadcast, test.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package pixiecore
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/metal-stack/pixie/dhcp6"
@@ -10,6 +11,10 @@ func (s *ServerV6) serveDHCP(conn *dhcp6.Conn) error {
 	s.Log.Debug("waiting for packets...")
 	for {
 		pkt, src, err := conn.RecvDHCP()
+		if errors.Is(err, dhcp6.ErrMalformedPacket) {
+			s.Log.Debug("discarding packet", "error", err)
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("error receiving DHCP packet: %w", err)
 		}
@@ -19,6 +24,11 @@ func (s *ServerV6) serveDHCP(conn *dhcp6.Conn) error {
 		}
 
 		s.Log.Debug("received packet", "type", pkt.Type, "packet", pkt.TransactionID, "options", pkt.Options.HumanReadable())
+		for _, relay := range pkt.Relays {
+			enterprise, remoteID := relay.RemoteID()
+			s.Log.Debug("packet was relayed", "packet", pkt.TransactionID, "link", relay.LinkAddr, "peer", relay.PeerAddr,
+				"interfaceid", string(relay.InterfaceID()), "remoteid", string(remoteID), "enterprise", enterprise)
+		}
 
 		response, err := s.PacketBuilder.BuildResponse(pkt, s.Duid, s.BootConfig, s.AddressPool)
 		if err != nil {
@@ -35,6 +45,7 @@ func (s *ServerV6) serveDHCP(conn *dhcp6.Conn) error {
 			continue
 		}
 
+		response.Relays = pkt.ReplyRelays()
 		marshalledResponse, err := response.Marshal()
 		if err != nil {
 			s.Log.Error("error marshalling response", "type", response.Type, "packet", response.TransactionID, "error", err)
@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// bootInProgressWindow is how long after its last step a machine that
+// hasn't booted yet is considered to be in the middle of booting.
+const bootInProgressWindow = 10 * time.Minute
+
+// drainState is the maintenance mode of a Server.
+type drainState struct {
+	mu      sync.Mutex
+	enabled bool
+	allow   map[string]bool
+}
+
+// SetDrain switches drain mode on or off.
+//
+// While draining, the Server makes no new boot offers, except to the
+// machines in allow and to machines that are already in the middle of
+// booting. iPXE scripts and boot files are still served.
+func (s *Server) SetDrain(enabled bool, allow []net.HardwareAddr) {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	s.drain.enabled = enabled
+	s.drain.allow = make(map[string]bool, len(allow))
+	for _, mac := range allow {
+		s.drain.allow[mac.String()] = true
+	}
+	if enabled {
+		drainEnabled.Set(1)
+	} else {
+		drainEnabled.Set(0)
+	}
+}
+
+// setDrainAllow replaces the machines that are still offered to boot
+// in drain mode, without switching it on or off.
+func (s *Server) setDrainAllow(allow []net.HardwareAddr) {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	s.drain.allow = make(map[string]bool, len(allow))
+	for _, mac := range allow {
+		s.drain.allow[mac.String()] = true
+	}
+}
+
+// Draining returns whether drain mode is on, and the machines that are
+// still offered to boot.
+func (s *Server) Draining() (bool, []net.HardwareAddr) {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	var allow []net.HardwareAddr
+	for k := range s.drain.allow {
+		mac, _ := dhcp4.ParseHardwareAddr(k)
+		allow = append(allow, mac)
+	}
+	return s.drain.enabled, allow
+}
+
+// mayOffer returns whether a boot offer may be made to mac, logging
+// and recording the refusal if not.
+func (s *Server) mayOffer(mac net.HardwareAddr) bool {
+	s.drain.mu.Lock()
+	refuse := s.drain.enabled && !s.drain.allow[mac.String()]
+	s.drain.mu.Unlock()
+	if !refuse || s.bootInProgress(mac) {
+		return true
+	}
+
+	drainSuppressedOffers.Inc()
+	s.Log.Info("Draining, not offering to boot", "mac", mac.String())
+	s.machineEvent(mac, machineStateIgnored, "Not offering to boot, server is draining")
+	return false
+}
+
+// bootInProgress returns whether mac recently went through a boot step
+// other than the last one. Throttling isn't a boot step.
+func (s *Server) bootInProgress(mac net.HardwareAddr) bool {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	evts := s.events[mac.String()]
+	for len(evts) > 0 && evts[len(evts)-1].State == machineStateThrottled {
+		evts = evts[:len(evts)-1]
+	}
+	if len(evts) == 0 {
+		return false
+	}
+	last := evts[len(evts)-1]
+	if last.State == machineStateBooted || last.State == machineStateIgnored {
+		return false
+	}
+	return time.Since(last.Timestamp) < bootInProgressWindow
+}
+
+// drainStatus is the JSON representation of drain mode in the admin
+// API.
+type drainStatus struct {
+	Draining bool     `json:"draining"`
+	Allow    []string `json:"allow"`
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req drainStatus
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+			return
+		}
+		var allow []net.HardwareAddr
+		for _, a := range req.Allow {
+			mac, err := dhcp4.ParseHardwareAddr(a)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid MAC address %q", a), http.StatusBadRequest)
+				return
+			}
+			allow = append(allow, mac)
+		}
+		s.SetDrain(req.Draining, allow)
+		s.Log.Info("Changed drain mode", "draining", req.Draining, "allow", req.Allow, "remoteaddr", r.RemoteAddr)
+	case http.MethodDelete:
+		s.SetDrain(false, nil)
+		s.Log.Info("Changed drain mode", "draining", false, "remoteaddr", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	draining, allow := s.Draining()
+	resp := drainStatus{Draining: draining, Allow: []string{}}
+	for _, mac := range allow {
+		resp.Allow = append(resp.Allow, mac.String())
+	}
+	slices.Sort(resp.Allow)
+	s.writeJSON(w, resp)
+}
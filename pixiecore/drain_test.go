@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMayOffer(t *testing.T) {
+	s := &Server{
+		Log:    slog.Default(),
+		events: make(map[string][]machineEvent),
+	}
+	fresh := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	booting := net.HardwareAddr{1, 2, 3, 4, 5, 7}
+	booted := net.HardwareAddr{1, 2, 3, 4, 5, 8}
+	stale := net.HardwareAddr{1, 2, 3, 4, 5, 9}
+	allowed := net.HardwareAddr{1, 2, 3, 4, 5, 10}
+
+	s.machineEvent(booting, machineStateTFTP, "Sent iPXE binary")
+	s.machineEvent(booted, machineStateBooted, "Booting into OS")
+	s.events[stale.String()] = []machineEvent{{Timestamp: time.Now().Add(-time.Hour), State: machineStateTFTP}}
+
+	for _, mac := range []net.HardwareAddr{fresh, booting, booted, stale, allowed} {
+		if !s.mayOffer(mac) {
+			t.Errorf("offer to %s refused without drain mode", mac)
+		}
+	}
+
+	s.SetDrain(true, []net.HardwareAddr{allowed})
+	tests := []struct {
+		mac  net.HardwareAddr
+		want bool
+	}{
+		{fresh, false},
+		{booting, true},
+		{booted, false},
+		{stale, false},
+		{allowed, true},
+	}
+	for _, test := range tests {
+		if got := s.mayOffer(test.mac); got != test.want {
+			t.Errorf("mayOffer(%s) while draining = %v, want %v", test.mac, got, test.want)
+		}
+	}
+
+	s.SetDrain(false, nil)
+	if !s.mayOffer(fresh) {
+		t.Errorf("offer to %s refused after leaving drain mode", fresh)
+	}
+}
+
+func TestDrainAdmin(t *testing.T) {
+	s := &Server{
+		Log:        slog.Default(),
+		AdminToken: "secret",
+		events:     make(map[string][]machineEvent),
+	}
+	mux := http.NewServeMux()
+	s.serveAdmin(mux)
+
+	do := func(method, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/drain", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("GET", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("request without token got HTTP %d, want 401", rr.Code)
+	}
+	if rr := do("GET", "", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("request with wrong token got HTTP %d, want 401", rr.Code)
+	}
+
+	rr := do("PUT", `{"draining": true, "allow": ["01:02:03:04:05:06"]}`, "secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("enabling drain mode got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	want := `{
+  "draining": true,
+  "allow": [
+    "01:02:03:04:05:06"
+  ]
+}`
+	if rr.Body.String() != want {
+		t.Errorf("got drain status %s, want %s", rr.Body, want)
+	}
+	if draining, allow := s.Draining(); !draining || len(allow) != 1 {
+		t.Errorf("server not draining after enabling drain mode: %v %v", draining, allow)
+	}
+
+	if rr := do("PUT", `{"draining": true, "allow": ["nope"]}`, "secret"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid allow list got HTTP %d, want 400", rr.Code)
+	}
+	if rr := do("PATCH", "", "secret"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PATCH got HTTP %d, want 405", rr.Code)
+	}
+
+	rr = do("DELETE", "", "secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("disabling drain mode got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	if draining, _ := s.Draining(); draining {
+		t.Errorf("server still draining after disabling drain mode")
+	}
+}
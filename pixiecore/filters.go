@@ -0,0 +1,318 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// A ClientFilter decides whether the machines it matches are served,
+// before the Booter is asked about them. Empty fields match
+// everything, so a filter matches a machine if all of its non-empty
+// fields do.
+//
+// Filters keep devices that send PXE-looking requests but are never
+// provisioned, such as BMCs, switches and IP phones, away from the
+// Booter.
+type ClientFilter struct {
+	// Allow makes the matching machines served. Otherwise they are
+	// silently ignored.
+	Allow bool
+
+	// MACPrefix matches machines whose MAC address starts with
+	// these bytes: a full MAC address, or an OUI.
+	MACPrefix []byte
+	// GUID matches the machine's UUID (DHCP option 97),
+	// case-insensitively.
+	GUID string
+	// Interface matches machines served by the Interface of this
+	// name.
+	Interface string
+	// RelaySubnet matches relayed requests whose relay address, or
+	// link selection, is in this subnet.
+	RelaySubnet *net.IPNet
+	// CircuitID and RemoteID match requests whose relay agent
+	// information (DHCP option 82) has a circuit-id, respectively
+	// remote-id, matching the pattern. Patterns are in the syntax of
+	// path.Match.
+	CircuitID string
+	RemoteID  string
+}
+
+// filterClient is what the filters know about a machine.
+type filterClient struct {
+	mac   net.HardwareAddr
+	guid  string
+	iface string
+	relay net.IP
+	agent *dhcp4.RelayAgentInfo
+}
+
+func newFilterClient(pkt *dhcp4.Packet, iface *Interface) filterClient {
+	agent, _ := pkt.Options.RelayAgentInfo()
+	guid, _ := pkt.Options.GUID(97)
+	return filterClient{
+		mac:   pkt.MachineAddr(),
+		guid:  guid,
+		iface: iface.Name,
+		relay: clientLink(pkt, agent),
+		agent: agent,
+	}
+}
+
+func (f ClientFilter) matches(c filterClient) bool {
+	if !bytes.HasPrefix(c.mac, f.MACPrefix) {
+		return false
+	}
+	if f.GUID != "" && !strings.EqualFold(f.GUID, c.guid) {
+		return false
+	}
+	if f.Interface != "" && f.Interface != c.iface {
+		return false
+	}
+	if f.RelaySubnet != nil && (c.relay == nil || !f.RelaySubnet.Contains(c.relay)) {
+		return false
+	}
+	if f.CircuitID != "" || f.RemoteID != "" {
+		if c.agent == nil {
+			return false
+		}
+		if f.CircuitID != "" && !matchPattern(f.CircuitID, c.agent.CircuitID) {
+			return false
+		}
+		if f.RemoteID != "" && !matchPattern(f.RemoteID, c.agent.RemoteID) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPattern(pattern string, v []byte) bool {
+	ok, _ := path.Match(pattern, string(v))
+	return ok
+}
+
+// ParseClientFilter parses a filter of comma-separated key=value
+// pairs, for example "action=deny,oui=00:1b:21". The keys are action
+// (allow or deny), which is required, mac (a MAC address or prefix),
+// oui (an alias of mac), guid, interface, relay (a CIDR), circuit-id
+// and remote-id (patterns).
+func ParseClientFilter(s string) (ClientFilter, error) {
+	var (
+		ret       ClientFilter
+		hasAction bool
+	)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || v == "" {
+			return ret, fmt.Errorf("invalid filter element %q, want key=value", kv)
+		}
+		switch k {
+		case "action":
+			switch v {
+			case "allow":
+				ret.Allow = true
+			case "deny":
+				ret.Allow = false
+			default:
+				return ret, fmt.Errorf("invalid filter action %q, want allow or deny", v)
+			}
+			hasAction = true
+		case "mac", "oui":
+			bs, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(v))
+			if err != nil || len(bs) == 0 {
+				return ret, fmt.Errorf("invalid MAC address prefix %q", v)
+			}
+			ret.MACPrefix = bs
+		case "guid":
+			ret.GUID = v
+		case "interface":
+			ret.Interface = v
+		case "relay":
+			_, subnet, err := net.ParseCIDR(v)
+			if err != nil {
+				return ret, fmt.Errorf("invalid relay subnet %q: %w", v, err)
+			}
+			ret.RelaySubnet = subnet
+		case "circuit-id", "remote-id":
+			if _, err := path.Match(v, ""); err != nil {
+				return ret, fmt.Errorf("invalid %s pattern %q: %w", k, v, err)
+			}
+			if k == "circuit-id" {
+				ret.CircuitID = v
+			} else {
+				ret.RemoteID = v
+			}
+		default:
+			return ret, fmt.Errorf("unknown filter key %q", k)
+		}
+	}
+	if !hasAction {
+		return ret, errors.New("filter has no action")
+	}
+	return ret, nil
+}
+
+// String returns f in the syntax of ParseClientFilter.
+func (f ClientFilter) String() string {
+	action := "deny"
+	if f.Allow {
+		action = "allow"
+	}
+	ret := []string{"action=" + action}
+	if len(f.MACPrefix) > 0 {
+		ret = append(ret, "mac="+net.HardwareAddr(f.MACPrefix).String())
+	}
+	if f.GUID != "" {
+		ret = append(ret, "guid="+f.GUID)
+	}
+	if f.Interface != "" {
+		ret = append(ret, "interface="+f.Interface)
+	}
+	if f.RelaySubnet != nil {
+		ret = append(ret, "relay="+f.RelaySubnet.String())
+	}
+	if f.CircuitID != "" {
+		ret = append(ret, "circuit-id="+f.CircuitID)
+	}
+	if f.RemoteID != "" {
+		ret = append(ret, "remote-id="+f.RemoteID)
+	}
+	return strings.Join(ret, ",")
+}
+
+// filterState holds the ClientFilters in use.
+type filterState struct {
+	mu          sync.Mutex
+	filters     []ClientFilter
+	defaultDeny bool
+}
+
+// SetClientFilters replaces the filters that decide which machines are
+// served. The first filter that matches a machine decides. Machines
+// that match no filter are served, unless defaultDeny is set.
+func (s *Server) SetClientFilters(filters []ClientFilter, defaultDeny bool) {
+	s.filters.mu.Lock()
+	defer s.filters.mu.Unlock()
+	s.filters.filters = append([]ClientFilter(nil), filters...)
+	s.filters.defaultDeny = defaultDeny
+}
+
+// ClientFilters returns the filters in use, and whether machines that
+// match none of them are ignored.
+func (s *Server) ClientFilters() ([]ClientFilter, bool) {
+	s.filters.mu.Lock()
+	defer s.filters.mu.Unlock()
+	return append([]ClientFilter(nil), s.filters.filters...), s.filters.defaultDeny
+}
+
+// filtered returns whether the machine that sent pkt to iface must be
+// ignored because of the ClientFilters. Ignored machines are only
+// logged at debug level, they are usually not meant to boot at all.
+func (s *Server) filtered(pkt *dhcp4.Packet, iface *Interface) bool {
+	if s.filterAllows(pkt, iface) {
+		return false
+	}
+
+	filterIgnored.WithLabelValues(iface.Name).Inc()
+	s.Log.Debug("Ignoring packet, machine is filtered", "mac", pkt.MachineAddr().String(), "interface", iface.Name)
+	return true
+}
+
+// filterAllows returns whether the ClientFilters let the machine that
+// sent pkt to iface be served, without logging or counting anything.
+func (s *Server) filterAllows(pkt *dhcp4.Packet, iface *Interface) bool {
+	c := newFilterClient(pkt, iface)
+
+	s.filters.mu.Lock()
+	defer s.filters.mu.Unlock()
+	for _, f := range s.filters.filters {
+		if f.matches(c) {
+			return f.Allow
+		}
+	}
+	return !s.filters.defaultDeny
+}
+
+// filterStatus is the JSON representation of the ClientFilters in the
+// admin API.
+type filterStatus struct {
+	// Default is the action for machines that match no filter.
+	Default string   `json:"default"`
+	Filters []string `json:"filters"`
+}
+
+func (s *Server) handleFilters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req filterStatus
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+			return
+		}
+		var defaultDeny bool
+		switch req.Default {
+		case "", "allow":
+		case "deny":
+			defaultDeny = true
+		default:
+			http.Error(w, fmt.Sprintf("invalid default action %q, want allow or deny", req.Default), http.StatusBadRequest)
+			return
+		}
+		filters := make([]ClientFilter, 0, len(req.Filters))
+		for _, f := range req.Filters {
+			filter, err := ParseClientFilter(f)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid filter %q: %s", f, err), http.StatusBadRequest)
+				return
+			}
+			filters = append(filters, filter)
+		}
+		s.SetClientFilters(filters, defaultDeny)
+		s.Log.Info("Changed client filters", "filters", req.Filters, "default", req.Default, "remoteaddr", r.RemoteAddr)
+	case http.MethodDelete:
+		s.SetClientFilters(nil, false)
+		s.Log.Info("Removed client filters", "remoteaddr", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filters, defaultDeny := s.ClientFilters()
+	status := filterStatus{
+		Default: "allow",
+		Filters: []string{},
+	}
+	if defaultDeny {
+		status.Default = "deny"
+	}
+	for _, f := range filters {
+		status.Filters = append(status.Filters, f.String())
+	}
+	s.writeJSON(w, status)
+}
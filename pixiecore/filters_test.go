@@ -0,0 +1,182 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestParseClientFilter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "action=deny,oui=00-1B-21", want: "action=deny,mac=00:1b:21"},
+		{in: "action=allow,mac=00:1b:21:0a:0b:0c,guid=abc", want: "action=allow,mac=00:1b:21:0a:0b:0c,guid=abc"},
+		{in: "action=deny,interface=vlan100,relay=10.1.0.0/24", want: "action=deny,interface=vlan100,relay=10.1.0.0/24"},
+		{in: "action=deny,circuit-id=eth1/*,remote-id=leaf0?", want: "action=deny,circuit-id=eth1/*,remote-id=leaf0?"},
+		{in: "oui=00:1b:21", err: true},
+		{in: "action=maybe", err: true},
+		{in: "action=deny,mac=zz", err: true},
+		{in: "action=deny,relay=10.1.0.0", err: true},
+		{in: "action=deny,circuit-id=[", err: true},
+		{in: "action=deny,color=blue", err: true},
+	}
+	for _, test := range tests {
+		f, err := ParseClientFilter(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseClientFilter(%q) = %s, want error", test.in, f)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseClientFilter(%q): %s", test.in, err)
+			continue
+		}
+		if got := f.String(); got != test.want {
+			t.Errorf("ParseClientFilter(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFiltered(t *testing.T) {
+	s := &Server{Log: slog.Default()}
+	bmc := net.HardwareAddr{0x00, 0x25, 0x90, 1, 2, 3}
+	server := net.HardwareAddr{0x00, 0x25, 0x90, 4, 5, 6}
+	other := net.HardwareAddr{0x52, 0x54, 0, 1, 2, 3}
+	vlan100 := &Interface{Name: "vlan100"}
+	vlan200 := &Interface{Name: "vlan200"}
+
+	pkt := func(mac net.HardwareAddr, relay net.IP, circuit string) *dhcp4.Packet {
+		p := &dhcp4.Packet{HardwareAddr: mac, RelayAddr: relay, Options: dhcp4.Options{}}
+		if circuit != "" {
+			if err := p.Options.SetRelayAgentInfo(&dhcp4.RelayAgentInfo{CircuitID: []byte(circuit)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return p
+	}
+
+	for _, mac := range []net.HardwareAddr{bmc, server, other} {
+		if s.filtered(pkt(mac, nil, ""), vlan100) {
+			t.Errorf("%s filtered without filters", mac)
+		}
+	}
+
+	var filters []ClientFilter
+	for _, f := range []string{
+		"action=allow,mac=00:25:90:04:05:06",
+		"action=deny,oui=00:25:90",
+		"action=deny,interface=vlan200",
+		"action=deny,relay=10.2.0.0/16",
+		"action=deny,circuit-id=mgmt*",
+	} {
+		filter, err := ParseClientFilter(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filters = append(filters, filter)
+	}
+	s.SetClientFilters(filters, false)
+
+	tests := []struct {
+		pkt   *dhcp4.Packet
+		iface *Interface
+		want  bool
+	}{
+		{pkt(bmc, nil, ""), vlan100, true},
+		{pkt(server, nil, ""), vlan100, false},
+		{pkt(server, nil, ""), vlan200, false},
+		{pkt(other, nil, ""), vlan100, false},
+		{pkt(other, nil, ""), vlan200, true},
+		{pkt(other, net.IPv4(10, 2, 3, 1), ""), vlan100, true},
+		{pkt(other, net.IPv4(10, 3, 3, 1), ""), vlan100, false},
+		{pkt(other, nil, "mgmt-eth1"), vlan100, true},
+		{pkt(other, nil, "eth1"), vlan100, false},
+	}
+	for i, test := range tests {
+		if got := s.filtered(test.pkt, test.iface); got != test.want {
+			t.Errorf("test %d: filtered(%s on %s) = %v, want %v", i, test.pkt.HardwareAddr, test.iface.Name, got, test.want)
+		}
+	}
+
+	s.SetClientFilters(filters[:1], true)
+	if s.filtered(pkt(server, nil, ""), vlan100) || !s.filtered(pkt(other, nil, ""), vlan100) {
+		t.Error("default deny not applied to unmatched machines only")
+	}
+}
+
+func TestFiltersAdmin(t *testing.T) {
+	s := &Server{Log: slog.Default()}
+	mux := http.NewServeMux()
+	s.serveAdmin(mux)
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := adminRequest(method, "/admin/filters", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("PUT", `{"default": "deny", "filters": ["action=allow,oui=00-25-90"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("setting filters got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	want := `{
+  "default": "deny",
+  "filters": [
+    "action=allow,mac=00:25:90"
+  ]
+}`
+	if rr.Body.String() != want {
+		t.Errorf("got filters %s, want %s", rr.Body, want)
+	}
+	if filters, defaultDeny := s.ClientFilters(); len(filters) != 1 || !defaultDeny {
+		t.Errorf("got filters %v, %v after setting them", filters, defaultDeny)
+	}
+
+	for _, body := range []string{
+		`{"default": "maybe"}`,
+		`{"filters": ["action=deny,color=blue"]}`,
+		`nope`,
+	} {
+		if rr := do("PUT", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s got HTTP %d, want 400", body, rr.Code)
+		}
+	}
+	if filters, _ := s.ClientFilters(); len(filters) != 1 {
+		t.Errorf("invalid requests changed the filters to %v", filters)
+	}
+	if rr := do("PATCH", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PATCH got HTTP %d, want 405", rr.Code)
+	}
+
+	rr = do("DELETE", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("removing filters got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	if filters, defaultDeny := s.ClientFilters(); len(filters) != 0 || defaultDeny {
+		t.Errorf("got filters %v, %v after removing them", filters, defaultDeny)
+	}
+}
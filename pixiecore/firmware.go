@@ -0,0 +1,272 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// architectureNames are the names accepted for Architecture values.
+var architectureNames = map[string]Architecture{
+	"ia32": ArchIA32,
+	"x64":  ArchX64,
+}
+
+// A FirmwareRule classifies the machines it matches into a firmware
+// type, and optionally an architecture. Empty fields match everything,
+// so a rule matches a machine if all of its non-empty fields do.
+//
+// Rules are evaluated in order. The first matching rule gives the
+// firmware type, the first matching rule that has an Architecture
+// gives the architecture.
+type FirmwareRule struct {
+	// Archs match machines whose client system architecture (DHCP
+	// option 93) is one of these codes.
+	Archs []uint16
+	// UserClass matches machines whose user class (DHCP option 77)
+	// is this string.
+	UserClass string
+	// VendorClass matches machines whose vendor class identifier
+	// (DHCP option 60) starts with this string.
+	VendorClass string
+	// MACPrefix matches machines whose MAC address starts with
+	// these bytes: a full MAC address, or an OUI.
+	MACPrefix []byte
+	// Protocol matches requests received on the DHCP port ("dhcp")
+	// or on the PXE port ("pxe").
+	Protocol string
+
+	// Firmware is the firmware type of the matching machines.
+	Firmware Firmware
+	// Architecture, if not nil, is the architecture of the matching
+	// machines reported to Booters. If nil, it is left to the
+	// following rules.
+	Architecture *Architecture
+}
+
+// pixiecoreIpxeRule identifies the iPXE that we chainloaded, so we
+// don't loop on the chainload step. It is evaluated before all other
+// rules, so that no FirmwareRule can break chainloading.
+var pixiecoreIpxeRule = FirmwareRule{UserClass: "pixiecore", Protocol: "dhcp", Firmware: FirmwarePixiecoreIpxe}
+
+// DefaultFirmwareRules classify the standard PXE client system
+// architectures, and the quirks of iPXE clients. Server.FirmwareRules
+// are evaluated before them.
+//
+// see: https://ipxe.org/cfg/platform for reference
+var DefaultFirmwareRules = []FirmwareRule{
+	// iPXE burned into the ROM, or used by a VM as its PXE "ROM".
+	// It uses its native drivers, so chainloading to a UNDI stack
+	// won't work.
+	{Archs: []uint16{0}, UserClass: "iPXE", Protocol: "dhcp", Firmware: FirmwareX86Ipxe},
+	// Legacy BIOS machines only ask the PXE port after booting
+	// through the PXE menu.
+	{Archs: []uint16{0}, Protocol: "pxe", Firmware: FirmwareX86Ipxe},
+	{Archs: []uint16{0}, Firmware: FirmwareX86PC, Architecture: architecture(ArchIA32)},
+	{Archs: []uint16{6}, Firmware: FirmwareEFI32, Architecture: architecture(ArchIA32)},
+	{Archs: []uint16{7, 16}, Firmware: FirmwareEFI64, Architecture: architecture(ArchX64)},
+	{Archs: []uint16{9}, Firmware: FirmwareEFIBC, Architecture: architecture(ArchX64)},
+}
+
+func architecture(a Architecture) *Architecture {
+	return &a
+}
+
+// firmwareClient is what the firmware classification knows about a
+// machine. arch is a single code of its option 93 list.
+type firmwareClient struct {
+	mac         net.HardwareAddr
+	arch        uint16
+	userClass   string
+	vendorClass string
+	protocol    string
+}
+
+func newFirmwareClients(pkt *dhcp4.Packet, archs []uint16, protocol string) []firmwareClient {
+	userClass, _ := pkt.Options.String(dhcp4.OptUserClass)
+	vendorClass, _ := pkt.Options.String(dhcp4.OptVendorIdentifier)
+	ret := make([]firmwareClient, 0, len(archs))
+	for _, arch := range archs {
+		ret = append(ret, firmwareClient{
+			mac:         pkt.MachineAddr(),
+			arch:        arch,
+			userClass:   userClass,
+			vendorClass: vendorClass,
+			protocol:    protocol,
+		})
+	}
+	return ret
+}
+
+func (r FirmwareRule) matches(c firmwareClient) bool {
+	if len(r.Archs) > 0 && !containsArch(r.Archs, c.arch) {
+		return false
+	}
+	if r.UserClass != "" && r.UserClass != c.userClass {
+		return false
+	}
+	if !strings.HasPrefix(c.vendorClass, r.VendorClass) {
+		return false
+	}
+	if !bytes.HasPrefix(c.mac, r.MACPrefix) {
+		return false
+	}
+	if r.Protocol != "" && r.Protocol != c.protocol {
+		return false
+	}
+	return true
+}
+
+func containsArch(archs []uint16, arch uint16) bool {
+	for _, a := range archs {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyFirmware returns the architecture and firmware type of c, or
+// false if no rules give both.
+func classifyFirmware(rules []FirmwareRule, c firmwareClient) (arch Architecture, fwtype Firmware, ok bool) {
+	var haveFirmware bool
+	for _, r := range rules {
+		if !r.matches(c) {
+			continue
+		}
+		if !haveFirmware {
+			fwtype, haveFirmware = r.Firmware, true
+		}
+		if r.Architecture != nil {
+			return *r.Architecture, fwtype, true
+		}
+	}
+	return 0, 0, false
+}
+
+// firmwareRules returns the FirmwareRules in use. Callers must not
+// modify them.
+func (s *Server) firmwareRules() []FirmwareRule {
+	if rules := s.firmware.Load(); rules != nil {
+		return *rules
+	}
+	return s.FirmwareRules
+}
+
+// classify returns the architecture and firmware type of the machine
+// that sent pkt on the DHCP or PXE port, as given by protocol. Of the
+// architectures the machine lists in option 93, in its order of
+// preference, it picks the first one whose firmware type has an iPXE
+// binary, or else the first one that the rules know at all.
+func (s *Server) classify(pkt *dhcp4.Packet, protocol string) (Architecture, Firmware, error) {
+	info, err := pkt.Options.PXEClientInfo()
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid PXE request: %w", err)
+	}
+
+	rules := append([]FirmwareRule{pixiecoreIpxeRule}, s.firmwareRules()...)
+	rules = append(rules, DefaultFirmwareRules...)
+	ipxe := s.ipxeConfig().Ipxe
+	var (
+		retArch Architecture
+		retFw   Firmware
+		found   bool
+	)
+	for _, c := range newFirmwareClients(pkt, info.Archs, protocol) {
+		arch, fwtype, ok := classifyFirmware(rules, c)
+		if !ok {
+			continue
+		}
+		if ipxe[fwtype] != nil {
+			return arch, fwtype, nil
+		}
+		if !found {
+			retArch, retFw, found = arch, fwtype, true
+		}
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("unsupported client firmware types %v (please file a bug!)", info.Archs)
+	}
+	return retArch, retFw, nil
+}
+
+// ParseFirmwareRule parses a rule of comma-separated key=value pairs,
+// for example "arch=11,architecture=x64,firmware=efi64". The keys are
+// arch (an option 93 code, may be repeated), user-class, vendor, mac
+// (a MAC address or prefix), oui (an alias of mac), protocol (dhcp or
+// pxe), architecture (ia32 or x64) and firmware (a name or number),
+// which is required.
+func ParseFirmwareRule(s string) (FirmwareRule, error) {
+	var (
+		ret         FirmwareRule
+		hasFirmware bool
+	)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || v == "" {
+			return ret, fmt.Errorf("invalid firmware rule element %q, want key=value", kv)
+		}
+		switch k {
+		case "arch":
+			arch, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return ret, fmt.Errorf("invalid client system architecture %q", v)
+			}
+			ret.Archs = append(ret.Archs, uint16(arch))
+		case "user-class":
+			ret.UserClass = v
+		case "vendor":
+			ret.VendorClass = v
+		case "mac", "oui":
+			bs, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(v))
+			if err != nil || len(bs) == 0 {
+				return ret, fmt.Errorf("invalid MAC address prefix %q", v)
+			}
+			ret.MACPrefix = bs
+		case "protocol":
+			if v != "dhcp" && v != "pxe" {
+				return ret, fmt.Errorf("invalid protocol %q, want dhcp or pxe", v)
+			}
+			ret.Protocol = v
+		case "architecture":
+			arch, ok := architectureNames[v]
+			if !ok {
+				return ret, fmt.Errorf("unknown architecture %q", v)
+			}
+			ret.Architecture = architecture(arch)
+		case "firmware":
+			fw, err := ParseFirmware(v)
+			if err != nil {
+				return ret, err
+			}
+			ret.Firmware = fw
+			hasFirmware = true
+		default:
+			return ret, fmt.Errorf("unknown firmware rule key %q", k)
+		}
+	}
+	if !hasFirmware {
+		return ret, errors.New("firmware rule has no firmware")
+	}
+	return ret, nil
+}
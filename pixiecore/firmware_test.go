@@ -0,0 +1,124 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestParseFirmwareRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want FirmwareRule
+		err  bool
+	}{
+		{
+			in:   "arch=11,arch=12,architecture=x64,firmware=efi64",
+			want: FirmwareRule{Archs: []uint16{11, 12}, Firmware: FirmwareEFI64, Architecture: architecture(ArchX64)},
+		},
+		{
+			in:   "oui=00-1b-21,vendor=PXEClient:Arch:00000,user-class=iPXE,protocol=dhcp,firmware=ipxe",
+			want: FirmwareRule{MACPrefix: []byte{0, 0x1b, 0x21}, VendorClass: "PXEClient:Arch:00000", UserClass: "iPXE", Protocol: "dhcp", Firmware: FirmwareX86Ipxe},
+		},
+		{in: "arch=7", err: true},
+		{in: "arch=70000,firmware=efi64", err: true},
+		{in: "architecture=arm64,firmware=efi64", err: true},
+		{in: "protocol=http,firmware=efi64", err: true},
+		{in: "firmware=uefi", err: true},
+		{in: "color=blue,firmware=efi64", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseFirmwareRule(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseFirmwareRule(%q) = %+v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFirmwareRule(%q): %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseFirmwareRule(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	quirky := net.HardwareAddr{0x00, 0x1b, 0x21, 1, 2, 3}
+	other := net.HardwareAddr{0x52, 0x54, 0, 1, 2, 3}
+
+	pkt := func(mac net.HardwareAddr, archs []uint16, userClass string) *dhcp4.Packet {
+		p := &dhcp4.Packet{HardwareAddr: mac, Options: dhcp4.Options{}}
+		p.Options.SetUint16s(dhcp4.OptClientSystem, archs)
+		if userClass != "" {
+			p.Options.SetString(dhcp4.OptUserClass, userClass)
+		}
+		return p
+	}
+
+	tests := []struct {
+		pkt      *dhcp4.Packet
+		protocol string
+		arch     Architecture
+		fwtype   Firmware
+		err      bool
+	}{
+		// The default table.
+		{pkt(other, []uint16{0}, ""), "dhcp", ArchIA32, FirmwareX86PC, false},
+		{pkt(other, []uint16{0}, ""), "pxe", ArchIA32, FirmwareX86Ipxe, false},
+		{pkt(other, []uint16{0}, "iPXE"), "dhcp", ArchIA32, FirmwareX86Ipxe, false},
+		{pkt(other, []uint16{6}, ""), "pxe", ArchIA32, FirmwareEFI32, false},
+		{pkt(other, []uint16{7}, ""), "pxe", ArchX64, FirmwareEFI64, false},
+		{pkt(other, []uint16{16}, ""), "dhcp", ArchX64, FirmwareEFI64, false},
+		{pkt(other, []uint16{9}, "iPXE"), "dhcp", ArchX64, FirmwareEFIBC, false},
+		{pkt(other, []uint16{7}, "pixiecore"), "dhcp", ArchX64, FirmwarePixiecoreIpxe, false},
+		{pkt(other, []uint16{7}, "pixiecore"), "pxe", ArchX64, FirmwareEFI64, false},
+		{pkt(other, []uint16{12}, ""), "dhcp", 0, 0, true},
+		{pkt(other, []uint16{12}, "pixiecore"), "dhcp", 0, 0, true},
+		// The operator's rules.
+		{pkt(other, []uint16{11}, ""), "dhcp", ArchX64, FirmwareEFI64, false},
+		{pkt(quirky, []uint16{0}, ""), "dhcp", ArchX64, FirmwareEFIBC, false},
+		{pkt(quirky, []uint16{0}, ""), "pxe", ArchX64, FirmwareEFIBC, false},
+		// No rule breaks chainloading.
+		{pkt(quirky, []uint16{0}, "pixiecore"), "dhcp", ArchX64, FirmwarePixiecoreIpxe, false},
+	}
+
+	s := &Server{FirmwareRules: []FirmwareRule{
+		{Archs: []uint16{11}, Firmware: FirmwareEFI64, Architecture: architecture(ArchX64)},
+		{MACPrefix: []byte{0x00, 0x1b, 0x21}, Archs: []uint16{0}, Firmware: FirmwareEFIBC, Architecture: architecture(ArchX64)},
+	}}
+	for i, test := range tests {
+		arch, fwtype, err := s.classify(test.pkt, test.protocol)
+		if test.err {
+			if err == nil {
+				t.Errorf("test %d: classify = %s, %d, want error", i, arch, fwtype)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: classify: %s", i, err)
+			continue
+		}
+		if arch != test.arch || fwtype != test.fwtype {
+			t.Errorf("test %d: classify = %s, %d, want %s, %d", i, arch, fwtype, test.arch, test.fwtype)
+		}
+	}
+}
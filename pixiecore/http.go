@@ -20,20 +20,29 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
 )
 
-func serveHTTP(l net.Listener, handlers ...func(*http.ServeMux)) error {
+func newHTTPServer(handlers ...func(*http.ServeMux)) *http.Server {
 	mux := http.NewServeMux()
 	for _, h := range handlers {
 		h(mux)
 	}
-	if err := http.Serve(l, mux); err != nil { // nolint:gosec
+	return &http.Server{Handler: mux} // nolint:gosec
+}
+
+func serveHTTP(srv *http.Server, l net.Listener) error {
+	if err := srv.Serve(l); err != nil {
 		return fmt.Errorf("HTTP server shut down: %w", err)
 	}
 	return nil
@@ -61,7 +70,7 @@ func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mac, err := net.ParseMAC(macStr)
+	mac, err := dhcp4.ParseHardwareAddr(macStr)
 	if err != nil {
 		s.Log.Debug("Bad request, invalid MAC address", "url", r.URL, "remoteaddr", r.RemoteAddr, "mac", macStr, "error", err)
 		http.Error(w, "invalid MAC address", http.StatusBadRequest)
@@ -83,12 +92,18 @@ func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	iface, ok := s.httpInterface(w, r)
+	if !ok {
+		return
+	}
+
 	mach := Machine{
 		MAC:  mac,
 		Arch: arch,
+		IP:   remoteIP(r),
 	}
 	start := time.Now()
-	spec, err := s.Booter.BootSpec(mach)
+	spec, err := s.booterFor(iface).BootSpec(mach)
 	s.Log.Debug("Get bootspec for", "mac", mac, "duration", time.Since(start))
 	if err != nil {
 		s.Log.Info("Couldn't get a bootspec for", "mac", mac, "url", r.URL, "remoteaddr", r.RemoteAddr, "error", err)
@@ -103,7 +118,11 @@ func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	start = time.Now()
-	script, err := ipxeScript(mach, spec, r.Host)
+	query := ""
+	if iface != nil {
+		query = iface.query()
+	}
+	script, err := ipxeScript(mach, spec, r.Host, query)
 	s.Log.Debug("Construct ipxe script for", "mac", mac, "duration", time.Since(start))
 	if err != nil {
 		s.Log.Info("Failed to assemble ipxe script for", "mac", mac, "url", r.URL, "remoteaddr", r.RemoteAddr, "error", err)
@@ -125,9 +144,33 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
 	if name == "" {
 		s.Log.Debug("Bad request, missing filename", "url", r.URL, "remoteaddr", r.RemoteAddr)
 		http.Error(w, "missing filename", http.StatusBadRequest)
+		return
+	}
+
+	// The MAC is optional, but IDs that are bound to a machine can
+	// only be fetched with it, and from the machine's address.
+	mach := Machine{IP: remoteIP(r)}
+	if macStr := r.URL.Query().Get("mac"); macStr != "" {
+		mac, err := dhcp4.ParseHardwareAddr(macStr)
+		if err != nil {
+			s.Log.Debug("Bad request, invalid MAC address", "url", r.URL, "remoteaddr", r.RemoteAddr, "mac", macStr, "error", err)
+			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+			return
+		}
+		mach.MAC = mac
 	}
 
-	f, sz, err := s.Booter.ReadBootFile(ID(name))
+	iface, ok := s.httpInterface(w, r)
+	if !ok {
+		return
+	}
+
+	f, sz, err := readMachineBootFile(s.booterFor(iface), mach, ID(name))
+	if errors.Is(err, errIDExpired) || errors.Is(err, errIDWrongMachine) {
+		s.Log.Info("Refusing file", "name", name, "url", r.URL, "remoteaddr", r.RemoteAddr, "error", err)
+		http.Error(w, "file ID not valid for this request", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		s.Log.Info("Error getting file", "name", name, "url", r.URL, "remoteaddr", r.RemoteAddr, "error", err)
 		http.Error(w, "couldn't get file", http.StatusInternalServerError)
@@ -136,35 +179,81 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		_ = f.Close()
 	}()
-	if sz >= 0 {
-		w.Header().Set("Content-Length", strconv.FormatInt(sz, 10))
+
+	// Only valid IDs take a download slot, so that garbage or expired
+	// IDs can't push real downloads out of the queue.
+	if s.files != nil && r.Method != http.MethodHead {
+		release, err := s.files.acquire(r.Context())
+		if err != nil {
+			s.Log.Info("Deferring file download", "name", name, "remoteaddr", r.RemoteAddr, "error", err)
+			retryAfter := int(math.Ceil(s.files.limits.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "too many downloads in progress, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		var done func()
+		w, done = s.files.writer(r.Context(), w, client)
+		defer done()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if bf, ok := f.(BootFile); ok && sz >= 0 {
+		// ServeContent takes care of HEAD, Range, If-Range and the
+		// other conditional request headers.
+		if etag := bf.ETag(); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "", bf.ModTime(), bf)
 	} else {
-		s.Log.Info("Unknown file size, boot will be VERY slow (can your Booter provide file sizes?)", "name", name)
+		if sz >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(sz, 10))
+		} else {
+			s.Log.Info("Unknown file size, boot will be VERY slow (can your Booter provide file sizes?)", "name", name)
+		}
+		if r.Method != http.MethodHead {
+			if _, err = io.Copy(w, f); err != nil {
+				s.Log.Info("Copy failed", "name", name, "remoteaddr", r.RemoteAddr, "url", r.URL, "error", err)
+				return
+			}
+		}
+	}
+	if r.Method == http.MethodHead {
+		return
 	}
-	if _, err = io.Copy(w, f); err != nil {
-		s.Log.Info("Copy failed", "name", name, "remoteaddr", r.RemoteAddr, "url", r.URL, "error", err)
+	s.Log.Info("Sent file", "name", name, "remoteaddr", r.RemoteAddr, "range", r.Header.Get("Range"))
+	if !fullOrFirstRange(w.Header().Get("Content-Range")) {
 		return
 	}
-	s.Log.Info("Sent file", "name", name, "remoteaddr", r.RemoteAddr)
 
 	switch r.URL.Query().Get("type") {
 	case "kernel":
-		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
-		if err != nil {
-			s.Log.Info("File fetch provided invalid MAC address", "mac", r.URL.Query().Get("mac"))
+		if mach.MAC == nil {
+			s.Log.Info("File fetch provided no MAC address", "name", name)
 			return
 		}
-		s.machineEvent(mac, machineStateKernel, "Sent kernel %q", name)
+		s.machineEvent(mach.MAC, machineStateKernel, "Sent kernel %q", name)
 	case "initrd":
-		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
-		if err != nil {
-			s.Log.Info("File fetch provided invalid MAC address", "mac", r.URL.Query().Get("mac"))
+		if mach.MAC == nil {
+			s.Log.Info("File fetch provided no MAC address", "name", name)
 			return
 		}
-		s.machineEvent(mac, machineStateInitrd, "Sent initrd %q", name)
+		s.machineEvent(mach.MAC, machineStateInitrd, "Sent initrd %q", name)
 	}
 }
 
+// fullOrFirstRange returns whether a response with the Content-Range
+// header rng sent a whole file or its start, so that a download that
+// is resumed or split into ranges only counts once.
+func fullOrFirstRange(rng string) bool {
+	return rng == "" || strings.HasPrefix(rng, "bytes 0-")
+}
+
 func (s *Server) handleBooting(w http.ResponseWriter, r *http.Request) {
 	// Return a no-op boot script, to satisfy iPXE. It won't get used,
 	// the boot script deletes this image immediately after
@@ -176,7 +265,7 @@ func (s *Server) handleBooting(w http.ResponseWriter, r *http.Request) {
 		s.Log.Debug("Bad request, missing MAC address", "url", r.URL, "remoteaddr", r.RemoteAddr)
 		return
 	}
-	mac, err := net.ParseMAC(macStr)
+	mac, err := dhcp4.ParseHardwareAddr(macStr)
 	if err != nil {
 		s.Log.Debug("Bad request, invalid MAC address", "url", r.URL, "remoteaddr", r.RemoteAddr, "mac", macStr, "error", err)
 		return
@@ -184,7 +273,53 @@ func (s *Server) handleBooting(w http.ResponseWriter, r *http.Request) {
 	s.machineEvent(mac, machineStateBooted, "Booting into OS")
 }
 
-func ipxeScript(mach Machine, spec *Spec, serverHost string) ([]byte, error) {
+// remoteIP returns the address that r came from, or nil if it can't be
+// told.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// httpInterface returns the Interface that serves the connection of
+// r, or nil if none does. The request's "intf" parameter, which
+// machines get from their DHCP offer, only picks among the Interfaces
+// that serve the connection, for those that are told apart by relay
+// agent information. If it names another Interface, it answers the
+// request and returns false.
+func (s *Server) httpInterface(w http.ResponseWriter, r *http.Request) (*Interface, bool) {
+	var local net.IP
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		local = addr.IP
+	}
+	ifaces := s.connInterfaces(remoteIP(r), local)
+
+	name := r.URL.Query().Get("intf")
+	if name == "" {
+		if len(ifaces) == 0 {
+			return nil, true
+		}
+		return ifaces[0], true
+	}
+	iface, err := s.interfaceByName(name)
+	if err != nil {
+		s.Log.Debug("Bad request, unknown interface", "url", r.URL, "remoteaddr", r.RemoteAddr, "error", err)
+		http.Error(w, "unknown interface", http.StatusBadRequest)
+		return nil, false
+	}
+	if !slices.Contains(ifaces, iface) {
+		s.Log.Info("Refusing request for an interface that doesn't serve the client", "url", r.URL, "remoteaddr", r.RemoteAddr, "interface", name)
+		http.Error(w, "interface doesn't serve this client", http.StatusForbidden)
+		return nil, false
+	}
+	return iface, true
+}
+
+// ipxeScript returns the boot script for mach. query is appended to the
+// URLs of the files the script fetches.
+func ipxeScript(mach Machine, spec *Spec, serverHost, query string) ([]byte, error) {
 	if spec.IpxeScript != "" {
 		return []byte(spec.IpxeScript), nil
 	}
@@ -197,10 +332,10 @@ func ipxeScript(mach Machine, spec *Spec, serverHost string) ([]byte, error) {
 	var b bytes.Buffer
 	b.WriteString("#!ipxe\n")
 	b.WriteString("isset ${console} || set console ttyS1\n")
-	u := fmt.Sprintf(urlTemplate, url.QueryEscape(string(spec.Kernel)), "kernel", url.QueryEscape(mach.MAC.String()))
+	u := fmt.Sprintf(urlTemplate, url.QueryEscape(string(spec.Kernel)), "kernel", url.QueryEscape(mach.MAC.String())) + query
 	fmt.Fprintf(&b, "kernel --name kernel %s\n", u)
 	for i, initrd := range spec.Initrd {
-		u = fmt.Sprintf(urlTemplate, url.QueryEscape(string(initrd)), "initrd", url.QueryEscape(mach.MAC.String()))
+		u = fmt.Sprintf(urlTemplate, url.QueryEscape(string(initrd)), "initrd", url.QueryEscape(mach.MAC.String())) + query
 		fmt.Fprintf(&b, "initrd --name initrd%d %s\n", i, u)
 	}
 
@@ -213,7 +348,7 @@ func ipxeScript(mach Machine, spec *Spec, serverHost string) ([]byte, error) {
 	}
 
 	f := func(id string) string {
-		return fmt.Sprintf("http://%s/_/file?name=%s", serverHost, url.QueryEscape(id))
+		return fmt.Sprintf("http://%s/_/file?name=%s&mac=%s%s", serverHost, url.QueryEscape(id), url.QueryEscape(mach.MAC.String()), query)
 	}
 	cmdline, err := expandCmdline(spec.Cmdline, template.FuncMap{"ID": f})
 	if err != nil {
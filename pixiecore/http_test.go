@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type booterFunc func(Machine) (*Spec, error)
@@ -72,7 +73,7 @@ initrd --name initrd0 http://localhost:1234/_/file?name=i1-01%3A02%3A03%3A04%3A0
 initrd --name initrd1 http://localhost:1234/_/file?name=i2-01%3A02%3A03%3A04%3A05%3A06-0&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
 imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
 imgfree ready ||
-boot kernel initrd=initrd0 initrd=initrd1 console=${console},115200n8 thing=http://localhost:1234/_/file?name=f-01%3A02%3A03%3A04%3A05%3A06-0 foo=bar
+boot kernel initrd=initrd0 initrd=initrd1 console=${console},115200n8 thing=http://localhost:1234/_/file?name=f-01%3A02%3A03%3A04%3A05%3A06-0&mac=01%3A02%3A03%3A04%3A05%3A06 foo=bar
 `
 	if rr.Body.String() != expected {
 		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
@@ -98,7 +99,7 @@ initrd --name initrd0 http://localhost:1234/_/file?name=i1-fe%3Afe%3Afe%3Afe%3Af
 initrd --name initrd1 http://localhost:1234/_/file?name=i2-fe%3Afe%3Afe%3Afe%3Afe%3Afe-1&type=initrd&mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe
 imgfetch --name ready http://localhost:1234/_/booting?mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe ||
 imgfree ready ||
-boot kernel initrd=initrd0 initrd=initrd1 console=${console},115200n8 thing=http://localhost:1234/_/file?name=f-fe%3Afe%3Afe%3Afe%3Afe%3Afe-1 foo=bar
+boot kernel initrd=initrd0 initrd=initrd1 console=${console},115200n8 thing=http://localhost:1234/_/file?name=f-fe%3Afe%3Afe%3Afe%3Afe%3Afe-1&mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe foo=bar
 `
 	if rr.Body.String() != expected {
 		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
@@ -197,3 +198,100 @@ func TestFile(t *testing.T) {
 		t.Fatalf("Wrong file contents, want %q, got %q", expected, rr.Body.Bytes())
 	}
 }
+
+type seekableFile struct {
+	*bytes.Reader
+}
+
+func (f seekableFile) Close() error       { return nil }
+func (f seekableFile) ModTime() time.Time { return time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC) }
+func (f seekableFile) ETag() string       { return `"v1"` }
+
+type seekableBootFile string
+
+func (b seekableBootFile) BootSpec(m Machine) (*Spec, error) { return nil, nil }
+func (b seekableBootFile) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	return seekableFile{bytes.NewReader([]byte(b))}, int64(len(b)), nil
+}
+func (b seekableBootFile) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
+
+func TestFileRanges(t *testing.T) {
+	s := &Server{
+		Booter: seekableBootFile("0123456789"),
+		Log:    slog.Default(),
+	}
+
+	for _, tc := range []struct {
+		method  string
+		headers map[string]string
+		code    int
+		body    string
+	}{
+		{"GET", nil, 200, "0123456789"},
+		{"HEAD", nil, 200, ""},
+		{"GET", map[string]string{"Range": "bytes=4-"}, 206, "456789"},
+		{"GET", map[string]string{"Range": "bytes=2-3"}, 206, "23"},
+		{"GET", map[string]string{"Range": "bytes=20-"}, 416, ""},
+		{"GET", map[string]string{"Range": "bytes=4-", "If-Range": `"v1"`}, 206, "456789"},
+		{"GET", map[string]string{"Range": "bytes=4-", "If-Range": `"v0"`}, 200, "0123456789"},
+		{"GET", map[string]string{"If-None-Match": `"v1"`}, 304, ""},
+		{"GET", map[string]string{"If-Modified-Since": "Sat, 02 Jan 2016 00:00:00 GMT"}, 304, ""},
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequestWithContext(context.Background(), tc.method, "/_/file?name=test", nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		s.handleFile(rr, req)
+
+		if rr.Code != tc.code {
+			t.Fatalf("%s %v: got HTTP %d, expected %d", tc.method, tc.headers, rr.Code, tc.code)
+		}
+		if tc.code != 416 && rr.Body.String() != tc.body {
+			t.Fatalf("%s %v: wrong file contents, want %q, got %q", tc.method, tc.headers, tc.body, rr.Body.String())
+		}
+		if tc.code == 200 && rr.Header().Get("Content-Length") != "10" {
+			t.Fatalf("%s %v: wrong Content-Length %q", tc.method, tc.headers, rr.Header().Get("Content-Length"))
+		}
+		if tc.code != 416 && rr.Header().Get("ETag") != `"v1"` {
+			t.Fatalf("%s %v: wrong ETag %q", tc.method, tc.headers, rr.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestFileRangeEvents(t *testing.T) {
+	s := &Server{
+		Booter: seekableBootFile("0123456789"),
+		Log:    slog.Default(),
+		events: make(map[string][]machineEvent),
+	}
+	mac := "01:02:03:04:05:06"
+
+	for _, tc := range []struct {
+		method string
+		rng    string
+		event  bool
+	}{
+		{"GET", "", true},
+		{"HEAD", "", false},
+		{"GET", "bytes=0-3", true},
+		{"GET", "bytes=4-", false},
+		{"GET", "bytes=-2", false},
+	} {
+		req, err := http.NewRequestWithContext(context.Background(), tc.method, "/_/file?name=test&type=kernel&mac="+mac, nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		before := len(s.events[mac])
+		s.handleFile(httptest.NewRecorder(), req)
+		if got := len(s.events[mac]) > before; got != tc.event {
+			t.Errorf("%s %q: got kernel event %v, want %v", tc.method, tc.rng, got, tc.event)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// An Interface is a provisioning network that a Server boots machines
+// on, with its own boot policy.
+type Interface struct {
+	// Name identifies the Interface in metrics and logs. Unless
+	// Subnets is set, it is also the name of the network interface
+	// that is served, e.g. "vlan100".
+	Name string
+	// Subnets, if set, select the requests that are served by their
+	// address instead of by interface name: relayed requests whose
+	// relay address is in one of Subnets, and requests received on a
+	// network interface that has an address in one of Subnets.
+	Subnets []*net.IPNet
+	// CircuitIDs and RemoteIDs, if set, restrict the Interface to
+	// requests whose relay agent information (DHCP option 82) has a
+	// circuit-id, respectively remote-id, matching one of the
+	// patterns, for example to serve the ports of one leaf switch.
+	// Patterns are in the syntax of path.Match.
+	CircuitIDs []string
+	RemoteIDs  []string
+
+	// Booter, if set, is used instead of Server.Booter for the
+	// machines on this Interface.
+	Booter Booter
+	// Partition is the partition the machines on this Interface
+	// belong to. The Server doesn't use it, it's for building the
+	// Interface's Booter.
+	Partition string
+	// AdvertiseIP, if set, is the address handed to booting machines
+	// to reach the Server, instead of the address of the network
+	// interface the request arrived on.
+	AdvertiseIP net.IP
+	// Firmwares, if set, are the only firmware types booted on this
+	// Interface.
+	Firmwares []Firmware
+
+	// implicit is set for the Interface made up for a request when
+	// the Server has no Interfaces configured.
+	implicit bool
+}
+
+// ParseInterface parses an Interface of comma-separated key=value
+// pairs, for example "name=vlan100,advertise=10.1.0.1,firmware=efi64".
+// The keys are name, which is required, subnet (a CIDR, may be
+// repeated), circuit-id and remote-id (patterns, may be repeated),
+// advertise (an IPv4 address), firmware (a name or number, may be
+// repeated) and partition.
+func ParseInterface(s string) (Interface, error) {
+	var ret Interface
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || v == "" {
+			return ret, fmt.Errorf("invalid interface element %q, want key=value", kv)
+		}
+		switch k {
+		case "name":
+			ret.Name = v
+		case "subnet":
+			_, subnet, err := net.ParseCIDR(v)
+			if err != nil {
+				return ret, fmt.Errorf("invalid subnet %q: %w", v, err)
+			}
+			ret.Subnets = append(ret.Subnets, subnet)
+		case "circuit-id", "remote-id":
+			if _, err := path.Match(v, ""); err != nil {
+				return ret, fmt.Errorf("invalid %s pattern %q: %w", k, v, err)
+			}
+			if k == "circuit-id" {
+				ret.CircuitIDs = append(ret.CircuitIDs, v)
+			} else {
+				ret.RemoteIDs = append(ret.RemoteIDs, v)
+			}
+		case "advertise":
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return ret, fmt.Errorf("invalid IPv4 address %q", v)
+			}
+			ret.AdvertiseIP = ip
+		case "firmware":
+			fw, err := ParseFirmware(v)
+			if err != nil {
+				return ret, err
+			}
+			ret.Firmwares = append(ret.Firmwares, fw)
+		case "partition":
+			ret.Partition = v
+		default:
+			return ret, fmt.Errorf("unknown interface key %q", k)
+		}
+	}
+	if ret.Name == "" {
+		return ret, errors.New("interface has no name")
+	}
+	return ret, nil
+}
+
+// servesFirmware returns whether machines with fwtype are booted on i.
+func (i *Interface) servesFirmware(fwtype Firmware) bool {
+	// Machines running our iPXE have already been allowed to boot.
+	if len(i.Firmwares) == 0 || fwtype == FirmwarePixiecoreIpxe {
+		return true
+	}
+	return slices.Contains(i.Firmwares, fwtype)
+}
+
+// containsAny returns whether one of ips is in one of i's Subnets.
+func (i *Interface) containsAny(ips ...net.IP) bool {
+	for _, subnet := range i.Subnets {
+		for _, ip := range ips {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesAgent returns whether a request with the relay agent
+// information agent, which may be nil, is served by i.
+func (i *Interface) matchesAgent(agent *dhcp4.RelayAgentInfo) bool {
+	if len(i.CircuitIDs) == 0 && len(i.RemoteIDs) == 0 {
+		return true
+	}
+	if agent == nil {
+		return false
+	}
+	return matchesAny(i.CircuitIDs, agent.CircuitID) && matchesAny(i.RemoteIDs, agent.RemoteID)
+}
+
+// matchesAny returns whether id matches one of patterns, or patterns
+// is empty.
+func matchesAny(patterns []string, id []byte) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, string(id)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// query returns the URL query parameter that leads HTTP requests of
+// machines booting on i back to i.
+func (i *Interface) query() string {
+	if i.implicit {
+		return ""
+	}
+	return "&intf=" + url.QueryEscape(i.Name)
+}
+
+// validateInterfaces checks that the configured Interfaces can be told
+// apart.
+func (s *Server) validateInterfaces() error {
+	if len(s.Interfaces) == 0 {
+		return nil
+	}
+	if s.Address != "" && !net.ParseIP(s.Address).Equal(net.IPv4zero) {
+		return errors.New("can't serve Interfaces when listening on a single address")
+	}
+	names := map[string]bool{}
+	for _, i := range s.Interfaces {
+		if i.Name == "" {
+			return errors.New("interface without a name")
+		}
+		if names[i.Name] {
+			return fmt.Errorf("duplicate interface %q", i.Name)
+		}
+		names[i.Name] = true
+	}
+	return nil
+}
+
+// packetInterface returns the Interface that serves pkt, received on
+// intf.
+func (s *Server) packetInterface(intf *net.Interface, pkt *dhcp4.Packet) (*Interface, error) {
+	agent, err := pkt.Options.RelayAgentInfo()
+	if err != nil && pkt.Options[dhcp4.OptAgentInformation] != nil {
+		s.Log.Debug("Ignoring malformed relay agent information", "mac", pkt.MachineAddr().String(), "error", err)
+	}
+	return s.interfaceFor(intf, clientLink(pkt, agent), agent)
+}
+
+// interfaceFor returns the Interface that serves a request received on
+// intf, relayed by relay if it isn't nil or 0.0.0.0, with the relay
+// agent information agent, which may be nil.
+//
+// If the Server has no Interfaces configured, all requests are served
+// with the default policy.
+func (s *Server) interfaceFor(intf *net.Interface, relay net.IP, agent *dhcp4.RelayAgentInfo) (*Interface, error) {
+	if len(s.Interfaces) == 0 {
+		return &Interface{Name: intf.Name, implicit: true}, nil
+	}
+
+	if relay != nil && !relay.Equal(net.IPv4zero) {
+		for i := range s.Interfaces {
+			if s.Interfaces[i].containsAny(relay) && s.Interfaces[i].matchesAgent(agent) {
+				return &s.Interfaces[i], nil
+			}
+		}
+		return nil, fmt.Errorf("relay address %s is not in a provisioning subnet", relay)
+	}
+
+	for i := range s.Interfaces {
+		if len(s.Interfaces[i].Subnets) == 0 && s.Interfaces[i].Name == intf.Name && s.Interfaces[i].matchesAgent(agent) {
+			return &s.Interfaces[i], nil
+		}
+	}
+	var addrs []net.IP
+	if as, err := intf.Addrs(); err == nil {
+		for _, a := range as {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				addrs = append(addrs, ipnet.IP)
+			}
+		}
+	}
+	for i := range s.Interfaces {
+		if s.Interfaces[i].containsAny(addrs...) && s.Interfaces[i].matchesAgent(agent) {
+			return &s.Interfaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s is not a provisioning interface", intf.Name)
+}
+
+// interfaceForLocalIP returns the Interface of the network interface
+// that has ip, or nil if none.
+func (s *Server) interfaceForLocalIP(ip net.IP) *Interface {
+	if len(s.Interfaces) == 0 || ip == nil {
+		return nil
+	}
+	intf, ok := s.localAddrs.lookup(ip)
+	if !ok {
+		return nil
+	}
+	iface, err := s.interfaceFor(&intf, nil, nil)
+	if err != nil {
+		return nil
+	}
+	return iface
+}
+
+// localAddrsTTL is how long the network interfaces of local addresses
+// are cached. Reload forgets them right away.
+const localAddrsTTL = 30 * time.Second
+
+// localAddrCache caches the network interface of each local address,
+// so that HTTP and TFTP requests don't list the host's interfaces.
+type localAddrCache struct {
+	mu      sync.Mutex
+	intfs   map[string]net.Interface
+	fetched time.Time
+}
+
+// lookup returns the network interface that has ip, refreshing the
+// cache if it is older than localAddrsTTL.
+func (c *localAddrCache) lookup(ip net.IP) (net.Interface, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.intfs == nil || time.Since(c.fetched) > localAddrsTTL {
+		c.refresh()
+	}
+	intf, ok := c.intfs[ip.String()]
+	return intf, ok
+}
+
+// refresh re-reads the local addresses. If that fails, the previous
+// ones stay in use. c.mu must be held.
+func (c *localAddrCache) refresh() {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	byIP := map[string]net.Interface{}
+	for _, intf := range intfs {
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				byIP[ipnet.IP.String()] = intf
+			}
+		}
+	}
+	c.intfs, c.fetched = byIP, time.Now()
+}
+
+// forget drops the cached addresses, so that the next lookup re-reads
+// them.
+func (c *localAddrCache) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.intfs = nil
+}
+
+// connInterfaces returns the Interfaces that serve a connection from
+// remote to local, either of which may be nil. Relayed clients are
+// told by their own address, the others by the local address they
+// connected to.
+func (s *Server) connInterfaces(remote, local net.IP) []*Interface {
+	var ret []*Interface
+	if remote != nil {
+		for i := range s.Interfaces {
+			if s.Interfaces[i].containsAny(remote) {
+				ret = append(ret, &s.Interfaces[i])
+			}
+		}
+	}
+	if iface := s.interfaceForLocalIP(local); iface != nil && !slices.Contains(ret, iface) {
+		ret = append(ret, iface)
+	}
+	return ret
+}
+
+// interfaceByName returns the configured Interface called name.
+func (s *Server) interfaceByName(name string) (*Interface, error) {
+	for i := range s.Interfaces {
+		if s.Interfaces[i].Name == name {
+			return &s.Interfaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown interface %q", name)
+}
+
+// booterFor returns the Booter for machines on iface, which may be nil
+// for the default Booter.
+func (s *Server) booterFor(iface *Interface) Booter {
+	if iface != nil && iface.Booter != nil {
+		return iface.Booter
+	}
+	return s.Booter
+}
+
+// advertiseIP returns the address that machines on iface, whose
+// request arrived on intf, use to reach the Server.
+func advertiseIP(iface *Interface, intf *net.Interface) (net.IP, error) {
+	if iface.AdvertiseIP != nil {
+		return iface.AdvertiseIP, nil
+	}
+	return interfaceIP(intf)
+}
@@ -0,0 +1,316 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestParseInterface(t *testing.T) {
+	iface, err := ParseInterface("name=vlan100, subnet=10.1.0.0/24,subnet=10.2.0.0/16,advertise=10.1.0.1,firmware=efi64,firmware=2,partition=fra-1")
+	if err != nil {
+		t.Fatalf("parsing interface: %s", err)
+	}
+	if iface.Name != "vlan100" {
+		t.Errorf("got name %q, want vlan100", iface.Name)
+	}
+	if len(iface.Subnets) != 2 || iface.Subnets[0].String() != "10.1.0.0/24" || iface.Subnets[1].String() != "10.2.0.0/16" {
+		t.Errorf("got subnets %v, want [10.1.0.0/24 10.2.0.0/16]", iface.Subnets)
+	}
+	if !iface.AdvertiseIP.Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("got advertised address %s, want 10.1.0.1", iface.AdvertiseIP)
+	}
+	if len(iface.Firmwares) != 2 || iface.Firmwares[0] != FirmwareEFI64 || iface.Firmwares[1] != FirmwareEFI64 {
+		t.Errorf("got firmwares %v, want [efi64 efi64]", iface.Firmwares)
+	}
+	if iface.Partition != "fra-1" {
+		t.Errorf("got partition %q, want fra-1", iface.Partition)
+	}
+
+	for _, bad := range []string{
+		"subnet=10.1.0.0/24",
+		"name=vlan100,subnet=10.1.0.1",
+		"name=vlan100,advertise=fe80::1",
+		"name=vlan100,firmware=arm",
+		"name=vlan100,speed=fast",
+		"name=vlan100,circuit-id=[swp",
+		"name=",
+	} {
+		if _, err := ParseInterface(bad); err == nil {
+			t.Errorf("ParseInterface(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestInterfaceForRelayAgent(t *testing.T) {
+	leaf1, err := ParseInterface("name=rack1,subnet=10.1.0.0/16,remote-id=leaf01,remote-id=leaf02,partition=p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf1Port1, err := ParseInterface("name=rack1-port1,subnet=10.1.0.0/16,remote-id=leaf01,circuit-id=swp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ParseInterface("name=other,subnet=10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Interfaces: []Interface{leaf1Port1, leaf1, other}}
+	relay := net.IPv4(10, 1, 0, 1)
+
+	for _, test := range []struct {
+		agent *dhcp4.RelayAgentInfo
+		want  string
+	}{
+		{nil, "other"},
+		{&dhcp4.RelayAgentInfo{RemoteID: []byte("leaf01"), CircuitID: []byte("swp1")}, "rack1-port1"},
+		{&dhcp4.RelayAgentInfo{RemoteID: []byte("leaf01"), CircuitID: []byte("swp2")}, "rack1"},
+		{&dhcp4.RelayAgentInfo{RemoteID: []byte("leaf02"), CircuitID: []byte("swp1")}, "rack1"},
+		{&dhcp4.RelayAgentInfo{RemoteID: []byte("leaf03")}, "other"},
+	} {
+		iface, err := s.interfaceFor(&net.Interface{Name: "eth0"}, relay, test.agent)
+		if err != nil {
+			t.Errorf("request with relay agent information %+v: %s", test.agent, err)
+			continue
+		}
+		if iface.Name != test.want {
+			t.Errorf("request with relay agent information %+v served by %q, want %q", test.agent, iface.Name, test.want)
+		}
+	}
+
+	// The link selection sub-option takes precedence over the relay
+	// address.
+	pkt := &dhcp4.Packet{
+		RelayAddr: net.IPv4(10, 9, 0, 1),
+		Options: dhcp4.Options{
+			dhcp4.OptAgentInformation: []byte{2, 6, 'l', 'e', 'a', 'f', '0', '1', 5, 4, 10, 1, 2, 0},
+		},
+	}
+	iface, err := s.packetInterface(&net.Interface{Name: "eth0"}, pkt)
+	if err != nil || iface.Name != "rack1" {
+		t.Errorf("request with link selection served by %v (%v), want rack1", iface, err)
+	}
+}
+
+func TestInterfaceFor(t *testing.T) {
+	lo := &net.Interface{Name: "lo"}
+	_, relayed, _ := net.ParseCIDR("10.1.0.0/24")
+	s := &Server{
+		Interfaces: []Interface{
+			{Name: "vlan100"},
+			{Name: "relayed", Subnets: []*net.IPNet{relayed}},
+			{Name: "lo"},
+		},
+	}
+
+	tests := []struct {
+		intf  *net.Interface
+		relay net.IP
+		want  string
+	}{
+		{&net.Interface{Name: "vlan100"}, nil, "vlan100"},
+		{&net.Interface{Name: "vlan100"}, net.IPv4zero, "vlan100"},
+		{lo, net.IPv4(10, 1, 0, 254), "relayed"},
+		{lo, nil, "lo"},
+		{&net.Interface{Name: "eth0"}, nil, ""},
+		{lo, net.IPv4(10, 9, 0, 254), ""},
+	}
+	for _, test := range tests {
+		iface, err := s.interfaceFor(test.intf, test.relay, nil)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("request on %s relayed by %s served by %q, want ignored", test.intf.Name, test.relay, iface.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("request on %s relayed by %s: %s", test.intf.Name, test.relay, err)
+			continue
+		}
+		if iface.Name != test.want {
+			t.Errorf("request on %s relayed by %s served by %q, want %q", test.intf.Name, test.relay, iface.Name, test.want)
+		}
+	}
+
+	s.Interfaces = nil
+	iface, err := s.interfaceFor(&net.Interface{Name: "eth0"}, nil, nil)
+	if err != nil {
+		t.Fatalf("request without Interfaces configured: %s", err)
+	}
+	if !iface.implicit || iface.Name != "eth0" || iface.query() != "" {
+		t.Errorf("got %+v for request without Interfaces configured, want implicit eth0", iface)
+	}
+}
+
+func TestInterfacePolicy(t *testing.T) {
+	booter := func(kernel ID) Booter {
+		return booterFunc(func(Machine) (*Spec, error) { return &Spec{Kernel: kernel}, nil })
+	}
+	s := &Server{
+		Booter: booter("default"),
+		Interfaces: []Interface{
+			{Name: "vlan 100", Booter: booter("vlan100"), Firmwares: []Firmware{FirmwareEFI64}},
+		},
+	}
+	iface, err := s.interfaceByName("vlan 100")
+	if err != nil {
+		t.Fatalf("looking up interface: %s", err)
+	}
+	for _, test := range []struct {
+		iface *Interface
+		want  ID
+	}{
+		{iface, "vlan100"},
+		{nil, "default"},
+		{&Interface{Name: "eth0", implicit: true}, "default"},
+	} {
+		spec, _ := s.booterFor(test.iface).BootSpec(Machine{})
+		if spec.Kernel != test.want {
+			t.Errorf("got kernel %q for interface %v, want %q", spec.Kernel, test.iface, test.want)
+		}
+	}
+	if _, err := s.interfaceByName("vlan200"); err == nil {
+		t.Error("unknown interface found")
+	}
+
+	if !iface.servesFirmware(FirmwareEFI64) || !iface.servesFirmware(FirmwarePixiecoreIpxe) {
+		t.Error("interface doesn't boot its firmware types")
+	}
+	if iface.servesFirmware(FirmwareX86PC) {
+		t.Error("interface boots BIOS machines")
+	}
+	if got, want := iface.query(), "&intf=vlan+100"; got != want {
+		t.Errorf("got query %q, want %q", got, want)
+	}
+
+	ip := net.IPv4(10, 1, 0, 1)
+	got, err := advertiseIP(&Interface{AdvertiseIP: ip}, &net.Interface{Name: "none"})
+	if err != nil || !got.Equal(ip) {
+		t.Errorf("got advertised address %s (%v), want %s", got, err, ip)
+	}
+
+	script, err := ipxeScript(Machine{MAC: net.HardwareAddr{1, 2, 3, 4, 5, 6}}, &Spec{Kernel: "k", Cmdline: `x={{ ID "f" }}`}, "localhost:1234", iface.query())
+	if err != nil {
+		t.Fatalf("assembling script: %s", err)
+	}
+	if n := strings.Count(string(script), "&intf=vlan+100"); n != 2 {
+		t.Errorf("interface is in %d URLs of script, want 2:\n%s", n, script)
+	}
+}
+
+func TestHTTPInterface(t *testing.T) {
+	_, vlan100, _ := net.ParseCIDR("10.1.0.0/24")
+	_, vlan200, _ := net.ParseCIDR("10.2.0.0/24")
+	s := &Server{
+		Log: slog.Default(),
+		Interfaces: []Interface{
+			{Name: "vlan100", Subnets: []*net.IPNet{vlan100}},
+			{Name: "leaf1", Subnets: []*net.IPNet{vlan100}, CircuitIDs: []string{"leaf1:*"}},
+			{Name: "vlan200", Subnets: []*net.IPNet{vlan200}},
+		},
+	}
+
+	for _, test := range []struct {
+		remoteAddr string
+		intf       string
+		want       string
+		code       int
+	}{
+		{"10.1.0.50:1234", "", "vlan100", http.StatusOK},
+		{"10.1.0.50:1234", "leaf1", "leaf1", http.StatusOK},
+		{"10.2.0.50:1234", "", "vlan200", http.StatusOK},
+		{"192.0.2.1:1234", "", "", http.StatusOK},
+		// The parameter can't move a machine to another network.
+		{"10.1.0.50:1234", "vlan200", "", http.StatusForbidden},
+		{"192.0.2.1:1234", "vlan100", "", http.StatusForbidden},
+		{"10.1.0.50:1234", "vlan300", "", http.StatusBadRequest},
+	} {
+		target := "/_/ipxe"
+		if test.intf != "" {
+			target += "?intf=" + test.intf
+		}
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = test.remoteAddr
+		rr := httptest.NewRecorder()
+		iface, ok := s.httpInterface(rr, req)
+		if ok != (test.code == http.StatusOK) || rr.Code != test.code {
+			t.Errorf("request from %s for %q: got %v, HTTP %d, want HTTP %d", test.remoteAddr, test.intf, ok, rr.Code, test.code)
+			continue
+		}
+		var got string
+		if iface != nil {
+			got = iface.Name
+		}
+		if got != test.want {
+			t.Errorf("request from %s for %q: got interface %q, want %q", test.remoteAddr, test.intf, got, test.want)
+		}
+	}
+}
+
+func TestLocalAddrCache(t *testing.T) {
+	var c localAddrCache
+	lo, ok := c.lookup(net.IPv4(127, 0, 0, 1))
+	if !ok || lo.Flags&net.FlagLoopback == 0 {
+		t.Fatalf("got %v, %v for 127.0.0.1, want the loopback interface", lo, ok)
+	}
+	if _, ok := c.lookup(net.IPv4(192, 0, 2, 1)); ok {
+		t.Errorf("got an interface for 192.0.2.1, which is not local")
+	}
+
+	// Lookups use the cached addresses until they are forgotten.
+	c.intfs["192.0.2.1"] = net.Interface{Name: "fake0"}
+	if intf, ok := c.lookup(net.IPv4(192, 0, 2, 1)); !ok || intf.Name != "fake0" {
+		t.Errorf("got %v, %v for 192.0.2.1, want the cached fake0", intf, ok)
+	}
+	c.forget()
+	if _, ok := c.lookup(net.IPv4(192, 0, 2, 1)); ok {
+		t.Errorf("got an interface for 192.0.2.1 after forgetting the cache")
+	}
+
+	// They are also re-read once they are too old.
+	c.intfs["192.0.2.1"] = net.Interface{Name: "fake0"}
+	c.fetched = time.Now().Add(-localAddrsTTL - time.Second)
+	if _, ok := c.lookup(net.IPv4(192, 0, 2, 1)); ok {
+		t.Errorf("got an interface for 192.0.2.1 from an expired cache")
+	}
+}
+
+func TestValidateInterfaces(t *testing.T) {
+	tests := []struct {
+		addr       string
+		interfaces []Interface
+		wantErr    bool
+	}{
+		{"", nil, false},
+		{"0.0.0.0", []Interface{{Name: "a"}, {Name: "b"}}, false},
+		{"10.0.0.1", []Interface{{Name: "a"}}, true},
+		{"", []Interface{{Name: "a"}, {Name: "a"}}, true},
+		{"", []Interface{{}}, true},
+	}
+	for i, test := range tests {
+		s := &Server{Address: test.addr, Interfaces: test.interfaces}
+		if err := s.validateInterfaces(); (err != nil) != test.wantErr {
+			t.Errorf("test %d: got error %v, want error: %v", i, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// firmwareNames are the names accepted for Firmware values, matching
+// the --ipxe-* flags.
+var firmwareNames = map[string]Firmware{
+	"bios":  FirmwareX86PC,
+	"efi32": FirmwareEFI32,
+	"efi64": FirmwareEFI64,
+	"efibc": FirmwareEFIBC,
+	"ipxe":  FirmwareX86Ipxe,
+}
+
+// ParseFirmware parses a firmware type given by name, e.g. "efi64", or
+// by number.
+func ParseFirmware(s string) (Firmware, error) {
+	if fw, ok := firmwareNames[s]; ok {
+		return fw, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown firmware type %q", s)
+	}
+	return Firmware(i), nil
+}
+
+// An IpxeRule selects a named iPXE binary from Server.IpxeBinaries for
+// the machines it matches. Empty fields match everything, so a rule
+// matches a machine if all of its non-empty fields do.
+type IpxeRule struct {
+	// MACPrefix matches machines whose MAC address starts with
+	// these bytes: a full MAC address, or an OUI.
+	MACPrefix []byte
+	// VendorClass matches machines whose vendor class identifier
+	// (DHCP option 60) starts with this string.
+	VendorClass string
+	// GUID matches the machine's UUID (DHCP option 97),
+	// case-insensitively.
+	GUID string
+	// Firmware matches machines detected as one of these firmware
+	// types.
+	Firmware []Firmware
+
+	// Binary is the name of the binary to serve.
+	Binary string
+}
+
+func (r IpxeRule) matches(c ipxeClient) bool {
+	if !bytes.HasPrefix(c.mac, r.MACPrefix) {
+		return false
+	}
+	if !strings.HasPrefix(c.vendorClass, r.VendorClass) {
+		return false
+	}
+	if r.GUID != "" && !strings.EqualFold(r.GUID, c.guid) {
+		return false
+	}
+	if len(r.Firmware) == 0 {
+		return true
+	}
+	for _, fw := range r.Firmware {
+		if fw == c.fwtype {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseIpxeRule parses a rule of comma-separated key=value pairs, for
+// example "oui=00:1b:21,firmware=efi64,binary=snponly.efi". The keys
+// are mac (a MAC address or prefix), oui (an alias of mac), vendor,
+// guid, firmware (a name or number, may be repeated) and binary, which
+// is required.
+func ParseIpxeRule(s string) (IpxeRule, error) {
+	var ret IpxeRule
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || v == "" {
+			return ret, fmt.Errorf("invalid iPXE rule element %q, want key=value", kv)
+		}
+		switch k {
+		case "mac", "oui":
+			bs, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(v))
+			if err != nil || len(bs) == 0 {
+				return ret, fmt.Errorf("invalid MAC address prefix %q", v)
+			}
+			ret.MACPrefix = bs
+		case "vendor":
+			ret.VendorClass = v
+		case "guid":
+			ret.GUID = v
+		case "firmware":
+			fw, err := ParseFirmware(v)
+			if err != nil {
+				return ret, err
+			}
+			ret.Firmware = append(ret.Firmware, fw)
+		case "binary":
+			ret.Binary = v
+		default:
+			return ret, fmt.Errorf("unknown iPXE rule key %q", k)
+		}
+	}
+	if ret.Binary == "" {
+		return ret, errors.New("iPXE rule has no binary")
+	}
+	return ret, nil
+}
+
+// LoadIpxeBinaries reads all regular files in dir, keyed by their file
+// name.
+func LoadIpxeBinaries(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string][]byte{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret[e.Name()] = bs
+	}
+	return ret, nil
+}
+
+// ipxeClient is what the binary selection knows about a machine.
+type ipxeClient struct {
+	mac         net.HardwareAddr
+	vendorClass string
+	guid        string
+	fwtype      Firmware
+}
+
+func newIpxeClient(pkt *dhcp4.Packet, guid string, fwtype Firmware) ipxeClient {
+	vendorClass, _ := pkt.Options.String(dhcp4.OptVendorIdentifier)
+	return ipxeClient{
+		mac:         pkt.MachineAddr(),
+		vendorClass: vendorClass,
+		guid:        guid,
+		fwtype:      fwtype,
+	}
+}
+
+// selectIpxe returns the name of the binary in IpxeBinaries that c
+// should chainload, or "" for the default binary of its firmware
+// type. hint is the binary requested by the Booter, if any, which
+// takes precedence over the rules.
+//
+// The choice is remembered, so that the PXE exchange that follows the
+// ProxyDHCP offer for EFI clients serves the same binary.
+func (s *Server) selectIpxe(c ipxeClient, hint string) string {
+	cfg := s.ipxeConfig()
+	name := ""
+	if hint != "" {
+		if _, ok := cfg.IpxeBinaries[hint]; ok {
+			name = hint
+		} else {
+			s.Log.Info("Booter asked for unknown iPXE binary, using the rules instead", "mac", c.mac.String(), "binary", hint)
+		}
+	}
+	if name == "" {
+		for _, r := range cfg.IpxeRules {
+			if r.matches(c) {
+				name = r.Binary
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	s.ipxeChoices.mu.Lock()
+	defer s.ipxeChoices.mu.Unlock()
+	if s.ipxeChoices.choices == nil {
+		s.ipxeChoices.choices = make(map[string]ipxeChoice)
+	}
+	s.ipxeChoices.prune(now)
+	if name == "" {
+		delete(s.ipxeChoices.choices, c.mac.String())
+	} else {
+		s.ipxeChoices.choices[c.mac.String()] = ipxeChoice{name: name, chosen: now}
+	}
+	return name
+}
+
+// chosenIpxe returns the binary last chosen by selectIpxe for mac, if
+// that was within ipxeChoiceTTL.
+func (s *Server) chosenIpxe(mac net.HardwareAddr) string {
+	s.ipxeChoices.mu.Lock()
+	defer s.ipxeChoices.mu.Unlock()
+	choice, found := s.ipxeChoices.choices[mac.String()]
+	if !found || time.Since(choice.chosen) > ipxeChoiceTTL {
+		return ""
+	}
+	return choice.name
+}
+
+// ipxeChoiceTTL is how long the binary chosen for a machine is
+// remembered for the PXE exchange that follows its ProxyDHCP offer.
+// That exchange takes seconds, but the rules may have changed by the
+// time the machine boots again.
+const ipxeChoiceTTL = 5 * time.Minute
+
+// pruneIpxeChoicesInterval is how often the expired choices are
+// forgotten.
+const pruneIpxeChoicesInterval = time.Minute
+
+// ipxeChoiceState remembers the binaries chosen by selectIpxe, by MAC
+// address.
+type ipxeChoiceState struct {
+	mu        sync.Mutex
+	choices   map[string]ipxeChoice
+	lastPrune time.Time
+}
+
+type ipxeChoice struct {
+	name   string
+	chosen time.Time
+}
+
+// prune forgets the choices made longer than ipxeChoiceTTL ago, so
+// that machines that never continue to the PXE exchange don't
+// accumulate.
+func (c *ipxeChoiceState) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < pruneIpxeChoicesInterval {
+		return
+	}
+	c.lastPrune = now
+	for k, choice := range c.choices {
+		if now.Sub(choice.chosen) > ipxeChoiceTTL {
+			delete(c.choices, k)
+		}
+	}
+}
+
+// ipxePath returns the TFTP path of the iPXE binary for mac.
+func ipxePath(mac net.HardwareAddr, fwtype Firmware, name string) string {
+	if name != "" {
+		return fmt.Sprintf("%s/ipxe/%s", mac, name)
+	}
+	return fmt.Sprintf("%s/%d", mac, fwtype)
+}
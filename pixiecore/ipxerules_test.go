@@ -0,0 +1,186 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestParseIpxeRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		want IpxeRule
+	}{
+		{
+			"oui=00:1b:21,firmware=efi64,binary=snponly.efi",
+			IpxeRule{MACPrefix: []byte{0, 0x1b, 0x21}, Firmware: []Firmware{FirmwareEFI64}, Binary: "snponly.efi"},
+		},
+		{
+			"mac=01-02-03-04-05-06, vendor=PXEClient:Arch:00000, firmware=ipxe, firmware=0, binary=undionly.kpxe",
+			IpxeRule{
+				MACPrefix:   []byte{1, 2, 3, 4, 5, 6},
+				VendorClass: "PXEClient:Arch:00000",
+				Firmware:    []Firmware{FirmwareX86Ipxe, FirmwareX86PC},
+				Binary:      "undionly.kpxe",
+			},
+		},
+		{
+			"guid=4b37128e-6e72-4a8d-87da-8ad4d775582c,binary=a",
+			IpxeRule{GUID: "4b37128e-6e72-4a8d-87da-8ad4d775582c", Binary: "a"},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseIpxeRule(test.rule)
+		if err != nil {
+			t.Errorf("parsing %q: %s", test.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsing %q: got %+v, want %+v", test.rule, got, test.want)
+		}
+	}
+
+	for _, rule := range []string{
+		"",
+		"oui=00:1b:21",
+		"binary=",
+		"mac=zz,binary=a",
+		"firmware=efi128,binary=a",
+		"color=blue,binary=a",
+	} {
+		if _, err := ParseIpxeRule(rule); err == nil {
+			t.Errorf("parsing %q succeeded, want error", rule)
+		}
+	}
+}
+
+func TestLoadIpxeBinaries(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "snponly.efi"), []byte("snp"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	bins, err := LoadIpxeBinaries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]byte{"snponly.efi": []byte("snp")}; !reflect.DeepEqual(bins, want) {
+		t.Fatalf("got binaries %v, want %v", bins, want)
+	}
+}
+
+func TestSelectIpxe(t *testing.T) {
+	s := &Server{
+		Log: slog.Default(),
+		Ipxe: map[Firmware][]byte{
+			FirmwareEFI64: []byte("ipxe.efi"),
+		},
+		IpxeBinaries: map[string][]byte{
+			"snponly.efi":   []byte("snponly"),
+			"undionly.kpxe": []byte("undionly"),
+		},
+		IpxeRules: []IpxeRule{
+			{MACPrefix: []byte{0, 0x1b, 0x21}, Firmware: []Firmware{FirmwareEFI64}, Binary: "snponly.efi"},
+			{VendorClass: "PXEClient:Arch:00000", Binary: "undionly.kpxe"},
+		},
+		events: make(map[string][]machineEvent),
+	}
+	if err := s.ipxeConfig().validate(); err != nil {
+		t.Fatalf("validating rules: %s", err)
+	}
+
+	intel := net.HardwareAddr{0, 0x1b, 0x21, 1, 2, 3}
+	other := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		client ipxeClient
+		hint   string
+		want   string
+	}{
+		{ipxeClient{mac: intel, fwtype: FirmwareEFI64}, "", "snponly.efi"},
+		{ipxeClient{mac: intel, fwtype: FirmwareEFIBC}, "", ""},
+		{ipxeClient{mac: other, fwtype: FirmwareEFI64}, "", ""},
+		{ipxeClient{mac: other, vendorClass: "PXEClient:Arch:00000:UNDI:002001", fwtype: FirmwareX86Ipxe}, "", "undionly.kpxe"},
+		{ipxeClient{mac: other, fwtype: FirmwareEFI64}, "snponly.efi", "snponly.efi"},
+		{ipxeClient{mac: intel, fwtype: FirmwareEFI64}, "missing.efi", "snponly.efi"},
+	}
+	for _, test := range tests {
+		got := s.selectIpxe(test.client, test.hint)
+		if got != test.want {
+			t.Errorf("selecting for %+v with hint %q: got %q, want %q", test.client, test.hint, got, test.want)
+		}
+		if chosen := s.chosenIpxe(test.client.mac); chosen != got {
+			t.Errorf("remembered %q for %s, want %q", chosen, test.client.mac, got)
+		}
+	}
+
+	// The PXE exchange of EFI clients serves the binary chosen in
+	// the ProxyDHCP offer.
+	pkt := &dhcp4.Packet{HardwareAddr: other, Options: dhcp4.Options{}}
+	s.selectIpxe(ipxeClient{mac: other, fwtype: FirmwareEFI64}, "snponly.efi")
+	resp := s.offerPXE(pkt, net.IPv4(192, 168, 0, 1), FirmwareEFI64, s.chosenIpxe(other))
+	if want := "01:02:03:04:05:06/ipxe/snponly.efi"; resp.BootFilename != want {
+		t.Errorf("got PXE boot filename %q, want %q", resp.BootFilename, want)
+	}
+
+	// Choices are forgotten after a while, also those of machines
+	// that never continued to the PXE exchange.
+	choice := s.ipxeChoices.choices[other.String()]
+	choice.chosen = time.Now().Add(-ipxeChoiceTTL - time.Minute)
+	s.ipxeChoices.choices[other.String()] = choice
+	if chosen := s.chosenIpxe(other); chosen != "" {
+		t.Errorf("remembered expired choice %q for %s", chosen, other)
+	}
+	s.ipxeChoices.lastPrune = time.Time{}
+	s.ipxeChoices.prune(time.Now())
+	if _, ok := s.ipxeChoices.choices[other.String()]; ok || len(s.ipxeChoices.choices) != 1 {
+		t.Errorf("got %d choices after pruning, want only the one of %s", len(s.ipxeChoices.choices), intel)
+	}
+	s.selectIpxe(ipxeClient{mac: other, fwtype: FirmwareEFI64}, "snponly.efi")
+
+	offer, err := s.offerDHCP(pkt, Machine{MAC: other}, &Interface{implicit: true}, net.IPv4(192, 168, 0, 1), FirmwareX86Ipxe, "undionly.kpxe", nil)
+	if err != nil {
+		t.Fatalf("constructing offer: %s", err)
+	}
+	if want := "tftp://192.168.0.1/01:02:03:04:05:06/ipxe/undionly.kpxe"; offer.BootFilename != want {
+		t.Errorf("got DHCP boot filename %q, want %q", offer.BootFilename, want)
+	}
+
+	rf := &fakeTransfer{}
+	if err := s.readHandler("01:02:03:04:05:06/ipxe/snponly.efi", rf); err != nil {
+		t.Fatalf("reading named binary: %s", err)
+	}
+	if rf.String() != "snponly" || rf.size != int64(len("snponly")) {
+		t.Errorf("got %q with tsize %d for named binary", rf.String(), rf.size)
+	}
+	if err := s.readHandler("01:02:03:04:05:06/ipxe/missing.efi", &fakeTransfer{}); err == nil {
+		t.Errorf("reading unknown named binary succeeded")
+	}
+
+	s.IpxeRules = append(s.IpxeRules, IpxeRule{Binary: "missing.efi"})
+	if err := s.ipxeConfig().validate(); err == nil {
+		t.Errorf("rule with unknown binary passed validation")
+	}
+}
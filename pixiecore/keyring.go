@@ -0,0 +1,189 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A KeyRing holds the keys used to sign and open IDs.
+//
+// The first key in the ring signs new IDs, and every key in the ring
+// is accepted when opening an ID. To rotate keys across several
+// Pixiecore replicas without breaking boots in flight, first add the
+// new key at the end of every replica's ring, then move it to the
+// front, and finally drop the old key once its IDs have expired.
+type KeyRing struct {
+	path string
+
+	mu   sync.RWMutex
+	keys [][32]byte
+}
+
+// NewKeyRing returns a KeyRing holding keys, the first of which is
+// used for signing.
+func NewKeyRing(keys ...[32]byte) (*KeyRing, error) {
+	ret := &KeyRing{}
+	if err := ret.Set(keys); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// NewRandomKeyRing returns a KeyRing holding a single random key.
+//
+// IDs signed with it can only be opened by the same process, which is
+// fine for a single Pixiecore that never restarts mid-boot.
+func NewRandomKeyRing() (*KeyRing, error) {
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, fmt.Errorf("failed to get randomness for signing key: %w", err)
+	}
+	return NewKeyRing(key)
+}
+
+// ParseKeyRing returns a KeyRing holding the keys in data.
+//
+// data contains one key per line, each either 64 hex digits or the
+// base64 encoding of 32 bytes. Blank lines and lines starting with
+// '#' are ignored, and commas are accepted as separators so that keys
+// fit in a single environment variable.
+func ParseKeyRing(data []byte) (*KeyRing, error) {
+	keys, err := parseKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyRing(keys...)
+}
+
+// LoadKeyRing returns a KeyRing holding the keys in the file at path,
+// in the format accepted by ParseKeyRing.
+//
+// The returned KeyRing can later pick up changes to the file with
+// Reload.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	ret := &KeyRing{path: path}
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Reload re-reads the file the KeyRing was loaded from, and replaces
+// the keys in the ring with its contents. If the file can't be read
+// or parsed, the ring is left unchanged.
+func (k *KeyRing) Reload() error {
+	if k.path == "" {
+		return errors.New("key ring was not loaded from a file")
+	}
+	bs, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("reading signing keys: %w", err)
+	}
+	keys, err := parseKeys(bs)
+	if err != nil {
+		return fmt.Errorf("parsing signing keys from %q: %w", k.path, err)
+	}
+	return k.Set(keys)
+}
+
+// Set atomically replaces the keys in the ring. keys[0] becomes the
+// signing key.
+func (k *KeyRing) Set(keys [][32]byte) error {
+	if len(keys) == 0 {
+		return errors.New("key ring needs at least one key")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([][32]byte(nil), keys...)
+	return nil
+}
+
+// Len returns the number of keys in the ring.
+func (k *KeyRing) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+// signingKey returns the key that new IDs should be signed with.
+func (k *KeyRing) signingKey() [32]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[0]
+}
+
+// openingKeys returns all keys that IDs may have been signed with,
+// signing key first.
+func (k *KeyRing) openingKeys() [][32]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys
+}
+
+func parseKeys(data []byte) ([][32]byte, error) {
+	var ret [][32]byte
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		for _, f := range strings.Split(l, ",") {
+			f = strings.TrimSpace(f)
+			if f == "" {
+				continue
+			}
+			key, err := parseKey(f)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			ret = append(ret, key)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return ret, nil
+}
+
+func parseKey(s string) ([32]byte, error) {
+	var ret [32]byte
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		bs, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return ret, errors.New("key is neither hex nor base64")
+		}
+	}
+	if len(bs) != len(ret) {
+		return ret, fmt.Errorf("key is %d bytes, want %d", len(bs), len(ret))
+	}
+	copy(ret[:], bs)
+	return ret, nil
+}
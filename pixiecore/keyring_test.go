@@ -0,0 +1,135 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testKeyHex    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKeyBase64 = "ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8="
+)
+
+func TestParseKeyRing(t *testing.T) {
+	k, err := ParseKeyRing([]byte("# signing key\n" + testKeyHex + "\n\n" + testKeyBase64 + "\n"))
+	if err != nil {
+		t.Fatalf("Parsing key ring: %s", err)
+	}
+	if k.Len() != 2 {
+		t.Fatalf("Wrong number of keys, want 2, got %d", k.Len())
+	}
+	if sk := k.signingKey(); sk[1] != 1 {
+		t.Fatalf("Signing key is not the first key in the file")
+	}
+
+	k, err = ParseKeyRing([]byte(testKeyHex + "," + testKeyBase64))
+	if err != nil {
+		t.Fatalf("Parsing comma separated key ring: %s", err)
+	}
+	if k.Len() != 2 {
+		t.Fatalf("Wrong number of keys, want 2, got %d", k.Len())
+	}
+
+	for _, bad := range []string{"", "# only a comment\n", "abcd", "not a key at all"} {
+		if _, err := ParseKeyRing([]byte(bad)); err == nil {
+			t.Fatalf("Parsing %q succeeded", bad)
+		}
+	}
+}
+
+func TestKeyRingSharedAcrossReplicas(t *testing.T) {
+	a, err := ParseKeyRing([]byte(testKeyHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseKeyRing([]byte(testKeyHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := "http://test.example/foo/bar"
+	id, err := signURL(u, a, time.Time{}, nil, nil)
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+	u2, err := getURL(id, b, time.Now(), nil, nil)
+	if err != nil {
+		t.Fatalf("ID from one replica didn't open on another: %s", err)
+	}
+	if u != u2 {
+		t.Fatalf("getURL(signURL(%q)) = %q, which isn't the same thing", u, u2)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(testKeyHex+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyRing(path)
+	if err != nil {
+		t.Fatalf("Loading key ring: %s", err)
+	}
+
+	u := "http://test.example/foo/bar"
+	oldID, err := signURL(u, k, time.Time{}, nil, nil)
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+
+	// Promote a new key, keeping the old one for IDs in flight.
+	if err = os.WriteFile(path, []byte(testKeyBase64+"\n"+testKeyHex+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Reload(); err != nil {
+		t.Fatalf("Reloading key ring: %s", err)
+	}
+	if _, err = getURL(oldID, k, time.Now(), nil, nil); err != nil {
+		t.Fatalf("ID signed before rotation no longer opens: %s", err)
+	}
+	newID, err := signURL(u, k, time.Time{}, nil, nil)
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+
+	// Retire the old key.
+	if err = os.WriteFile(path, []byte(testKeyBase64+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Reload(); err != nil {
+		t.Fatalf("Reloading key ring: %s", err)
+	}
+	if _, err = getURL(oldID, k, time.Now(), nil, nil); err == nil {
+		t.Fatalf("ID signed with a retired key still opens")
+	}
+	if _, err = getURL(newID, k, time.Now(), nil, nil); err != nil {
+		t.Fatalf("ID signed with the new key doesn't open: %s", err)
+	}
+
+	// A broken file leaves the ring alone.
+	if err = os.WriteFile(path, []byte("garbage\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Reload(); err == nil {
+		t.Fatalf("Reloading a broken key file succeeded")
+	}
+	if _, err = getURL(newID, k, time.Now(), nil, nil); err != nil {
+		t.Fatalf("Failed reload changed the key ring: %s", err)
+	}
+}
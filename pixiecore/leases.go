@@ -0,0 +1,674 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+const (
+	// defaultLeaseTime is the lease time of DHCPPools that don't set
+	// one.
+	defaultLeaseTime = time.Hour
+	// offerHoldTime is how long an offered address is kept for the
+	// machine it was offered to, waiting for its DHCPREQUEST.
+	offerHoldTime = time.Minute
+	// declineHoldTime is how long an address that a machine found to
+	// be in use is not offered again.
+	declineHoldTime = 10 * time.Minute
+)
+
+var (
+	errPoolExhausted  = errors.New("no free address left in pool")
+	errAddressInvalid = errors.New("address can't be leased to this machine")
+)
+
+// A DHCPPool is a range of addresses that the Server leases to
+// machines when it acts as a full DHCP server.
+type DHCPPool struct {
+	// Subnet is the network of the pool. Requests are served from the
+	// pool if they were relayed from Subnet, or received on a network
+	// interface that has an address in Subnet.
+	Subnet *net.IPNet
+	// Start and End are the first and the last address that are
+	// leased to any machine.
+	Start, End net.IP
+	// LeaseTime is how long leases last. Defaults to one hour.
+	LeaseTime time.Duration
+
+	// Routers, DNSServers, NTPServers and DomainName are handed to
+	// the machines along with their address.
+	Routers    []net.IP
+	DNSServers []net.IP
+	NTPServers []net.IP
+	DomainName string
+
+	// Reservations are addresses that are only leased to one machine
+	// each. They need to be in Subnet, but not between Start and End.
+	Reservations []DHCPReservation
+
+	// excluded are the addresses in Subnet that are never leased: its
+	// network and broadcast addresses, the Routers and the server's
+	// own addresses. They are set by validate.
+	excluded map[string]bool
+}
+
+// A DHCPReservation is an address that is leased to one machine only.
+type DHCPReservation struct {
+	MAC net.HardwareAddr
+	IP  net.IP
+	// Hostname, if set, is handed to the machine along with its
+	// address.
+	Hostname string
+}
+
+// ParseDHCPPool parses a pool of comma-separated key=value pairs, for
+// example "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,router=10.1.0.1".
+// The keys are subnet and range, which are required, lease (a
+// duration), router, dns and ntp (IPv4 addresses, may be repeated) and
+// domain.
+func ParseDHCPPool(s string) (DHCPPool, error) {
+	var ret DHCPPool
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || v == "" {
+			return ret, fmt.Errorf("invalid DHCP pool element %q, want key=value", kv)
+		}
+		switch k {
+		case "subnet":
+			_, subnet, err := net.ParseCIDR(v)
+			if err != nil || subnet.IP.To4() == nil {
+				return ret, fmt.Errorf("invalid IPv4 subnet %q", v)
+			}
+			ret.Subnet = subnet
+		case "range":
+			start, end, ok := strings.Cut(v, "-")
+			ret.Start, ret.End = net.ParseIP(start).To4(), net.ParseIP(end).To4()
+			if !ok || ret.Start == nil || ret.End == nil {
+				return ret, fmt.Errorf("invalid address range %q, want start-end", v)
+			}
+		case "lease":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return ret, fmt.Errorf("invalid lease time %q: %w", v, err)
+			}
+			ret.LeaseTime = d
+		case "router", "dns", "ntp":
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return ret, fmt.Errorf("invalid IPv4 address %q", v)
+			}
+			switch k {
+			case "router":
+				ret.Routers = append(ret.Routers, ip)
+			case "dns":
+				ret.DNSServers = append(ret.DNSServers, ip)
+			case "ntp":
+				ret.NTPServers = append(ret.NTPServers, ip)
+			}
+		case "domain":
+			ret.DomainName = v
+		default:
+			return ret, fmt.Errorf("unknown DHCP pool key %q", k)
+		}
+	}
+	if ret.Subnet == nil || ret.Start == nil {
+		return ret, errors.New("DHCP pool needs a subnet and a range")
+	}
+	return ret, nil
+}
+
+// ParseDHCPReservation parses a reservation of comma-separated
+// key=value pairs, for example "mac=00:1b:21:0a:0b:0c,ip=10.1.0.10".
+// The keys are mac and ip, which are required, and hostname.
+func ParseDHCPReservation(s string) (DHCPReservation, error) {
+	var ret DHCPReservation
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || v == "" {
+			return ret, fmt.Errorf("invalid DHCP reservation element %q, want key=value", kv)
+		}
+		switch k {
+		case "mac":
+			mac, err := dhcp4.ParseHardwareAddr(v)
+			if err != nil {
+				return ret, fmt.Errorf("invalid MAC address %q: %w", v, err)
+			}
+			ret.MAC = mac
+		case "ip":
+			ret.IP = net.ParseIP(v).To4()
+			if ret.IP == nil {
+				return ret, fmt.Errorf("invalid IPv4 address %q", v)
+			}
+		case "hostname":
+			ret.Hostname = v
+		default:
+			return ret, fmt.Errorf("unknown DHCP reservation key %q", k)
+		}
+	}
+	if ret.MAC == nil || ret.IP == nil {
+		return ret, errors.New("DHCP reservation needs a mac and an ip")
+	}
+	return ret, nil
+}
+
+// validate checks that p is usable, and fills in defaults and the
+// addresses that are excluded from leasing, including those of the
+// server in local.
+func (p *DHCPPool) validate(local []net.IP) error {
+	if p.Subnet == nil || p.Subnet.IP.To4() == nil {
+		return errors.New("pool has no IPv4 subnet")
+	}
+	if !p.Subnet.Contains(p.Start) || !p.Subnet.Contains(p.End) {
+		return fmt.Errorf("range %s-%s is not in subnet %s", p.Start, p.End, p.Subnet)
+	}
+	if ipToUint32(p.Start) > ipToUint32(p.End) {
+		return fmt.Errorf("range %s-%s ends before it starts", p.Start, p.End)
+	}
+	if p.LeaseTime <= 0 {
+		p.LeaseTime = defaultLeaseTime
+	}
+
+	p.excluded = map[string]bool{}
+	// /31 and /32 subnets have no network and broadcast addresses
+	// (RFC 3021).
+	if ones, bits := p.Subnet.Mask.Size(); bits-ones > 1 {
+		network := ipToUint32(p.Subnet.IP.Mask(p.Subnet.Mask))
+		p.excluded[uint32ToIP(network).String()] = true
+		p.excluded[uint32ToIP(network|^ipToUint32(net.IP(p.Subnet.Mask))).String()] = true
+	}
+	for _, ip := range slices.Concat(p.Routers, local) {
+		if p.Subnet.Contains(ip) {
+			p.excluded[ip.To4().String()] = true
+		}
+	}
+	size := int64(ipToUint32(p.End)) - int64(ipToUint32(p.Start)) + 1
+	for ip := range p.excluded {
+		if p.inRange(net.ParseIP(ip)) {
+			size--
+		}
+	}
+	if size <= 0 {
+		return fmt.Errorf("range %s-%s has no address to lease besides the network, broadcast, router and server addresses", p.Start, p.End)
+	}
+
+	macs, ips := map[string]bool{}, map[string]bool{}
+	for _, r := range p.Reservations {
+		if !p.Subnet.Contains(r.IP) {
+			return fmt.Errorf("reservation %s for %s is not in subnet %s", r.IP, r.MAC, p.Subnet)
+		}
+		if p.inRange(r.IP) {
+			return fmt.Errorf("reservation %s for %s is in the dynamic range %s-%s", r.IP, r.MAC, p.Start, p.End)
+		}
+		if p.excluded[r.IP.To4().String()] {
+			return fmt.Errorf("reservation %s for %s is a network, broadcast, router or server address", r.IP, r.MAC)
+		}
+		if macs[r.MAC.String()] || ips[r.IP.String()] {
+			return fmt.Errorf("duplicate reservation %s for %s", r.IP, r.MAC)
+		}
+		macs[r.MAC.String()], ips[r.IP.String()] = true, true
+	}
+	return nil
+}
+
+// inRange returns whether ip is between p.Start and p.End.
+func (p *DHCPPool) inRange(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	n := ipToUint32(ip)
+	return n >= ipToUint32(p.Start) && n <= ipToUint32(p.End)
+}
+
+// reservation returns the reservation of mac in p, or nil.
+func (p *DHCPPool) reservation(mac net.HardwareAddr) *DHCPReservation {
+	for i := range p.Reservations {
+		if p.Reservations[i].MAC.String() == mac.String() {
+			return &p.Reservations[i]
+		}
+	}
+	return nil
+}
+
+// reservedFor returns the MAC address that ip is reserved for in p,
+// or nil.
+func (p *DHCPPool) reservedFor(ip net.IP) net.HardwareAddr {
+	for _, r := range p.Reservations {
+		if r.IP.Equal(ip) {
+			return r.MAC
+		}
+	}
+	return nil
+}
+
+// newLease returns a lease of ip to mac until expiry.
+func newLease(mac net.HardwareAddr, ip net.IP, expiry time.Time, state dhcp4.LeaseState) *dhcp4.Lease {
+	return &dhcp4.Lease{
+		HardwareAddr: append(net.HardwareAddr(nil), mac...),
+		IPAddress:    ip.To4(),
+		Expiry:       expiry,
+		State:        state,
+	}
+}
+
+// leaseTable allocates the addresses of DHCPPools to machines.
+type leaseTable struct {
+	pools []DHCPPool
+	now   func() time.Time
+	// store, if set, keeps bound and declined leases across restarts.
+	// Offers are short-lived and only kept in memory.
+	store dhcp4.LeaseStore
+	log   *slog.Logger
+
+	mu sync.Mutex
+	// leases are the current and expired leases, by MAC address. An
+	// expired lease is kept so that the machine gets the same
+	// address again if it's still free.
+	leases map[string]*dhcp4.Lease
+	// byIP indexes leases by address. It also holds the addresses
+	// that machines declined because they found them in use, which
+	// aren't offered again until their lease expires.
+	byIP map[string]*dhcp4.Lease
+}
+
+// newLeaseTable returns a leaseTable for pools, which never leases
+// the server's own addresses in local. If store is not nil, the leases
+// in it are loaded and changes are written back to it.
+func newLeaseTable(pools []DHCPPool, local []net.IP, store dhcp4.LeaseStore, log *slog.Logger) (*leaseTable, error) {
+	ret := &leaseTable{
+		pools:  make([]DHCPPool, len(pools)),
+		now:    time.Now,
+		store:  store,
+		log:    log,
+		leases: map[string]*dhcp4.Lease{},
+		byIP:   map[string]*dhcp4.Lease{},
+	}
+	copy(ret.pools, pools)
+	for i := range ret.pools {
+		if err := ret.pools[i].validate(local); err != nil {
+			return nil, fmt.Errorf("DHCP pool %d: %w", i, err)
+		}
+	}
+	if store == nil {
+		return ret, nil
+	}
+
+	stored, err := store.Leases()
+	if err != nil {
+		return nil, fmt.Errorf("loading DHCP leases: %w", err)
+	}
+	for _, l := range stored {
+		if ret.poolOf(l.IPAddress) == nil {
+			log.Info("Ignoring stored lease outside of the DHCP pools", "mac", l.HardwareAddr.String(), "ip", l.IPAddress)
+			continue
+		}
+		if l.State != dhcp4.LeaseDeclined {
+			// A machine moved to another address leaves its old
+			// lease behind, only the newest one counts.
+			if old := ret.leases[l.HardwareAddr.String()]; old != nil && old.Expiry.After(l.Expiry) {
+				continue
+			}
+		}
+		ret.hold(l)
+	}
+	return ret, nil
+}
+
+// serverIPs returns the addresses of s that pools must not lease: those
+// of the host's network interfaces, and the advertised ones.
+func (s *Server) serverIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("listing local addresses: %w", err)
+	}
+	var ret []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			ret = append(ret, ipnet.IP)
+		}
+	}
+	for _, i := range s.Interfaces {
+		if i.AdvertiseIP != nil {
+			ret = append(ret, i.AdvertiseIP)
+		}
+	}
+	return ret, nil
+}
+
+// poolFor returns the pool serving a request received on intf,
+// relayed by relay if it isn't nil or 0.0.0.0. It returns nil if
+// no pool serves the request.
+func (t *leaseTable) poolFor(intf *net.Interface, relay net.IP) *DHCPPool {
+	if relay != nil && !relay.Equal(net.IPv4zero) {
+		return t.poolOf(relay)
+	}
+
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return nil
+	}
+	for i := range t.pools {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && t.pools[i].Subnet.Contains(ipnet.IP) {
+				return &t.pools[i]
+			}
+		}
+	}
+	return nil
+}
+
+// poolOf returns the pool whose subnet contains ip, or nil.
+func (t *leaseTable) poolOf(ip net.IP) *DHCPPool {
+	for i := range t.pools {
+		if t.pools[i].Subnet.Contains(ip) {
+			return &t.pools[i]
+		}
+	}
+	return nil
+}
+
+// offer picks an address in pool for mac, preferring its reservation,
+// its previous address and requested, in that order. The address is
+// held for mac for a short while, waiting for its request.
+func (t *leaseTable) offer(pool *DHCPPool, mac net.HardwareAddr, requested net.IP) (net.IP, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	expiry := now.Add(offerHoldTime)
+
+	if r := pool.reservation(mac); r != nil {
+		t.hold(newLease(mac, r.IP, expiry, dhcp4.LeaseOffered))
+		return r.IP, nil
+	}
+	if l := t.leases[mac.String()]; l != nil && pool.inRange(l.IPAddress) && t.free(pool, mac, l.IPAddress, now) {
+		if l.State == dhcp4.LeaseBound && l.Expiry.After(expiry) {
+			return l.IPAddress, nil
+		}
+		t.hold(newLease(mac, l.IPAddress, expiry, dhcp4.LeaseOffered))
+		return l.IPAddress, nil
+	}
+	if requested != nil && pool.inRange(requested) && t.free(pool, mac, requested, now) {
+		t.hold(newLease(mac, requested, expiry, dhcp4.LeaseOffered))
+		return requested.To4(), nil
+	}
+
+	// Prefer addresses that were never leased, so that machines
+	// coming back after their lease expired find their address still
+	// free.
+	var expired net.IP
+	for n := ipToUint32(pool.Start); n <= ipToUint32(pool.End) && n != 0; n++ {
+		ip := uint32ToIP(n)
+		if !t.free(pool, mac, ip, now) {
+			continue
+		}
+		if t.byIP[ip.String()] == nil {
+			t.hold(newLease(mac, ip, expiry, dhcp4.LeaseOffered))
+			return ip, nil
+		}
+		if expired == nil {
+			expired = ip
+		}
+	}
+	if expired != nil {
+		t.hold(newLease(mac, expired, expiry, dhcp4.LeaseOffered))
+		return expired, nil
+	}
+	return nil, errPoolExhausted
+}
+
+// ack binds ip in pool to mac and returns the lease time, or fails
+// with errAddressInvalid if mac can't have ip.
+func (t *leaseTable) ack(pool *DHCPPool, mac net.HardwareAddr, ip net.IP) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	if r := pool.reservation(mac); r != nil {
+		if !r.IP.Equal(ip) {
+			return 0, fmt.Errorf("%w: %s is reserved %s", errAddressInvalid, mac, r.IP)
+		}
+	} else if !pool.inRange(ip) {
+		return 0, fmt.Errorf("%w: %s is not in the pool", errAddressInvalid, ip)
+	}
+	if !t.free(pool, mac, ip, now) {
+		return 0, fmt.Errorf("%w: %s is in use", errAddressInvalid, ip)
+	}
+	l := newLease(mac, ip, now.Add(pool.LeaseTime), dhcp4.LeaseBound)
+	t.hold(l)
+	t.persist(l)
+	return pool.LeaseTime, nil
+}
+
+// release ends the lease of ip to mac, if there is one.
+func (t *leaseTable) release(mac net.HardwareAddr, ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l := t.leases[mac.String()]; l != nil && l.IPAddress.Equal(ip) {
+		l.Expiry = t.now()
+		if l.State == dhcp4.LeaseBound {
+			t.persist(l)
+		}
+	}
+}
+
+// decline ends the lease of ip to mac, and stops offering ip for a
+// while because another host is using it.
+func (t *leaseTable) decline(mac net.HardwareAddr, ip net.IP) {
+	if ip.To4() == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := newLease(mac, ip, t.now().Add(declineHoldTime), dhcp4.LeaseDeclined)
+	t.hold(l)
+	t.persist(l)
+}
+
+// forget drops an offer to mac that it didn't take.
+func (t *leaseTable) forget(mac net.HardwareAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l := t.leases[mac.String()]; l != nil && l.State == dhcp4.LeaseOffered {
+		l.Expiry = t.now()
+	}
+}
+
+// list returns copies of all leases, including expired ones, ordered
+// by address.
+func (t *leaseTable) list() []*dhcp4.Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]*dhcp4.Lease, 0, len(t.byIP))
+	for _, l := range t.byIP {
+		c := *l
+		ret = append(ret, &c)
+	}
+	slices.SortFunc(ret, func(a, b *dhcp4.Lease) int {
+		return cmp.Compare(ipToUint32(a.IPAddress), ipToUint32(b.IPAddress))
+	})
+	return ret
+}
+
+// revoke drops the lease of ip, so that it can be leased to another
+// machine right away. It returns whether there was a lease.
+func (t *leaseTable) revoke(ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.byIP[ip.String()]
+	if l == nil {
+		return false
+	}
+	t.drop(l)
+	return true
+}
+
+// load adds leases to the table, replacing the leases of the same
+// machines and addresses. Either all of leases are added, or none if
+// one of them can't be leased.
+func (t *leaseTable) load(leases []*dhcp4.Lease) error {
+	for _, l := range leases {
+		pool := t.poolOf(l.IPAddress)
+		if pool == nil {
+			return fmt.Errorf("%w: %s is in no DHCP pool", errAddressInvalid, l.IPAddress)
+		}
+		if owner := pool.reservedFor(l.IPAddress); owner != nil && owner.String() != l.HardwareAddr.String() {
+			return fmt.Errorf("%w: %s is reserved for %s", errAddressInvalid, l.IPAddress, owner)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, l := range leases {
+		l = newLease(l.HardwareAddr, l.IPAddress, l.Expiry, l.State)
+		t.hold(l)
+		if l.State != dhcp4.LeaseOffered {
+			t.persist(l)
+		}
+	}
+	return nil
+}
+
+// free returns whether ip in pool may be handed to mac. t.mu must be
+// held.
+func (t *leaseTable) free(pool *DHCPPool, mac net.HardwareAddr, ip net.IP, now time.Time) bool {
+	if pool.excluded[ip.String()] {
+		return false
+	}
+	if owner := pool.reservedFor(ip); owner != nil && owner.String() != mac.String() {
+		return false
+	}
+	l := t.byIP[ip.String()]
+	if l == nil || !now.Before(l.Expiry) {
+		if l != nil && l.State == dhcp4.LeaseDeclined {
+			t.drop(l)
+		}
+		return true
+	}
+	return l.State != dhcp4.LeaseDeclined && l.HardwareAddr.String() == mac.String()
+}
+
+// hold puts l in the table, replacing the lease of its address and,
+// unless l is declined, the lease of its machine. t.mu must be held.
+func (t *leaseTable) hold(l *dhcp4.Lease) {
+	mac, ip := l.HardwareAddr.String(), l.IPAddress.String()
+	if old := t.leases[mac]; old != nil && !old.IPAddress.Equal(l.IPAddress) && l.State != dhcp4.LeaseDeclined {
+		if t.byIP[old.IPAddress.String()] == old {
+			delete(t.byIP, old.IPAddress.String())
+			t.unpersist(old.IPAddress)
+		}
+	}
+	if old := t.byIP[ip]; old != nil && t.leases[old.HardwareAddr.String()] == old {
+		delete(t.leases, old.HardwareAddr.String())
+	}
+	t.byIP[ip] = l
+	if l.State != dhcp4.LeaseDeclined {
+		t.leases[mac] = l
+	}
+}
+
+// drop removes l from the table. t.mu must be held.
+func (t *leaseTable) drop(l *dhcp4.Lease) {
+	if t.leases[l.HardwareAddr.String()] == l {
+		delete(t.leases, l.HardwareAddr.String())
+	}
+	if t.byIP[l.IPAddress.String()] == l {
+		delete(t.byIP, l.IPAddress.String())
+	}
+	t.unpersist(l.IPAddress)
+}
+
+// persist writes l to the store, if there is one. t.mu must be held.
+func (t *leaseTable) persist(l *dhcp4.Lease) {
+	if t.store == nil {
+		return
+	}
+	if err := t.store.PutLease(l); err != nil {
+		t.log.Error("Unable to store DHCP lease", "mac", l.HardwareAddr.String(), "ip", l.IPAddress, "error", err)
+	}
+}
+
+// unpersist removes the lease of ip from the store, if there is one.
+// t.mu must be held.
+func (t *leaseTable) unpersist(ip net.IP) {
+	if t.store == nil {
+		return
+	}
+	if err := t.store.DeleteLease(ip); err != nil {
+		t.log.Error("Unable to delete stored DHCP lease", "ip", ip, "error", err)
+	}
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// handleLeases lists the leases of the DHCP server, imports leases in
+// the format of dhcp4.WriteLeases, and revokes the lease of an address.
+func (s *Server) handleLeases(w http.ResponseWriter, r *http.Request) {
+	if s.leases == nil {
+		http.Error(w, "no DHCP pools configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		leases, err := dhcp4.ReadLeases(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.leases.load(leases); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Log.Info("Imported DHCP leases", "count", len(leases), "remoteaddr", r.RemoteAddr)
+	case http.MethodDelete:
+		ip := net.ParseIP(r.URL.Query().Get("ip")).To4()
+		if ip == nil {
+			http.Error(w, fmt.Sprintf("invalid IPv4 address %q", r.URL.Query().Get("ip")), http.StatusBadRequest)
+			return
+		}
+		if !s.leases.revoke(ip) {
+			http.Error(w, fmt.Sprintf("no lease of %s", ip), http.StatusNotFound)
+			return
+		}
+		s.Log.Info("Revoked DHCP lease", "ip", ip, "remoteaddr", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.writeJSON(w, s.leases.list())
+}
@@ -0,0 +1,338 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"github.com/metal-stack/pixie/dhcp4/leasestore"
+)
+
+func mustPool(t *testing.T, s string) DHCPPool {
+	t.Helper()
+	pool, err := ParseDHCPPool(s)
+	if err != nil {
+		t.Fatalf("parsing pool %q: %s", s, err)
+	}
+	return pool
+}
+
+func TestParseDHCPPool(t *testing.T) {
+	pool := mustPool(t, "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,router=10.1.0.1,dns=10.1.0.2,dns=10.1.0.3,ntp=10.1.0.4,domain=example.com,lease=12h")
+	if pool.Subnet.String() != "10.1.0.0/24" || !pool.Start.Equal(net.IPv4(10, 1, 0, 100)) || !pool.End.Equal(net.IPv4(10, 1, 0, 200)) {
+		t.Errorf("got subnet %s, range %s-%s", pool.Subnet, pool.Start, pool.End)
+	}
+	if len(pool.Routers) != 1 || len(pool.DNSServers) != 2 || len(pool.NTPServers) != 1 {
+		t.Errorf("got routers %v, DNS servers %v, NTP servers %v", pool.Routers, pool.DNSServers, pool.NTPServers)
+	}
+	if pool.DomainName != "example.com" || pool.LeaseTime != 12*time.Hour {
+		t.Errorf("got domain %q, lease time %s", pool.DomainName, pool.LeaseTime)
+	}
+
+	for _, bad := range []string{
+		"range=10.1.0.100-10.1.0.200",
+		"subnet=10.1.0.0/24",
+		"subnet=fd00::/64,range=10.1.0.100-10.1.0.200",
+		"subnet=10.1.0.0/24,range=10.1.0.100",
+		"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,lease=forever",
+		"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,gateway=10.1.0.1",
+	} {
+		if _, err := ParseDHCPPool(bad); err == nil {
+			t.Errorf("ParseDHCPPool(%q) succeeded, want error", bad)
+		}
+	}
+
+	res, err := ParseDHCPReservation("mac=00:1b:21:0a:0b:0c,ip=10.1.0.10,hostname=node1")
+	if err != nil {
+		t.Fatalf("parsing reservation: %s", err)
+	}
+	if res.MAC.String() != "00:1b:21:0a:0b:0c" || !res.IP.Equal(net.IPv4(10, 1, 0, 10)) || res.Hostname != "node1" {
+		t.Errorf("got reservation %+v", res)
+	}
+	if _, err := ParseDHCPReservation("mac=00:1b:21:0a:0b:0c"); err == nil {
+		t.Error("reservation without address parsed")
+	}
+}
+
+func TestNewLeaseTable(t *testing.T) {
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	for _, test := range []struct {
+		pool    string
+		res     []DHCPReservation
+		local   []net.IP
+		wantErr bool
+	}{
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", nil, nil, false},
+		{"subnet=10.1.0.0/24,range=10.1.0.200-10.1.0.100", nil, nil, true},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.1.200", nil, nil, true},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 1, 0, 10)}}, nil, false},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 1, 0, 150)}}, nil, true},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 2, 0, 10)}}, nil, true},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 1, 0, 10)}, {MAC: mac, IP: net.IPv4(10, 1, 0, 11)}}, nil, true},
+		// Network, broadcast, router and server addresses are skipped,
+		// but a range needs other addresses, and reservations can't be
+		// any of them.
+		{"subnet=10.1.0.0/24,range=10.1.0.0-10.1.0.255,router=10.1.0.1", nil, []net.IP{net.IPv4(10, 1, 0, 2)}, false},
+		{"subnet=10.1.0.0/30,range=10.1.0.1-10.1.0.3,router=10.1.0.1", nil, []net.IP{net.IPv4(10, 1, 0, 2)}, true},
+		{"subnet=10.1.0.0/31,range=10.1.0.0-10.1.0.1", nil, []net.IP{net.IPv4(10, 1, 0, 0)}, false},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 1, 0, 255)}}, nil, true},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200,router=10.1.0.1", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 1, 0, 1)}}, nil, true},
+		{"subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200", []DHCPReservation{{MAC: mac, IP: net.IPv4(10, 1, 0, 2)}}, []net.IP{net.IPv4(10, 1, 0, 2)}, true},
+	} {
+		pool := mustPool(t, test.pool)
+		pool.Reservations = test.res
+		if _, err := newLeaseTable([]DHCPPool{pool}, test.local, nil, slog.Default()); (err != nil) != test.wantErr {
+			t.Errorf("pool %q with reservations %v: got error %v, want error: %v", test.pool, test.res, err, test.wantErr)
+		}
+	}
+}
+
+func TestLeaseTable(t *testing.T) {
+	reserved := net.HardwareAddr{1, 2, 3, 4, 5, 1}
+	a := net.HardwareAddr{1, 2, 3, 4, 5, 2}
+	b := net.HardwareAddr{1, 2, 3, 4, 5, 3}
+	c := net.HardwareAddr{1, 2, 3, 4, 5, 4}
+	d := net.HardwareAddr{1, 2, 3, 4, 5, 5}
+
+	pool := mustPool(t, "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.102,lease=1h")
+	pool.Reservations = []DHCPReservation{{MAC: reserved, IP: net.IPv4(10, 1, 0, 10)}}
+	table, err := newLeaseTable([]DHCPPool{pool}, nil, nil, slog.Default())
+	if err != nil {
+		t.Fatalf("creating lease table: %s", err)
+	}
+	now := time.Now()
+	table.now = func() time.Time { return now }
+	p := &table.pools[0]
+
+	offer := func(mac net.HardwareAddr, requested net.IP, want net.IP) {
+		t.Helper()
+		ip, err := table.offer(p, mac, requested)
+		if err != nil {
+			t.Fatalf("offer to %s: %s", mac, err)
+		}
+		if !ip.Equal(want) {
+			t.Fatalf("offered %s to %s, want %s", ip, mac, want)
+		}
+	}
+	ack := func(mac net.HardwareAddr, ip net.IP, wantOK bool) {
+		t.Helper()
+		d, err := table.ack(p, mac, ip)
+		if wantOK && (err != nil || d != time.Hour) {
+			t.Fatalf("ack of %s to %s: %s, %s", ip, mac, d, err)
+		}
+		if !wantOK && !errors.Is(err, errAddressInvalid) {
+			t.Fatalf("ack of %s to %s: got error %v, want errAddressInvalid", ip, mac, err)
+		}
+	}
+
+	offer(reserved, nil, net.IPv4(10, 1, 0, 10))
+	ack(reserved, net.IPv4(10, 1, 0, 10), true)
+	ack(reserved, net.IPv4(10, 1, 0, 100), false)
+	ack(a, net.IPv4(10, 1, 0, 10), false)
+
+	offer(a, nil, net.IPv4(10, 1, 0, 100))
+	// The same machine gets the same offer again.
+	offer(a, nil, net.IPv4(10, 1, 0, 100))
+	ack(a, net.IPv4(10, 1, 0, 100), true)
+	ack(b, net.IPv4(10, 1, 0, 100), false)
+	ack(b, net.IPv4(10, 1, 0, 50), false)
+
+	offer(b, net.IPv4(10, 1, 0, 102), net.IPv4(10, 1, 0, 102))
+	ack(b, net.IPv4(10, 1, 0, 102), true)
+
+	// c declines its address, which is then not offered to d.
+	offer(c, nil, net.IPv4(10, 1, 0, 101))
+	table.decline(c, net.IPv4(10, 1, 0, 101))
+	if _, err := table.offer(p, d, nil); !errors.Is(err, errPoolExhausted) {
+		t.Fatalf("offer from exhausted pool: got error %v, want errPoolExhausted", err)
+	}
+
+	// Once a's lease is released, its address goes to d.
+	table.release(a, net.IPv4(10, 1, 0, 100))
+	offer(d, nil, net.IPv4(10, 1, 0, 100))
+
+	// b's lease expires, after which b still gets its old address
+	// back while the never-leased declined one becomes free again.
+	now = now.Add(2 * time.Hour)
+	offer(b, nil, net.IPv4(10, 1, 0, 102))
+	offer(c, nil, net.IPv4(10, 1, 0, 101))
+
+	// An offer that is not taken is forgotten.
+	ack(a, net.IPv4(10, 1, 0, 101), false)
+	table.forget(c)
+	ack(a, net.IPv4(10, 1, 0, 101), true)
+}
+
+func TestLeaseTableExcluded(t *testing.T) {
+	a := net.HardwareAddr{1, 2, 3, 4, 5, 2}
+	b := net.HardwareAddr{1, 2, 3, 4, 5, 3}
+
+	pool := mustPool(t, "subnet=10.1.0.0/29,range=10.1.0.0-10.1.0.7,router=10.1.0.1,lease=1h")
+	table, err := newLeaseTable([]DHCPPool{pool}, []net.IP{net.IPv4(10, 1, 0, 2)}, nil, slog.Default())
+	if err != nil {
+		t.Fatalf("creating lease table: %s", err)
+	}
+	p := &table.pools[0]
+
+	ip, err := table.offer(p, a, net.IPv4(10, 1, 0, 1))
+	if err != nil || !ip.Equal(net.IPv4(10, 1, 0, 3)) {
+		t.Fatalf("offer to %s: got %s, %v, want 10.1.0.3", a, ip, err)
+	}
+	for _, ip := range []net.IP{net.IPv4(10, 1, 0, 0), net.IPv4(10, 1, 0, 1), net.IPv4(10, 1, 0, 2), net.IPv4(10, 1, 0, 7)} {
+		if _, err := table.ack(p, b, ip); !errors.Is(err, errAddressInvalid) {
+			t.Errorf("ack of %s: got error %v, want errAddressInvalid", ip, err)
+		}
+	}
+
+	// A machine in INIT-REBOOT requests its previous address without
+	// an offer, which it gets if the address is free.
+	if d, err := table.ack(p, b, net.IPv4(10, 1, 0, 5)); err != nil || d != time.Hour {
+		t.Fatalf("ack of a free address without offer: %s, %v", d, err)
+	}
+	if _, err := table.ack(p, a, net.IPv4(10, 1, 0, 5)); !errors.Is(err, errAddressInvalid) {
+		t.Errorf("ack of a bound address: got error %v, want errAddressInvalid", err)
+	}
+}
+
+func TestLeaseTableStore(t *testing.T) {
+	a := net.HardwareAddr{1, 2, 3, 4, 5, 2}
+	b := net.HardwareAddr{1, 2, 3, 4, 5, 3}
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool := mustPool(t, "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.102,lease=1h")
+
+	open := func() *leaseTable {
+		t.Helper()
+		store, err := leasestore.NewFileLeaseStore(path)
+		if err != nil {
+			t.Fatalf("opening lease store: %s", err)
+		}
+		table, err := newLeaseTable([]DHCPPool{pool}, nil, store, slog.Default())
+		if err != nil {
+			t.Fatalf("creating lease table: %s", err)
+		}
+		return table
+	}
+
+	table := open()
+	p := &table.pools[0]
+	if _, err := table.offer(p, a, nil); err != nil {
+		t.Fatalf("offer to %s: %s", a, err)
+	}
+	if _, err := table.ack(p, a, net.IPv4(10, 1, 0, 100)); err != nil {
+		t.Fatalf("ack to %s: %s", a, err)
+	}
+	table.decline(b, net.IPv4(10, 1, 0, 101))
+	// Offers aren't stored.
+	if _, err := table.offer(p, b, nil); err != nil {
+		t.Fatalf("offer to %s: %s", b, err)
+	}
+
+	// After a restart, a keeps its lease and the declined address is
+	// still blocked.
+	table = open()
+	p = &table.pools[0]
+	leases := table.list()
+	if len(leases) != 2 {
+		t.Fatalf("got %d leases after restart, want 2: %v", len(leases), leases)
+	}
+	if l := leases[0]; !l.IPAddress.Equal(net.IPv4(10, 1, 0, 100)) || l.HardwareAddr.String() != a.String() || l.State != dhcp4.LeaseBound {
+		t.Errorf("got lease %+v, want 10.1.0.100 bound to %s", l, a)
+	}
+	if l := leases[1]; !l.IPAddress.Equal(net.IPv4(10, 1, 0, 101)) || l.State != dhcp4.LeaseDeclined {
+		t.Errorf("got lease %+v, want 10.1.0.101 declined", l)
+	}
+	if ip, err := table.offer(p, b, nil); err != nil || !ip.Equal(net.IPv4(10, 1, 0, 102)) {
+		t.Errorf("offer to %s after restart: got %s, %v, want 10.1.0.102", b, ip, err)
+	}
+
+	// A revoked lease is gone after a restart, too.
+	if !table.revoke(net.IPv4(10, 1, 0, 100)) {
+		t.Fatal("revoking lease of 10.1.0.100 found no lease")
+	}
+	if table.revoke(net.IPv4(10, 1, 0, 100)) {
+		t.Error("revoked lease of 10.1.0.100 twice")
+	}
+	table = open()
+	if leases := table.list(); len(leases) != 1 || leases[0].State != dhcp4.LeaseDeclined {
+		t.Errorf("got leases %v after revoking, want only the declined one", leases)
+	}
+}
+
+func TestLeasesAdmin(t *testing.T) {
+	pool := mustPool(t, "subnet=10.1.0.0/24,range=10.1.0.100-10.1.0.200")
+	pool.Reservations = []DHCPReservation{{MAC: net.HardwareAddr{1, 2, 3, 4, 5, 1}, IP: net.IPv4(10, 1, 0, 10)}}
+	leases, err := newLeaseTable([]DHCPPool{pool}, nil, nil, slog.Default())
+	if err != nil {
+		t.Fatalf("creating lease table: %s", err)
+	}
+	s := &Server{Log: slog.Default(), leases: leases}
+	mux := http.NewServeMux()
+	s.serveAdmin(mux)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, adminRequest(method, url, strings.NewReader(body)))
+		return rr
+	}
+
+	rr := do("PUT", "/admin/leases", `[{"mac":"01:02:03:04:05:06","ip":"10.1.0.150","expiry":"2030-01-02T03:04:05Z","state":"bound"}]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("importing leases got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	want := `[
+  {
+    "mac": "01:02:03:04:05:06",
+    "ip": "10.1.0.150",
+    "expiry": "2030-01-02T03:04:05Z",
+    "state": "bound"
+  }
+]`
+	if rr.Body.String() != want {
+		t.Errorf("got leases %s, want %s", rr.Body, want)
+	}
+	if rr := do("GET", "/admin/leases", ""); rr.Body.String() != want {
+		t.Errorf("got leases %s, want %s", rr.Body, want)
+	}
+
+	for _, bad := range []string{
+		`[{"mac":"01:02:03:04:05:06","ip":"10.2.0.150","state":"bound"}]`,
+		`[{"mac":"01:02:03:04:05:06","ip":"10.1.0.10","state":"bound"}]`,
+		`[{"mac":"01:02:03:04:05:06","ip":"10.1.0.151","state":"stolen"}]`,
+		`{}`,
+	} {
+		if rr := do("POST", "/admin/leases", bad); rr.Code != http.StatusBadRequest {
+			t.Errorf("importing %s got HTTP %d, want 400", bad, rr.Code)
+		}
+	}
+
+	if rr := do("DELETE", "/admin/leases?ip=10.1.0.151", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoking unknown lease got HTTP %d, want 404", rr.Code)
+	}
+	if rr := do("DELETE", "/admin/leases?ip=nope", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("revoking invalid address got HTTP %d, want 400", rr.Code)
+	}
+	if rr := do("DELETE", "/admin/leases?ip=10.1.0.150", ""); rr.Code != http.StatusOK || rr.Body.String() != "[]" {
+		t.Errorf("revoking lease got HTTP %d: %s", rr.Code, rr.Body)
+	}
+}
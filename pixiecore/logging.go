@@ -42,6 +42,10 @@ func (m machineState) String() string {
 		return "Sent initrd(s) (HTTP)"
 	case machineStateBooted:
 		return "Booted machine"
+	case machineStateTFTPFile:
+		return "Sent boot file (TFTP)"
+	case machineStateThrottled:
+		return "Throttled boot requests"
 	default:
 		return "Unknown"
 	}
@@ -56,8 +60,10 @@ const (
 	machineStateKernel
 	machineStateInitrd
 	machineStateBooted
+	machineStateTFTPFile
 
 	machineStateIgnored
+	machineStateThrottled
 )
 
 type machineEvent struct {
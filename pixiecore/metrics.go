@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "pixie"
+
+var (
+	fileDownloadsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "file",
+		Name:      "downloads_active",
+		Help:      "Number of boot file downloads currently being served.",
+	})
+	fileDownloadsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "file",
+		Name:      "downloads_queued",
+		Help:      "Number of boot file downloads waiting for a free download slot.",
+	})
+	fileDownloadsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "file",
+		Name:      "downloads_rejected_total",
+		Help:      "Boot file downloads that were told to retry later because all download slots were busy.",
+	})
+	fileBytesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "file",
+		Name:      "bytes_sent_total",
+		Help:      "Bytes of boot files sent over HTTP.",
+	})
+	fileThrottledSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "file",
+		Name:      "throttled_seconds_total",
+		Help:      "Time boot file downloads spent waiting for bandwidth.",
+	})
+	fileLimitInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "file",
+		Name:      "limit",
+		Help:      "Configured boot file download limits, 0 means unlimited.",
+	}, []string{"limit"})
+
+	drainEnabled = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "drain",
+		Name:      "enabled",
+		Help:      "1 if the server is draining and makes no new boot offers, 0 otherwise.",
+	})
+	drainSuppressedOffers = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "drain",
+		Name:      "suppressed_offers_total",
+		Help:      "Boot offers that were not made because the server is draining.",
+	})
+
+	filterIgnored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "filter",
+		Name:      "ignored_requests_total",
+		Help:      "Boot requests ignored because of the client filters, by interface.",
+	}, []string{"interface"})
+
+	interfaceRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "interface",
+		Name:      "boot_requests_total",
+		Help:      "Boot requests received, by interface and protocol.",
+	}, []string{"interface", "protocol"})
+	interfaceOffers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "interface",
+		Name:      "boot_offers_total",
+		Help:      "Boot offers sent, by interface and protocol.",
+	}, []string{"interface", "protocol"})
+
+	dhcpThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dhcp",
+		Name:      "throttled_requests_total",
+		Help:      "Boot requests dropped because of rate limits, by interface, protocol and exceeded limit.",
+	}, []string{"interface", "protocol", "limit"})
+
+	dhcpServerReplies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dhcp_server",
+		Name:      "replies_total",
+		Help:      "Replies sent as a full DHCP server, by message type.",
+	}, []string{"type"})
+	dhcpPoolExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dhcp_server",
+		Name:      "pool_exhausted_total",
+		Help:      "DHCPDISCOVERs that got no offer because the pool had no free address.",
+	})
+
+	reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reload",
+		Name:      "total",
+		Help:      "Reloads of the iPXE configuration, by result.",
+	}, []string{"result"})
+	reloadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reload",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful reload of the iPXE configuration.",
+	})
+)
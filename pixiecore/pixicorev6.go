@@ -1,6 +1,7 @@
 package pixiecore
 
 import (
+	"context"
 	"encoding/binary"
 	"log/slog"
 	"net"
@@ -19,7 +20,8 @@ type ServerV6 struct {
 	PacketBuilder *dhcp6.PacketBuilder
 	AddressPool   dhcp6.AddressPool
 
-	errs chan error
+	errs      chan error
+	lifecycle lifecycle
 
 	Log *slog.Logger
 }
@@ -35,6 +37,9 @@ func NewServerV6() *ServerV6 {
 // Serve listens for machines attempting to boot, and responds to
 // their DHCPv6 requests.
 func (s *ServerV6) Serve() error {
+	s.lifecycle.init()
+	defer s.lifecycle.done(nil)
+
 	s.Log.Info("starting...")
 
 	dhcp, err := dhcp6.NewConn(s.Address, s.Port)
@@ -44,31 +49,32 @@ func (s *ServerV6) Serve() error {
 
 	s.Log.Debug("new connection...")
 
-	// 5 buffer slots, one for each goroutine, plus one for
-	// Shutdown(). We only ever pull the first error out, but shutdown
-	// will likely generate some spurious errors from the other
-	// goroutines, and we want them to be able to dump them without
-	// blocking.
-	s.errs = make(chan error, 6)
+	// One buffer slot for the DHCP goroutine, so that it can report
+	// the error caused by closing its connection without blocking.
+	s.errs = make(chan error, 1)
 
 	s.setDUID(dhcp.SourceHardwareAddress())
 
 	go func() { s.errs <- s.serveDHCP(dhcp) }()
 
 	// Wait for either a fatal error, or Shutdown().
-	err = <-s.errs
+	select {
+	case err = <-s.errs:
+	case <-s.lifecycle.stop:
+	}
 	_ = dhcp.Close()
 
 	s.Log.Info("stopped...")
 	return err
 }
 
-// Shutdown causes Serve() to exit, cleaning up behind itself.
-func (s *ServerV6) Shutdown() {
-	select {
-	case s.errs <- nil:
-	default:
-	}
+// Shutdown stops Serve from answering DHCPv6 requests and waits for it
+// to return, or for ctx to be done.
+//
+// DHCPv6 exchanges are a single round trip, so unlike
+// Server.Shutdown there are no transfers to wait for.
+func (s *ServerV6) Shutdown(ctx context.Context) error {
+	return s.lifecycle.shutdown(ctx)
 }
 
 func (s *ServerV6) setDUID(addr net.HardwareAddr) {
@@ -16,19 +16,25 @@ package pixiecore // import "github.com/metal-stack/pixie/pixiecore"
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	httppprof "net/http/pprof"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/metal-stack/pixie/api"
 	"github.com/metal-stack/pixie/dhcp4"
 	"github.com/metal-stack/v"
+	"github.com/pin/tftp/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -72,9 +78,20 @@ func (a Architecture) String() string {
 
 // A Machine describes a machine that is attempting to boot.
 type Machine struct {
+	// MAC is the hardware address of the machine or, for machines
+	// that send none such as InfiniBand ones, its DHCP client
+	// identifier (option 61).
 	MAC  net.HardwareAddr
 	Arch Architecture
 	GUID string
+	// Relay is the relay agent information (DHCP option 82) that the
+	// machine's DHCP request was relayed with, if any. It is only set
+	// while the machine is offered to boot.
+	Relay *dhcp4.RelayAgentInfo
+	// IP is the address that the machine's HTTP or TFTP request came
+	// from. It is only set while the machine fetches its boot script
+	// and files.
+	IP net.IP
 }
 
 func (m Machine) String() string {
@@ -104,6 +121,15 @@ type Spec struct {
 	// responsibility to make the boot succeed, Pixiecore's
 	// involvement ends when it serves your script.
 	IpxeScript string
+
+	// Optional name of a binary in Server.IpxeBinaries that the
+	// machine should chainload instead of the one picked by
+	// Server.IpxeRules or its firmware type.
+	IpxeBinary string
+
+	// Optional boot menu for legacy BIOS machines, shown by their
+	// PXE firmware before iPXE is chainloaded.
+	PXEMenu *PXEMenu
 }
 
 func expandCmdline(tpl string, funcs template.FuncMap) (string, error) {
@@ -145,6 +171,42 @@ type Booter interface {
 	WriteBootFile(id ID, body io.Reader) error
 }
 
+// A MachineBooter is a Booter that wants to know which machine reads
+// a boot file, e.g. to check that the ID was handed out to it. For
+// Booters that implement it, Pixiecore calls ReadMachineBootFile
+// instead of ReadBootFile.
+type MachineBooter interface {
+	Booter
+	// ReadMachineBootFile is ReadBootFile on behalf of the machine
+	// m. Only the fields of m that the requester supplied are set,
+	// which may be none at all.
+	ReadMachineBootFile(m Machine, id ID) (io.ReadCloser, int64, error)
+}
+
+// readMachineBootFile reads id from b on behalf of m.
+func readMachineBootFile(b Booter, m Machine, id ID) (io.ReadCloser, int64, error) {
+	if mb, ok := b.(MachineBooter); ok {
+		return mb.ReadMachineBootFile(m, id)
+	}
+	return b.ReadBootFile(id)
+}
+
+// A BootFile is a boot file that supports random access.
+//
+// If the ReadCloser returned by Booter.ReadBootFile implements
+// BootFile and its size is known, Pixiecore answers HEAD, range and
+// conditional requests for it, which lets clients resume interrupted
+// downloads.
+type BootFile interface {
+	io.ReadSeekCloser
+	// ModTime returns the time the file was last modified, or the
+	// zero time if unknown.
+	ModTime() time.Time
+	// ETag returns the HTTP entity tag of the file, including
+	// quotes, or "" if unknown.
+	ETag() string
+}
+
 // Firmware describes a kind of firmware attempting to boot.
 //
 // This should only be used for selecting the right bootloader within
@@ -168,6 +230,10 @@ type Server struct {
 
 	// Address to listen on, or empty for all interfaces.
 	Address string
+	// Interfaces, if set, are the only networks machines are booted
+	// on, each with its own boot policy. Address must be empty or
+	// 0.0.0.0 then.
+	Interfaces []Interface
 	// HTTP port for boot services.
 	HTTPPort int
 	// HTTP port for human-readable information. Can be the same as
@@ -178,11 +244,42 @@ type Server struct {
 	MetricsPort int
 	// MetricsAddress is the bind address that the metrics server listens on.
 	MetricsAddress string
+	// AdminToken, if set, must be presented as a bearer token to use
+	// the admin API on the metrics server. Without it, the admin API
+	// only answers requests from localhost.
+	AdminToken string
 
 	// Ipxe lists the supported bootable Firmwares, and their
 	// associated ipxe binary.
 	Ipxe map[Firmware][]byte
 
+	// IpxeBinaries are additional iPXE binaries, by name, for
+	// machines that need a different binary than the one for their
+	// firmware type.
+	IpxeBinaries map[string][]byte
+	// IpxeRules select a binary from IpxeBinaries for the machines
+	// they match. The first matching rule wins; machines that match
+	// no rule get the binary in Ipxe for their firmware type.
+	IpxeRules []IpxeRule
+	// Reloader, if set, returns the new ReloadConfig when a reload is
+	// requested with Reload or the admin API. Ipxe, IpxeBinaries,
+	// IpxeRules, FirmwareRules and DHCPLimits are only used until
+	// the first reload.
+	Reloader func() (ReloadConfig, error)
+
+	// FirmwareRules classify machines into architectures and
+	// firmware types, before DefaultFirmwareRules. They add client
+	// system architecture codes, quirks of specific vendor classes or
+	// overrides for single machines.
+	FirmwareRules []FirmwareRule
+
+	// TFTP configures the TFTP server.
+	TFTP TFTPConfig
+
+	// FileLimits restricts the boot file downloads served over
+	// HTTP. The zero value imposes no limits.
+	FileLimits FileLimits
+
 	// Log receives logs on Pixiecore's operation. If nil, logging
 	// is suppressed.
 	Log *slog.Logger
@@ -199,29 +296,69 @@ type Server struct {
 	//
 	// Currently only supported on Linux.
 	DHCPNoBind bool
-
-	errs chan error
+	// DHCPUnicast sends the DHCP replies that RFC 2131 wants unicast
+	// to a machine's hardware address in Ethernet frames addressed to
+	// it, instead of broadcasting them. This needs CAP_NET_RAW.
+	//
+	// Currently only supported on Linux.
+	DHCPUnicast bool
+
+	// DHCPPools, if set, make the Server a full DHCP server that
+	// leases addresses from the pools and folds the boot instructions
+	// into its offers, instead of a ProxyDHCP server next to another
+	// DHCP server. DHCPNoBind must not be set then.
+	DHCPPools []DHCPPool
+	// LeaseStore, if set, keeps the leases of DHCPPools across
+	// restarts.
+	LeaseStore dhcp4.LeaseStore
+
+	// DHCPLimits limit how many boot requests are answered per
+	// machine and per Interface.
+	DHCPLimits DHCPLimits
+
+	// CaptureDir, if set, is where the packet captures started with
+	// the admin API are written as pcapng files, one per machine.
+	CaptureDir string
+	// CapturePackets is how many of the latest packets of each
+	// captured machine are kept in memory for download. Zero means
+	// 1000.
+	CapturePackets int
+
+	errs      chan error
+	lifecycle lifecycle
+
+	files       *fileLimiter
+	dhcpLimiter *dhcpLimiter
+	drain       drainState
+	filters     filterState
+	leases      *leaseTable
+	ipxe        atomic.Pointer[IpxeConfig]
+	firmware    atomic.Pointer[[]FirmwareRule]
+	captures    captureTable
 
 	eventsMu sync.Mutex
 	events   map[string][]machineEvent
 
+	ipxeChoices ipxeChoiceState
+
+	pxeMenus pxeMenuState
+
+	tftpTransfers tftpTransfers
+
+	localAddrs localAddrCache
+
 	MetalConfig *api.MetalConfig
 }
 
 // Serve listens for machines attempting to boot, and uses Booter to
 // help them.
 func (s *Server) Serve() error {
-	if s.DHCPPort == 0 {
-		s.DHCPPort = portDHCP
-	}
-	if s.TFTPPort == 0 {
-		s.TFTPPort = portTFTP
-	}
-	if s.PXEPort == 0 {
-		s.PXEPort = portPXE
-	}
-	if s.HTTPPort == 0 {
-		s.HTTPPort = portHTTP
+	var shutdownErr error
+	s.lifecycle.init()
+	defer func() { s.lifecycle.done(shutdownErr) }()
+
+	if err := s.prepare(); err != nil {
+		return err
 	}
 
 	newDHCP := dhcp4.NewConn
@@ -233,6 +370,13 @@ func (s *Server) Serve() error {
 	if err != nil {
 		return err
 	}
+	if s.DHCPUnicast {
+		if err = dhcp.EnableLinkLayerUnicast(); err != nil {
+			_ = dhcp.Close()
+			return err
+		}
+	}
+	dhcp.SetTap(s.capturePacket)
 	pxe, err := net.ListenPacket("udp4", fmt.Sprintf("%s:%d", s.Address, s.PXEPort))
 	if err != nil {
 		_ = dhcp.Close()
@@ -252,41 +396,156 @@ func (s *Server) Serve() error {
 		return err
 	}
 
-	tftpAddr := fmt.Sprintf("%s:%d", s.Address, s.TFTPPort)
+	tftpConn, err := net.ListenPacket("udp4", fmt.Sprintf("%s:%d", s.Address, s.TFTPPort))
+	if err != nil {
+		_ = dhcp.Close()
+		_ = pxe.Close()
+		_ = http.Close()
+		_ = metrics.Close()
+		return err
+	}
+	tftpServers := []*tftp.Server{s.newTFTPServer()}
+	tftpConns := []net.PacketConn{tftpConn}
+	if s.TFTP.IPv6Address != "" {
+		tftp6, err := net.ListenPacket("udp6", net.JoinHostPort(s.TFTP.IPv6Address, strconv.Itoa(s.TFTPPort)))
+		if err != nil {
+			_ = dhcp.Close()
+			_ = pxe.Close()
+			_ = http.Close()
+			_ = metrics.Close()
+			_ = tftpConn.Close()
+			return err
+		}
+		tftpServers = append(tftpServers, s.newTFTPServer())
+		tftpConns = append(tftpConns, tftp6)
+	}
 
-	s.events = make(map[string][]machineEvent)
-	// 5 buffer slots, one for each goroutine, plus one for
-	// Shutdown(). We only ever pull the first error out, but shutdown
-	// will likely generate some spurious errors from the other
-	// goroutines, and we want them to be able to dump them without
-	// blocking.
-	s.errs = make(chan error, 6)
+	// One buffer slot for each goroutine. We only ever pull the
+	// first error out, but shutdown will likely generate some
+	// spurious errors from the other goroutines, and we want them to
+	// be able to dump them without blocking.
+	s.errs = make(chan error, 4+len(tftpServers))
 
 	s.Log.Debug("Starting Pixiecore goroutines", "version", v.V.String())
 
+	httpServer := newHTTPServer(s.serveHTTP)
+	metricsServer := newHTTPServer(s.serveMetrics, s.serveAdmin)
+
 	go func() { s.errs <- s.serveDHCP(dhcp) }()
 	go func() { s.errs <- s.servePXE(pxe) }()
-	go func() { s.errs <- s.serveTFTP(tftpAddr) }()
-	go func() { s.errs <- serveHTTP(http, s.serveHTTP) }()
-	go func() { s.errs <- serveHTTP(metrics, s.serveMetrics) }()
+	for i := range tftpServers {
+		go func() { s.errs <- serveTFTP(tftpServers[i], tftpConns[i]) }()
+	}
+	go func() { s.errs <- serveHTTP(httpServer, http) }()
+	go func() { s.errs <- serveHTTP(metricsServer, metrics) }()
 
 	// Wait for either a fatal error, or Shutdown().
-	err = <-s.errs
+	select {
+	case err = <-s.errs:
+	case ctx := <-s.lifecycle.stop:
+		s.Log.Info("Shutting down, waiting for running transfers to finish")
+		// Stop making offers, so that no new boots start here.
+		_ = dhcp.Close()
+		_ = pxe.Close()
+		shutdownErr = drainTransfers(ctx, httpServer, tftpServers, &s.tftpTransfers)
+		if shutdownErr != nil {
+			s.Log.Info("Aborting running transfers", "error", shutdownErr)
+		}
+	}
 	_ = dhcp.Close()
 	_ = pxe.Close()
-	_ = http.Close()
-	_ = metrics.Close()
+	_ = httpServer.Close()
+	_ = metricsServer.Close()
+	for i, srv := range tftpServers {
+		go srv.Shutdown()
+		_ = tftpConns[i].Close()
+	}
+	s.stopCaptures()
 	return err
 }
 
-// Shutdown causes Serve() to exit, cleaning up behind itself.
-func (s *Server) Shutdown() {
+// prepare validates the configuration of s and sets up its state,
+// short of opening any sockets.
+func (s *Server) prepare() error {
+	if s.DHCPPort == 0 {
+		s.DHCPPort = portDHCP
+	}
+	if s.TFTPPort == 0 {
+		s.TFTPPort = portTFTP
+	}
+	if s.PXEPort == 0 {
+		s.PXEPort = portPXE
+	}
+	if s.HTTPPort == 0 {
+		s.HTTPPort = portHTTP
+	}
+
+	err := s.setIpxeConfig(IpxeConfig{
+		Ipxe:         s.Ipxe,
+		IpxeBinaries: s.IpxeBinaries,
+		IpxeRules:    s.IpxeRules,
+	})
+	if err != nil {
+		return err
+	}
+	if err = s.validateInterfaces(); err != nil {
+		return err
+	}
+	if len(s.DHCPPools) > 0 {
+		if s.DHCPNoBind {
+			return errors.New("can't lease addresses without binding to the DHCP port")
+		}
+		local, err := s.serverIPs()
+		if err != nil {
+			return err
+		}
+		if s.leases, err = newLeaseTable(s.DHCPPools, local, s.LeaseStore, s.Log); err != nil {
+			return err
+		}
+	}
+	s.events = make(map[string][]machineEvent)
+	s.files = newFileLimiter(s.FileLimits)
+	s.dhcpLimiter = newDHCPLimiter(s.DHCPLimits)
+	return nil
+}
+
+// drainTransfers waits until ctx is done for the transfers running on
+// httpServer and tftpServers, tracked by transfers, to finish, while
+// refusing new ones.
+func drainTransfers(ctx context.Context, httpServer *http.Server, tftpServers []*tftp.Server, transfers *tftpTransfers) error {
+	var wg sync.WaitGroup
+	wg.Go(func() { _ = httpServer.Shutdown(ctx) })
+	wg.Go(func() {
+		// Single-port servers abort their transfers on Shutdown,
+		// so wait for them first.
+		transfers.drain()
+		for _, srv := range tftpServers {
+			srv.Shutdown()
+		}
+	})
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
 	select {
-	case s.errs <- nil:
-	default:
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// Shutdown stops Serve from making new boot offers, waits for running
+// HTTP and TFTP transfers to finish, and then makes Serve return.
+//
+// If ctx is done before all transfers have finished, Shutdown returns
+// the context's error and the remaining transfers are aborted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.lifecycle.shutdown(ctx)
+}
+
 func (s *Server) serveMetrics(mux *http.ServeMux) {
 	mux.Handle("/metrics", promhttp.Handler())
 	// see: https://dev.to/davidsbond/golang-debugging-memory-leaks-using-pprof-5di8
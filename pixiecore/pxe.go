@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/metal-stack/pixie/dhcp4"
 	"golang.org/x/net/ipv4"
@@ -49,12 +50,7 @@ func (s *Server) servePXE(conn net.PacketConn) error {
 		}
 
 		if err = s.isBootDHCP(pkt); err != nil {
-			s.Log.Debug("Ignoring packet", "mac", pkt.HardwareAddr.String(), "addr", addr, "error", err)
-		}
-		fwtype, err := s.validatePXE(pkt)
-		if err != nil {
-			s.Log.Info("Unusable packet", "mac", pkt.HardwareAddr.String(), "addr", addr, "error", err)
-			continue
+			s.Log.Debug("Ignoring packet", "mac", pkt.MachineAddr().String(), "addr", addr, "error", err)
 		}
 
 		intf, err := net.InterfaceByIndex(msg.IfIndex)
@@ -62,53 +58,111 @@ func (s *Server) servePXE(conn net.PacketConn) error {
 			s.Log.Info("Couldn't get information about local network interface", "ifindex", msg.IfIndex, "error", err)
 			continue
 		}
+		src, _ := addr.(*net.UDPAddr)
+		local := &net.UDPAddr{IP: net.IPv4zero, Port: s.PXEPort}
+		s.capturePacket(&dhcp4.CapturedPacket{Time: time.Now(), Direction: dhcp4.DirectionIn, Interface: intf, Src: src, Dst: local, Data: buf[:n]})
 
-		serverIP, err := interfaceIP(intf)
+		iface, err := s.packetInterface(intf, pkt)
 		if err != nil {
-			s.Log.Info("Want to boot, but couldn't get a source address", "mac", pkt.HardwareAddr.String(), "addr", addr, "interface", intf.Name, "error", err)
+			s.Log.Debug("Ignoring packet", "mac", pkt.MachineAddr().String(), "addr", addr, "interface", intf.Name, "error", err)
+			continue
+		}
+		if s.throttled(pkt, iface, "pxe") {
+			continue
+		}
+		resp := s.pxeReply(pkt, intf, iface, addr)
+		if resp == nil {
 			continue
 		}
-
-		s.machineEvent(pkt.HardwareAddr, machineStatePXE, "Sent PXE configuration")
-
-		resp := s.offerPXE(pkt, serverIP, fwtype)
 
 		bs, err := resp.Marshal()
 		if err != nil {
-			s.Log.Info("Failed to marshal PXE offer", "mac", pkt.HardwareAddr.String(), "addr", addr, "error", err)
+			s.Log.Info("Failed to marshal PXE offer", "mac", pkt.MachineAddr().String(), "addr", addr, "error", err)
 			continue
 		}
 
 		if _, err := l.WriteTo(bs, &ipv4.ControlMessage{
 			IfIndex: msg.IfIndex,
 		}, addr); err != nil {
-			s.Log.Info("Failed to send PXE response", "mac", pkt.HardwareAddr.String(), "to", addr, "error", err)
+			s.Log.Info("Failed to send PXE response", "mac", pkt.MachineAddr().String(), "to", addr, "error", err)
+			continue
 		}
+		s.capturePacket(&dhcp4.CapturedPacket{Time: time.Now(), Direction: dhcp4.DirectionOut, Interface: intf, Src: local, Dst: src, Data: bs})
+		interfaceOffers.WithLabelValues(iface.Name, "pxe").Inc()
 	}
 }
 
-func (s *Server) validatePXE(pkt *dhcp4.Packet) (fwtype Firmware, err error) {
-	fwt, err := pkt.Options.Uint16(93)
+// pxeReply returns the reply to the PXE request pkt, received from addr
+// on intf and served by iface, or nil if pkt is ignored.
+func (s *Server) pxeReply(pkt *dhcp4.Packet, intf *net.Interface, iface *Interface, addr net.Addr) *dhcp4.Packet {
+	interfaceRequests.WithLabelValues(iface.Name, "pxe").Inc()
+
+	fwtype, err := s.validatePXE(pkt)
 	if err != nil {
-		return 0, fmt.Errorf("malformed DHCP option 93 (required for PXE): %w", err)
+		s.Log.Info("Unusable packet", "mac", pkt.MachineAddr().String(), "addr", addr, "error", err)
+		return nil
 	}
-	// see: https://ipxe.org/cfg/platform for reference
-	switch fwt {
-	case 0:
-		fwtype = FirmwareX86Ipxe
-	case 6:
-		fwtype = FirmwareEFI32
-	case 7:
-		fwtype = FirmwareEFI64
-	case 9:
-		fwtype = FirmwareEFIBC
-	default:
-		return 0, fmt.Errorf("unsupported client firmware type '%d' (please file a bug!)", fwt)
+	// A legacy BIOS machine asking for the item it chose from its PXE
+	// menu.
+	var menuItem *dhcp4.PXEBootItem
+	if pxe, err := pkt.Options.PXEVendorOptions(); err == nil && pxe.BootItem != nil {
+		menuItem = pxe.BootItem
+		if fwtype == FirmwareX86Ipxe {
+			fwtype = FirmwareX86PC
+		}
+	}
+	if !iface.servesFirmware(fwtype) {
+		s.Log.Debug("Ignoring packet, firmware type not booted on interface", "mac", pkt.MachineAddr().String(), "interface", iface.Name, "firmware", fwtype)
+		return nil
+	}
+
+	if s.filtered(pkt, iface) || !s.mayOffer(pkt.MachineAddr()) {
+		return nil
+	}
+
+	serverIP, err := advertiseIP(iface, intf)
+	if err != nil {
+		s.Log.Info("Want to boot, but couldn't get a source address", "mac", pkt.MachineAddr().String(), "addr", addr, "interface", intf.Name, "error", err)
+		return nil
+	}
+
+	ipxe := s.chosenIpxe(pkt.MachineAddr())
+	if menuItem != nil {
+		name, ok := s.pxeMenuChoice(pkt.MachineAddr(), menuItem.Type)
+		if !ok {
+			s.Log.Info("Ignoring choice of unknown PXE menu item", "mac", pkt.MachineAddr().String(), "addr", addr, "type", menuItem.Type)
+			return nil
+		}
+		if name != "" {
+			ipxe = name
+		}
+	}
+	if ipxe == "" {
+		guid, _ := pkt.Options.GUID(97)
+		ipxe = s.selectIpxe(newIpxeClient(pkt, guid, fwtype), "")
 	}
-	if s.Ipxe[fwtype] == nil {
-		return 0, fmt.Errorf("unsupported client firmware type '%d' (please file a bug!)", fwtype)
+	if ipxe == "" && s.ipxeConfig().Ipxe[fwtype] == nil {
+		s.Log.Info("Unusable packet", "mac", pkt.MachineAddr().String(), "addr", addr, "error", fmt.Errorf("unsupported client firmware type '%d' (please file a bug!)", fwtype))
+		return nil
 	}
 
+	s.machineEvent(pkt.MachineAddr(), machineStatePXE, "Sent PXE configuration")
+
+	resp := s.offerPXE(pkt, serverIP, fwtype, ipxe)
+	if menuItem != nil {
+		// The reply names the item it is for.
+		if err := resp.Options.SetPXEVendorOptions(&dhcp4.PXEVendorOptions{BootItem: menuItem}); err != nil {
+			s.Log.Info("Failed to serialize PXE vendor options", "mac", pkt.MachineAddr().String(), "addr", addr, "error", err)
+			return nil
+		}
+	}
+	return resp
+}
+
+func (s *Server) validatePXE(pkt *dhcp4.Packet) (fwtype Firmware, err error) {
+	if _, fwtype, err = s.classify(pkt, "pxe"); err != nil {
+		return 0, err
+	}
 	guid := pkt.Options[97]
 	switch len(guid) {
 	case 0:
@@ -125,24 +179,25 @@ func (s *Server) validatePXE(pkt *dhcp4.Packet) (fwtype Firmware, err error) {
 	return fwtype, nil
 }
 
-func (s *Server) offerPXE(pkt *dhcp4.Packet, serverIP net.IP, fwtype Firmware) (resp *dhcp4.Packet) {
+func (s *Server) offerPXE(pkt *dhcp4.Packet, serverIP net.IP, fwtype Firmware, ipxe string) (resp *dhcp4.Packet) {
 	resp = &dhcp4.Packet{
 		Type:           dhcp4.MsgAck,
 		TransactionID:  pkt.TransactionID,
+		HardwareType:   pkt.HardwareType,
 		HardwareAddr:   pkt.HardwareAddr,
 		ClientAddr:     pkt.ClientAddr,
 		RelayAddr:      pkt.RelayAddr,
 		ServerAddr:     serverIP,
 		BootServerName: serverIP.String(),
-		BootFilename:   fmt.Sprintf("%s/%d", pkt.HardwareAddr, fwtype),
-		Options: dhcp4.Options{
-			dhcp4.OptServerIdentifier: serverIP,
-			dhcp4.OptVendorIdentifier: []byte("PXEClient"),
-		},
+		BootFilename:   ipxePath(pkt.MachineAddr(), fwtype, ipxe),
+		Options:        dhcp4.Options{},
 	}
-	if pkt.Options[97] != nil {
-		resp.Options[97] = pkt.Options[97]
+	_ = resp.Options.SetIP(dhcp4.OptServerIdentifier, serverIP)
+	resp.Options.SetString(dhcp4.OptVendorIdentifier, "PXEClient")
+	if pkt.Options[dhcp4.OptClientMachineID] != nil {
+		resp.Options.SetBytes(dhcp4.OptClientMachineID, pkt.Options[dhcp4.OptClientMachineID])
 	}
+	echoClientID(pkt, resp)
 
 	return resp
 }
@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// pxeMenuBaseType is the boot server type of the first network item of
+// a PXEMenu. Types from here on are free for vendor use.
+const pxeMenuBaseType = 0x8000
+
+// pxeMenuTTL is how long the menu shown to a machine is remembered for
+// its choice on the PXE port. It is generous, because a menu without
+// a timeout waits for someone at the console.
+const pxeMenuTTL = time.Hour
+
+// prunePXEMenusInterval is how often the expired menus are forgotten.
+const prunePXEMenusInterval = time.Minute
+
+// pxeMenuState remembers the binaries of the menus shown to machines,
+// by MAC address.
+type pxeMenuState struct {
+	mu        sync.Mutex
+	menus     map[string]shownPXEMenu
+	lastPrune time.Time
+}
+
+type shownPXEMenu struct {
+	binaries []string
+	shown    time.Time
+}
+
+// prune forgets the menus that were shown longer than pxeMenuTTL ago,
+// so that machines that never choose don't accumulate.
+func (m *pxeMenuState) prune(now time.Time) {
+	if now.Sub(m.lastPrune) < prunePXEMenusInterval {
+		return
+	}
+	m.lastPrune = now
+	for k, menu := range m.menus {
+		if now.Sub(menu.shown) > pxeMenuTTL {
+			delete(m.menus, k)
+		}
+	}
+}
+
+// A PXEMenu is a boot menu that the PXE firmware of legacy BIOS
+// machines shows before chainloading iPXE. Other machines ignore it.
+type PXEMenu struct {
+	// Prompt is shown for Timeout, after which the first of Items is
+	// booted unless a key is pressed to show the menu. A negative
+	// Timeout shows the menu right away and waits for a choice.
+	Prompt  string
+	Timeout time.Duration
+	Items   []PXEMenuItem
+}
+
+// A PXEMenuItem is an entry of a PXEMenu.
+type PXEMenuItem struct {
+	Label string
+	// Local makes the item boot from the local disk.
+	Local bool
+	// IpxeBinary, if set, is the name of a binary in
+	// Server.IpxeBinaries that the item chainloads, as for
+	// Spec.IpxeBinary.
+	IpxeBinary string
+}
+
+// pxeMenuOptions returns the PXE vendor options that show menu to mac,
+// booting the network items from serverIP. The items' binaries are
+// remembered for the machine's choice on the PXE port.
+func (s *Server) pxeMenuOptions(mac net.HardwareAddr, menu *PXEMenu, serverIP net.IP) (*dhcp4.PXEVendorOptions, error) {
+	if len(menu.Items) == 0 {
+		return nil, errors.New("PXE menu has no items")
+	}
+	ret := &dhcp4.PXEVendorOptions{
+		// Ask only us, on the PXE port, for the boot file of the
+		// chosen item.
+		Discovery:   dhcp4.PXEDisableBroadcast | dhcp4.PXEDisableMulticast | dhcp4.PXEOnlyListedServers,
+		MenuPrompt:  menu.Prompt,
+		MenuTimeout: menu.Timeout,
+	}
+	binaries := make([]string, len(menu.Items))
+	for i, item := range menu.Items {
+		typ := dhcp4.PXELocalBoot
+		if !item.Local {
+			typ = uint16(pxeMenuBaseType + i) // nolint:gosec
+			ret.BootServers = append(ret.BootServers, dhcp4.PXEBootServer{Type: typ, IPs: []net.IP{serverIP}})
+			binaries[i] = item.IpxeBinary
+		}
+		ret.Menu = append(ret.Menu, dhcp4.PXEMenuItem{Type: typ, Description: item.Label})
+	}
+
+	now := time.Now()
+	s.pxeMenus.mu.Lock()
+	defer s.pxeMenus.mu.Unlock()
+	if s.pxeMenus.menus == nil {
+		s.pxeMenus.menus = make(map[string]shownPXEMenu)
+	}
+	s.pxeMenus.prune(now)
+	s.pxeMenus.menus[mac.String()] = shownPXEMenu{binaries: binaries, shown: now}
+	return ret, nil
+}
+
+// pxeMenuChoice returns the name of the binary to chainload for the
+// item of type typ in the menu last shown to mac, which is empty for
+// the default binary. ok is false if mac wasn't shown such an item
+// within pxeMenuTTL.
+func (s *Server) pxeMenuChoice(mac net.HardwareAddr, typ uint16) (name string, ok bool) {
+	s.pxeMenus.mu.Lock()
+	defer s.pxeMenus.mu.Unlock()
+	menu, found := s.pxeMenus.menus[mac.String()]
+	if !found || time.Since(menu.shown) > pxeMenuTTL {
+		return "", false
+	}
+	binaries := menu.binaries
+	i := int(typ) - pxeMenuBaseType
+	if i < 0 || i >= len(binaries) {
+		return "", false
+	}
+	name = binaries[i]
+	if name != "" {
+		if _, ok := s.ipxeConfig().IpxeBinaries[name]; !ok {
+			s.Log.Info("PXE menu item asks for unknown iPXE binary, using the default", "mac", mac.String(), "binary", name)
+			name = ""
+		}
+	}
+	return name, true
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestPXEMenu(t *testing.T) {
+	s := &Server{
+		Log: slog.Default(),
+		IpxeBinaries: map[string][]byte{
+			"undionly.kpxe": []byte("undionly"),
+		},
+		events: make(map[string][]machineEvent),
+	}
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	serverIP := net.IPv4(192, 168, 0, 1)
+	menu := &PXEMenu{
+		Prompt:  "Press F8 for boot menu",
+		Timeout: 3 * time.Second,
+		Items: []PXEMenuItem{
+			{Label: "Install"},
+			{Label: "Boot from disk", Local: true},
+			{Label: "Install (UNDI)", IpxeBinary: "undionly.kpxe"},
+			{Label: "Install (missing)", IpxeBinary: "missing.kpxe"},
+		},
+	}
+
+	pkt := &dhcp4.Packet{HardwareAddr: mac, Options: dhcp4.Options{}}
+	offer, err := s.offerDHCP(pkt, Machine{MAC: mac}, &Interface{implicit: true}, serverIP, FirmwareX86PC, "", menu)
+	if err != nil {
+		t.Fatalf("constructing offer: %s", err)
+	}
+	if offer.BootFilename != "" {
+		t.Errorf("got boot filename %q in menu offer, want none", offer.BootFilename)
+	}
+	pxe, err := offer.Options.PXEVendorOptions()
+	if err != nil {
+		t.Fatalf("decoding PXE vendor options: %s", err)
+	}
+	if pxe.Discovery&dhcp4.PXEBypassDiscovery != 0 || pxe.Discovery&dhcp4.PXEOnlyListedServers == 0 {
+		t.Errorf("got discovery control %#x for menu offer", pxe.Discovery)
+	}
+	wantMenu := []dhcp4.PXEMenuItem{
+		{Type: 0x8000, Description: "Install"},
+		{Type: dhcp4.PXELocalBoot, Description: "Boot from disk"},
+		{Type: 0x8002, Description: "Install (UNDI)"},
+		{Type: 0x8003, Description: "Install (missing)"},
+	}
+	if len(pxe.Menu) != len(wantMenu) {
+		t.Fatalf("got menu %+v, want %+v", pxe.Menu, wantMenu)
+	}
+	for i := range wantMenu {
+		if pxe.Menu[i] != wantMenu[i] {
+			t.Errorf("got menu item %d %+v, want %+v", i, pxe.Menu[i], wantMenu[i])
+		}
+	}
+	if len(pxe.BootServers) != 3 {
+		t.Errorf("got %d boot servers, want one per network item", len(pxe.BootServers))
+	}
+	for _, srv := range pxe.BootServers {
+		if len(srv.IPs) != 1 || !srv.IPs[0].Equal(serverIP) {
+			t.Errorf("boot server type %#x has addresses %v, want %s", srv.Type, srv.IPs, serverIP)
+		}
+	}
+	if pxe.MenuPrompt != menu.Prompt || pxe.MenuTimeout != menu.Timeout {
+		t.Errorf("got prompt %q for %s, want %q for %s", pxe.MenuPrompt, pxe.MenuTimeout, menu.Prompt, menu.Timeout)
+	}
+
+	tests := []struct {
+		typ  uint16
+		want string
+		ok   bool
+	}{
+		{0x8000, "", true},
+		{0x8002, "undionly.kpxe", true},
+		{0x8003, "", true},
+		{0x8004, "", false},
+		{dhcp4.PXELocalBoot, "", false},
+	}
+	for _, test := range tests {
+		got, ok := s.pxeMenuChoice(mac, test.typ)
+		if got != test.want || ok != test.ok {
+			t.Errorf("choosing item %#x: got %q, %v, want %q, %v", test.typ, got, ok, test.want, test.ok)
+		}
+	}
+	if _, ok := s.pxeMenuChoice(net.HardwareAddr{6, 5, 4, 3, 2, 1}, 0x8000); ok {
+		t.Error("chose a menu item for a machine that wasn't shown the menu")
+	}
+
+	// Menus are forgotten after a while, also those of machines that
+	// never chose.
+	other := net.HardwareAddr{6, 5, 4, 3, 2, 1}
+	if _, err := s.pxeMenuOptions(other, menu, serverIP); err != nil {
+		t.Fatalf("showing menu: %s", err)
+	}
+	shown := s.pxeMenus.menus[mac.String()]
+	shown.shown = time.Now().Add(-pxeMenuTTL - time.Minute)
+	s.pxeMenus.menus[mac.String()] = shown
+	if _, ok := s.pxeMenuChoice(mac, 0x8000); ok {
+		t.Error("chose a menu item of an expired menu")
+	}
+	s.pxeMenus.lastPrune = time.Time{}
+	s.pxeMenus.prune(time.Now())
+	if _, ok := s.pxeMenus.menus[mac.String()]; ok || len(s.pxeMenus.menus) != 1 {
+		t.Errorf("got %d menus after pruning, want only the one of %s", len(s.pxeMenus.menus), other)
+	}
+
+	// Without a menu, BIOS machines boot right away as before.
+	offer, err = s.offerDHCP(pkt, Machine{MAC: mac}, &Interface{implicit: true}, serverIP, FirmwareX86PC, "", nil)
+	if err != nil {
+		t.Fatalf("constructing offer: %s", err)
+	}
+	if pxe, err := offer.Options.PXEVendorOptions(); err != nil || pxe.Discovery != dhcp4.PXEBypassDiscovery || len(pxe.Menu) != 0 {
+		t.Errorf("got PXE vendor options %+v (%v) without a menu", pxe, err)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+	"golang.org/x/time/rate"
+)
+
+// Default bursts of DHCPLimits.
+const (
+	defaultMachineBurst   = 5
+	defaultInterfaceBurst = 50
+)
+
+// pruneLimitersInterval is how often the limiters of machines that
+// went quiet are forgotten.
+const pruneLimitersInterval = time.Minute
+
+// DHCPLimits limit how many PXE boot requests, on the DHCP and the PXE
+// port, are answered, so that a NIC that spams DHCPDISCOVERs or a loop
+// on the network don't turn into a flood of Booter calls. Requests
+// over the limits are dropped. The zero value imposes no limits.
+type DHCPLimits struct {
+	// MachineRate is the number of requests per second that are
+	// answered for a single machine. Zero means unlimited.
+	MachineRate float64
+	// MachineBurst is the number of requests of a single machine
+	// that are answered at once. Defaults to 5.
+	MachineBurst int
+
+	// InterfaceRate is the number of requests per second that are
+	// answered for all machines of an Interface. Zero means
+	// unlimited.
+	InterfaceRate float64
+	// InterfaceBurst is the number of requests of all machines of an
+	// Interface that are answered at once. Defaults to 50.
+	InterfaceBurst int
+}
+
+// dhcpLimiter enforces DHCPLimits with token buckets.
+type dhcpLimiter struct {
+	limits DHCPLimits
+
+	mu         sync.Mutex
+	machines   map[string]*machineLimiter
+	interfaces map[string]*rate.Limiter
+	lastPrune  time.Time
+}
+
+type machineLimiter struct {
+	// lim is nil if machines aren't limited.
+	lim      *rate.Limiter
+	lastSeen time.Time
+	// throttled is whether the last request of the machine was
+	// dropped.
+	throttled bool
+}
+
+func newDHCPLimiter(limits DHCPLimits) *dhcpLimiter {
+	return &dhcpLimiter{
+		limits:     limits.withDefaults(),
+		machines:   map[string]*machineLimiter{},
+		interfaces: map[string]*rate.Limiter{},
+		lastPrune:  time.Now(),
+	}
+}
+
+func (l DHCPLimits) withDefaults() DHCPLimits {
+	if l.MachineBurst <= 0 {
+		l.MachineBurst = defaultMachineBurst
+	}
+	if l.InterfaceBurst <= 0 {
+		l.InterfaceBurst = defaultInterfaceBurst
+	}
+	return l
+}
+
+// setLimits replaces the limits of l. All machines and Interfaces
+// start over with full buckets.
+func (l *dhcpLimiter) setLimits(limits DHCPLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits.withDefaults()
+	l.machines = map[string]*machineLimiter{}
+	l.interfaces = map[string]*rate.Limiter{}
+}
+
+// Reasons that requests are throttled.
+const (
+	throttleMachine   = "machine"
+	throttleInterface = "interface"
+)
+
+// allow returns whether a request of mac on the Interface named iface
+// is answered. If not, it returns why, and whether mac was just
+// throttled after its previous request was answered. A nil dhcpLimiter
+// allows everything.
+func (l *dhcpLimiter) allow(mac net.HardwareAddr, iface string) (ok bool, reason string, started bool) {
+	if l == nil {
+		return true, "", false
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MachineRate <= 0 && l.limits.InterfaceRate <= 0 {
+		return true, "", false
+	}
+	l.prune(now)
+
+	m := l.machines[mac.String()]
+	if m == nil {
+		m = &machineLimiter{}
+		if l.limits.MachineRate > 0 {
+			m.lim = rate.NewLimiter(rate.Limit(l.limits.MachineRate), l.limits.MachineBurst)
+		}
+		l.machines[mac.String()] = m
+	}
+	m.lastSeen = now
+
+	switch {
+	case m.lim != nil && !m.lim.AllowN(now, 1):
+		reason = throttleMachine
+	case l.limits.InterfaceRate > 0:
+		lim := l.interfaces[iface]
+		if lim == nil {
+			lim = rate.NewLimiter(rate.Limit(l.limits.InterfaceRate), l.limits.InterfaceBurst)
+			l.interfaces[iface] = lim
+		}
+		if !lim.AllowN(now, 1) {
+			reason = throttleInterface
+		}
+	}
+	if reason == "" {
+		m.throttled = false
+		return true, "", false
+	}
+	started = !m.throttled
+	m.throttled = true
+	return false, reason, started
+}
+
+// prune forgets the machines that have been quiet for long enough
+// that their buckets have refilled, which is the same as starting over
+// with a new bucket.
+func (l *dhcpLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneLimitersInterval {
+		return
+	}
+	l.lastPrune = now
+	idle := pruneLimitersInterval
+	if l.limits.MachineRate > 0 {
+		idle = max(idle, time.Duration(float64(l.limits.MachineBurst)/l.limits.MachineRate*float64(time.Second)))
+	}
+	for k, m := range l.machines {
+		if now.Sub(m.lastSeen) > idle {
+			delete(l.machines, k)
+		}
+	}
+}
+
+// throttled returns whether the boot request pkt on iface, received
+// with protocol, must be dropped because of s.DHCPLimits. Machines that
+// the ClientFilters ignore anyway don't count against the limits, so
+// that a flood from one of them doesn't starve the Interface.
+func (s *Server) throttled(pkt *dhcp4.Packet, iface *Interface, protocol string) bool {
+	if !s.filterAllows(pkt, iface) {
+		return false
+	}
+	mac := pkt.MachineAddr()
+	ok, reason, started := s.dhcpLimiter.allow(mac, iface.Name)
+	if ok {
+		return false
+	}
+	dhcpThrottled.WithLabelValues(iface.Name, protocol, reason).Inc()
+	if started {
+		s.Log.Info("Throttling machine, dropping its boot requests", "mac", mac.String(), "interface", iface.Name, "limit", reason)
+		s.machineEvent(mac, machineStateThrottled, "Throttled, too many boot requests per %s", reason)
+	} else {
+		s.Log.Debug("Dropping boot request of throttled machine", "mac", mac.String(), "interface", iface.Name, "limit", reason)
+	}
+	return true
+}
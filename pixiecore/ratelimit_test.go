@@ -0,0 +1,138 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+func TestDHCPLimiter(t *testing.T) {
+	mac1 := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	mac2 := net.HardwareAddr{1, 2, 3, 4, 5, 7}
+	mac3 := net.HardwareAddr{1, 2, 3, 4, 5, 8}
+
+	// Rates so low that no token is refilled during the test.
+	l := newDHCPLimiter(DHCPLimits{
+		MachineRate:    0.001,
+		MachineBurst:   2,
+		InterfaceRate:  0.001,
+		InterfaceBurst: 3,
+	})
+	tests := []struct {
+		mac     net.HardwareAddr
+		iface   string
+		ok      bool
+		reason  string
+		started bool
+	}{
+		{mac1, "eth0", true, "", false},
+		{mac1, "eth0", true, "", false},
+		{mac1, "eth0", false, throttleMachine, true},
+		{mac1, "eth0", false, throttleMachine, false},
+		{mac2, "eth0", true, "", false},
+		{mac2, "eth0", false, throttleInterface, true},
+		{mac3, "eth1", true, "", false},
+	}
+	for i, test := range tests {
+		ok, reason, started := l.allow(test.mac, test.iface)
+		if ok != test.ok || reason != test.reason || started != test.started {
+			t.Errorf("request %d of %s on %s: got %v, %q, %v, want %v, %q, %v", i, test.mac, test.iface, ok, reason, started, test.ok, test.reason, test.started)
+		}
+	}
+
+	// Machines that went quiet are forgotten.
+	l.lastPrune = time.Now().Add(-2 * pruneLimitersInterval)
+	for _, m := range l.machines {
+		m.lastSeen = time.Now().Add(-time.Hour)
+	}
+	l.machines[mac1.String()].lastSeen = time.Now()
+	l.prune(time.Now())
+	if _, ok := l.machines[mac1.String()]; !ok || len(l.machines) != 1 {
+		t.Errorf("got %d machines after pruning, want only %s", len(l.machines), mac1)
+	}
+
+	if ok, _, _ := (*dhcpLimiter)(nil).allow(mac1, "eth0"); !ok {
+		t.Error("nil limiter throttled a request")
+	}
+	l = newDHCPLimiter(DHCPLimits{})
+	for range 100 {
+		if ok, _, _ := l.allow(mac1, "eth0"); !ok {
+			t.Fatal("limiter without limits throttled a request")
+		}
+	}
+}
+
+func TestThrottledEvents(t *testing.T) {
+	s := &Server{
+		Log:         slog.Default(),
+		events:      make(map[string][]machineEvent),
+		dhcpLimiter: newDHCPLimiter(DHCPLimits{MachineRate: 0.001, MachineBurst: 1}),
+	}
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	pkt := &dhcp4.Packet{HardwareAddr: mac, Options: dhcp4.Options{}}
+	iface := &Interface{Name: "eth0"}
+
+	s.machineEvent(mac, machineStateProxyDHCP, "Offering to boot")
+	if s.throttled(pkt, iface, "dhcp") {
+		t.Fatal("first request throttled")
+	}
+	for range 5 {
+		if !s.throttled(pkt, iface, "dhcp") {
+			t.Fatal("request over the limit not throttled")
+		}
+	}
+
+	evts := s.events[mac.String()]
+	if len(evts) != 2 || evts[1].State != machineStateThrottled {
+		t.Fatalf("got events %+v, want one throttling event after the offer", evts)
+	}
+	// Throttling doesn't end a boot in progress.
+	if !s.bootInProgress(mac) {
+		t.Error("throttled machine isn't booting anymore")
+	}
+}
+
+func TestThrottledFilteredMachine(t *testing.T) {
+	s := &Server{
+		Log:         slog.Default(),
+		events:      make(map[string][]machineEvent),
+		dhcpLimiter: newDHCPLimiter(DHCPLimits{InterfaceRate: 0.001, InterfaceBurst: 2}),
+	}
+	denied := &dhcp4.Packet{HardwareAddr: net.HardwareAddr{0x52, 0x54, 0, 1, 2, 3}, Options: dhcp4.Options{}}
+	allowed := &dhcp4.Packet{HardwareAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6}, Options: dhcp4.Options{}}
+	iface := &Interface{Name: "eth0"}
+	s.SetClientFilters([]ClientFilter{{MACPrefix: []byte{0x52, 0x54, 0}}}, false)
+
+	// A denied machine flooding the Interface is left to the filters,
+	// and doesn't use up the requests of the others.
+	for range 100 {
+		if s.throttled(denied, iface, "dhcp") {
+			t.Fatal("filtered machine throttled")
+		}
+	}
+	for i := range 2 {
+		if s.throttled(allowed, iface, "dhcp") {
+			t.Fatalf("request %d of allowed machine throttled after a filtered machine's flood", i)
+		}
+	}
+	if !s.throttled(allowed, iface, "dhcp") {
+		t.Error("request over the interface limit not throttled")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// IpxeConfig is the set of iPXE binaries that a Server hands out, and
+// the rules to pick one. It can be replaced with Reload while the
+// Server is running.
+type IpxeConfig struct {
+	// Ipxe is the binary for each supported Firmware.
+	Ipxe map[Firmware][]byte
+	// IpxeBinaries are additional binaries, by name.
+	IpxeBinaries map[string][]byte
+	// IpxeRules select a binary from IpxeBinaries for the machines
+	// they match.
+	IpxeRules []IpxeRule
+}
+
+// ReloadConfig is the part of a Server's configuration that Reload
+// replaces while the Server is running.
+type ReloadConfig struct {
+	IpxeConfig
+
+	// FirmwareRules replace Server.FirmwareRules.
+	FirmwareRules []FirmwareRule
+	// ClientFilters and FilterDefaultDeny replace the filters set
+	// with SetClientFilters, including changes made through the
+	// admin API.
+	ClientFilters     []ClientFilter
+	FilterDefaultDeny bool
+	// DrainAllow replaces the machines that are still offered to
+	// boot in drain mode. Whether the Server is draining is left
+	// alone.
+	DrainAllow []net.HardwareAddr
+	// DHCPLimits replace Server.DHCPLimits. Machines start over
+	// with full buckets.
+	DHCPLimits DHCPLimits
+}
+
+func (c *ReloadConfig) validate() error {
+	if err := c.IpxeConfig.validate(); err != nil {
+		return err
+	}
+	l := c.DHCPLimits
+	if l.MachineRate < 0 || l.MachineBurst < 0 || l.InterfaceRate < 0 || l.InterfaceBurst < 0 {
+		return errors.New("DHCP rate limits must be >=0")
+	}
+	return nil
+}
+
+func (c *IpxeConfig) validate() error {
+	for fw, bs := range c.Ipxe {
+		if len(bs) == 0 {
+			return fmt.Errorf("iPXE binary for firmware type %d is empty", fw)
+		}
+	}
+	for name, bs := range c.IpxeBinaries {
+		if len(bs) == 0 {
+			return fmt.Errorf("iPXE binary %q is empty", name)
+		}
+	}
+	for _, r := range c.IpxeRules {
+		if _, ok := c.IpxeBinaries[r.Binary]; !ok {
+			return fmt.Errorf("iPXE rule refers to unknown binary %q", r.Binary)
+		}
+	}
+	return nil
+}
+
+// ipxeConfig returns the IpxeConfig in use. Callers must not modify it.
+func (s *Server) ipxeConfig() *IpxeConfig {
+	if cfg := s.ipxe.Load(); cfg != nil {
+		return cfg
+	}
+	return &IpxeConfig{
+		Ipxe:         s.Ipxe,
+		IpxeBinaries: s.IpxeBinaries,
+		IpxeRules:    s.IpxeRules,
+	}
+}
+
+// setIpxeConfig validates cfg and puts it in use. Transfers that are
+// already running keep sending the binary they started with.
+func (s *Server) setIpxeConfig(cfg IpxeConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	s.ipxe.Store(&cfg)
+	return nil
+}
+
+// Reload replaces the settings in ReloadConfig with the ones returned
+// by Reloader, re-reads the host's addresses, and leaves all other
+// settings alone. If Reloader fails or returns an invalid
+// configuration, the previous one stays in use.
+func (s *Server) Reload() error {
+	if s.Reloader == nil {
+		return errors.New("reloading is not supported")
+	}
+	cfg, err := s.Reloader()
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		reloads.WithLabelValues("failure").Inc()
+		s.Log.Error("Reload failed, keeping the previous configuration", "error", err)
+		return err
+	}
+
+	s.ipxe.Store(&cfg.IpxeConfig)
+	rules := cfg.FirmwareRules
+	s.firmware.Store(&rules)
+	s.SetClientFilters(cfg.ClientFilters, cfg.FilterDefaultDeny)
+	s.setDrainAllow(cfg.DrainAllow)
+	s.localAddrs.forget()
+	if s.dhcpLimiter != nil {
+		s.dhcpLimiter.setLimits(cfg.DHCPLimits)
+	} else {
+		s.DHCPLimits = cfg.DHCPLimits
+	}
+
+	reloads.WithLabelValues("success").Inc()
+	reloadTimestamp.Set(float64(time.Now().Unix()))
+	s.Log.Info("Reloaded configuration", "firmwares", len(cfg.Ipxe), "binaries", len(cfg.IpxeBinaries), "rules", len(cfg.IpxeRules),
+		"firmwarerules", len(cfg.FirmwareRules), "filters", len(cfg.ClientFilters), "drainallow", len(cfg.DrainAllow))
+	return nil
+}
+
+// reloadStatus is the JSON answer to a successful reload in the admin
+// API.
+type reloadStatus struct {
+	Firmwares int `json:"firmwares"`
+	Binaries  int `json:"binaries"`
+	Rules     int `json:"rules"`
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Reloader == nil {
+		http.Error(w, "reloading is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err := s.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("reload failed: %s", err), http.StatusInternalServerError)
+		return
+	}
+	cfg := s.ipxeConfig()
+	s.writeJSON(w, reloadStatus{
+		Firmwares: len(cfg.Ipxe),
+		Binaries:  len(cfg.IpxeBinaries),
+		Rules:     len(cfg.IpxeRules),
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	var (
+		next    ReloadConfig
+		nextErr error
+	)
+	s := &Server{
+		Log: slog.Default(),
+		Ipxe: map[Firmware][]byte{
+			FirmwareEFI64: []byte("old"),
+		},
+		Reloader: func() (ReloadConfig, error) { return next, nextErr },
+		events:   make(map[string][]machineEvent),
+	}
+	mux := http.NewServeMux()
+	s.serveAdmin(mux)
+
+	read := func() string {
+		rf := &fakeTransfer{}
+		if err := s.readHandler("01:02:03:04:05:06/2", rf); err != nil {
+			return err.Error()
+		}
+		return rf.String()
+	}
+	if got := read(); got != "old" {
+		t.Fatalf("before reload got %q, want %q", got, "old")
+	}
+
+	filter, err := ParseClientFilter("action=deny,mac=01:02:03:04:05:07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := ParseFirmwareRule("vendor=Custom,firmware=efi64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	s.SetDrain(true, nil)
+	next = ReloadConfig{
+		IpxeConfig:    IpxeConfig{Ipxe: map[Firmware][]byte{FirmwareEFI64: []byte("new")}},
+		FirmwareRules: []FirmwareRule{rule},
+		ClientFilters: []ClientFilter{filter},
+		DrainAllow:    []net.HardwareAddr{allow},
+		DHCPLimits:    DHCPLimits{MachineRate: 1},
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, adminRequest("POST", "/admin/reload", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("reload got HTTP %d: %s", rr.Code, rr.Body)
+	}
+	if got := read(); got != "new" {
+		t.Errorf("after reload got %q, want %q", got, "new")
+	}
+	if filters, _ := s.ClientFilters(); len(filters) != 1 {
+		t.Errorf("after reload got %d client filters, want 1", len(filters))
+	}
+	if rules := s.firmwareRules(); len(rules) != 1 {
+		t.Errorf("after reload got %d firmware rules, want 1", len(rules))
+	}
+	if draining, allowed := s.Draining(); !draining || len(allowed) != 1 || allowed[0].String() != allow.String() {
+		t.Errorf("after reload got drain %v %v, want true [%s]", draining, allowed, allow)
+	}
+	if s.DHCPLimits.MachineRate != 1 {
+		t.Errorf("after reload got machine rate %v, want 1", s.DHCPLimits.MachineRate)
+	}
+
+	// Failed and invalid reloads keep the previous configuration.
+	nextErr = errors.New("file not found")
+	if err := s.Reload(); err == nil {
+		t.Errorf("reload with a failing Reloader succeeded")
+	}
+	nextErr = nil
+	next = ReloadConfig{IpxeConfig: IpxeConfig{
+		Ipxe:      map[Firmware][]byte{FirmwareEFI64: []byte("newer")},
+		IpxeRules: []IpxeRule{{Binary: "missing.efi"}},
+	}}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, adminRequest("POST", "/admin/reload", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("invalid reload got HTTP %d, want 500", rr.Code)
+	}
+	if got := read(); got != "new" {
+		t.Errorf("after failed reloads got %q, want %q", got, "new")
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, adminRequest("GET", "/admin/reload", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got HTTP %d, want 405", rr.Code)
+	}
+
+	s.Reloader = nil
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, adminRequest("POST", "/admin/reload", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("reload without Reloader got HTTP %d, want 501", rr.Code)
+	}
+}
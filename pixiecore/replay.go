@@ -0,0 +1,108 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"net"
+
+	"github.com/metal-stack/pixie/dhcp4"
+)
+
+// replayInterface names the network interface of replayed packets
+// that were captured without one.
+const replayInterface = "replay"
+
+// A ReplayedPacket is a recorded request and the reply that the Server
+// made to it.
+type ReplayedPacket struct {
+	Request *dhcp4.Packet
+	// Port is the port the request was sent to, the DHCP or the PXE
+	// port.
+	Port int
+	// Reply is nil if the Server ignored the request.
+	Reply *dhcp4.Packet
+}
+
+// Replay feeds the DHCP and PXE requests among pkts to s as if they had
+// been received, and returns the replies s made, without sending them
+// or opening any sockets. Packets that s sent and packets that aren't
+// requests to its DHCP or PXE port are skipped.
+//
+// The recorded interfaces need not exist on this machine, so serverIP
+// is advertised on the Interfaces that don't set AdvertiseIP.
+//
+// Replay sets s up like Serve does, and must not be called on a Server
+// that is serving.
+func (s *Server) Replay(pkts []*dhcp4.CapturedPacket, serverIP net.IP) ([]ReplayedPacket, error) {
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+
+	var ret []ReplayedPacket
+	for _, p := range pkts {
+		if p.Direction == dhcp4.DirectionOut || p.Dst == nil || (p.Dst.Port != s.DHCPPort && p.Dst.Port != s.PXEPort) {
+			continue
+		}
+		pkt, err := dhcp4.Unmarshal(p.Data)
+		if err != nil {
+			s.Log.Debug("Skipping replayed packet, not a DHCP packet", "error", err)
+			continue
+		}
+		switch pkt.Type {
+		case dhcp4.MsgOffer, dhcp4.MsgAck, dhcp4.MsgNack:
+			continue
+		}
+
+		intf := &net.Interface{Name: replayInterface}
+		if p.Interface != nil && p.Interface.Name != "" {
+			intf.Name = p.Interface.Name
+		}
+		var src net.Addr
+		if p.Src != nil {
+			src = p.Src
+		}
+
+		r := ReplayedPacket{Request: pkt, Port: p.Dst.Port}
+		if iface, err := s.packetInterface(intf, pkt); err != nil {
+			s.Log.Debug("Ignoring replayed packet", "mac", pkt.MachineAddr().String(), "interface", intf.Name, "error", err)
+		} else {
+			replayed := *iface
+			if replayed.AdvertiseIP == nil {
+				replayed.AdvertiseIP = serverIP
+			}
+			if p.Dst.Port == s.PXEPort {
+				r.Reply = s.pxeReply(pkt, intf, &replayed, src)
+			} else {
+				r.Reply = s.replayDHCP(pkt, intf, &replayed)
+			}
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// replayDHCP returns the reply to the DHCP request pkt, as serveDHCP
+// would send it.
+func (s *Server) replayDHCP(pkt *dhcp4.Packet, intf *net.Interface, iface *Interface) *dhcp4.Packet {
+	if s.leases != nil {
+		resp, _ := s.leaseReply(pkt, intf, iface)
+		return resp
+	}
+	if err := s.isBootDHCP(pkt); err != nil {
+		s.Log.Debug("Ignoring replayed packet", "mac", pkt.MachineAddr().String(), "error", err)
+		return nil
+	}
+	return s.bootOffer(pkt, intf, iface)
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/metal-stack/pixie/dhcp4/pcapng"
+)
+
+// TestReplay replays the captures in testdata/replay, and compares the
+// replies to the .golden file of each. Set UPDATE_TESTDATA=1 to
+// regenerate the golden files after an intended change of replies.
+func TestReplay(t *testing.T) {
+	captures, err := filepath.Glob("testdata/replay/*.pcap*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no captures in testdata/replay")
+	}
+
+	for _, capture := range captures {
+		t.Run(filepath.Base(capture), func(t *testing.T) {
+			f, err := os.Open(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			pkts, err := pcapng.ReadPackets(f)
+			if err != nil {
+				t.Fatalf("reading %s: %s", capture, err)
+			}
+
+			s := &Server{
+				Booter: booterFunc(func(m Machine) (*Spec, error) {
+					return &Spec{Kernel: "kernel"}, nil
+				}),
+				Ipxe: map[Firmware][]byte{
+					FirmwareX86PC:   []byte("bios"),
+					FirmwareEFI32:   []byte("efi32"),
+					FirmwareEFI64:   []byte("efi64"),
+					FirmwareEFIBC:   []byte("efibc"),
+					FirmwareX86Ipxe: []byte("ipxe"),
+				},
+				Log: slog.Default(),
+			}
+			replayed, err := s.Replay(pkts, net.IPv4(192, 168, 0, 1))
+			if err != nil {
+				t.Fatalf("replaying %s: %s", capture, err)
+			}
+
+			var b bytes.Buffer
+			for _, r := range replayed {
+				fmt.Fprintf(&b, "%s from %s to port %d\n", r.Request.Type, r.Request.MachineAddr(), r.Port)
+				if r.Reply == nil {
+					b.WriteString("no reply\n")
+				} else {
+					b.WriteString(r.Reply.DebugString())
+				}
+				b.WriteString("======\n")
+			}
+
+			golden := strings.TrimSuffix(capture, filepath.Ext(capture)) + ".golden"
+			if os.Getenv("UPDATE_TESTDATA") != "" {
+				if err := os.WriteFile(golden, b.Bytes(), 0o644); err != nil {
+					t.Fatalf("writing %s: %s", golden, err)
+				}
+				t.Errorf("updated %s, rerun without UPDATE_TESTDATA", golden)
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading %s: %s", golden, err)
+			}
+			if got := b.String(); got != string(want) {
+				t.Errorf("replies to %s differ from %s:\ngot:\n%s\nwant:\n%s", capture, golden, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"sync"
+)
+
+// lifecycle hands a Shutdown request to the running Serve, and its
+// outcome back.
+type lifecycle struct {
+	once sync.Once
+	// stop receives the deadline for a graceful shutdown.
+	stop chan context.Context
+	// stopped is closed when Serve returns.
+	stopped chan struct{}
+	// err is the outcome of the graceful shutdown. Only valid once
+	// stopped is closed.
+	err error
+}
+
+func (l *lifecycle) init() {
+	l.once.Do(func() {
+		l.stop = make(chan context.Context)
+		l.stopped = make(chan struct{})
+	})
+}
+
+// shutdown asks Serve to shut down gracefully until ctx is done, and
+// waits for it to return.
+func (l *lifecycle) shutdown(ctx context.Context) error {
+	l.init()
+	select {
+	case l.stop <- ctx:
+	case <-l.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-l.stopped:
+		return l.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// done records the outcome of the graceful shutdown, if any, and
+// unblocks shutdown.
+func (l *lifecycle) done(err error) {
+	l.err = err
+	close(l.stopped)
+}
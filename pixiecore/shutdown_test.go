@@ -0,0 +1,191 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+func TestDrainTransfers(t *testing.T) {
+	for _, finish := range []bool{true, false} {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		srv := newHTTPServer(func(mux *http.ServeMux) {
+			mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				_, _ = io.WriteString(w, "done")
+			})
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = serveHTTP(srv, l) }()
+
+		body := make(chan string, 1)
+		go func() {
+			resp, err := http.Get("http://" + l.Addr().String() + "/slow") // nolint:noctx
+			if err != nil {
+				body <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			bs, _ := io.ReadAll(resp.Body)
+			body <- string(bs)
+		}()
+		<-started
+
+		tftpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tftpServer := tftp.NewServer(func(string, io.ReaderFrom) error { return nil }, nil)
+		go func() { _ = serveTFTP(tftpServer, tftpConn) }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		if finish {
+			time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		}
+		err = drainTransfers(ctx, srv, []*tftp.Server{tftpServer}, &tftpTransfers{})
+		cancel()
+
+		if finish {
+			if err != nil {
+				t.Errorf("drain with a finishing transfer: %s", err)
+			}
+			if got := <-body; got != "done" {
+				t.Errorf("in-flight request got %q, want it to complete", got)
+			}
+		} else {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("drain with a stuck transfer returned %v, want deadline exceeded", err)
+			}
+			close(release)
+		}
+		_ = srv.Close()
+	}
+}
+
+func TestDrainSinglePortTFTP(t *testing.T) {
+	// Several blocks, so that the transfer needs the server to
+	// receive acknowledgements.
+	contents := strings.Repeat("0123456789", 200)
+	for _, finish := range []bool{true, false} {
+		var transfers tftpTransfers
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		tftpServer := tftp.NewServer(transfers.track(func(path string, rf io.ReaderFrom) error {
+			started <- struct{}{}
+			<-release
+			_, err := rf.ReadFrom(strings.NewReader(contents))
+			return err
+		}), nil)
+		tftpServer.EnableSinglePort()
+		tftpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = serveTFTP(tftpServer, tftpConn) }()
+
+		client, err := tftp.NewClient(tftpConn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make(chan string, 1)
+		go func() {
+			wt, err := client.Receive("file", "octet")
+			if err != nil {
+				body <- err.Error()
+				return
+			}
+			var buf bytes.Buffer
+			if _, err := wt.WriteTo(&buf); err != nil {
+				body <- err.Error()
+				return
+			}
+			body <- buf.String()
+		}()
+		<-started
+
+		srv := newHTTPServer()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		if finish {
+			time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		}
+		err = drainTransfers(ctx, srv, []*tftp.Server{tftpServer}, &transfers)
+		cancel()
+
+		if finish {
+			if err != nil {
+				t.Errorf("drain with a finishing transfer: %s", err)
+			}
+			if got := <-body; got != contents {
+				t.Errorf("in-flight transfer got %q, want it to complete", got)
+			}
+		} else {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("drain with a stuck transfer returned %v, want deadline exceeded", err)
+			}
+			// New transfers are refused while draining.
+			if _, err := client.Receive("other", "octet"); err == nil {
+				t.Errorf("transfer started while draining")
+			}
+			close(release)
+		}
+		_ = tftpConn.Close()
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	var l lifecycle
+	l.init()
+
+	// Shutdown waits for Serve to pick up the request and return.
+	result := make(chan error)
+	go func() { result <- l.shutdown(context.Background()) }()
+	ctx := <-l.stop
+	if ctx == nil {
+		t.Fatal("Serve got no shutdown context")
+	}
+	wantErr := errors.New("transfers aborted")
+	l.done(wantErr)
+	if err := <-result; !errors.Is(err, wantErr) {
+		t.Errorf("shutdown returned %v, want %v", err, wantErr)
+	}
+
+	// Once Serve has returned, Shutdown returns right away.
+	if err := l.shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown after Serve returned: %s", err)
+	}
+
+	// Without a running Serve, Shutdown gives up with ctx.
+	var idle lifecycle
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := idle.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown without Serve returned %v, want deadline exceeded", err)
+	}
+}
@@ -22,59 +22,300 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/metal-stack/pixie/dhcp4"
 	"github.com/pin/tftp/v3"
 )
 
-func (s *Server) serveTFTP(addr string) error {
+// defaultTFTPTimeout is the default time to wait for a client's
+// acknowledgement.
+const defaultTFTPTimeout = time.Minute
 
+// TFTPConfig tunes the TFTP server that hands out iPXE binaries and
+// boot files. The zero value gives a server that is compatible with
+// every PXE ROM.
+//
+// The windowsize option (RFC 7440) is not supported, the TFTP library
+// can't negotiate it. Clients that ask for it get one block at a time.
+type TFTPConfig struct {
+	// MaxBlockSize caps the block size that clients may request with
+	// the blksize option (RFC 2348). Zero means the largest size
+	// that fits the MTU of the interface.
+	MaxBlockSize int
+	// Timeout is how long to wait for an acknowledgement before
+	// retransmitting. Defaults to one minute.
+	Timeout time.Duration
+	// Retries is how often a block is retransmitted before the
+	// transfer is aborted. Zero means the library default of 5.
+	Retries int
+	// SinglePort serves all transfers from the TFTP port rather
+	// than from a new port per transfer. This helps clients behind
+	// NAT or firewalls, at the cost of some performance.
+	SinglePort bool
+	// IPv6Address is an IPv6 address to serve TFTP on in addition
+	// to the Server's Address, or "::" for all interfaces. Empty
+	// disables IPv6.
+	IPv6Address string
+}
+
+func (s *Server) newTFTPServer() *tftp.Server {
 	// use nil in place of handler to disable read or write operations
-	tftpServer := tftp.NewServer(s.readHandler, nil)
-	tftpServer.SetTimeout(time.Minute)     // optional
-	err := tftpServer.ListenAndServe(addr) // blocks until s.Shutdown() is called
+	tftpServer := tftp.NewServer(s.tftpTransfers.track(s.readHandler), nil)
+	if s.TFTP.SinglePort {
+		tftpServer.EnableSinglePort()
+	}
+	timeout := s.TFTP.Timeout
+	if timeout == 0 {
+		timeout = defaultTFTPTimeout
+	}
+	tftpServer.SetTimeout(timeout)
+	tftpServer.SetRetries(s.TFTP.Retries)
+	if s.TFTP.MaxBlockSize > 0 {
+		tftpServer.SetBlockSize(s.TFTP.MaxBlockSize)
+	}
+	return tftpServer
+}
+
+// tftpTransfers tracks the running TFTP transfers, so that they can
+// be drained on shutdown. tftp.Server.Shutdown only waits for them
+// itself without single-port mode: in single-port mode, it stops
+// receiving their acknowledgements right away.
+type tftpTransfers struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+// track wraps handler so that its transfers are tracked, and refused
+// once draining has begun.
+func (t *tftpTransfers) track(handler func(string, io.ReaderFrom) error) func(string, io.ReaderFrom) error {
+	return func(path string, rf io.ReaderFrom) error {
+		t.mu.Lock()
+		if t.draining {
+			t.mu.Unlock()
+			return errors.New("shutting down")
+		}
+		t.wg.Add(1)
+		t.mu.Unlock()
+		defer t.wg.Done()
+		return handler(path, rf)
+	}
+}
+
+// drain refuses new transfers, and waits for the running ones to
+// finish.
+func (t *tftpTransfers) drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+func serveTFTP(tftpServer *tftp.Server, conn net.PacketConn) error {
+	err := tftpServer.Serve(conn) // blocks until tftpServer.Shutdown() is called
 	if err != nil {
 		return fmt.Errorf("TFTP server shut down: %w", err)
 	}
 	return nil
 }
 
-func extractInfo(path string) (net.HardwareAddr, int, error) {
-	pathElements := strings.Split(path, "/")
-	if len(pathElements) != 2 {
-		return nil, 0, errors.New("not found")
+// tftpPath is a parsed TFTP read request path.
+type tftpPath struct {
+	mac net.HardwareAddr
+	// firmware is set for "<mac>/<firmware>" requests of an iPXE binary.
+	firmware Firmware
+	// binary is set for "<mac>/ipxe/<name>" requests of a named iPXE
+	// binary.
+	binary string
+	// id is set for "<mac>/file/<id>" requests of a Booter file.
+	id ID
+	// arch and artifact are set for "<mac>/<arch>/<artifact>" requests
+	// of the kernel or an initrd of the machine's Spec.
+	arch     Architecture
+	artifact string
+}
+
+func extractInfo(path string) (tftpPath, error) {
+	var ret tftpPath
+
+	// Some bootloaders insist on absolute paths.
+	pathElements := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(pathElements) != 2 && len(pathElements) != 3 {
+		return ret, errors.New("not found")
 	}
 
-	mac, err := net.ParseMAC(pathElements[0])
+	mac, err := dhcp4.ParseHardwareAddr(pathElements[0])
 	if err != nil {
-		return nil, 0, fmt.Errorf("invalid MAC address %q", pathElements[0])
+		return ret, fmt.Errorf("invalid MAC address %q", pathElements[0])
+	}
+	ret.mac = mac
+
+	if len(pathElements) == 2 {
+		i, err := strconv.Atoi(pathElements[1])
+		if err != nil {
+			return ret, errors.New("not found")
+		}
+		ret.firmware = Firmware(i)
+		return ret, nil
+	}
+
+	switch pathElements[1] {
+	case "file":
+		if pathElements[2] == "" {
+			return ret, errors.New("not found")
+		}
+		ret.id = ID(pathElements[2])
+		return ret, nil
+	case "ipxe":
+		if pathElements[2] == "" {
+			return ret, errors.New("not found")
+		}
+		ret.binary = pathElements[2]
+		return ret, nil
 	}
 
 	i, err := strconv.Atoi(pathElements[1])
 	if err != nil {
-		return nil, 0, errors.New("not found")
+		return ret, errors.New("not found")
+	}
+	ret.arch = Architecture(i)
+	ret.artifact = pathElements[2]
+	if ret.artifact != "kernel" && !strings.HasPrefix(ret.artifact, "initrd") {
+		return ret, errors.New("not found")
 	}
 
-	return mac, i, nil
+	return ret, nil
 }
 
-// readHandler is called when client starts file download from server
+// readHandler is called when client starts file download from server.
+//
+// Besides the iPXE binaries at "<mac>/<firmware>" and
+// "<mac>/ipxe/<name>", it serves Booter files to clients that cannot
+// run iPXE: "<mac>/file/<id>" fetches a signed file ID, and
+// "<mac>/<arch>/kernel" and "<mac>/<arch>/initrdN" fetch the artifacts
+// of the machine's Spec.
 func (s *Server) readHandler(path string, rf io.ReaderFrom) error {
-	_, i, err := extractInfo(path)
+	p, err := extractInfo(path)
 	if err != nil {
 		return fmt.Errorf("unknown path %q", path)
 	}
 
-	bs, ok := s.Ipxe[Firmware(i)]
-	if !ok {
-		return fmt.Errorf("unknown firmware type %d", i)
+	if p.id == "" && p.artifact == "" {
+		return s.sendIpxe(p, rf)
 	}
 
+	booter := s.booterFor(s.tftpInterface(rf))
+	var ip net.IP
+	if ot, ok := rf.(tftp.OutgoingTransfer); ok {
+		ip = ot.RemoteAddr().IP
+	}
+	id := p.id
+	if id == "" {
+		id, err = specArtifact(booter, Machine{MAC: p.mac, Arch: p.arch, IP: ip}, p.artifact)
+		if err != nil {
+			s.Log.Info("Unable to find boot artifact", "path", path, "error", err)
+			return err
+		}
+	}
+
+	f, sz, err := readMachineBootFile(booter, Machine{MAC: p.mac, IP: ip}, id)
+	if err != nil {
+		s.Log.Info("Error getting file", "path", path, "error", err)
+		return fmt.Errorf("couldn't get file %q", path)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if sz >= 0 {
+		setTransferSize(rf, sz)
+	}
+	n, err := rf.ReadFrom(f)
+	if err != nil {
+		s.Log.Error("unable to send payload", "path", path, "error", err)
+		return err
+	}
+	s.Log.Info("Sent file", "path", path, "bytes", n)
+	s.machineEvent(p.mac, machineStateTFTPFile, "Sent file %q", path)
+	return nil
+}
+
+func (s *Server) sendIpxe(p tftpPath, rf io.ReaderFrom) error {
+	var (
+		cfg = s.ipxeConfig()
+		bs  []byte
+		ok  bool
+		msg string
+	)
+	if p.binary != "" {
+		if bs, ok = cfg.IpxeBinaries[p.binary]; !ok {
+			return fmt.Errorf("unknown iPXE binary %q", p.binary)
+		}
+		msg = fmt.Sprintf("Sent iPXE binary %q", p.binary)
+	} else {
+		if bs, ok = cfg.Ipxe[p.firmware]; !ok {
+			return fmt.Errorf("unknown firmware type %d", p.firmware)
+		}
+		msg = fmt.Sprintf("Sent iPXE binary for firmware %d", p.firmware)
+	}
+
+	setTransferSize(rf, int64(len(bs)))
 	n, err := rf.ReadFrom(bytes.NewReader(bs))
 	if err != nil {
 		s.Log.Error("unable to send payload", "error", err)
 		return err
 	}
 	s.Log.Info("sent", "bytes", n)
+	s.machineEvent(p.mac, machineStateTFTP, "%s", msg)
+	return nil
+}
+
+// tftpInterface returns the Interface a TFTP request arrived on, or
+// nil if it can't be told.
+func (s *Server) tftpInterface(rf io.ReaderFrom) *Interface {
+	var remote, local net.IP
+	if ot, ok := rf.(tftp.OutgoingTransfer); ok {
+		remote = ot.RemoteAddr().IP
+	}
+	if rpi, ok := rf.(tftp.RequestPacketInfo); ok {
+		local = rpi.LocalIP()
+	}
+	if ifaces := s.connInterfaces(remote, local); len(ifaces) > 0 {
+		return ifaces[0]
+	}
 	return nil
 }
+
+// specArtifact returns the ID of the kernel or the initrd named by
+// artifact in m's Spec.
+func specArtifact(booter Booter, m Machine, artifact string) (ID, error) {
+	spec, err := booter.BootSpec(m)
+	if err != nil {
+		return "", fmt.Errorf("getting boot spec for %s: %w", m, err)
+	}
+	if spec == nil {
+		return "", fmt.Errorf("no boot spec for %s", m)
+	}
+	if spec.IpxeScript != "" {
+		return "", fmt.Errorf("boot spec for %s is an iPXE script", m)
+	}
+
+	if artifact == "kernel" {
+		return spec.Kernel, nil
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(artifact, "initrd"))
+	if err != nil || i < 0 || i >= len(spec.Initrd) {
+		return "", fmt.Errorf("boot spec for %s has no %s", m, artifact)
+	}
+	return spec.Initrd[i], nil
+}
+
+// setTransferSize reports the size of the outgoing file through the
+// tsize option, if the client asked for it.
+func setTransferSize(rf io.ReaderFrom, size int64) {
+	if ot, ok := rf.(tftp.OutgoingTransfer); ok {
+		ot.SetSize(size)
+	}
+}
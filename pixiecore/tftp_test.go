@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+// fakeTransfer records what readHandler sends to a TFTP client.
+type fakeTransfer struct {
+	bytes.Buffer
+	size int64
+}
+
+func (t *fakeTransfer) SetSize(n int64)         { t.size = n }
+func (t *fakeTransfer) RemoteAddr() net.UDPAddr { return net.UDPAddr{} }
+
+type tftpBooter struct{}
+
+func (tftpBooter) BootSpec(m Machine) (*Spec, error) {
+	return &Spec{
+		Kernel: ID(fmt.Sprintf("k-%d", m.Arch)),
+		Initrd: []ID{ID(fmt.Sprintf("i0-%d", m.Arch)), ID(fmt.Sprintf("i1-%d", m.Arch))},
+	}, nil
+}
+
+func (tftpBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(string(id), "unsized") {
+		return io.NopCloser(strings.NewReader(string(id))), -1, nil
+	}
+	if strings.HasPrefix(string(id), "missing") {
+		return nil, -1, errors.New("no such file")
+	}
+	return io.NopCloser(strings.NewReader(string(id))), int64(len(id)), nil
+}
+
+func (tftpBooter) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
+
+func TestTFTPReadHandler(t *testing.T) {
+	s := &Server{
+		Booter: tftpBooter{},
+		Log:    slog.Default(),
+		Ipxe: map[Firmware][]byte{
+			FirmwareX86PC: []byte("undionly"),
+		},
+		events: make(map[string][]machineEvent),
+	}
+
+	tests := []struct {
+		path string
+		body string
+		size int64
+	}{
+		{"01:02:03:04:05:06/0", "undionly", 8},
+		{"/01:02:03:04:05:06/0", "undionly", 8},
+		{"01:02:03:04:05:06/file/foo", "foo", 3},
+		{"01:02:03:04:05:06/file/unsized", "unsized", -1},
+		{"01:02:03:04:05:06/1/kernel", "k-1", 3},
+		{"01:02:03:04:05:06/0/initrd1", "i1-0", 4},
+	}
+	for _, test := range tests {
+		rf := &fakeTransfer{size: -1}
+		if err := s.readHandler(test.path, rf); err != nil {
+			t.Errorf("reading %q: %s", test.path, err)
+			continue
+		}
+		if rf.String() != test.body {
+			t.Errorf("reading %q: got body %q, want %q", test.path, rf.String(), test.body)
+		}
+		if rf.size != test.size {
+			t.Errorf("reading %q: got tsize %d, want %d", test.path, rf.size, test.size)
+		}
+	}
+
+	for _, path := range []string{
+		"01:02:03:04:05:06",
+		"01:02:03:04:05:06/7",
+		"foo/0",
+		"01:02:03:04:05:06/file/",
+		"01:02:03:04:05:06/file/missing",
+		"01:02:03:04:05:06/0/initrd2",
+		"01:02:03:04:05:06/0/initrd",
+		"01:02:03:04:05:06/0/other",
+		"01:02:03:04:05:06/a/b/c",
+	} {
+		if err := s.readHandler(path, &fakeTransfer{}); err == nil {
+			t.Errorf("reading %q succeeded, want error", path)
+		}
+	}
+
+	if evts := s.events["01:02:03:04:05:06"]; len(evts) == 0 || evts[len(evts)-1].State != machineStateTFTPFile {
+		t.Errorf("expected a TFTP file event, got %v", evts)
+	}
+}
+
+func TestTFTPServer(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	for _, cfg := range []TFTPConfig{
+		{},
+		{MaxBlockSize: 1024, Timeout: time.Second, Retries: 3},
+		{SinglePort: true, MaxBlockSize: 1024, Timeout: time.Second},
+	} {
+		s := &Server{
+			Booter: tftpBooter{},
+			Log:    slog.Default(),
+			Ipxe: map[Firmware][]byte{
+				FirmwareEFI64: payload,
+			},
+			TFTP:   cfg,
+			events: make(map[string][]machineEvent),
+		}
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listening: %s", err)
+		}
+		srv := s.newTFTPServer()
+		errs := make(chan error, 1)
+		go func() { errs <- serveTFTP(srv, conn) }()
+
+		c, err := tftp.NewClient(conn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("creating client: %s", err)
+		}
+		c.SetBlockSize(1468)
+		c.RequestTSize(true)
+		wt, err := c.Receive("01:02:03:04:05:06/2", "octet")
+		if err != nil {
+			t.Fatalf("%+v: requesting file: %s", cfg, err)
+		}
+		if n, ok := wt.(tftp.IncomingTransfer).Size(); !ok || n != int64(len(payload)) {
+			t.Errorf("%+v: got tsize %d (%v), want %d", cfg, n, ok, len(payload))
+		}
+		var buf bytes.Buffer
+		if _, err := wt.WriteTo(&buf); err != nil {
+			t.Fatalf("%+v: receiving file: %s", cfg, err)
+		}
+		if !bytes.Equal(buf.Bytes(), payload) {
+			t.Errorf("%+v: received %d bytes that don't match the payload", cfg, buf.Len())
+		}
+
+		srv.Shutdown()
+		_ = conn.Close()
+		if err := <-errs; err != nil {
+			t.Errorf("%+v: serving: %s", cfg, err)
+		}
+	}
+}
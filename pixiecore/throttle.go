@@ -0,0 +1,252 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxThrottleChunk is the largest write that is paced in one go.
+const maxThrottleChunk = 64 * 1024
+
+var errDownloadsBusy = errors.New("all download slots are busy")
+
+// FileLimits shape the boot file downloads served over HTTP, so that
+// mass reboots don't saturate the uplink. The zero value imposes no
+// limits.
+type FileLimits struct {
+	// MaxConcurrent is the number of downloads served at once. Zero
+	// means unlimited.
+	MaxConcurrent int
+	// MaxQueued is the number of downloads that may wait for a free
+	// slot when MaxConcurrent are already running. Further requests
+	// are answered right away with 503 and a Retry-After header.
+	MaxQueued int
+	// QueueTimeout is how long a queued download waits for a free
+	// slot before it is also told to retry later.
+	QueueTimeout time.Duration
+	// RetryAfter is the delay suggested to clients that couldn't be
+	// served. Defaults to 10 seconds.
+	RetryAfter time.Duration
+
+	// Bandwidth is the total rate for all downloads, in bytes per
+	// second. Zero means unlimited.
+	Bandwidth int64
+	// ClientBandwidth is the rate for all downloads of a single
+	// client IP, in bytes per second. Zero means unlimited.
+	ClientBandwidth int64
+}
+
+// fileLimiter enforces FileLimits.
+type fileLimiter struct {
+	limits FileLimits
+
+	// slots holds a token for every running download. nil if the
+	// number of downloads is unlimited.
+	slots  chan struct{}
+	global *rate.Limiter
+
+	mu      sync.Mutex
+	queued  int
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	lim  *rate.Limiter
+	refs int
+}
+
+func newFileLimiter(limits FileLimits) *fileLimiter {
+	if limits.RetryAfter <= 0 {
+		limits.RetryAfter = 10 * time.Second
+	}
+	ret := &fileLimiter{
+		limits:  limits,
+		clients: map[string]*clientLimiter{},
+	}
+	if limits.MaxConcurrent > 0 {
+		ret.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	if limits.Bandwidth > 0 {
+		ret.global = newByteLimiter(limits.Bandwidth)
+	}
+
+	fileLimitInfo.WithLabelValues("max_concurrent").Set(float64(limits.MaxConcurrent))
+	fileLimitInfo.WithLabelValues("max_queued").Set(float64(limits.MaxQueued))
+	fileLimitInfo.WithLabelValues("bandwidth_bytes").Set(float64(limits.Bandwidth))
+	fileLimitInfo.WithLabelValues("client_bandwidth_bytes").Set(float64(limits.ClientBandwidth))
+	return ret
+}
+
+func newByteLimiter(bytesPerSec int64) *rate.Limiter {
+	burst := min(bytesPerSec, maxThrottleChunk)
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// acquire waits for a download slot. The returned function must be
+// called when the download is done.
+func (l *fileLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() {
+		fileDownloadsActive.Dec()
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+	if l.slots == nil {
+		fileDownloadsActive.Inc()
+		return release, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		fileDownloadsActive.Inc()
+		return release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.limits.MaxQueued {
+		l.mu.Unlock()
+		fileDownloadsRejected.Inc()
+		return nil, errDownloadsBusy
+	}
+	l.queued++
+	l.mu.Unlock()
+	fileDownloadsQueued.Inc()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+		fileDownloadsQueued.Dec()
+	}()
+
+	var timeout <-chan time.Time
+	if l.limits.QueueTimeout > 0 {
+		t := time.NewTimer(l.limits.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		fileDownloadsActive.Inc()
+		return release, nil
+	case <-timeout:
+		fileDownloadsRejected.Inc()
+		return nil, errDownloadsBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// writer returns a ResponseWriter that counts the bytes sent to
+// client, and paces them to the configured bandwidth. The returned
+// function must be called when the download is done.
+func (l *fileLimiter) writer(ctx context.Context, w http.ResponseWriter, client string) (http.ResponseWriter, func()) {
+	ret := &throttledWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		global:         l.global,
+	}
+	if l.limits.ClientBandwidth <= 0 {
+		return ret, func() {}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.clients[client]
+	if c == nil {
+		c = &clientLimiter{lim: newByteLimiter(l.limits.ClientBandwidth)}
+		l.clients[client] = c
+	}
+	c.refs++
+	ret.client = c.lim
+
+	return ret, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if c.refs--; c.refs == 0 {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// throttledWriter is an http.ResponseWriter that paces writes through
+// rate limiters.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	global *rate.Limiter
+	client *rate.Limiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.chunk())
+		start := time.Now()
+		for _, lim := range []*rate.Limiter{w.client, w.global} {
+			if lim == nil {
+				continue
+			}
+			if err := lim.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		fileThrottledSeconds.Add(time.Since(start).Seconds())
+
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		fileBytesSent.Add(float64(m))
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// chunk returns the largest write that fits in the limiters' bursts.
+func (w *throttledWriter) chunk() int {
+	ret := maxThrottleChunk
+	for _, lim := range []*rate.Limiter{w.client, w.global} {
+		if lim != nil {
+			ret = min(ret, lim.Burst())
+		}
+	}
+	return ret
+}
+
+// ReadFrom keeps the underlying ResponseWriter's zero-copy path (e.g.
+// sendfile) when no bandwidth limit applies.
+func (w *throttledWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && w.global == nil && w.client == nil {
+		n, err := rf.ReadFrom(r)
+		fileBytesSent.Add(float64(n))
+		return n, err
+	}
+	return io.Copy(writerOnly{w}, r)
+}
+
+// writerOnly hides the ReadFrom method of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFileLimiterAdmission(t *testing.T) {
+	l := newFileLimiter(FileLimits{
+		MaxConcurrent: 1,
+		MaxQueued:     1,
+		QueueTimeout:  50 * time.Millisecond,
+	})
+
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("First download wasn't admitted: %s", err)
+	}
+
+	// The second download queues, and times out.
+	start := time.Now()
+	if _, err = l.acquire(context.Background()); !errors.Is(err, errDownloadsBusy) {
+		t.Fatalf("Queued download should have timed out, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("Queued download gave up before the queue timeout")
+	}
+
+	// With one download queued, the next is rejected right away.
+	queued := make(chan error)
+	go func() {
+		r, err := l.acquire(context.Background())
+		if err == nil {
+			r()
+		}
+		queued <- err
+	}()
+	for {
+		l.mu.Lock()
+		n := l.queued
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err = l.acquire(context.Background()); !errors.Is(err, errDownloadsBusy) {
+		t.Fatalf("Download beyond the queue should have been rejected, got %v", err)
+	}
+
+	// Finishing the first download lets the queued one in.
+	release()
+	if err = <-queued; err != nil {
+		t.Fatalf("Queued download wasn't admitted after a slot freed up: %s", err)
+	}
+}
+
+func TestFileLimiterBandwidth(t *testing.T) {
+	l := newFileLimiter(FileLimits{ClientBandwidth: 200000})
+
+	rr := httptest.NewRecorder()
+	w, done := l.writer(context.Background(), rr, "192.0.2.1")
+	defer done()
+
+	// The first 64KiB are the burst, the rest is paced at 200KB/s.
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 100000)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("100000 bytes at 200000B/s took only %s", d)
+	}
+	if rr.Body.Len() != 100000 {
+		t.Fatalf("Wrote %d bytes, want 100000", rr.Body.Len())
+	}
+}
+
+func TestFileRetryAfter(t *testing.T) {
+	s := &Server{
+		Booter: readBootFile("stuff"),
+		Log:    slog.Default(),
+		files:  newFileLimiter(FileLimits{MaxConcurrent: 1, RetryAfter: 30 * time.Second}),
+	}
+	release, err := s.files.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(context.Background(), "GET", "/_/file?name=test", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Got HTTP %d from request, expected 503", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "30" {
+		t.Fatalf("Wrong Retry-After %q", rr.Header().Get("Retry-After"))
+	}
+}
+
+// expiredIDBooter refuses every file ID as expired.
+type expiredIDBooter struct{}
+
+func (expiredIDBooter) BootSpec(m Machine) (*Spec, error) { return nil, nil }
+func (expiredIDBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	return nil, -1, errIDExpired
+}
+func (expiredIDBooter) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
+
+func TestFileInvalidIDTakesNoSlot(t *testing.T) {
+	s := &Server{
+		Booter: expiredIDBooter{},
+		Log:    slog.Default(),
+		files:  newFileLimiter(FileLimits{MaxConcurrent: 1, RetryAfter: 30 * time.Second}),
+	}
+	release, err := s.files.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// All slots are taken, but the ID is refused before a slot is
+	// asked for.
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(context.Background(), "GET", "/_/file?name=garbage", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Got HTTP %d from request, expected 403", rr.Code)
+	}
+}
@@ -15,22 +15,82 @@
 package pixiecore
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
-// signURL constructs an ID from u, signed with key.
-func signURL(u string, key *[32]byte) (ID, error) {
+// signedIDVersion is the first byte of every sealed ID payload.
+const signedIDVersion = 2
+
+var (
+	errIDExpired      = errors.New("signed ID has expired")
+	errIDWrongMachine = errors.New("signed ID was issued for a different machine")
+)
+
+// SignedIDConfig controls the IDs that the API and gRPC Booters hand
+// out for boot files.
+type SignedIDConfig struct {
+	// TTL is how long an ID remains valid after it was issued. Zero
+	// means IDs never expire.
+	TTL time.Duration
+	// BindMachine restricts each ID to the machine it was issued
+	// for. Requests for the file must then come from the address the
+	// machine fetched its boot script from, and carry its MAC
+	// address. The MAC alone proves nothing, it is part of every URL
+	// handed out.
+	BindMachine bool
+	// Keys signs and opens IDs. Replicas that share a key ring can
+	// serve each other's IDs. If nil, a random key is generated when
+	// the Booter is created.
+	Keys *KeyRing
+}
+
+// signURL constructs an ID from u, signed with the signing key of keys.
+//
+// If expires is non-zero, the ID stops being valid at that time. If
+// mac or ip are non-empty, the ID is only valid when requested on
+// behalf of that machine, respectively from that address.
+func signURL(u string, keys *KeyRing, expires time.Time, mac net.HardwareAddr, ip net.IP) (ID, error) {
+	if len(mac) > 255 {
+		return "", fmt.Errorf("hardware address %s is too long to bind an ID to", mac)
+	}
+	if ip != nil {
+		ip = ip.To16()
+	}
+
 	var nonce [24]byte
 	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
 		return "", fmt.Errorf("could not read randomness for signing nonce: %w", err)
 	}
 
+	// The sealed payload is:
+	//   version (1 byte)
+	//   expiry, unix seconds, 0 = never (8 bytes)
+	//   MAC length (1 byte), followed by the MAC
+	//   IP length (1 byte, 0 or 16), followed by the IP
+	//   URL (remainder)
+	var payload bytes.Buffer
+	payload.WriteByte(signedIDVersion)
+	var exp [8]byte
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(exp[:], uint64(expires.Unix())) // nolint:gosec
+	}
+	payload.Write(exp[:])
+	payload.WriteByte(byte(len(mac)))
+	payload.Write(mac)
+	payload.WriteByte(byte(len(ip)))
+	payload.Write(ip)
+	payload.WriteString(u)
+
 	out := nonce[:]
 
 	// Secretbox is authenticated encryption. In theory we only need
@@ -40,14 +100,17 @@ func signURL(u string, key *[32]byte) (ID, error) {
 	// simultaneously netboot a million machines. This is one case
 	// where convenience and certainty that you got it right trumps
 	// pure efficiency.
-	out = secretbox.Seal(out, []byte(u), &nonce, key)
+	key := keys.signingKey()
+	out = secretbox.Seal(out, payload.Bytes(), &nonce, &key)
 	return ID(base64.URLEncoding.EncodeToString(out)), nil
 }
 
 // getURL returns the URL contained within id.
 //
-// id must have been created by signURL, with key.
-func getURL(id ID, key *[32]byte) (string, error) {
+// id must have been created by signURL, with any of the keys in
+// keys. getURL fails if id expired before now, or if id is bound to a
+// machine other than mac, or to an address other than ip.
+func getURL(id ID, keys *KeyRing, now time.Time, mac net.HardwareAddr, ip net.IP) (string, error) {
 	signed, err := base64.URLEncoding.DecodeString(string(id))
 	if err != nil {
 		return "", err
@@ -58,9 +121,42 @@ func getURL(id ID, key *[32]byte) (string, error) {
 
 	var nonce [24]byte
 	copy(nonce[:], signed)
-	out, ok := secretbox.Open(nil, signed[24:], &nonce, key)
+	var (
+		out []byte
+		ok  bool
+	)
+	for _, key := range keys.openingKeys() {
+		if out, ok = secretbox.Open(nil, signed[24:], &nonce, &key); ok {
+			break
+		}
+	}
 	if !ok {
 		return "", errors.New("signature verification failed")
 	}
-	return string(out), nil
+
+	if len(out) < 10 || out[0] != signedIDVersion {
+		return "", errors.New("signed blob has an unknown format")
+	}
+	exp := binary.BigEndian.Uint64(out[1:9])
+	if exp != 0 && now.Unix() >= int64(exp) { // nolint:gosec
+		return "", fmt.Errorf("%w (at %s)", errIDExpired, time.Unix(int64(exp), 0).UTC()) // nolint:gosec
+	}
+	macLen := int(out[9])
+	if len(out) < 11+macLen {
+		return "", errors.New("signed blob has a truncated hardware address")
+	}
+	boundMAC := net.HardwareAddr(out[10 : 10+macLen])
+	out = out[10+macLen:]
+	ipLen := int(out[0])
+	if len(out) < 1+ipLen {
+		return "", errors.New("signed blob has a truncated IP address")
+	}
+	boundIP := net.IP(out[1 : 1+ipLen])
+	if len(boundMAC) > 0 && !bytes.Equal(boundMAC, mac) {
+		return "", fmt.Errorf("%w (issued for %s, requested by %q)", errIDWrongMachine, boundMAC, mac)
+	}
+	if len(boundIP) > 0 && !boundIP.Equal(ip) {
+		return "", fmt.Errorf("%w (issued to %s, requested from %s)", errIDWrongMachine, boundIP, ip)
+	}
+	return string(out[1+ipLen:]), nil
 }
@@ -15,25 +15,26 @@
 package pixiecore
 
 import (
-	"crypto/rand"
-	"io"
+	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestSignURL(t *testing.T) {
-	var k [32]byte
-	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
-		t.Fatalf("could not read randomness for signing nonce: %s", err)
+	k, err := NewRandomKeyRing()
+	if err != nil {
+		t.Fatalf("could not create key ring: %s", err)
 	}
 
 	u := "http://test.example/foo/bar"
 
-	id, err := signURL(u, &k)
+	id, err := signURL(u, k, time.Time{}, nil, nil)
 	if err != nil {
 		t.Fatalf("URL signing failed: %s", err)
 	}
 
-	u2, err := getURL(id, &k)
+	u2, err := getURL(id, k, time.Now(), nil, nil)
 	if err != nil {
 		t.Fatalf("URL decoding failed: %s", err)
 	}
@@ -44,8 +45,96 @@ func TestSignURL(t *testing.T) {
 
 	// Corrupt the signed thing
 	id += "d"
-	_, err = getURL(id, &k)
+	_, err = getURL(id, k, time.Now(), nil, nil)
 	if err == nil {
 		t.Fatalf("Corrupted id %q decoded correctly", id)
 	}
 }
+
+func TestSignURLExpiry(t *testing.T) {
+	k, err := NewRandomKeyRing()
+	if err != nil {
+		t.Fatalf("could not create key ring: %s", err)
+	}
+
+	u := "http://test.example/foo/bar"
+	now := time.Now()
+
+	id, err := signURL(u, k, now.Add(time.Minute), nil, nil)
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+
+	if _, err = getURL(id, k, now, nil, nil); err != nil {
+		t.Fatalf("URL decoding failed before expiry: %s", err)
+	}
+	_, err = getURL(id, k, now.Add(2*time.Minute), nil, nil)
+	if !errors.Is(err, errIDExpired) {
+		t.Fatalf("Expected errIDExpired after expiry, got %v", err)
+	}
+}
+
+func TestSignURLMachineBound(t *testing.T) {
+	k, err := NewRandomKeyRing()
+	if err != nil {
+		t.Fatalf("could not create key ring: %s", err)
+	}
+
+	u := "http://test.example/foo/bar"
+	mac := mustMAC("01:02:03:04:05:06")
+
+	id, err := signURL(u, k, time.Time{}, mac, nil)
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+
+	u2, err := getURL(id, k, time.Now(), mac, nil)
+	if err != nil {
+		t.Fatalf("URL decoding failed for the bound machine: %s", err)
+	}
+	if u != u2 {
+		t.Fatalf("getURL(signURL(%q)) = %q, which isn't the same thing", u, u2)
+	}
+
+	for _, other := range []string{"06:05:04:03:02:01", ""} {
+		var m []byte
+		if other != "" {
+			m = mustMAC(other)
+		}
+		_, err = getURL(id, k, time.Now(), m, nil)
+		if !errors.Is(err, errIDWrongMachine) {
+			t.Fatalf("Expected errIDWrongMachine for %q, got %v", other, err)
+		}
+	}
+}
+
+func TestSignURLAddressBound(t *testing.T) {
+	k, err := NewRandomKeyRing()
+	if err != nil {
+		t.Fatalf("could not create key ring: %s", err)
+	}
+
+	u := "http://test.example/foo/bar"
+	mac := mustMAC("01:02:03:04:05:06")
+	ip := net.ParseIP("192.168.0.10")
+
+	id, err := signURL(u, k, time.Time{}, mac, ip)
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+
+	// The same address in its 4 or 16 byte form.
+	for _, from := range []net.IP{ip, ip.To4()} {
+		if _, err = getURL(id, k, time.Now(), mac, from); err != nil {
+			t.Fatalf("URL decoding failed for the bound address %s: %s", from, err)
+		}
+	}
+
+	// Someone who copied the URL, MAC included, from another host.
+	for _, from := range []net.IP{net.ParseIP("192.168.0.11"), nil} {
+		_, err = getURL(id, k, time.Now(), mac, from)
+		if !errors.Is(err, errIDWrongMachine) {
+			t.Fatalf("Expected errIDWrongMachine from %s, got %v", from, err)
+		}
+	}
+}